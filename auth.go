@@ -14,6 +14,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
 	"strings"
 
@@ -34,6 +36,9 @@ type AuthManager interface {
 	HasKey() bool
 	// generate device key (will overwrite an already existing key)
 	GenerateKey() error
+	// selects the server authorization token is kept for; empty string
+	// selects the preferred server
+	UseServer(server string)
 
 	client.AuthDataMessenger
 }
@@ -49,6 +54,7 @@ type MenderAuthManager struct {
 	keyStore    *store.Keystore
 	idSrc       IdentityDataGetter
 	tenantToken client.AuthToken
+	tokenName   string
 }
 
 type AuthManagerConfig struct {
@@ -70,6 +76,7 @@ func NewAuthManager(conf AuthManagerConfig) AuthManager {
 		keyStore:    conf.KeyStore,
 		idSrc:       conf.IdentitySource,
 		tenantToken: client.AuthToken(conf.TenantToken),
+		tokenName:   authTokenName,
 	}
 
 	if err := mgr.keyStore.Load(); err != nil && !store.IsNoKeys(err) {
@@ -145,14 +152,14 @@ func (m *MenderAuthManager) RecvAuthResponse(data []byte) error {
 		return errors.New("empty auth response data")
 	}
 
-	if err := m.store.WriteAll(authTokenName, data); err != nil {
+	if err := m.store.WriteAll(m.tokenName, data); err != nil {
 		return errors.Wrapf(err, "failed to save auth token")
 	}
 	return nil
 }
 
 func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
-	data, err := m.store.ReadAll(authTokenName)
+	data, err := m.store.ReadAll(m.tokenName)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return noAuthToken, nil
@@ -166,11 +173,22 @@ func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
 func (m *MenderAuthManager) RemoveAuthToken() error {
 	// remove token only if we have one
 	if aToken, err := m.AuthToken(); err == nil && aToken != noAuthToken {
-		return m.store.Remove(authTokenName)
+		return m.store.Remove(m.tokenName)
 	}
 	return nil
 }
 
+// UseServer selects the token of given server. Token of the preferred server
+// is kept under the same name as with a single server, so that it survives
+// changes to the list of fallback servers.
+func (m *MenderAuthManager) UseServer(server string) {
+	if server == "" {
+		m.tokenName = authTokenName
+		return
+	}
+	m.tokenName = fmt.Sprintf("%s-%x", authTokenName, sha256.Sum256([]byte(server)))
+}
+
 func (m *MenderAuthManager) HasKey() bool {
 	return m.keyStore.Private() != nil
 }
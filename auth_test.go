@@ -94,6 +94,20 @@ func TestAuthManager(t *testing.T) {
 	code, err = am.AuthToken()
 	assert.Equal(t, client.AuthToken("footoken"), code)
 	assert.NoError(t, err)
+
+	// tokens are kept per server
+	am.UseServer("https://other")
+	code, err = am.AuthToken()
+	assert.Equal(t, noAuthToken, code)
+	assert.NoError(t, err)
+	assert.NoError(t, am.RecvAuthResponse([]byte("othertoken")))
+	assert.NoError(t, am.RemoveAuthToken())
+	assert.False(t, am.IsAuthorized())
+
+	am.UseServer("")
+	code, err = am.AuthToken()
+	assert.Equal(t, client.AuthToken("footoken"), code)
+	assert.NoError(t, err)
 }
 
 func TestAuthManagerRequest(t *testing.T) {
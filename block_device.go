@@ -14,12 +14,29 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"os"
+	"syscall"
+	"unsafe"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
 )
 
+const (
+	// sector size assumed for regular files standing in for block devices
+	fileSectorSize = 512
+	// alignment of buffers for O_DIRECT I/O, enough for any sector size
+	directIOAlignment = 4096
+)
+
+// size of the buffer for reading images back from the device
+var readBackBufferSize = 1024 * 1024
+
 var (
 	BlockDeviceGetSizeOf       BlockDeviceGetSizeFunc       = getBlockDeviceSize
 	BlockDeviceGetSectorSizeOf BlockDeviceGetSectorSizeFunc = getBlockDeviceSectorSize
@@ -38,7 +55,19 @@ type BlockDevice struct {
 	out       *os.File             // os.File for writing
 	w         *utils.LimitedWriter // wrapper for `out` limited the number of bytes written
 	typeUBI   bool                 // Set to true if we are updating an UBI volume
+	typeFile  bool                 // Set to true if a regular file stands in for the device
 	ImageSize int64                // image size
+	Offset    int64                // where writing starts; not for UBI volumes
+	Direct    bool                 // write with O_DIRECT; not for UBI volumes
+	direct    bool                 // set while writing with O_DIRECT
+	ssz       int                  // sector size, known when writing with O_DIRECT
+	pos       int64                // offset of the next write
+	// Only write blocks that differ from what is on the device; not for UBI
+	// volumes, which are rewritten as a whole
+	SkipUnchanged bool
+	Skipped       int64 // bytes not written, as they were on the device already
+	// Called whenever data is written or read back, as that can take long
+	Progress func()
 }
 
 // Write writes data `p` to underlying block device. Will automatically open
@@ -46,7 +75,7 @@ type BlockDevice struct {
 func (bd *BlockDevice) Write(p []byte) (int, error) {
 	if bd.out == nil {
 		log.Infof("opening device %s for writing", bd.Path)
-		out, err := os.OpenFile(bd.Path, os.O_WRONLY, 0)
+		out, err := bd.openWrite()
 		if err != nil {
 			return 0, err
 		}
@@ -75,7 +104,7 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 			}
 		}
 
-		size, err := BlockDeviceGetSizeOf(out)
+		size, err := bd.sizeOf(out)
 		if err != nil {
 			log.Errorf("failed to read block device size: %v", err)
 			out.Close()
@@ -83,14 +112,42 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 		}
 		log.Infof("partition %s size: %v", bd.Path, size)
 
+		if bd.Offset > 0 {
+			if _, err := out.Seek(bd.Offset, io.SeekStart); err != nil {
+				log.Errorf("failed to seek to offset %v of partition %s: %v",
+					bd.Offset, bd.Path, err)
+				out.Close()
+				return 0, err
+			}
+		}
+
 		bd.out = out
 		bd.w = &utils.LimitedWriter{
 			W: out,
-			N: size,
+			N: size - uint64(bd.Offset),
+		}
+		bd.pos = bd.Offset
+		if bd.SkipUnchanged && !bd.typeUBI {
+			bd.w.W = newChangedWriter(bd)
 		}
 	}
 
+	if bd.direct && !bd.alignedWrite(p) {
+		// only the tail of an image is expected to be unaligned
+		log.Debugf("unaligned write of %v bytes at offset %v, turning off O_DIRECT "+
+			"for partition %s", len(p), bd.pos, bd.Path)
+		if err := clearDirectIO(bd.out); err != nil {
+			log.Errorf("failed to turn off O_DIRECT for partition %s: %v", bd.Path, err)
+			return 0, err
+		}
+		bd.direct = false
+	}
+
 	w, err := bd.w.Write(p)
+	bd.pos += int64(w)
+	if w > 0 && bd.Progress != nil {
+		bd.Progress()
+	}
 	if err != nil {
 		log.Errorf("written %v out of %v bytes to partition %s: %v",
 			w, len(p), bd.Path, err)
@@ -98,6 +155,135 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 	return w, err
 }
 
+// openWrite opens the device for writing, with O_DIRECT if requested and
+// supported.
+func (bd *BlockDevice) openWrite() (*os.File, error) {
+	bd.direct = false
+	if bd.typeUBI {
+		return os.OpenFile(bd.Path, os.O_WRONLY, 0)
+	}
+
+	flags := os.O_WRONLY
+	if bd.SkipUnchanged {
+		// what is on the device is read before writing
+		flags = os.O_RDWR
+	}
+	if !bd.Direct && !bd.SkipUnchanged {
+		return os.OpenFile(bd.Path, flags, 0)
+	}
+
+	ssz, err := bd.SectorSize()
+	if err != nil {
+		return nil, err
+	}
+	bd.ssz = ssz
+	if !bd.Direct {
+		return os.OpenFile(bd.Path, flags, 0)
+	}
+
+	out, err := os.OpenFile(bd.Path, flags|syscall.O_DIRECT, 0)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		log.Warnf("partition %s can not be written with O_DIRECT, writing "+
+			"through the page cache: %v", bd.Path, err)
+		return os.OpenFile(bd.Path, flags, 0)
+	}
+	log.Debugf("writing partition %s with O_DIRECT", bd.Path)
+	bd.direct = true
+	return out, nil
+}
+
+// alignedWrite tells if `p` can be written at the current offset with O_DIRECT
+func (bd *BlockDevice) alignedWrite(p []byte) bool {
+	if len(p) == 0 {
+		return true
+	}
+	return len(p)%bd.ssz == 0 && bd.pos%int64(bd.ssz) == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%directIOAlignment == 0
+}
+
+// size of the blocks compared with what is on the device when skipping
+// unchanged blocks, unless sectors are larger
+const unchangedBlockSize = 4096
+
+// changedWriter writes to the offset of the block device the next write goes
+// to, skipping blocks holding the same data already.
+type changedWriter struct {
+	bd *BlockDevice
+	// block size
+	bs int
+	// what is on the device
+	old []byte
+}
+
+func newChangedWriter(bd *BlockDevice) *changedWriter {
+	bs := unchangedBlockSize
+	if bs%bd.ssz != 0 {
+		bs = bd.ssz
+	}
+	return &changedWriter{bd: bd, bs: bs}
+}
+
+func (cw *changedWriter) Write(p []byte) (int, error) {
+	bd := cw.bd
+	if cap(cw.old) < len(p) {
+		cw.old = alignedBuffer(len(p), directIOAlignment)
+	}
+	old := cw.old[:len(p)]
+	// blocks that could not be read back are written
+	n, err := bd.out.ReadAt(old, bd.pos)
+	if err != nil && err != io.EOF {
+		return 0, errors.Wrapf(err, "failed to read partition %s at offset %v",
+			bd.Path, bd.pos)
+	}
+
+	unchanged := func(start int) (int, bool) {
+		end := start + cw.bs
+		if end > len(p) {
+			end = len(p)
+		}
+		return end, end <= n && bytes.Equal(p[start:end], old[start:end])
+	}
+
+	// blocks start at multiples of the block size in `p`, so that they
+	// stay aligned for O_DIRECT
+	for start := 0; start < len(p); {
+		end, same := unchanged(start)
+		if same {
+			bd.Skipped += int64(end - start)
+			start = end
+			continue
+		}
+		// write the run of changed blocks at once
+		for end < len(p) {
+			next, same := unchanged(end)
+			if same {
+				break
+			}
+			end = next
+		}
+		w, err := bd.out.WriteAt(p[start:end], bd.pos+int64(start))
+		if err != nil {
+			return start + w, err
+		}
+		start = end
+	}
+	return len(p), nil
+}
+
+// Sync commits data written so far to the underlying block device.
+func (bd *BlockDevice) Sync() error {
+	if bd.out == nil {
+		return nil
+	}
+	if err := bd.out.Sync(); err != nil {
+		log.Errorf("failed to fsync partition %s: %v", bd.Path, err)
+		return err
+	}
+	return nil
+}
+
 // Close closes underlying block device automatically syncing any unwritten
 // data. Othewise, behaves like io.Closer.
 func (bd *BlockDevice) Close() error {
@@ -111,6 +297,7 @@ func (bd *BlockDevice) Close() error {
 		}
 		bd.out = nil
 		bd.w = nil
+		bd.direct = false
 	}
 
 	return nil
@@ -125,12 +312,98 @@ func (bd *BlockDevice) Size() (uint64, error) {
 	}
 	defer out.Close()
 
-	return BlockDeviceGetSizeOf(out)
+	return bd.sizeOf(out)
+}
+
+// errDiscardNotSupported is returned by Discard() for devices that can not
+// discard data.
+var errDiscardNotSupported = errors.New("discard not supported")
+
+// Discard tells the underlying block device that the data from offset `from`,
+// rounded up to a whole sector, to the end of the device is no longer needed.
+// If secure discard is not supported, a regular one is done. Regular files
+// standing in for the device get a hole punched instead. Automatically opens a
+// new fd in O_WRONLY mode.
+func (bd *BlockDevice) Discard(from int64, secure bool) error {
+	if bd.typeUBI {
+		return errDiscardNotSupported
+	}
+
+	out, err := os.OpenFile(bd.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	size, err := bd.sizeOf(out)
+	if err != nil {
+		return err
+	}
+	ssz, err := bd.SectorSize()
+	if err != nil {
+		return err
+	}
+	if rem := from % int64(ssz); rem != 0 {
+		from += int64(ssz) - rem
+	}
+	if from >= int64(size) {
+		return nil
+	}
+
+	if bd.typeFile {
+		err = punchHole(out, from, int64(size)-from)
+	} else {
+		err = discardRange(out, uint64(from), size-uint64(from), secure)
+		if secure && discardUnsupported(err) {
+			log.Infof("partition %s does not support secure discard, discarding "+
+				"instead: %v", bd.Path, err)
+			err = discardRange(out, uint64(from), size-uint64(from), false)
+		}
+	}
+	if discardUnsupported(err) {
+		return errDiscardNotSupported
+	} else if err != nil {
+		return err
+	}
+	log.Debugf("discarded %v bytes from offset %v of partition %s",
+		int64(size)-from, from, bd.Path)
+	return nil
+}
+
+func discardUnsupported(err error) bool {
+	return err == NotABlockDevice || err == syscall.EOPNOTSUPP ||
+		err == syscall.EINVAL || err == syscall.ENOTTY
+}
+
+func (bd *BlockDevice) sizeOf(file *os.File) (uint64, error) {
+	if bd.typeFile {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(info.Size()), nil
+	}
+	return BlockDeviceGetSizeOf(file)
+}
+
+// ReadAt reads the device at offset `off`. Automatically opens a new fd in
+// O_RDONLY mode, thus can be used in parallel to other operations.
+func (bd *BlockDevice) ReadAt(p []byte, off int64) (int, error) {
+	in, err := os.OpenFile(bd.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	return in.ReadAt(p, off)
 }
 
 // SectorSize queries the logical sector size of the underlying block device. Automatically opens a
 // new fd in O_RDONLY mode, thus can be used in parallel to other operations.
 func (bd *BlockDevice) SectorSize() (int, error) {
+	if bd.typeFile {
+		return fileSectorSize, nil
+	}
 	out, err := os.OpenFile(bd.Path, os.O_RDONLY, 0)
 	if err != nil {
 		return 0, err
@@ -139,3 +412,70 @@ func (bd *BlockDevice) SectorSize() (int, error) {
 
 	return BlockDeviceGetSectorSizeOf(out)
 }
+
+// Checksum reads back the first ImageSize bytes of the device and returns
+// their SHA256 checksum, hex encoded like in artifact manifests. The page cache
+// is bypassed with O_DIRECT, so that what is on the storage is read rather than
+// what was just written, unless the device does not support it.
+func (bd *BlockDevice) Checksum() ([]byte, error) {
+	in, err := os.OpenFile(bd.Path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err == nil {
+		log.Debugf("reading partition %s with O_DIRECT", bd.Path)
+	} else if os.IsNotExist(err) {
+		return nil, err
+	} else {
+		log.Warnf("partition %s can not be read with O_DIRECT, reading "+
+			"through the page cache: %v", bd.Path, err)
+		if in, err = os.OpenFile(bd.Path, os.O_RDONLY, 0); err != nil {
+			return nil, err
+		}
+	}
+	defer in.Close()
+
+	ssz, err := bd.SectorSize()
+	if err != nil {
+		return nil, err
+	}
+	// direct reads have to be whole sectors, of at most the buffer size
+	buf := alignedBuffer(readBackBufferSize-readBackBufferSize%ssz, directIOAlignment)
+
+	h := sha256.New()
+	for left := bd.ImageSize; left > 0; {
+		n := len(buf)
+		if int64(n) > left {
+			n = int(left)
+			if rem := n % ssz; rem != 0 {
+				n += ssz - rem
+			}
+		}
+		r, err := io.ReadFull(in, buf[:n])
+		if int64(r) < left && err != nil {
+			return nil, errors.Wrapf(err, "failed to read partition %s at offset %v",
+				bd.Path, bd.ImageSize-left)
+		}
+		if int64(r) > left {
+			r = int(left)
+		}
+		h.Write(buf[:r])
+		left -= int64(r)
+		if bd.Progress != nil {
+			bd.Progress()
+		}
+	}
+
+	sum := h.Sum(nil)
+	checksum := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(checksum, sum)
+	return checksum, nil
+}
+
+// alignedBuffer returns a buffer of `size` bytes starting at a multiple of
+// `align` in memory, as required for O_DIRECT I/O.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		off = align - rem
+	}
+	return buf[off : off+size : off+size]
+}
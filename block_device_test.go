@@ -14,11 +14,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"syscall"
 	"testing"
+	"unsafe"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -135,3 +140,159 @@ func TestBlockDeviceSize(t *testing.T) {
 
 	BlockDeviceGetSizeOf = old
 }
+
+func TestBlockDeviceChecksum(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "checksum")
+	defer os.RemoveAll(tdir)
+
+	defer func(size int) { readBackBufferSize = size }(readBackBufferSize)
+	readBackBufferSize = 4096
+
+	// partition larger than the image, image not a whole number of sectors
+	img := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(img)
+	part := path.Join(tdir, "part")
+	assert.NoError(t, ioutil.WriteFile(part, append(img, make([]byte, 5000)...), 0600))
+
+	sum := sha256.Sum256(img)
+	bd := BlockDevice{Path: part, typeFile: true, ImageSize: int64(len(img))}
+	checksum, err := bd.Checksum()
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), string(checksum))
+
+	// image ending where the partition does
+	assert.NoError(t, ioutil.WriteFile(part, img, 0600))
+	checksum, err = bd.Checksum()
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), string(checksum))
+
+	// partition shorter than the image
+	assert.NoError(t, ioutil.WriteFile(part, img[:5000], 0600))
+	_, err = bd.Checksum()
+	assert.Error(t, err)
+
+	bd.Path = path.Join(tdir, "missing")
+	_, err = bd.Checksum()
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int{512, 4096, 1000000} {
+		buf := alignedBuffer(size, directIOAlignment)
+		assert.Len(t, buf, size)
+		assert.Equal(t, size, cap(buf))
+		assert.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%directIOAlignment)
+	}
+}
+
+func TestBlockDeviceDirect(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "direct")
+	defer os.RemoveAll(tdir)
+
+	part := path.Join(tdir, "part")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 16384), 0600))
+
+	img := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(img)
+	buf := alignedBuffer(8192, directIOAlignment)
+	copy(buf, img)
+
+	bd := BlockDevice{Path: part, typeFile: true, ImageSize: int64(len(img)),
+		Direct: true}
+	n, err := bd.Write(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, len(buf), n)
+	if !bd.direct {
+		t.Skipf("O_DIRECT not supported in %s", tdir)
+	}
+
+	// the tail is not whole sectors
+	copy(buf, img[8192:])
+	n, err = bd.Write(buf[:len(img)-8192])
+	assert.NoError(t, err)
+	assert.Equal(t, len(img)-8192, n)
+	assert.False(t, bd.direct)
+	assert.NoError(t, bd.Close())
+
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:len(img)])
+}
+
+func TestBlockDeviceSkipUnchanged(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "unchanged")
+	defer os.RemoveAll(tdir)
+
+	old := make([]byte, 5*unchangedBlockSize)
+	rand.New(rand.NewSource(1)).Read(old)
+	part := path.Join(tdir, "part")
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+
+	// second and fourth block changed, and the tail of the last one
+	img := append([]byte{}, old[:4*unchangedBlockSize+100]...)
+	img[unchangedBlockSize+10]++
+	img[3*unchangedBlockSize]++
+	img[len(img)-1]++
+
+	for _, direct := range []bool{false, true} {
+		assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+		bd := BlockDevice{Path: part, typeFile: true, ImageSize: int64(len(img)),
+			SkipUnchanged: true, Direct: direct}
+		buf := alignedBuffer(3*unchangedBlockSize, directIOAlignment)
+		for i := 0; i < len(img); i += len(buf) {
+			n := copy(buf, img[i:])
+			w, err := bd.Write(buf[:n])
+			assert.NoError(t, err)
+			assert.Equal(t, n, w)
+		}
+		assert.NoError(t, bd.Close())
+
+		data, _ := ioutil.ReadFile(part)
+		assert.Equal(t, img, data[:len(img)])
+		assert.Equal(t, old[len(img):], data[len(img):])
+		assert.Equal(t, int64(2*unchangedBlockSize), bd.Skipped, "direct: %v", direct)
+	}
+
+	// not past the end of the device
+	assert.NoError(t, ioutil.WriteFile(part, old[:unchangedBlockSize], 0600))
+	bd := BlockDevice{Path: part, typeFile: true, SkipUnchanged: true}
+	w, err := bd.Write(make([]byte, 2*unchangedBlockSize))
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, unchangedBlockSize, w)
+	assert.NoError(t, bd.Close())
+}
+
+func TestBlockDeviceDiscard(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "discard")
+	defer os.RemoveAll(tdir)
+
+	part := path.Join(tdir, "part")
+	old := bytes.Repeat([]byte{0xff}, 8192)
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+
+	bd := BlockDevice{Path: part, typeFile: true}
+	err := bd.Discard(1000, false)
+	if err == errDiscardNotSupported {
+		t.Skipf("punching holes not supported in %s", tdir)
+	}
+	assert.NoError(t, err)
+
+	// from the next sector on
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, old[:1024], data[:1024])
+	assert.Equal(t, make([]byte, 8192-1024), data[1024:])
+
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+	assert.NoError(t, bd.Discard(4096, true))
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, old[:4096], data[:4096])
+	assert.Equal(t, make([]byte, 4096), data[4096:])
+
+	// nothing past the end
+	assert.NoError(t, bd.Discard(8192, false))
+
+	bd.Path = path.Join(tdir, "missing")
+	assert.True(t, os.IsNotExist(bd.Discard(0, false)))
+
+	bd.typeUBI = true
+	assert.Equal(t, errDiscardNotSupported, bd.Discard(0, false))
+}
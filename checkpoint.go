@@ -0,0 +1,147 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"hash"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// InstallCheckpoint records how far writing an update to the inactive
+// partition got, so that a restarted daemon does not download and write it all
+// over again.
+//
+// The image is compressed within the artifact; installing it picks up again at
+// `Resume`, the start of a block of the compressed data, which is downloaded
+// from there on. The part of the image between it and `Written` is
+// decompressed again, but not written.
+type InstallCheckpoint struct {
+	// bytes of the image written to the partition and synced
+	Written int64
+	// state of the SHA-256 hash of the bytes written
+	Checksum []byte
+	// where in the artifact installing picks up again
+	Resume *installer.ResumePoint `json:",omitempty"`
+}
+
+// bytes written to the partition between checkpoints
+var installCheckpointInterval int64 = 32 * 1024 * 1024
+
+// installResumer is implemented by devices able to resume writing an update
+type installResumer interface {
+	// resumeInstall makes following calls to InstallUpdate() write the
+	// image given after the part written before `from`, and record progress
+	// with `save`; nil `save` turns it off
+	resumeInstall(from *InstallCheckpoint, save func(written int64, sum []byte) error)
+	// readImage reads the image written at offset `off`
+	readImage(p []byte, off int64) (int, error)
+}
+
+// loadInstallCheckpoint returns the checkpoint stored for `update`, if any
+func loadInstallCheckpoint(s store.Store, update client.UpdateResponse) *InstallCheckpoint {
+	sd, err := LoadStateData(s)
+	if err != nil || sd.Checkpoint == nil {
+		return nil
+	}
+	if sd.UpdateInfo.ID != update.ID ||
+		sd.UpdateInfo.ArtifactName() != update.ArtifactName() {
+		return nil
+	}
+	return sd.Checkpoint
+}
+
+// checkpointWriter writes an image to a block device, saving a checkpoint
+// every installCheckpointInterval bytes
+type checkpointWriter struct {
+	dev  *BlockDevice
+	hash hash.Hash
+	save func(written int64, sum []byte) error
+	// bytes of the image written, and when the last checkpoint was made
+	written    int64
+	checkpoint int64
+}
+
+// newCheckpointWriter prepares writing an image to `dev`; if resuming `from` a
+// checkpoint, writing continues after the part of the image written before
+func newCheckpointWriter(dev *BlockDevice, from *InstallCheckpoint,
+	save func(written int64, sum []byte) error) (*checkpointWriter, error) {
+
+	cw := &checkpointWriter{
+		dev:  dev,
+		hash: sha256.New(),
+		save: save,
+	}
+	if from == nil || from.Written == 0 {
+		return cw, nil
+	}
+
+	u, ok := cw.hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, errors.New("checksum state can not be restored")
+	}
+	if err := u.UnmarshalBinary(from.Checksum); err != nil {
+		return nil, errors.Wrapf(installer.ErrNotResumable,
+			"failed to restore checksum state: %v", err)
+	}
+
+	log.Infof("resuming write of update to %s after %d bytes", dev.Path, from.Written)
+	dev.Offset = from.Written
+	cw.written = from.Written
+	cw.checkpoint = from.Written
+	return cw, nil
+}
+
+func (cw *checkpointWriter) sum() ([]byte, error) {
+	m, ok := cw.hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.New("checksum state can not be saved")
+	}
+	return m.MarshalBinary()
+}
+
+func (cw *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := cw.dev.Write(p)
+	cw.hash.Write(p[:n])
+	cw.written += int64(n)
+	if err == nil && cw.written-cw.checkpoint >= installCheckpointInterval {
+		err = cw.makeCheckpoint()
+	}
+	return n, err
+}
+
+func (cw *checkpointWriter) makeCheckpoint() error {
+	// the checkpoint must not claim more than what made it to the device
+	if err := cw.dev.Sync(); err != nil {
+		return err
+	}
+	sum, err := cw.sum()
+	if err != nil {
+		return err
+	}
+	if err := cw.save(cw.written, sum); err != nil {
+		// only the ability to resume is lost
+		log.Errorf("failed to save install checkpoint: %v", err)
+		return nil
+	}
+	log.Debugf("install checkpoint: %d bytes written to %s", cw.written, cw.dev.Path)
+	cw.checkpoint = cw.written
+	return nil
+}
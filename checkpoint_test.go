@@ -0,0 +1,208 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenReader fails once the data it has is read
+type brokenReader struct {
+	io.Reader
+}
+
+func (r brokenReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestDeviceResumeInstall(t *testing.T) {
+	oldInterval := installCheckpointInterval
+	installCheckpointInterval = 4096
+	defer func() {
+		installCheckpointInterval = oldInterval
+	}()
+
+	tdir, _ := ioutil.TempDir("", "checkpoint")
+	defer os.RemoveAll(tdir)
+
+	part := filepath.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 65536), 0600))
+
+	d := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{BufferSize: 4096},
+	})
+	d.files = true
+	d.inactive = part
+
+	img := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(img)
+
+	var last *InstallCheckpoint
+	save := func(written int64, sum []byte) error {
+		last = &InstallCheckpoint{Written: written, Checksum: sum}
+		return nil
+	}
+
+	// interrupted after the second checkpoint
+	d.resumeInstall(nil, save)
+	err := d.InstallUpdate(ioutil.NopCloser(brokenReader{bytes.NewReader(img[:10000])}),
+		int64(len(img)))
+	assert.Error(t, err)
+	if !assert.NotNil(t, last) {
+		return
+	}
+	assert.Equal(t, int64(8192), last.Written)
+
+	// mark what was written before, to tell it is not written again
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img[:8192], data[:8192])
+	copy(data, bytes.Repeat([]byte{'x'}, 8192))
+	assert.NoError(t, ioutil.WriteFile(part, data, 0600))
+
+	from := last
+	d.resumeInstall(from, save)
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img[8192:])),
+		int64(len(img))))
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, bytes.Repeat([]byte{'x'}, 8192), data[:8192])
+	assert.Equal(t, img[8192:], data[8192:len(img)])
+	assert.Equal(t, int64(16384), last.Written)
+	// the checksum covers what was written before too
+	h := sha256.New()
+	h.Write(img[:16384])
+	sum, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+	assert.Equal(t, sum, last.Checksum)
+
+	// a checkpoint without a valid checksum state is not resumed
+	d.resumeInstall(&InstallCheckpoint{Written: 8192, Checksum: []byte("sum")}, save)
+	err = d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img[8192:])), int64(len(img)))
+	assert.Error(t, err)
+	assert.Equal(t, installer.ErrNotResumable, errors.Cause(err))
+
+	// and nothing is resumed without a checkpoint
+	other := append([]byte{}, img...)
+	other[100]++
+	d.resumeInstall(nil, nil)
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(other)),
+		int64(len(other))))
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, other, data[:len(other)])
+}
+
+// artifactReader reads an artifact, counting the bytes read
+type artifactReader struct {
+	*bytes.Reader
+	read int64
+}
+
+func (r *artifactReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *artifactReader) Close() error {
+	return nil
+}
+
+func TestMenderResumeUpdate(t *testing.T) {
+	oldInterval := installCheckpointInterval
+	installCheckpointInterval = 128 * 1024
+	defer func() {
+		installCheckpointInterval = oldInterval
+	}()
+
+	tdir, _ := ioutil.TempDir("", "checkpoint")
+	defer os.RemoveAll(tdir)
+
+	size := 4 * 1024 * 1024
+	art := makeLargeArtifact(t, tdir, size, false, []string{"vexpress-qemu"})
+	img := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(img)
+
+	part := filepath.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 2*size), 0600))
+	dev := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{BufferSize: 4096},
+	})
+	dev.files = true
+	dev.inactive = part
+
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{device: dev},
+	})
+	m.deviceTypeFile = filepath.Join(tdir, "device_type")
+
+	var saved *InstallCheckpoint
+	save := func(cp InstallCheckpoint) error {
+		saved = &cp
+		return nil
+	}
+
+	// interrupted half way through the artifact
+	err := m.ResumeUpdate(ioutil.NopCloser(brokenReader{bytes.NewReader(art[:len(art)/2])}),
+		int64(len(art)), "large", nil, save)
+	assert.Error(t, err)
+	if !assert.NotNil(t, saved) || !assert.NotNil(t, saved.Resume) {
+		return
+	}
+	assert.True(t, saved.Written > 0)
+	assert.True(t, saved.Resume.Image() <= saved.Written)
+
+	// only the rest of the artifact is read
+	from := saved
+	in := &artifactReader{Reader: bytes.NewReader(art)}
+	assert.NoError(t, m.ResumeUpdate(in, int64(len(art)), "large", from, save))
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:size])
+	assert.True(t, in.read < int64(len(art))-from.Resume.Image(),
+		"read %d bytes of the artifact", in.read)
+	// device is not left set up to resume
+	assert.Nil(t, dev.checkpoint)
+
+	// another artifact does not resume it, and the next attempt starts over
+	other := makeLargeArtifact(t, tdir, size+1, false, []string{"vexpress-qemu"})
+	err = m.ResumeUpdate(&artifactReader{Reader: bytes.NewReader(other)},
+		int64(len(other)), "large", from, save)
+	assert.Error(t, err)
+	assert.Equal(t, installer.ErrNotResumable, errors.Cause(err))
+	assert.Equal(t, &InstallCheckpoint{}, saved)
+
+	// devices that can not resume install the update as usual
+	fake := &fakeDevice{consumeUpdate: true}
+	m = newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{device: fake},
+	})
+	m.deviceTypeFile = filepath.Join(tdir, "device_type")
+	saved = nil
+	assert.NoError(t, m.ResumeUpdate(ioutil.NopCloser(bytes.NewReader(art)),
+		int64(len(art)), "large", from, save))
+	assert.Nil(t, saved)
+}
@@ -25,6 +25,7 @@ import (
 )
 
 var AuthErrorUnauthorized = errors.New("authentication request rejected")
+var AuthErrorForbidden = errors.New("authentication request forbidden")
 
 type AuthRequester interface {
 	Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error)
@@ -58,6 +59,8 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	switch rsp.StatusCode {
 	case http.StatusUnauthorized:
 		return nil, AuthErrorUnauthorized
+	case http.StatusForbidden:
+		return nil, AuthErrorForbidden
 	case http.StatusOK:
 		log.Debugf("receive response data")
 		data, err := ioutil.ReadAll(rsp.Body)
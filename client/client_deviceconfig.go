@@ -0,0 +1,158 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	DeviceConfigApplied = "applied"
+	DeviceConfigFailed  = "failed"
+)
+
+type DeviceConfigurer interface {
+	// Fetch obtains the configuration document assigned to the device; returns
+	// nil if there is none
+	Fetch(api ApiRequester, server string) (*DeviceConfig, error)
+	// Report tells the server whether the configuration was applied
+	Report(api ApiRequester, server string, report DeviceConfigReport) error
+}
+
+// DeviceConfig is a device specific configuration document. Configuration
+// holds a JSON object with a subset of the client configuration keys.
+type DeviceConfig struct {
+	Version       string          `json:"version"`
+	Configuration json.RawMessage `json:"configuration"`
+}
+
+type DeviceConfigReport struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type DeviceConfigClient struct {
+}
+
+func NewDeviceConfig() DeviceConfigurer {
+	return &DeviceConfigClient{}
+}
+
+// Fetch device configuration from the backend
+func (d *DeviceConfigClient) Fetch(api ApiRequester, url string) (*DeviceConfig, error) {
+	req, err := makeDeviceConfigFetchRequest(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare device configuration request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		log.Error("failed to fetch device configuration: ", err)
+		return nil, errors.Wrapf(err, "device configuration request failed")
+	}
+
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to receive device configuration")
+		}
+
+		var conf DeviceConfig
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse device configuration")
+		}
+		if conf.Version == "" {
+			return nil, errors.New("device configuration is missing version")
+		}
+		log.Debugf("received device configuration version %v", conf.Version)
+		return &conf, nil
+
+	case http.StatusNoContent, http.StatusNotFound:
+		log.Debug("no device configuration available")
+		return nil, nil
+
+	case http.StatusUnauthorized:
+		log.Warn("client not authorized to get device configuration")
+		return nil, ErrNotAuthorized
+
+	default:
+		log.Errorf("got unexpected HTTP status when fetching device configuration: %v",
+			r.StatusCode)
+		return nil, errors.Errorf("device configuration request failed, bad status %v",
+			r.StatusCode)
+	}
+}
+
+// Report device configuration status to the backend
+func (d *DeviceConfigClient) Report(api ApiRequester, url string, report DeviceConfigReport) error {
+	req, err := makeDeviceConfigReportRequest(url, report)
+	if err != nil {
+		return errors.Wrapf(err, "failed to prepare device configuration report request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		log.Error("failed to report device configuration status: ", err)
+		return errors.Wrapf(err, "reporting device configuration status failed")
+	}
+
+	defer r.Body.Close()
+
+	// HTTP 204 No Content
+	if r.StatusCode != http.StatusNoContent {
+		log.Errorf("got unexpected HTTP status when reporting device configuration status: %v",
+			r.StatusCode)
+		return errors.Errorf("reporting device configuration status failed, bad status %v",
+			r.StatusCode)
+	}
+	log.Debugf("device configuration status reported, response %v", r)
+
+	return nil
+}
+
+func makeDeviceConfigFetchRequest(server string) (*http.Request, error) {
+	url := buildApiURL(server, "/deviceconfig/configuration")
+
+	hreq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create device configuration HTTP request")
+	}
+	return hreq, nil
+}
+
+func makeDeviceConfigReportRequest(server string, report DeviceConfigReport) (*http.Request, error) {
+	url := buildApiURL(server, "/deviceconfig/configuration/status")
+
+	out := &bytes.Buffer{}
+	enc := json.NewEncoder(out)
+	enc.Encode(&report)
+
+	hreq, err := http.NewRequest(http.MethodPut, url, out)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create device configuration HTTP request")
+	}
+
+	hreq.Header.Add("Content-Type", "application/json")
+	return hreq, nil
+}
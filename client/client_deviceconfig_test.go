@@ -0,0 +1,102 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceConfigClient(t *testing.T) {
+	responder := &struct {
+		httpStatus int
+		data       string
+		recdata    []byte
+		path       string
+		method     string
+	}{
+		http.StatusOK,
+		`{"version": "1", "configuration": {"UpdatePollIntervalSeconds": 10}}`,
+		[]byte{},
+		"",
+		"",
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(responder.httpStatus)
+		w.Write([]byte(responder.data))
+
+		responder.recdata, _ = ioutil.ReadAll(r.Body)
+		responder.path = r.URL.Path
+		responder.method = r.Method
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NotNil(t, ac)
+	assert.NoError(t, err)
+
+	client := NewDeviceConfig()
+	assert.NotNil(t, client)
+
+	_, err = client.Fetch(NewMockApiClient(nil, errors.New("foo")), ts.URL)
+	assert.Error(t, err)
+
+	conf, err := client.Fetch(ac, ts.URL)
+	assert.NoError(t, err)
+	assert.NotNil(t, conf)
+	assert.Equal(t, "1", conf.Version)
+	assert.JSONEq(t, `{"UpdatePollIntervalSeconds": 10}`, string(conf.Configuration))
+	assert.Equal(t, apiPrefix+"deviceconfig/configuration", responder.path)
+	assert.Equal(t, http.MethodGet, responder.method)
+
+	// no version
+	responder.data = `{"configuration": {}}`
+	_, err = client.Fetch(ac, ts.URL)
+	assert.Error(t, err)
+
+	responder.httpStatus = http.StatusNoContent
+	responder.data = ""
+	conf, err = client.Fetch(ac, ts.URL)
+	assert.NoError(t, err)
+	assert.Nil(t, conf)
+
+	responder.httpStatus = http.StatusUnauthorized
+	_, err = client.Fetch(ac, ts.URL)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	responder.httpStatus = http.StatusNoContent
+	err = client.Report(ac, ts.URL, DeviceConfigReport{
+		Version: "1",
+		Status:  DeviceConfigFailed,
+		Error:   "bad value",
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version": "1", "status": "failed", "error": "bad value"}`,
+		string(responder.recdata))
+	assert.Equal(t, apiPrefix+"deviceconfig/configuration/status", responder.path)
+	assert.Equal(t, http.MethodPut, responder.method)
+
+	responder.httpStatus = http.StatusBadRequest
+	err = client.Report(ac, ts.URL, DeviceConfigReport{
+		Version: "1",
+		Status:  DeviceConfigApplied,
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,296 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// replaced with client ID in topic names
+	MQTTClientIDPlaceholder = "{clientid}"
+
+	defaultMQTTTimeout   = 30 * time.Second
+	defaultMQTTKeepAlive = 60 * time.Second
+)
+
+// Default topics, used for the topics not set in MQTTConfig
+var (
+	DefaultMQTTStatusTopic         = "mender/{clientid}/status"
+	DefaultMQTTInventoryTopic      = "mender/{clientid}/inventory"
+	DefaultMQTTLogTopic            = "mender/{clientid}/log"
+	DefaultMQTTUpdateRequestTopic  = "mender/{clientid}/update/request"
+	DefaultMQTTUpdateResponseTopic = "mender/{clientid}/update/response"
+)
+
+type MQTTConfig struct {
+	// broker address, for instance ssl://broker:8883 or tcp://broker:1883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// 0 or 1
+	QoS int
+
+	StatusTopic         string
+	InventoryTopic      string
+	LogTopic            string
+	UpdateRequestTopic  string
+	UpdateResponseTopic string
+
+	// how long to wait for the broker and for update check responses
+	Timeout time.Duration
+
+	// TLS settings for ssl:// brokers
+	Config
+}
+
+// MQTT update check request, published to UpdateRequestTopic
+type MQTTUpdateRequest struct {
+	RequestID    string `json:"request_id"`
+	ArtifactName string `json:"artifact_name,omitempty"`
+	DeviceType   string `json:"device_type,omitempty"`
+}
+
+// MQTT update check response, expected on UpdateResponseTopic. Update is
+// omitted if there is no update for the device.
+type MQTTUpdateResponse struct {
+	RequestID string          `json:"request_id"`
+	Update    *UpdateResponse `json:"update,omitempty"`
+}
+
+// MQTTClient implements the device side of the deployments and inventory APIs
+// over MQTT. Artifacts are still downloaded from the location given in the
+// update check response.
+//
+// The `api` and `server` arguments of the methods are not used; the broker
+// and topics come from MQTTConfig.
+type MQTTClient struct {
+	*UpdateClient
+	conf      MQTTConfig
+	tlsConfig *tls.Config
+
+	lock      sync.Mutex
+	conn      *mqttConn
+	requestID int
+}
+
+func NewMQTT(conf MQTTConfig) (*MQTTClient, error) {
+	if conf.Broker == "" {
+		return nil, errors.New("MQTT broker not set")
+	}
+	if conf.QoS < 0 || conf.QoS > 1 {
+		return nil, errors.Errorf("unsupported MQTT QoS %d", conf.QoS)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultMQTTTimeout
+	}
+
+	topics := []struct {
+		topic *string
+		def   string
+	}{
+		{&conf.StatusTopic, DefaultMQTTStatusTopic},
+		{&conf.InventoryTopic, DefaultMQTTInventoryTopic},
+		{&conf.LogTopic, DefaultMQTTLogTopic},
+		{&conf.UpdateRequestTopic, DefaultMQTTUpdateRequestTopic},
+		{&conf.UpdateResponseTopic, DefaultMQTTUpdateResponseTopic},
+	}
+	for _, t := range topics {
+		if *t.topic == "" {
+			*t.topic = t.def
+		}
+		*t.topic = strings.Replace(*t.topic, MQTTClientIDPlaceholder, conf.ClientID, -1)
+	}
+
+	tlsc := &tls.Config{
+		InsecureSkipVerify: conf.NoVerify,
+	}
+	if conf.ServerCert != "" {
+		certs, err := loadServerTrust(conf.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot initialize MQTT broker trust")
+		}
+		tlsc.RootCAs = certs
+	}
+
+	return &MQTTClient{
+		UpdateClient: NewUpdate(),
+		conf:         conf,
+		tlsConfig:    tlsc,
+	}, nil
+}
+
+// connect returns connection to the broker, connecting if needed; must be
+// called with the lock held
+func (m *MQTTClient) connect() (*mqttConn, error) {
+	if m.conn != nil && !m.conn.Closed() {
+		return m.conn, nil
+	}
+
+	log.Debugf("connecting to MQTT broker %s", m.conf.Broker)
+	conn, err := dialMQTT(mqttConnConfig{
+		broker:    m.conf.Broker,
+		clientID:  m.conf.ClientID,
+		username:  m.conf.Username,
+		password:  m.conf.Password,
+		tls:       m.tlsConfig,
+		keepAlive: defaultMQTTKeepAlive,
+		timeout:   m.conf.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Subscribe(m.conf.UpdateResponseTopic, byte(m.conf.QoS)); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to subscribe to %s",
+			m.conf.UpdateResponseTopic)
+	}
+	m.conn = conn
+	return conn, nil
+}
+
+func (m *MQTTClient) publish(topic string, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode MQTT message")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	conn, err := m.connect()
+	if err != nil {
+		return err
+	}
+	if err := conn.Publish(topic, data, byte(m.conf.QoS)); err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "failed to publish to %s", topic)
+	}
+	return nil
+}
+
+func (m *MQTTClient) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	return nil
+}
+
+// Report deployment status to the status topic
+func (m *MQTTClient) Report(api ApiRequester, server string, report StatusReport) error {
+	if err := m.publish(m.conf.StatusTopic, report); err != nil {
+		return errors.Wrapf(err, "reporting status failed")
+	}
+	return nil
+}
+
+// Submit inventory data to the inventory topic
+func (m *MQTTClient) Submit(api ApiRequester, server string, data interface{}) error {
+	if err := m.publish(m.conf.InventoryTopic, data); err != nil {
+		return errors.Wrapf(err, "inventory submit failed")
+	}
+	return nil
+}
+
+// Upload deployment logs to the log topic
+func (m *MQTTClient) Upload(api ApiRequester, server string, logs LogData) error {
+	msg := struct {
+		DeploymentID string          `json:"deployment_id"`
+		Messages     json.RawMessage `json:"messages"`
+	}{
+		DeploymentID: logs.DeploymentID,
+	}
+	if len(logs.Messages) > 0 {
+		msg.Messages = logs.Messages
+	}
+	if err := m.publish(m.conf.LogTopic, msg); err != nil {
+		return errors.Wrapf(err, "uploading logs failed")
+	}
+	return nil
+}
+
+// GetScheduledUpdate publishes update check request and waits for the
+// response with the same request ID
+func (m *MQTTClient) GetScheduledUpdate(api ApiRequester, server string,
+	current CurrentUpdate) (interface{}, error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	conn, err := m.connect()
+	if err != nil {
+		return nil, errors.Wrapf(err, "update check request failed")
+	}
+
+	// responses to earlier requests that timed out
+	for len(conn.messages) > 0 {
+		<-conn.messages
+	}
+
+	m.requestID++
+	req := MQTTUpdateRequest{
+		RequestID:    fmt.Sprintf("%s-%d", m.conf.ClientID, m.requestID),
+		ArtifactName: current.Artifact,
+		DeviceType:   current.DeviceType,
+	}
+	data, _ := json.Marshal(req)
+	if err := conn.Publish(m.conf.UpdateRequestTopic, data, byte(m.conf.QoS)); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "update check request failed")
+	}
+
+	timeout := time.After(m.conf.Timeout)
+	for {
+		select {
+		case msg := <-conn.messages:
+			var rsp MQTTUpdateResponse
+			if err := json.Unmarshal(msg.payload, &rsp); err != nil {
+				log.Warnf("ignoring malformed update check response: %v", err)
+				continue
+			}
+			if rsp.RequestID != req.RequestID {
+				log.Debugf("ignoring response to update check request %v", rsp.RequestID)
+				continue
+			}
+			if rsp.Update == nil {
+				log.Debug("No update available")
+				return nil, nil
+			}
+			if err := validateGetUpdate(*rsp.Update); err != nil {
+				return nil, err
+			}
+			return *rsp.Update, nil
+
+		case <-conn.closed:
+			return nil, errors.Wrapf(errMQTTClosed, "update check request failed")
+
+		case <-timeout:
+			return nil, errors.New("timeout waiting for update check response")
+		}
+	}
+}
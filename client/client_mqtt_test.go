@@ -0,0 +1,309 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker is a tiny in-process MQTT broker, good enough for a single
+// client
+type fakeBroker struct {
+	listener net.Listener
+
+	lock       sync.Mutex
+	clientID   string
+	username   string
+	subscribed []string
+	published  []mqttMessage
+	qos        []byte
+	// refuse subscriptions and don't acknowledge messages, respectively
+	refuseSubscribe bool
+	noPuback        bool
+	// called for messages on the update request topic, returns response
+	respond func(req MQTTUpdateRequest) *MQTTUpdateResponse
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	b := &fakeBroker{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) Close() {
+	b.listener.Close()
+}
+
+func (b *fakeBroker) setRespond(f func(req MQTTUpdateRequest) *MQTTUpdateResponse) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.respond = f
+}
+
+func (b *fakeBroker) messages() []mqttMessage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]mqttMessage{}, b.published...)
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(p *mqttPacket) {
+		data, _ := p.encode()
+		conn.Write(data)
+	}
+
+	for {
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+
+		b.lock.Lock()
+		switch p.kind {
+		case mqttConnect:
+			_, rest, _ := readMQTTString(p.body)
+			flags := rest[1]
+			rest = rest[4:]
+			b.clientID, rest, _ = readMQTTString(rest)
+			if flags&0x80 != 0 {
+				b.username, rest, _ = readMQTTString(rest)
+			}
+			send(&mqttPacket{kind: mqttConnack, body: []byte{0, 0}})
+
+		case mqttSubscribe:
+			id := binary.BigEndian.Uint16(p.body)
+			topic, rest, _ := readMQTTString(p.body[2:])
+			code := rest[0]
+			if b.refuseSubscribe {
+				code = mqttSubackFailure
+			} else {
+				b.subscribed = append(b.subscribed, topic)
+			}
+			send(&mqttPacket{kind: mqttSuback, body: []byte{byte(id >> 8), byte(id), code}})
+
+		case mqttPublish:
+			msg, qos, id, _ := parseMQTTPublish(p)
+			b.published = append(b.published, msg)
+			b.qos = append(b.qos, qos)
+			if qos > 0 && !b.noPuback {
+				send(&mqttPacket{kind: mqttPuback, body: appendMQTTUint16(nil, id)})
+			}
+			if b.respond != nil && msg.topic == "mender/dev1/update/request" {
+				var req MQTTUpdateRequest
+				json.Unmarshal(msg.payload, &req)
+				if rsp := b.respond(req); rsp != nil {
+					data, _ := json.Marshal(rsp)
+					send(makeMQTTPublish(b.subscribed[0], data, 0, 0))
+				}
+			}
+
+		case mqttPingreq:
+			send(&mqttPacket{kind: mqttPingresp})
+
+		case mqttDisconnect:
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Unlock()
+	}
+}
+
+func TestMQTTPacket(t *testing.T) {
+	p := makeMQTTPublish("foo/bar", make([]byte, 300), 1, 0x1234)
+	data, err := p.encode()
+	assert.NoError(t, err)
+	// 2 bytes for remaining length of 2+7+2+300
+	assert.Equal(t, []byte{0x32, 0xb7, 0x02}, data[:3])
+
+	rp, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(data)))
+	assert.NoError(t, err)
+	msg, qos, id, err := parseMQTTPublish(rp)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/bar", msg.topic)
+	assert.Len(t, msg.payload, 300)
+	assert.Equal(t, byte(1), qos)
+	assert.Equal(t, uint16(0x1234), id)
+
+	_, _, err = readMQTTString([]byte{0, 5, 'a'})
+	assert.Error(t, err)
+}
+
+func TestMQTTClient(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.Close()
+
+	_, err := NewMQTT(MQTTConfig{})
+	assert.Error(t, err)
+	_, err = NewMQTT(MQTTConfig{Broker: broker.URL(), QoS: 2})
+	assert.Error(t, err)
+
+	mc, err := NewMQTT(MQTTConfig{
+		Broker:      broker.URL(),
+		ClientID:    "dev1",
+		Username:    "user",
+		QoS:         1,
+		StatusTopic: "fleet/{clientid}/deployments",
+		Timeout:     time.Second,
+	})
+	assert.NoError(t, err)
+	defer mc.Close()
+
+	// the client implements all of the interfaces
+	var _ StatusReporter = mc
+	var _ InventorySubmitter = mc
+	var _ LogUploader = mc
+	var _ Updater = mc
+
+	err = mc.Report(nil, "", StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusSuccess,
+	})
+	assert.NoError(t, err)
+	broker.lock.Lock()
+	assert.Equal(t, "dev1", broker.clientID)
+	assert.Equal(t, "user", broker.username)
+	assert.Equal(t, []string{"mender/dev1/update/response"}, broker.subscribed)
+	broker.lock.Unlock()
+
+	err = mc.Submit(nil, "", []InventoryAttribute{{Name: "foo", Value: "bar"}})
+	assert.NoError(t, err)
+
+	err = mc.Upload(nil, "", LogData{
+		DeploymentID: "deployment1",
+		Messages:     []byte(`[{"msg": "foo"}]`),
+	})
+	assert.NoError(t, err)
+
+	msgs := broker.messages()
+	assert.Len(t, msgs, 3)
+	assert.Equal(t, "fleet/dev1/deployments", msgs[0].topic)
+	assert.JSONEq(t, `{"status": "success"}`, string(msgs[0].payload))
+	assert.Equal(t, "mender/dev1/inventory", msgs[1].topic)
+	assert.JSONEq(t, `[{"name": "foo", "value": "bar"}]`, string(msgs[1].payload))
+	assert.Equal(t, "mender/dev1/log", msgs[2].topic)
+	assert.JSONEq(t, `{"deployment_id": "deployment1", "messages": [{"msg": "foo"}]}`,
+		string(msgs[2].payload))
+	broker.lock.Lock()
+	assert.Equal(t, []byte{1, 1, 1}, broker.qos)
+	broker.lock.Unlock()
+
+	// no response
+	_, err = mc.GetScheduledUpdate(nil, "", CurrentUpdate{})
+	assert.Error(t, err)
+
+	// no update
+	var lastReq MQTTUpdateRequest
+	broker.setRespond(func(req MQTTUpdateRequest) *MQTTUpdateResponse {
+		lastReq = req
+		return &MQTTUpdateResponse{RequestID: req.RequestID}
+	})
+	update, err := mc.GetScheduledUpdate(nil, "", CurrentUpdate{
+		Artifact:   "release-1",
+		DeviceType: "foo",
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, update)
+	broker.lock.Lock()
+	assert.Equal(t, "release-1", lastReq.ArtifactName)
+	assert.Equal(t, "foo", lastReq.DeviceType)
+	broker.lock.Unlock()
+
+	// update available; response to other request is ignored
+	upd := UpdateResponse{ID: "deployment2"}
+	upd.Artifact.ArtifactName = "release-2"
+	upd.Artifact.CompatibleDevices = []string{"foo"}
+	upd.Artifact.Source.URI = "https://s3/artifact"
+	broker.setRespond(func(req MQTTUpdateRequest) *MQTTUpdateResponse {
+		return &MQTTUpdateResponse{RequestID: req.RequestID, Update: &upd}
+	})
+	update, err = mc.GetScheduledUpdate(nil, "", CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Equal(t, upd, update)
+
+	// invalid update
+	broker.lock.Lock()
+	upd.Artifact.Source.URI = ""
+	broker.lock.Unlock()
+	_, err = mc.GetScheduledUpdate(nil, "", CurrentUpdate{})
+	assert.Error(t, err)
+
+	// broker gone
+	broker.Close()
+	mc.conn.Close()
+	err = mc.Report(nil, "", StatusReport{})
+	assert.Error(t, err)
+}
+
+func TestMQTTAcknowledgements(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.Close()
+
+	conf := MQTTConfig{
+		Broker:   broker.URL(),
+		ClientID: "dev1",
+		QoS:      1,
+		Timeout:  100 * time.Millisecond,
+	}
+
+	// refused subscription fails connecting
+	broker.lock.Lock()
+	broker.refuseSubscribe = true
+	broker.lock.Unlock()
+	mc, err := NewMQTT(conf)
+	assert.NoError(t, err)
+	err = mc.Report(nil, "", StatusReport{DeploymentID: "deployment1"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refused subscription")
+	mc.Close()
+
+	// missing acknowledgement times out, and is not waited for any longer
+	broker.lock.Lock()
+	broker.refuseSubscribe = false
+	broker.noPuback = true
+	broker.lock.Unlock()
+	mc, err = NewMQTT(conf)
+	assert.NoError(t, err)
+	defer mc.Close()
+	err = mc.Report(nil, "", StatusReport{DeploymentID: "deployment1"})
+	assert.Error(t, err)
+	mc.conn.lock.Lock()
+	assert.Len(t, mc.conn.acks, 0)
+	mc.conn.lock.Unlock()
+}
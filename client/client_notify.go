@@ -0,0 +1,111 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	NotifyCheckUpdate     = "check-update"
+	NotifySendInventory   = "send-inventory"
+	NotifyAbortDeployment = "abort-deployment"
+)
+
+// How long the server may hold a notification request before responding with
+// no notification.
+var NotifyLongPollTimeout = 5 * time.Minute
+
+type Notifier interface {
+	// Next waits for the next notification from the server; returns nil if
+	// there was none within the long-poll timeout
+	Next(ctx context.Context, api ApiRequester, server string) (*Notification, error)
+}
+
+// Notification is a message pushed by the server to the device.
+type Notification struct {
+	Type string `json:"type"`
+	// Deployment the notification refers to, if any
+	DeploymentID string `json:"deployment_id,omitempty"`
+}
+
+type NotifyClient struct {
+}
+
+func NewNotify() Notifier {
+	return &NotifyClient{}
+}
+
+// Next notification from the backend
+func (n *NotifyClient) Next(ctx context.Context, api ApiRequester, url string) (*Notification, error) {
+	req, err := makeNotifyRequest(url, NotifyLongPollTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare notification request")
+	}
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "notification request failed")
+	}
+
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to receive notification")
+		}
+
+		var note Notification
+		if err := json.Unmarshal(data, &note); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse notification")
+		}
+		if note.Type == "" {
+			return nil, errors.New("notification is missing type")
+		}
+		log.Debugf("received notification: %v", note)
+		return &note, nil
+
+	case http.StatusNoContent:
+		return nil, nil
+
+	case http.StatusUnauthorized:
+		log.Warn("client not authorized to receive notifications")
+		return nil, ErrNotAuthorized
+
+	default:
+		return nil, errors.Errorf("notification request failed, bad status %v",
+			r.StatusCode)
+	}
+}
+
+func makeNotifyRequest(server string, wait time.Duration) (*http.Request, error) {
+	url := buildApiURL(server, "/notifications/device/next")
+	url += fmt.Sprintf("?wait=%d", int(wait.Seconds()))
+
+	hreq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create notification HTTP request")
+	}
+	return hreq, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyClient(t *testing.T) {
+	responder := &struct {
+		httpStatus int
+		data       string
+		path       string
+		query      string
+		hold       time.Duration
+	}{
+		http.StatusOK,
+		`{"type": "abort-deployment", "deployment_id": "foo"}`,
+		"",
+		"",
+		0,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder.path = r.URL.Path
+		responder.query = r.URL.RawQuery
+		select {
+		case <-time.After(responder.hold):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(responder.httpStatus)
+		w.Write([]byte(responder.data))
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NotNil(t, ac)
+	assert.NoError(t, err)
+
+	client := NewNotify()
+	assert.NotNil(t, client)
+
+	ctx := context.Background()
+
+	_, err = client.Next(ctx, NewMockApiClient(nil, errors.New("foo")), ts.URL)
+	assert.Error(t, err)
+
+	note, err := client.Next(ctx, ac, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, &Notification{
+		Type:         NotifyAbortDeployment,
+		DeploymentID: "foo",
+	}, note)
+	assert.Equal(t, apiPrefix+"notifications/device/next", responder.path)
+	assert.Equal(t, "wait=300", responder.query)
+
+	responder.data = `{}`
+	_, err = client.Next(ctx, ac, ts.URL)
+	assert.Error(t, err)
+
+	responder.httpStatus = http.StatusNoContent
+	responder.data = ""
+	note, err = client.Next(ctx, ac, ts.URL)
+	assert.NoError(t, err)
+	assert.Nil(t, note)
+
+	responder.httpStatus = http.StatusUnauthorized
+	_, err = client.Next(ctx, ac, ts.URL)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	responder.httpStatus = http.StatusBadGateway
+	_, err = client.Next(ctx, ac, ts.URL)
+	assert.Error(t, err)
+
+	// long-poll in progress is cancelled
+	responder.hold = time.Minute
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = client.Next(ctx, ac, ts.URL)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
@@ -36,10 +36,14 @@ type Updater interface {
 
 var (
 	ErrNotAuthorized = errors.New("client not authorized")
+	// the server refused to serve the artifact, likely as the link to it
+	// has expired
+	ErrDownloadForbidden = errors.New("artifact download forbidden")
 )
 
 type UpdateClient struct {
 	minImageSize int64
+	concurrency  int
 }
 
 func NewUpdate() *UpdateClient {
@@ -97,6 +101,10 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 
 	log.Debugf("Received fetch update response %v+", r)
 
+	if r.StatusCode == http.StatusForbidden {
+		r.Body.Close()
+		return nil, -1, ErrDownloadForbidden
+	}
 	if r.StatusCode != http.StatusOK {
 		r.Body.Close()
 		log.Errorf("Error fetching shcheduled update info: code (%d)", r.StatusCode)
@@ -112,9 +120,20 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
 	}
 
+	if u.concurrency > 1 && r.ContentLength > DownloadChunkSize &&
+		r.Header.Get("Accept-Ranges") == "bytes" {
+		log.Infof("Downloading image using %d concurrent connections", u.concurrency)
+		return newParallelReader(r.Body, api, req, r.ContentLength, u.concurrency,
+			maxWait), r.ContentLength, nil
+	}
+
 	return NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req), r.ContentLength, nil
 }
 
+func (u *UpdateClient) SetDownloadConcurrency(n int) {
+	u.concurrency = n
+}
+
 // have update for the client
 type UpdateResponse struct {
 	Artifact struct {
@@ -126,6 +145,8 @@ type UpdateResponse struct {
 		ArtifactName      string   `json:"artifact_name"`
 	}
 	ID string
+	// set for updates found on local media; never by the server
+	Media bool `json:",omitempty"`
 }
 
 func (ur UpdateResponse) CompatibleDevices() []string {
@@ -140,6 +161,15 @@ func (ur UpdateResponse) URI() string {
 	return ur.Artifact.Source.URI
 }
 
+// Expire returns when the link to the artifact expires; zero if unknown
+func (ur UpdateResponse) Expire() time.Time {
+	expire, err := time.Parse(time.RFC3339, ur.Artifact.Source.Expire)
+	if err != nil {
+		return time.Time{}
+	}
+	return expire
+}
+
 func validateGetUpdate(update UpdateResponse) error {
 	// check if we have JSON data correctly decoded
 	if update.ID == "" ||
@@ -148,6 +178,15 @@ func validateGetUpdate(update UpdateResponse) error {
 		update.Artifact.Source.URI == "" {
 		return errors.New("Missing parameters in encoded JSON update response")
 	}
+	if update.Media {
+		return errors.New("Update response claims update from local media")
+	}
+	// anything else would have the client open local files, for instance
+	if uri, err := url.Parse(update.Artifact.Source.URI); err != nil ||
+		(uri.Scheme != "http" && uri.Scheme != "https") {
+		return errors.Errorf("Unsupported artifact URI in update response: %q",
+			update.Artifact.Source.URI)
+	}
 
 	log.Infof("Correct request for getting image from: %s [name: %v; devices: %v]",
 		update.Artifact.Source.URI,
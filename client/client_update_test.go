@@ -105,6 +105,29 @@ const missingNameUpdateResponse = `{
 	}
 }`
 
+const fileUpdateResponse = `{
+	"id": "deplyoment-123",
+	"artifact": {
+		"source": {
+			"uri": "file:///etc/shadow"
+		},
+		"device_types_compatible": ["BBB"],
+		"artifact_name": "myapp-release-z-build-123"
+	}
+}`
+
+const mediaUpdateResponse = `{
+	"id": "deplyoment-123",
+	"artifact": {
+		"source": {
+			"uri": "https://menderupdate.com"
+		},
+		"device_types_compatible": ["BBB"],
+		"artifact_name": "myapp-release-z-build-123"
+	},
+	"media": true
+}`
+
 var updateTest = []struct {
 	responseStatusCode    int
 	responseBody          []byte
@@ -125,6 +148,8 @@ var updateTest = []struct {
 	{200, []byte(malformedUpdateResponse), true, false, 0},
 	{200, []byte(missingDevicesUpdateResponse), true, false, 0},
 	{200, []byte(missingNameUpdateResponse), true, false, 0},
+	{200, []byte(fileUpdateResponse), true, false, 0},
+	{200, []byte(mediaUpdateResponse), true, false, 0},
 }
 
 type testReadCloser struct {
@@ -13,6 +13,9 @@
 //    limitations under the License.
 package client
 
+// InventoryAttribute is a single inventory entry. Value may be a string,
+// a number, a boolean, a nested object or a list of these; it is submitted to
+// the backend as-is.
 type InventoryAttribute struct {
 	Name  string      `json:"name"`
 	Value interface{} `json:"value"`
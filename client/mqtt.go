@@ -0,0 +1,449 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Minimal MQTT 3.1.1 client, supporting QoS 0 and 1, which is all that is
+// needed for talking to the deployment service through a broker.
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+
+	mqttMaxRemainingLength = 268435455
+
+	// SUBACK return code of a refused subscription
+	mqttSubackFailure = 0x80
+)
+
+var (
+	errMQTTClosed = errors.New("MQTT connection closed")
+)
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	hdr, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, errors.New("malformed MQTT packet length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{kind: hdr >> 4, flags: hdr & 0x0f, body: body}, nil
+}
+
+func (p *mqttPacket) encode() ([]byte, error) {
+	length := len(p.body)
+	if length > mqttMaxRemainingLength {
+		return nil, errors.New("MQTT packet too large")
+	}
+
+	out := []byte{p.kind<<4 | p.flags}
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(out, p.body...), nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = appendMQTTUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendMQTTUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("malformed MQTT string")
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", nil, errors.New("malformed MQTT string")
+	}
+	return string(b[2 : 2+l]), b[2+l:], nil
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func makeMQTTPublish(topic string, payload []byte, qos byte, id uint16) *mqttPacket {
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = appendMQTTUint16(body, id)
+	}
+	return &mqttPacket{
+		kind:  mqttPublish,
+		flags: qos << 1,
+		body:  append(body, payload...),
+	}
+}
+
+// parseMQTTPublish returns the message, QoS and packet ID of a PUBLISH packet
+func parseMQTTPublish(p *mqttPacket) (mqttMessage, byte, uint16, error) {
+	qos := (p.flags >> 1) & 0x03
+	topic, rest, err := readMQTTString(p.body)
+	if err != nil {
+		return mqttMessage{}, 0, 0, err
+	}
+	var id uint16
+	if qos > 0 {
+		if len(rest) < 2 {
+			return mqttMessage{}, 0, 0, errors.New("malformed MQTT publish")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return mqttMessage{topic: topic, payload: rest}, qos, id, nil
+}
+
+type mqttConnConfig struct {
+	broker    string
+	clientID  string
+	username  string
+	password  string
+	tls       *tls.Config
+	keepAlive time.Duration
+	timeout   time.Duration
+}
+
+// mqttConn is a connection to the broker; incoming messages of subscribed
+// topics are delivered over `messages`.
+type mqttConn struct {
+	conn     net.Conn
+	timeout  time.Duration
+	messages chan mqttMessage
+
+	// serializes writes to the connection
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	nextID uint16
+	// pending acknowledgements, receiving the return code of SUBACK
+	acks map[uint16]chan byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func dialMQTT(conf mqttConnConfig) (*mqttConn, error) {
+	u, err := url.Parse(conf.broker)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid MQTT broker address")
+	}
+
+	dialer := &net.Dialer{Timeout: conf.timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", u.Host)
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, conf.tls)
+	default:
+		return nil, errors.Errorf("unsupported MQTT broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to MQTT broker")
+	}
+
+	c := &mqttConn{
+		conn:     conn,
+		timeout:  conf.timeout,
+		messages: make(chan mqttMessage, 16),
+		acks:     map[uint16]chan byte{},
+		closed:   make(chan struct{}),
+	}
+
+	r := bufio.NewReader(conn)
+	if err := c.handshake(r, conf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop(r)
+	if conf.keepAlive > 0 {
+		go c.pingLoop(conf.keepAlive)
+	}
+	return c, nil
+}
+
+func (c *mqttConn) handshake(r *bufio.Reader, conf mqttConnConfig) error {
+	flags := byte(0x02) // clean session
+	if conf.username != "" {
+		flags |= 0x80
+	}
+	if conf.password != "" {
+		flags |= 0x40
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendMQTTUint16(body, uint16(conf.keepAlive/time.Second))
+	body = appendMQTTString(body, conf.clientID)
+	if conf.username != "" {
+		body = appendMQTTString(body, conf.username)
+	}
+	if conf.password != "" {
+		body = appendMQTTString(body, conf.password)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.write(&mqttPacket{kind: mqttConnect, body: body}); err != nil {
+		return errors.Wrapf(err, "failed to send MQTT connect")
+	}
+
+	p, err := readMQTTPacket(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to receive MQTT connect acknowledgement")
+	}
+	if p.kind != mqttConnack || len(p.body) != 2 {
+		return errors.New("unexpected response to MQTT connect")
+	}
+	if p.body[1] != 0 {
+		return errors.Errorf("MQTT broker refused connection, return code %d", p.body[1])
+	}
+	return nil
+}
+
+func (c *mqttConn) write(p *mqttPacket) error {
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+func (c *mqttConn) readLoop(r *bufio.Reader) {
+	defer c.Close()
+
+	for {
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			select {
+			case <-c.closed:
+			default:
+				log.Warnf("MQTT connection lost: %v", err)
+			}
+			return
+		}
+
+		switch p.kind {
+		case mqttPuback, mqttSuback:
+			if len(p.body) < 2 || (p.kind == mqttSuback && len(p.body) < 3) {
+				log.Errorf("malformed MQTT acknowledgement")
+				return
+			}
+			var code byte
+			if p.kind == mqttSuback {
+				code = p.body[2]
+			}
+			c.ack(binary.BigEndian.Uint16(p.body), code)
+
+		case mqttPublish:
+			msg, qos, id, err := parseMQTTPublish(p)
+			if err != nil {
+				log.Errorf("failed to parse MQTT message: %v", err)
+				return
+			}
+			if qos > 0 {
+				c.write(&mqttPacket{kind: mqttPuback, body: appendMQTTUint16(nil, id)})
+			}
+			select {
+			case c.messages <- msg:
+			default:
+				log.Warnf("dropping MQTT message on topic %s", msg.topic)
+			}
+
+		case mqttPingresp:
+		default:
+			log.Debugf("ignoring MQTT packet of type %d", p.kind)
+		}
+	}
+}
+
+func (c *mqttConn) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(&mqttPacket{kind: mqttPingreq}); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *mqttConn) newID() (uint16, chan byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID++
+	}
+	ch := make(chan byte, 1)
+	c.acks[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *mqttConn) ack(id uint16, code byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ch, ok := c.acks[id]; ok {
+		ch <- code
+		delete(c.acks, id)
+	}
+}
+
+func (c *mqttConn) forget(id uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.acks, id)
+}
+
+// waitAck waits for acknowledgement of packet `id` and returns its return
+// code (always 0 for PUBACK)
+func (c *mqttConn) waitAck(id uint16, ch chan byte) (byte, error) {
+	select {
+	case code := <-ch:
+		return code, nil
+	case <-c.closed:
+		c.forget(id)
+		return 0, errMQTTClosed
+	case <-time.After(c.timeout):
+		c.forget(id)
+		return 0, errors.New("timeout waiting for MQTT acknowledgement")
+	}
+}
+
+// Publish sends message to `topic`; with QoS 1 waits until the broker has
+// acknowledged it
+func (c *mqttConn) Publish(topic string, payload []byte, qos byte) error {
+	if qos == 0 {
+		return c.write(makeMQTTPublish(topic, payload, 0, 0))
+	}
+
+	id, ch := c.newID()
+	if err := c.write(makeMQTTPublish(topic, payload, 1, id)); err != nil {
+		c.forget(id)
+		return err
+	}
+	_, err := c.waitAck(id, ch)
+	return err
+}
+
+func (c *mqttConn) Subscribe(topic string, qos byte) error {
+	id, ch := c.newID()
+	body := appendMQTTUint16(nil, id)
+	body = appendMQTTString(body, topic)
+	body = append(body, qos)
+
+	if err := c.write(&mqttPacket{kind: mqttSubscribe, flags: 0x02, body: body}); err != nil {
+		c.forget(id)
+		return err
+	}
+	code, err := c.waitAck(id, ch)
+	if err != nil {
+		return err
+	}
+	if code == mqttSubackFailure {
+		return errors.Errorf("MQTT broker refused subscription to %s", topic)
+	}
+	return nil
+}
+
+func (c *mqttConn) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *mqttConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.write(&mqttPacket{kind: mqttDisconnect})
+		c.conn.Close()
+	})
+	return nil
+}
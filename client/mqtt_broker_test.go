@@ -0,0 +1,167 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mqttTestBroker returns address of a real MQTT broker: the one in
+// MENDER_TEST_MQTT_BROKER, or mosquitto started for the test, which is
+// skipped if there is neither. Returned function stops the broker.
+func mqttTestBroker(t *testing.T) (string, func()) {
+	if broker := os.Getenv("MENDER_TEST_MQTT_BROKER"); broker != "" {
+		return broker, func() {}
+	}
+	path, err := exec.LookPath("mosquitto")
+	if err != nil {
+		t.Skip("mosquitto not found and MENDER_TEST_MQTT_BROKER not set")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cmd := exec.Command(path, "-p", strconv.Itoa(port))
+	if !assert.NoError(t, cmd.Start()) {
+		t.FailNow()
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			stop()
+			t.Fatalf("mosquitto did not start: %v", err)
+		}
+	}
+	return "tcp://" + addr, stop
+}
+
+// receiveMQTT returns the next message delivered over `c`
+func receiveMQTT(t *testing.T, c *mqttConn) mqttMessage {
+	select {
+	case msg := <-c.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Error("no MQTT message delivered")
+	}
+	return mqttMessage{}
+}
+
+func TestMQTTBroker(t *testing.T) {
+	broker, stop := mqttTestBroker(t)
+	defer stop()
+
+	// unique topics, in case the broker is shared
+	device := fmt.Sprintf("mender-test-%d", time.Now().UnixNano())
+
+	// the deployment service side
+	service, err := dialMQTT(mqttConnConfig{
+		broker:    broker,
+		clientID:  device + "-service",
+		keepAlive: time.Second,
+		timeout:   5 * time.Second,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer service.Close()
+	assert.NoError(t, service.Subscribe("mender/"+device+"/#", 1))
+
+	mc, err := NewMQTT(MQTTConfig{
+		Broker:   broker,
+		ClientID: device,
+		QoS:      1,
+		Timeout:  5 * time.Second,
+	})
+	assert.NoError(t, err)
+	defer mc.Close()
+
+	err = mc.Report(nil, "", StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusSuccess,
+	})
+	assert.NoError(t, err)
+	msg := receiveMQTT(t, service)
+	assert.Equal(t, "mender/"+device+"/status", msg.topic)
+	assert.JSONEq(t, `{"status": "success"}`, string(msg.payload))
+
+	// large enough for a four byte remaining length
+	value := string(bytes.Repeat([]byte("x"), 3*1024*1024))
+	err = mc.Submit(nil, "", []InventoryAttribute{{Name: "big", Value: value}})
+	assert.NoError(t, err)
+	msg = receiveMQTT(t, service)
+	assert.Equal(t, "mender/"+device+"/inventory", msg.topic)
+	var attrs []InventoryAttribute
+	assert.NoError(t, json.Unmarshal(msg.payload, &attrs))
+	assert.Equal(t, []InventoryAttribute{{Name: "big", Value: value}}, attrs)
+
+	// update check answered by the service
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msg := receiveMQTT(t, service)
+		var req MQTTUpdateRequest
+		assert.NoError(t, json.Unmarshal(msg.payload, &req))
+		assert.Equal(t, "release-1", req.ArtifactName)
+
+		upd := UpdateResponse{ID: "deployment2"}
+		upd.Artifact.ArtifactName = "release-2"
+		upd.Artifact.CompatibleDevices = []string{"foo"}
+		upd.Artifact.Source.URI = "https://s3/artifact"
+		data, _ := json.Marshal(MQTTUpdateResponse{RequestID: req.RequestID, Update: &upd})
+		assert.NoError(t, service.Publish(mc.conf.UpdateResponseTopic, data, 1))
+	}()
+	update, err := mc.GetScheduledUpdate(nil, "", CurrentUpdate{
+		Artifact:   "release-1",
+		DeviceType: "foo",
+	})
+	<-done
+	assert.NoError(t, err)
+	if assert.IsType(t, UpdateResponse{}, update) {
+		assert.Equal(t, "deployment2", update.(UpdateResponse).ID)
+	}
+	// the service is subscribed to the response topic as well
+	msg = receiveMQTT(t, service)
+	assert.Equal(t, mc.conf.UpdateResponseTopic, msg.topic)
+
+	// pings keep the connection of the service up beyond its keep-alive
+	time.Sleep(2500 * time.Millisecond)
+	assert.False(t, service.Closed())
+	assert.NoError(t, service.Publish("mender/"+device+"/ping", []byte("still here"), 1))
+	msg = receiveMQTT(t, service)
+	assert.Equal(t, []byte("still here"), msg.payload)
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Size of the ranges fetched by parallel downloads
+var DownloadChunkSize int64 = 4 * 1024 * 1024
+
+type ConcurrentDownloader interface {
+	// SetDownloadConcurrency sets the number of concurrent range requests
+	// used for downloading artifacts; 1 or less downloads sequentially
+	SetDownloadConcurrency(n int)
+}
+
+var errDownloadClosed = errors.New("download was closed")
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// ParallelReader downloads an artifact using several concurrent range
+// requests, while still returning the data strictly in order. At most
+// `concurrency` chunks are downloaded or buffered at any time.
+type ParallelReader struct {
+	api           ApiRequester
+	req           *http.Request
+	contentLength int64
+	maxWait       time.Duration
+	link          *artifactLink
+	concurrency   int
+	chunkSize     int64
+
+	// response to the initial request; chunks are dispatched once reading
+	// starts, so that the download can still be set up
+	first io.ReadCloser
+
+	// guards starting and stopping the download, as Close() may be called
+	// while reading
+	lock    sync.Mutex
+	started bool
+	closed  bool
+	cancel  context.CancelFunc
+
+	// the chunks being downloaded; see run()
+	ordered chan chan chunkResult
+	slots   chan struct{}
+
+	cur     []byte
+	holding bool
+	err     error
+}
+
+// newParallelReader sets up the download; `first` is the response body of the
+// initial request for the whole artifact, used for the first chunk
+func newParallelReader(first io.ReadCloser, api ApiRequester, req *http.Request,
+	contentLength int64, concurrency int, maxWait time.Duration) *ParallelReader {
+
+	p := &ParallelReader{
+		api:           api,
+		req:           req,
+		contentLength: contentLength,
+		maxWait:       maxWait,
+		link:          newArtifactLink(req),
+		concurrency:   concurrency,
+		chunkSize:     DownloadChunkSize,
+		first:         first,
+	}
+	return p
+}
+
+// run starts downloading the chunks from `from` on, using `first` for the
+// first one if not nil; p.lock is held
+func (p *ParallelReader) run(from int64, first io.ReadCloser) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.started = true
+	p.cancel = cancel
+	// results of the chunks, in artifact order
+	p.ordered = make(chan chan chunkResult, p.concurrency)
+	// one slot is taken by each chunk being downloaded or buffered
+	p.slots = make(chan struct{}, p.concurrency)
+	go p.dispatch(ctx, p.ordered, p.slots, from, first)
+}
+
+func (p *ParallelReader) dispatch(ctx context.Context, ordered chan chan chunkResult,
+	slots chan struct{}, from int64, first io.ReadCloser) {
+
+	defer close(ordered)
+
+	for start := from; start < p.contentLength; start += p.chunkSize {
+		end := start + p.chunkSize
+		if end > p.contentLength {
+			end = p.contentLength
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		res := make(chan chunkResult, 1)
+		ordered <- res
+
+		stream := first
+		first = nil
+		go func(start, end int64) {
+			res <- p.fetch(ctx, start, end, stream)
+		}(start, end)
+	}
+}
+
+// fetch downloads [start, end), using `stream` if not nil
+func (p *ParallelReader) fetch(ctx context.Context, start, end int64,
+	stream io.ReadCloser) chunkResult {
+
+	// every chunk needs its own headers, as the resumer updates Range
+	req := p.req.WithContext(ctx)
+	req.Header = http.Header{}
+	for k, v := range p.req.Header {
+		req.Header[k] = v
+	}
+
+	r := newRangeResumer(stream, start, end, p.contentLength, p.maxWait, p.api, req,
+		p.link)
+	if stream == nil {
+		req.Header.Set("Range", rangeHeader(start, end, p.contentLength))
+		rsp, err := r.do()
+		if err != nil {
+			return chunkResult{err: errors.Wrapf(err, "range request failed")}
+		}
+		body, err := r.getStreamFromPartialContent(rsp)
+		if err != nil {
+			rsp.Body.Close()
+			return chunkResult{err: err}
+		}
+		r.stream = body
+	}
+	defer r.Close()
+
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return chunkResult{err: errors.Wrapf(err, "failed to download bytes %d-%d",
+			start, end-1)}
+	}
+	return chunkResult{data: data}
+}
+
+// SetRefresh makes the download renew the link to the artifact using
+// `refresh`, when the link expires at `expire` or is rejected by the server
+func (p *ParallelReader) SetRefresh(expire time.Time, refresh RefreshFunc) {
+	p.link.set(expire, refresh)
+}
+
+// start starts the download, unless it is started or closed already
+func (p *ParallelReader) start() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errDownloadClosed
+	}
+	if !p.started {
+		p.run(0, p.first)
+	}
+	return nil
+}
+
+// restart drops the chunks being downloaded and downloads the ones from `from`
+// on, unless closed
+func (p *ParallelReader) restart(from int64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errDownloadClosed
+	}
+	p.stop()
+	p.run(from, nil)
+	return nil
+}
+
+// stop drops the chunks being downloaded; p.lock is held
+func (p *ParallelReader) stop() {
+	if !p.started {
+		// never read from
+		p.started = true
+		p.first.Close()
+	} else if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+func (p *ParallelReader) Read(buf []byte) (int, error) {
+	if err := p.start(); err != nil {
+		return 0, err
+	}
+
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		res, ok := <-p.ordered
+		if !ok {
+			p.err = io.EOF
+			continue
+		}
+		r := <-res
+		if r.err != nil {
+			log.Errorf("parallel download failed: %v", r.err)
+			p.err = r.err
+			p.lock.Lock()
+			p.stop()
+			p.lock.Unlock()
+			continue
+		}
+		p.cur = r.data
+		p.holding = true
+	}
+
+	n := copy(buf, p.cur)
+	p.cur = p.cur[n:]
+	if len(p.cur) == 0 && p.holding {
+		// chunk consumed, let the next one start
+		p.holding = false
+		<-p.slots
+	}
+	return n, nil
+}
+
+// Seek makes reading continue at `offset` of the artifact, dropping the chunks
+// being downloaded and downloading the ones from there on; only seeking from
+// the start of the artifact is supported.
+func (p *ParallelReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("download can only seek from the start")
+	}
+	if offset < 0 || offset >= p.contentLength {
+		return 0, errors.Errorf("offset %d is out of the artifact", offset)
+	}
+
+	if err := p.restart(offset); err != nil {
+		return 0, err
+	}
+	log.Infof("continuing artifact download at offset %d", offset)
+	p.cur = nil
+	p.holding = false
+	p.err = nil
+	return offset, nil
+}
+
+// Close stops the download; it may be called while reading, which then fails.
+func (p *ParallelReader) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.stop()
+	}
+	return nil
+}
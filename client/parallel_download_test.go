@@ -0,0 +1,268 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeServer serves `data` with range support, counting concurrent requests
+type rangeServer struct {
+	data []byte
+
+	lock     sync.Mutex
+	active   int
+	maxAlive int
+	ranges   []string
+	// break connection of the first request for this range after
+	// sending half of it
+	breakRange string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.active++
+	if s.active > s.maxAlive {
+		s.maxAlive = s.active
+	}
+	rng := r.Header.Get("Range")
+	s.ranges = append(s.ranges, rng)
+	broken := rng != "" && rng == s.breakRange
+	if broken {
+		s.breakRange = ""
+	}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.active--
+		s.lock.Unlock()
+	}()
+
+	// give the other requests a chance to overlap
+	time.Sleep(10 * time.Millisecond)
+
+	if broken {
+		var start, end int
+		_, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		if err == nil {
+			w.Header().Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(s.data[start : start+(end-start+1)/2])
+			return
+		}
+	}
+	http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(s.data))
+}
+
+func TestParallelDownload(t *testing.T) {
+	oldChunk := DownloadChunkSize
+	defer func() {
+		DownloadChunkSize = oldChunk
+	}()
+	DownloadChunkSize = 16 * 1024
+
+	data := make([]byte, 10*DownloadChunkSize+123)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+
+	srv := &rangeServer{data: data}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	client := NewUpdate()
+	client.SetDownloadConcurrency(4)
+
+	r, size, err := client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	assert.IsType(t, &ParallelReader{}, r)
+
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	assert.NoError(t, r.Close())
+
+	assert.Len(t, srv.ranges, 11)
+	assert.Equal(t, "", srv.ranges[0])
+	assert.Contains(t, srv.ranges, "bytes=163840-")
+	assert.True(t, srv.maxAlive > 1)
+	assert.True(t, srv.maxAlive <= 4)
+
+	// broken range is resumed
+	exponentialBackoffSmallestUnit = time.Millisecond
+	defer func() {
+		exponentialBackoffSmallestUnit = time.Minute
+	}()
+	srv.ranges = nil
+	srv.breakRange = "bytes=32768-49151"
+	r, _, err = client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	assert.Contains(t, srv.ranges, "bytes=40960-49151")
+
+	// sequential download without concurrency or for small artifacts
+	client.SetDownloadConcurrency(1)
+	r, _, err = client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.IsType(t, &UpdateResumer{}, r)
+	r.Close()
+
+	client.SetDownloadConcurrency(4)
+	srv.data = data[:DownloadChunkSize]
+	r, _, err = client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.IsType(t, &UpdateResumer{}, r)
+	r.Close()
+}
+
+func TestParallelDownloadClose(t *testing.T) {
+	oldChunk := DownloadChunkSize
+	defer func() {
+		DownloadChunkSize = oldChunk
+	}()
+	DownloadChunkSize = 16 * 1024
+
+	data := make([]byte, 64*DownloadChunkSize)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(&rangeServer{data: data})
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	client := NewUpdate()
+	client.SetDownloadConcurrency(4)
+
+	// closed before reading
+	r, _, err := client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	_, err = r.Read(make([]byte, 1024))
+	assert.Equal(t, errDownloadClosed, err)
+
+	// closed while reading, from another goroutine
+	r, _, err = client.FetchUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	_, err = r.Read(make([]byte, 1024))
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+	assert.NoError(t, r.Close())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading did not stop once closed")
+	}
+}
+
+func TestDownloadSeek(t *testing.T) {
+	oldChunk := DownloadChunkSize
+	defer func() {
+		DownloadChunkSize = oldChunk
+	}()
+	DownloadChunkSize = 16 * 1024
+
+	data := make([]byte, 10*DownloadChunkSize+123)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+
+	srv := &rangeServer{data: data}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	for _, concurrency := range []int{1, 4} {
+		client.SetDownloadConcurrency(concurrency)
+		srv.ranges = nil
+
+		r, _, err := client.FetchUpdate(ac, ts.URL, time.Minute)
+		assert.NoError(t, err)
+		buf := make([]byte, 100)
+		_, err = io.ReadFull(r, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, data[:100], buf)
+
+		s, ok := r.(io.Seeker)
+		assert.True(t, ok)
+		off, err := s.Seek(50000, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(50000), off)
+
+		out, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data[50000:], out), "concurrency %d", concurrency)
+		if concurrency == 1 {
+			assert.Contains(t, srv.ranges, "bytes=50000-")
+		} else {
+			assert.Contains(t, srv.ranges,
+				fmt.Sprintf("bytes=50000-%d", 50000+DownloadChunkSize-1))
+		}
+		assert.NoError(t, r.Close())
+
+		_, err = s.Seek(int64(len(data)), io.SeekStart)
+		assert.Error(t, err)
+		_, err = s.Seek(0, io.SeekCurrent)
+		assert.Error(t, err)
+	}
+
+	// servers not supporting ranges can not seek, and the download goes on
+	noRanges := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+		}))
+	defer noRanges.Close()
+
+	client.SetDownloadConcurrency(1)
+	r, _, err := client.FetchUpdate(ac, noRanges.URL, time.Minute)
+	assert.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(r, buf)
+	assert.NoError(t, err)
+	_, err = r.(io.Seeker).Seek(50000, io.SeekStart)
+	assert.Error(t, err)
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data[100:], out))
+	r.Close()
+}
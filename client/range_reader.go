@@ -0,0 +1,144 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRangeLimit is returned when reading past the limit of a RangeReader.
+var ErrRangeLimit = errors.New("read limit of artifact range reached")
+
+// RangeReader reads the beginning of an artifact with range requests of
+// growing size, so that little more of it is downloaded than is read.
+type RangeReader struct {
+	api    ApiRequester
+	url    string
+	limit  int64
+	offset int64
+	// size of the next range to request
+	next int64
+	body io.ReadCloser
+	// set once the end of the artifact is known to be reached
+	eof bool
+}
+
+// NewRangeReader returns a reader of at most `limit` bytes of the artifact at
+// `url`, requested `chunk` bytes at first.
+func NewRangeReader(api ApiRequester, url string, chunk, limit int64) *RangeReader {
+	return &RangeReader{
+		api:   api,
+		url:   url,
+		limit: limit,
+		next:  chunk,
+	}
+}
+
+func (r *RangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.body != nil && r.offset < r.limit {
+			if rest := r.limit - r.offset; int64(len(p)) > rest {
+				p = p[:rest]
+			}
+			n, err := r.body.Read(p)
+			r.offset += int64(n)
+			if err != io.EOF {
+				return n, err
+			}
+			r.body.Close()
+			r.body = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if r.eof && r.body == nil {
+			return 0, io.EOF
+		}
+		if r.offset >= r.limit {
+			return 0, ErrRangeLimit
+		}
+		if err := r.request(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *RangeReader) request() error {
+	end := r.offset + r.next
+	if end > r.limit {
+		end = r.limit
+	}
+	r.next *= 2
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create artifact range request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, end-1))
+
+	res, err := r.api.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "artifact range request failed")
+	}
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		var start, last, size int64
+		_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d",
+			&start, &last, &size)
+		if err != nil || start != r.offset {
+			res.Body.Close()
+			return errors.Errorf("unexpected range of artifact returned: %q",
+				res.Header.Get("Content-Range"))
+		}
+		r.eof = last+1 >= size
+
+	case http.StatusOK:
+		if r.offset > 0 {
+			res.Body.Close()
+			return errors.New("server stopped serving ranges of the artifact")
+		}
+		// no range support; read as much of the whole artifact as needed
+		r.eof = true
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		res.Body.Close()
+		r.eof = true
+		return nil
+
+	case http.StatusForbidden:
+		res.Body.Close()
+		return ErrDownloadForbidden
+
+	default:
+		res.Body.Close()
+		return errors.Errorf("artifact range request failed: %s", res.Status)
+	}
+
+	r.body = res.Body
+	return nil
+}
+
+func (r *RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeReader(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	srv := &rangeServer{data: data}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	// ranges double in size until the end is reached
+	r := NewRangeReader(ac, ts.URL, 50, 1000)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	assert.Equal(t, []string{"bytes=0-49", "bytes=50-149", "bytes=150-349"}, srv.ranges)
+	assert.NoError(t, r.Close())
+
+	// reading stops at the limit
+	srv.ranges = nil
+	r = NewRangeReader(ac, ts.URL, 50, 100)
+	b, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrRangeLimit, err)
+	assert.Equal(t, data[:100], b)
+	assert.Equal(t, []string{"bytes=0-49", "bytes=50-99"}, srv.ranges)
+
+	// artifact exactly at the limit
+	r = NewRangeReader(ac, ts.URL, 1000, 300)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// whole artifact returned, limit still applies
+	whole := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		}))
+	defer whole.Close()
+
+	r = NewRangeReader(ac, whole.URL, 50, 1000)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	r = NewRangeReader(ac, whole.URL, 50, 100)
+	b, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrRangeLimit, err)
+	assert.Equal(t, data[:100], b)
+	assert.NoError(t, r.Close())
+
+	status := http.StatusForbidden
+	failing := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+	defer failing.Close()
+
+	r = NewRangeReader(ac, failing.URL, 50, 100)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrDownloadForbidden, err)
+
+	status = http.StatusInternalServerError
+	r = NewRangeReader(ac, failing.URL, 50, 100)
+	_, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, fmt.Sprintf("artifact range request failed: %d %s",
+		http.StatusInternalServerError,
+		http.StatusText(http.StatusInternalServerError)))
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateWindow applies a different download rate limit between Start and End,
+// given as "HH:MM" in local time. A window may wrap around midnight, for
+// instance 22:00-06:00.
+type RateWindow struct {
+	Start          string
+	End            string
+	BytesPerSecond int64
+}
+
+// RateLimit is the download rate limit; zero means unlimited
+type RateLimit struct {
+	BytesPerSecond int64
+	// first matching window overrides BytesPerSecond
+	Schedule []RateWindow
+}
+
+// ParseTimeOfDay parses "HH:MM" into time since midnight
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 ||
+		h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w RateWindow) contains(t time.Time) bool {
+	start, err := ParseTimeOfDay(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := ParseTimeOfDay(w.End)
+	if err != nil {
+		return false
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// Rate returns the limit in effect at `t`
+func (r *RateLimit) Rate(t time.Time) int64 {
+	if r == nil {
+		return 0
+	}
+	for _, w := range r.Schedule {
+		if w.contains(t) {
+			return w.BytesPerSecond
+		}
+	}
+	return r.BytesPerSecond
+}
+
+// needed so that we can override it when testing
+var (
+	rateNow   = time.Now
+	rateSleep = time.Sleep
+)
+
+// ThrottledReader limits the rate at which data is read from the underlying
+// reader
+type ThrottledReader struct {
+	io.ReadCloser
+	limit *RateLimit
+
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func NewThrottledReader(r io.ReadCloser, limit *RateLimit) *ThrottledReader {
+	return &ThrottledReader{
+		ReadCloser: r,
+		limit:      limit,
+	}
+}
+
+func (t *ThrottledReader) Read(buf []byte) (int, error) {
+	now := rateNow()
+	rate := t.limit.Rate(now)
+	if rate <= 0 {
+		t.rate = 0
+		return t.ReadCloser.Read(buf)
+	}
+
+	// start counting over if the rate changed or we fell behind, so that
+	// time spent elsewhere does not turn into a burst
+	if rate != t.rate || now.Sub(t.start) > time.Second+t.expected() {
+		t.rate = rate
+		t.start = now
+		t.read = 0
+	}
+
+	// read in chunks of at most 1/10th of a second worth of data
+	if chunk := rate / 10; chunk > 0 && int64(len(buf)) > chunk {
+		buf = buf[:chunk]
+	} else if chunk == 0 && len(buf) > 1 {
+		buf = buf[:1]
+	}
+
+	n, err := t.ReadCloser.Read(buf)
+	t.read += int64(n)
+
+	if wait := t.expected() - rateNow().Sub(t.start); wait > 0 {
+		rateSleep(wait)
+	}
+	return n, err
+}
+
+// time it should take to read what was read so far
+func (t *ThrottledReader) expected() time.Duration {
+	if t.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+}
+
+// Seek seeks the underlying download, if it supports it
+func (t *ThrottledReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := t.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("download can not seek")
+	}
+	return s.Seek(offset, whence)
+}
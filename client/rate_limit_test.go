@@ -0,0 +1,114 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	_, err := ParseTimeOfDay("25:00")
+	assert.Error(t, err)
+	_, err = ParseTimeOfDay("noon")
+	assert.Error(t, err)
+	d, err := ParseTimeOfDay("06:30")
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Hour+30*time.Minute, d)
+
+	var none *RateLimit
+	assert.Equal(t, int64(0), none.Rate(time.Now()))
+
+	limit := &RateLimit{
+		BytesPerSecond: 1000,
+		Schedule: []RateWindow{
+			{Start: "08:00", End: "18:00", BytesPerSecond: 100},
+			{Start: "22:00", End: "06:00", BytesPerSecond: 0},
+		},
+	}
+	at := func(hm string) time.Time {
+		tm, err := time.Parse("15:04", hm)
+		assert.NoError(t, err)
+		return tm
+	}
+	assert.Equal(t, int64(1000), limit.Rate(at("07:59")))
+	assert.Equal(t, int64(100), limit.Rate(at("08:00")))
+	assert.Equal(t, int64(100), limit.Rate(at("17:59")))
+	assert.Equal(t, int64(1000), limit.Rate(at("18:00")))
+	assert.Equal(t, int64(0), limit.Rate(at("23:00")))
+	assert.Equal(t, int64(0), limit.Rate(at("05:00")))
+}
+
+func TestThrottledReader(t *testing.T) {
+	oldNow, oldSleep := rateNow, rateSleep
+	defer func() {
+		rateNow, rateSleep = oldNow, oldSleep
+	}()
+
+	// fake clock, advanced by sleeping
+	clock := time.Date(2017, 1, 1, 12, 0, 0, 0, time.Local)
+	slept := time.Duration(0)
+	rateNow = func() time.Time { return clock }
+	rateSleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	data := make([]byte, 10000)
+	r := NewThrottledReader(ioutil.NopCloser(bytes.NewReader(data)),
+		&RateLimit{BytesPerSecond: 1000})
+
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	// 1/10th of a second worth of data
+	assert.Equal(t, 100, n)
+
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, out, len(data)-100)
+	assert.Equal(t, 10*time.Second, slept)
+
+	// unlimited
+	slept = 0
+	r = NewThrottledReader(ioutil.NopCloser(bytes.NewReader(data)), &RateLimit{})
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, out, len(data))
+	assert.Equal(t, time.Duration(0), slept)
+
+	// seeking is up to the underlying reader
+	_, err = r.Seek(10, io.SeekStart)
+	assert.Error(t, err)
+	r = NewThrottledReader(readSeekCloser{bytes.NewReader(data)}, &RateLimit{})
+	off, err := r.Seek(10, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), off)
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Len(t, out, len(data)-10)
+}
+
+type readSeekCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekCloser) Close() error {
+	return nil
+}
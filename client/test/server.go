@@ -64,6 +64,13 @@ type inventoryType struct {
 	Attrs  []client.InventoryAttribute
 }
 
+type deviceConfigType struct {
+	Called   bool
+	Data     *client.DeviceConfig
+	Reported bool
+	Report   client.DeviceConfigReport
+}
+
 type ClientTestServer struct {
 	*httptest.Server
 
@@ -73,6 +80,7 @@ type ClientTestServer struct {
 	Status         statusType
 	Log            logType
 	Inventory      inventoryType
+	DeviceConfig   deviceConfigType
 }
 
 func NewClientTestServer() *ClientTestServer {
@@ -86,6 +94,8 @@ func NewClientTestServer() *ClientTestServer {
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/status", cts.statusReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/", cts.deploymentsReq)
 	mux.HandleFunc("/api/devices/v1/download", cts.updateDownloadReq)
+	mux.HandleFunc("/api/devices/v1/deviceconfig/configuration", cts.deviceConfigReq)
+	mux.HandleFunc("/api/devices/v1/deviceconfig/configuration/status", cts.deviceConfigStatusReq)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Infof("fallback request handler, request %v", r)
 		w.WriteHeader(http.StatusBadRequest)
@@ -114,6 +124,7 @@ func (cts *ClientTestServer) Reset() {
 	cts.Log = logType{}
 	cts.Inventory = inventoryType{}
 	cts.Status = statusType{}
+	cts.DeviceConfig = deviceConfigType{}
 }
 
 func isMethod(method string, w http.ResponseWriter, r *http.Request) bool {
@@ -377,3 +388,52 @@ func (cts *ClientTestServer) updateDownloadReq(w http.ResponseWriter, r *http.Re
 	w.WriteHeader(http.StatusOK)
 	io.Copy(w, &cts.UpdateDownload.Data)
 }
+
+func (cts *ClientTestServer) deviceConfigReq(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got device configuration request %v", r)
+	cts.DeviceConfig.Called = true
+
+	if !isMethod(http.MethodGet, w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	if cts.DeviceConfig.Data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, cts.DeviceConfig.Data)
+}
+
+func (cts *ClientTestServer) deviceConfigStatusReq(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got device configuration status request %v", r)
+
+	if !isMethod(http.MethodPut, w, r) {
+		return
+	}
+
+	if !isContentType("application/json", w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	var report client.DeviceConfigReport
+	if err := fromJSON(r.Body, &report); err != nil {
+		log.Errorf("failed to parse device configuration status: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cts.DeviceConfig.Reported = true
+	cts.DeviceConfig.Report = report
+	w.WriteHeader(http.StatusNoContent)
+}
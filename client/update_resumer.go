@@ -21,19 +21,105 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// renew links this long before they expire, not to start requests that are
+// bound to be rejected
+const linkExpiryMargin = 10 * time.Second
+
+// RefreshFunc returns a new link to download the artifact from, and when it
+// expires
+type RefreshFunc func() (string, time.Time, error)
+
+// Refresher is implemented by downloads that can switch to a new link to the
+// artifact once the one they were started with expires or is rejected.
+type Refresher interface {
+	SetRefresh(expire time.Time, refresh RefreshFunc)
+}
+
+// artifactLink is the link an artifact is downloaded from; it is shared by
+// all the requests of a download, so that it is renewed just once
+type artifactLink struct {
+	lock    sync.Mutex
+	uri     string
+	expire  time.Time
+	refresh RefreshFunc
+}
+
+func newArtifactLink(req *http.Request) *artifactLink {
+	l := &artifactLink{}
+	if req != nil && req.URL != nil {
+		l.uri = req.URL.String()
+	}
+	return l
+}
+
+func (l *artifactLink) set(expire time.Time, refresh RefreshFunc) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.expire = expire
+	l.refresh = refresh
+}
+
+func (l *artifactLink) refreshable() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.refresh != nil
+}
+
+// get returns the link to use for a new request, renewing it if it expired
+func (l *artifactLink) get() (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.refresh == nil || l.expire.IsZero() ||
+		time.Now().Before(l.expire.Add(-linkExpiryMargin)) {
+		return l.uri, nil
+	}
+	log.Infof("artifact download link expired at %v", l.expire)
+	return l.uri, l.renewLocked()
+}
+
+// renew replaces the link `stale`, rejected by the server, unless another
+// request has already done so
+func (l *artifactLink) renew(stale string) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.uri != stale {
+		return l.uri, nil
+	}
+	return l.uri, l.renewLocked()
+}
+
+func (l *artifactLink) renewLocked() error {
+	uri, expire, err := l.refresh()
+	if err != nil {
+		return errors.Wrapf(err, "failed to renew artifact download link")
+	}
+	log.Infof("renewed artifact download link, expires at %v", expire)
+	l.uri = uri
+	l.expire = expire
+	return nil
+}
+
 type UpdateResumer struct {
 	stream        io.ReadCloser
 	apiReq        ApiRequester
 	req           *http.Request
 	offset        int64
+	// range being downloaded, [start, end)
+	start         int64
+	end           int64
 	contentLength int64
 	retryAttempts int
 	maxWait       time.Duration
+	link          *artifactLink
 }
 
 // Note: It is important that nothing has been read from the stream yet.
@@ -47,11 +133,27 @@ func NewUpdateResumer(stream io.ReadCloser,
 		stream:        stream,
 		apiReq:        apiReq,
 		req:           req,
+		end:           contentLength,
 		contentLength: contentLength,
 		maxWait:       maxWait,
+		link:          newArtifactLink(req),
 	}
 }
 
+// newRangeResumer is like NewUpdateResumer, but for the part [start, end) of
+// the artifact of size contentLength; `stream` must begin at `start`.
+func newRangeResumer(stream io.ReadCloser, start, end, contentLength int64,
+	maxWait time.Duration, apiReq ApiRequester, req *http.Request,
+	link *artifactLink) *UpdateResumer {
+
+	r := NewUpdateResumer(stream, contentLength, maxWait, apiReq, req)
+	r.link = link
+	r.offset = start
+	r.start = start
+	r.end = end
+	return r
+}
+
 func (h *UpdateResumer) Read(buf []byte) (int, error) {
 	origOffset := h.offset
 	for {
@@ -60,8 +162,8 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 			h.offset += int64(bytesRead)
 		}
 		if err == nil ||
-			h.offset <= 0 ||
-			(err == io.EOF && h.offset >= h.contentLength) {
+			h.offset <= h.start ||
+			(err == io.EOF && h.offset >= h.end) {
 
 			return int(h.offset - origOffset), err
 		}
@@ -70,7 +172,7 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 		// EOF, or a normal EOF, but with an unexpected number of bytes. This is
 		// a sign that we should try to resume from the same position.
 
-		h.req.Header.Set("Range", fmt.Sprintf("bytes=%d-", h.offset))
+		h.req.Header.Set("Range", rangeHeader(h.offset, h.end, h.contentLength))
 
 		var res *http.Response
 		for {
@@ -89,7 +191,7 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 
 			log.Infof("Attempting to resume artifact download from offset %d", h.offset)
 
-			res, err = h.apiReq.Do(h.req)
+			res, err = h.do()
 			if err != nil {
 				log.Infof("Download resume request failed: %s", err.Error())
 				continue
@@ -108,6 +210,59 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 	}
 }
 
+// SetRefresh makes the download renew the link to the artifact using
+// `refresh`, when the link expires at `expire` or is rejected by the server
+func (h *UpdateResumer) SetRefresh(expire time.Time, refresh RefreshFunc) {
+	h.link.set(expire, refresh)
+}
+
+// do sends the request for the rest of the range, renewing the link to the
+// artifact if needed
+func (h *UpdateResumer) do() (*http.Response, error) {
+	uri, err := h.link.get()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.useLink(uri); err != nil {
+		return nil, err
+	}
+
+	res, err := h.apiReq.Do(h.req)
+	if err != nil || res.StatusCode != http.StatusForbidden || !h.link.refreshable() {
+		return res, err
+	}
+	res.Body.Close()
+
+	log.Infof("artifact download link was rejected, requesting a new one")
+	if uri, err = h.link.renew(uri); err != nil {
+		return nil, err
+	}
+	if err := h.useLink(uri); err != nil {
+		return nil, err
+	}
+	return h.apiReq.Do(h.req)
+}
+
+func (h *UpdateResumer) useLink(uri string) error {
+	if uri == "" || uri == h.req.URL.String() {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errors.Wrapf(err, "invalid artifact download link")
+	}
+	h.req.URL = u
+	h.req.Host = ""
+	return nil
+}
+
+func rangeHeader(start, end, contentLength int64) string {
+	if end < contentLength {
+		return fmt.Sprintf("bytes=%d-%d", start, end-1)
+	}
+	return fmt.Sprintf("bytes=%d-", start)
+}
+
 func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.ReadCloser, error) {
 	var err error
 
@@ -170,6 +325,39 @@ func (h *UpdateResumer) getStreamFromPartialContent(res *http.Response) (io.Read
 	return res.Body, nil
 }
 
+// Seek makes reading continue at `offset` of the artifact, with a range
+// request; only seeking from the start of the artifact is supported. The
+// download goes on from where it was if the request fails.
+func (h *UpdateResumer) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return h.offset, errors.New("download can only seek from the start")
+	}
+	if offset < h.start || offset >= h.end {
+		return h.offset, errors.Errorf("offset %d is out of the range downloaded", offset)
+	}
+	if offset == h.offset {
+		return offset, nil
+	}
+
+	log.Infof("continuing artifact download at offset %d", offset)
+	h.req.Header.Set("Range", rangeHeader(offset, h.end, h.contentLength))
+	res, err := h.do()
+	if err != nil {
+		return h.offset, errors.Wrapf(err, "range request failed")
+	}
+	prev := h.offset
+	h.offset = offset
+	stream, err := h.getStreamFromPartialContent(res)
+	if err != nil {
+		res.Body.Close()
+		h.offset = prev
+		return prev, err
+	}
+	h.stream.Close()
+	h.stream = stream
+	return offset, nil
+}
+
 func (h *UpdateResumer) Close() error {
 	return h.stream.Close()
 }
@@ -15,14 +15,19 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -358,3 +363,134 @@ func TestBrokenReadAndPartialDownload(t *testing.T) {
 
 	t.Run("group", testBrokenReadAndPartialDownload_group)
 }
+
+// linkServer serves `data` at `link` only, as if links to it expired
+type linkServer struct {
+	data []byte
+
+	lock     sync.Mutex
+	link     string
+	requests []string
+	// cut the next download short
+	cut bool
+	// link to switch to once the current one was used
+	next string
+}
+
+func (s *linkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests = append(s.requests, r.URL.Path+" "+r.Header.Get("Range"))
+	link, cut := s.link, s.cut
+	if r.URL.Path == link && s.next != "" {
+		s.link = s.next
+		s.next = ""
+	}
+	s.cut = false
+	s.lock.Unlock()
+
+	if r.URL.Path != link {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if cut {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.data[:len(s.data)/2])
+		return
+	}
+	http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *linkServer) setLink(link string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.link = link
+}
+
+func TestUpdateResumerRefresh(t *testing.T) {
+	oldUnit := exponentialBackoffSmallestUnit
+	exponentialBackoffSmallestUnit = time.Millisecond
+	oldChunk := DownloadChunkSize
+	DownloadChunkSize = 16 * 1024
+	defer func() {
+		exponentialBackoffSmallestUnit = oldUnit
+		DownloadChunkSize = oldChunk
+	}()
+
+	data := make([]byte, 4*DownloadChunkSize+123)
+	rand.Read(data)
+	srv := &linkServer{data: data}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+	client := NewUpdate()
+
+	var refreshed int
+	refresh := func() (string, time.Time, error) {
+		refreshed++
+		return ts.URL + "/b", time.Now().Add(time.Hour), nil
+	}
+	half := fmt.Sprintf("bytes=%d-", len(data)/2)
+
+	// link rejected when resuming
+	srv.link, srv.cut = "/a", true
+	r, _, err := client.FetchUpdate(ac, ts.URL+"/a", time.Minute)
+	assert.NoError(t, err)
+	r.(Refresher).SetRefresh(time.Time{}, refresh)
+	srv.setLink("/b")
+
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	assert.Equal(t, 1, refreshed)
+	assert.Equal(t, []string{"/a ", "/a " + half, "/b " + half}, srv.requests)
+
+	// link known to have expired is renewed before resuming
+	refreshed = 0
+	srv.link, srv.cut, srv.requests = "/a", true, nil
+	r, _, err = client.FetchUpdate(ac, ts.URL+"/a", time.Minute)
+	assert.NoError(t, err)
+	r.(Refresher).SetRefresh(time.Now(), refresh)
+	srv.setLink("/b")
+
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	assert.Equal(t, 1, refreshed)
+	assert.Equal(t, []string{"/a ", "/b " + half}, srv.requests)
+
+	// renewed once for all the connections of a parallel download
+	refreshed = 0
+	srv.link, srv.next, srv.requests = "/a", "/b", nil
+	client.SetDownloadConcurrency(3)
+	r, _, err = client.FetchUpdate(ac, ts.URL+"/a", time.Minute)
+	assert.NoError(t, err)
+	assert.IsType(t, &ParallelReader{}, r)
+	r.(Refresher).SetRefresh(time.Time{}, refresh)
+
+	out, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	assert.Equal(t, 1, refreshed)
+	r.Close()
+
+	// failure to renew the link fails the download
+	srv.link, srv.cut, srv.requests = "/a", true, nil
+	client.SetDownloadConcurrency(1)
+	r, _, err = client.FetchUpdate(ac, ts.URL+"/a", 5*time.Millisecond)
+	assert.NoError(t, err)
+	r.(Refresher).SetRefresh(time.Time{}, func() (string, time.Time, error) {
+		return "", time.Time{}, errors.New("deployment aborted")
+	})
+	srv.setLink("/b")
+
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	// refused right away
+	srv.link = "/b"
+	_, _, err = client.FetchUpdate(ac, ts.URL+"/a", time.Minute)
+	assert.Equal(t, ErrDownloadForbidden, err)
+}
@@ -15,7 +15,17 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -32,6 +42,8 @@ type menderConfig struct {
 		Key         string
 		SkipVerify  bool
 	}
+	// Root filesystem partitions, as device paths or as PARTUUID=,
+	// PARTLABEL=, UUID= or LABEL= followed by the value
 	RootfsPartA                     string
 	RootfsPartB                     string
 	UpdatePollIntervalSeconds       int
@@ -44,19 +56,233 @@ type menderConfig struct {
 	ServerCertificate               string
 	UpdateLogPath                   string
 	TenantToken                     string
+	// Additional servers, in order of preference, used when ServerURL
+	// can not be reached.
+	Servers []serverConfig
+	// How often to check if the preferred server is back, after switching
+	// to another one.
+	ServerProbeIntervalSeconds int
+	// Keep a long-poll connection to the server, so that it can notify
+	// about new deployments without waiting for the poll interval.
+	EnableNotifications bool
+	// Transport used for status reports, logs, inventory and update checks,
+	// "http" (default) or "mqtt". Authorization, device configuration and
+	// notifications always use http(s), so ServerURL has to be reachable
+	// with "mqtt" too.
+	Transport string
+	MQTT      mqttConfig
+	// What to do with an installed update if its success can not be
+	// reported to the server: "rollback" (default) or "queue", which keeps
+	// the update and sends the report once the server can be reached.
+	StatusReportFailurePolicy string
+	// Download rate limit in bytes per second, 0 for unlimited
+	DownloadRateLimit int
+	// Rate limits for parts of the day, overriding DownloadRateLimit
+	DownloadRateSchedule []client.RateWindow
+	// Postpone downloading updates while on a metered connection
+	MeteredConnection meteredConfig
+	// Number of concurrent range requests used for downloading artifacts,
+	// if the server supports them; 0 or 1 downloads sequentially
+	DownloadConcurrency int
+	// Share installed artifacts with other devices on the local network
+	PeerSharing peerSharingConfig
+	// Serve the device API to devices without access to the server, see
+	// gateway.go; used with the -gateway option
+	Gateway gatewayConfig
+	// Install updates from removable media, see offline.go
+	OfflineUpdate offlineUpdateConfig
+	// How update images are written to the inactive partition
+	PartitionWrite partitionWriteConfig
 }
 
-func LoadConfig(configFile string) (*menderConfig, error) {
+type serverConfig struct {
+	ServerURL string
+	// Defaults to ServerCertificate of the main configuration if empty
+	ServerCertificate string
+}
+
+const (
+	transportHTTP = "http"
+	transportMQTT = "mqtt"
+)
+
+type mqttConfig struct {
+	// for instance ssl://broker.example.com:8883
+	Broker string
+	// Defaults to the host name if empty
+	ClientID string
+	Username string
+	Password string
+	QoS      int
+	// Topics, "{clientid}" is replaced with ClientID
+	StatusTopic         string
+	InventoryTopic      string
+	LogTopic            string
+	UpdateRequestTopic  string
+	UpdateResponseTopic string
+	TimeoutSeconds      int
+}
+
+type meteredConfig struct {
+	// Script exiting with 0 if the connection is metered, 1 if not
+	CheckScript string
+	// Patterns of metered interfaces, used if CheckScript is not set
+	Interfaces []string
+}
+
+type peerSharingConfig struct {
+	Enabled bool
+	// Address to serve the installed artifact on, for instance ":8443";
+	// artifacts are only downloaded from peers if empty
+	ListenAddress string
+	// TLS certificate and key used for serving peers
+	Certificate string
+	Key         string
+	// Directory for the shared artifact, data store directory by default
+	Directory string
+	// Peers tried before the server, for instance https://10.0.0.2:8443
+	Peers []string
+	// CA certificate of the peers; if empty, peers are not authenticated
+	ServerCertificate string
+}
+
+type gatewayConfig struct {
+	// Address to serve the device API on, for instance ":443"
+	ListenAddress string
+	// TLS certificate and key presented to the devices; plain HTTP is
+	// served if not set
+	Certificate string
+	Key         string
+	// Directory for cached artifacts, "gateway" in the data store
+	// directory by default
+	CacheDirectory string
+	// Number of artifacts kept in the cache, 3 by default
+	MaxCachedArtifacts int
+}
+
+type offlineUpdateConfig struct {
+	// Patterns of the directories removable media are mounted on, for
+	// instance "/media/*"; updates are looked for in their "mender"
+	// subdirectory
+	MediaPaths []string
+	// How often to look for inserted media, 5 seconds by default
+	PollIntervalSeconds int
+	// Ignore media without a signed deployment manifest
+	RequireManifest bool
+}
+
+type partitionWriteConfig struct {
+	// Read the image back from the partition after writing it and compare
+	// it with the checksum in the artifact manifest
+	VerifyWrites bool
+	// Write with O_DIRECT, bypassing the page cache, if the device allows
+	DirectIO bool
+	// Size in bytes of each of the two buffers images are written from,
+	// rounded down to whole sectors; 1 MiB by default
+	BufferSize int
+	// Read what is on the partition and only write the blocks that differ,
+	// to reduce flash wear; UBI volumes are always written as a whole
+	SkipUnchanged bool
+	// Discard the partition before writing and the part after the image:
+	// "discard", "secure" for a secure discard if the device supports it,
+	// or empty to not discard
+	Discard string
+}
+
+const (
+	discardRegular = "discard"
+	discardSecure  = "secure"
+)
+
+const (
+	configEnvPrefix     = "MENDER_"
+	configDropInSuffix  = ".d"
+	configDropInPattern = "*.conf"
+	configOverlayName   = "mender.conf"
+	configSourceDefault = "default"
+)
+
+// configSources tracks where the value of each configuration field was set,
+// field names are as returned by configFields()
+type configSources map[string]string
+
+// needed so that we can override it when testing
+var configEnviron = os.Environ
+
+// LoadConfig assembles the configuration from the following layers, each one
+// overriding values set by the previous ones:
+//
+//  1. the main configuration file `configFile`, for instance
+//     /etc/mender/mender.conf
+//  2. drop-in files matching *.conf in the directory named after the main
+//     configuration file with '.d' appended, in lexical order
+//  3. persistent overlay `overlayFile`, kept in the data store directory,
+//     which is not replaced by rootfs updates
+//  4. MENDER_* environment variables, see configEnvName()
+//
+// The main configuration file must exist and be valid. Broken drop-ins,
+// overlay or environment variables are logged and skipped. Returned sources
+// tell where the value of each field was set.
+func LoadConfig(configFile, overlayFile string) (*menderConfig, configSources, error) {
 	var confFromFile menderConfig
+	sources := configSources{}
 
-	if err := readConfigFile(&confFromFile, configFile); err != nil {
+	if err := readConfigLayer(&confFromFile, sources, configFile, "file"); err != nil {
 		// Some error occured while loading config file.
 		// Use default configuration.
 		log.Infof("Error loading configuration from file: %s (%s)", configFile, err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &confFromFile, nil
+	for _, dropIn := range configDropIns(configFile) {
+		if err := readConfigLayer(&confFromFile, sources, dropIn, "drop-in"); err != nil {
+			log.Errorf("Error loading configuration drop-in %s, skipping: %v",
+				dropIn, err)
+		}
+	}
+
+	if overlayFile != "" {
+		err := readConfigLayer(&confFromFile, sources, overlayFile, "overlay")
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			log.Errorf("Error loading configuration overlay %s, skipping: %v",
+				overlayFile, err)
+		}
+	}
+
+	readConfigEnv(&confFromFile, sources, configEnviron())
+
+	return &confFromFile, sources, nil
+}
+
+// configDropIns lists drop-in files of the main configuration file in the
+// order they are applied
+func configDropIns(configFile string) []string {
+	dropIns, err := filepath.Glob(path.Join(configFile+configDropInSuffix,
+		configDropInPattern))
+	if err != nil {
+		log.Errorf("failed to list configuration drop-ins: %v", err)
+	}
+	sort.Strings(dropIns)
+	return dropIns
+}
+
+// readConfigLayer reads a configuration file on top of `config` and records
+// the fields it has set in `sources`. Nothing is changed if the file can not be
+// parsed.
+func readConfigLayer(config *menderConfig, sources configSources, fileName, kind string) error {
+	layer := *config
+	if err := readConfigFile(&layer, fileName); err != nil {
+		return err
+	}
+
+	// file was parsed already, so this can not fail
+	conf, _ := ioutil.ReadFile(fileName)
+	for _, name := range configFieldsIn(conf) {
+		sources[name] = fmt.Sprintf("%s %s", kind, fileName)
+	}
+
+	*config = layer
+	return nil
 }
 
 func readConfigFile(config interface{}, fileName string) error {
@@ -76,6 +302,153 @@ func readConfigFile(config interface{}, fileName string) error {
 	return nil
 }
 
+// configFields lists all fields of menderConfig. Fields of nested structures
+// are named with a dot, for instance "HttpsClient.SkipVerify".
+func configFields() []string {
+	return structFields(reflect.TypeOf(menderConfig{}), "")
+}
+
+func structFields(t reflect.Type, prefix string) []string {
+	fields := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(f.Type, prefix+f.Name+".")...)
+		} else {
+			fields = append(fields, prefix+f.Name)
+		}
+	}
+	return fields
+}
+
+// configField returns value of the field `name` in `config`
+func configField(config *menderConfig, name string) reflect.Value {
+	v := reflect.ValueOf(config).Elem()
+	for _, n := range strings.Split(name, ".") {
+		v = v.FieldByName(n)
+	}
+	return v
+}
+
+// configFieldsIn lists configuration fields set in JSON document `data`. As
+// with encoding/json, key names are matched case-insensitively.
+func configFieldsIn(data []byte) []string {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil
+	}
+
+	set := []string{}
+	for _, name := range configFields() {
+		parts := strings.SplitN(name, ".", 2)
+		for k, v := range keys {
+			if !strings.EqualFold(k, parts[0]) {
+				continue
+			}
+			if len(parts) == 1 {
+				set = append(set, name)
+			} else if configFieldsInNested(v, parts[1]) {
+				set = append(set, name)
+			}
+		}
+	}
+	return set
+}
+
+func configFieldsInNested(data []byte, name string) bool {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return false
+	}
+	for k := range keys {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// configEnvName returns name of environment variable overriding the
+// configuration field, for instance MENDER_HTTPSCLIENT_SKIPVERIFY for
+// "HttpsClient.SkipVerify".
+func configEnvName(field string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(field, ".", "_", -1))
+}
+
+func readConfigEnv(config *menderConfig, sources configSources, environ []string) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, configEnvPrefix) {
+			continue
+		}
+		if v := strings.SplitN(kv, "=", 2); len(v) == 2 {
+			env[v[0]] = v[1]
+		}
+	}
+
+	for _, name := range configFields() {
+		envName := configEnvName(name)
+		val, ok := env[envName]
+		if !ok {
+			continue
+		}
+
+		field := configField(config, name)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(val)
+		case reflect.Int:
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				log.Errorf("invalid value of %s, skipping: %v", envName, err)
+				continue
+			}
+			field.SetInt(int64(i))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				log.Errorf("invalid value of %s, skipping: %v", envName, err)
+				continue
+			}
+			field.SetBool(b)
+		default:
+			// anything else is given in JSON, for instance server list
+			if err := json.Unmarshal([]byte(val), field.Addr().Interface()); err != nil {
+				log.Errorf("invalid value of %s, skipping: %v", envName, err)
+				continue
+			}
+		}
+		sources[name] = "environment " + envName
+	}
+}
+
+// credentials, which ShowConfig() does not reveal
+var secretConfigFields = map[string]bool{
+	"TenantToken":   true,
+	"MQTT.Password": true,
+}
+
+// ShowConfig writes the effective configuration, one field per line together
+// with the place the value was set. Credentials are only shown as <set>.
+func ShowConfig(out io.Writer, config *menderConfig, sources configSources) error {
+	for _, name := range configFields() {
+		field := configField(config, name)
+		val, _ := json.Marshal(field.Interface())
+		if secretConfigFields[name] && field.String() != "" {
+			val = []byte("<set>")
+		}
+
+		src, ok := sources[name]
+		if !ok {
+			src = configSourceDefault
+		}
+		if _, err := fmt.Fprintf(out, "%s=%s (%s)\n", name, val, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c menderConfig) GetHttpConfig() client.Config {
 	return client.Config{
 		ServerCert: c.ServerCertificate,
@@ -84,10 +457,64 @@ func (c menderConfig) GetHttpConfig() client.Config {
 	}
 }
 
+// GetRateLimit returns nil if downloads are not limited
+func (c menderConfig) GetRateLimit() *client.RateLimit {
+	if c.DownloadRateLimit == 0 && len(c.DownloadRateSchedule) == 0 {
+		return nil
+	}
+	return &client.RateLimit{
+		BytesPerSecond: int64(c.DownloadRateLimit),
+		Schedule:       c.DownloadRateSchedule,
+	}
+}
+
+// GetServers returns servers in order of preference. ServerURL, if set, is
+// always the preferred one. There is always at least one server in the list.
+func (c menderConfig) GetServers() []serverConfig {
+	servers := []serverConfig{}
+	if c.ServerURL != "" || len(c.Servers) == 0 {
+		servers = append(servers, serverConfig{ServerURL: c.ServerURL})
+	}
+	for _, s := range c.Servers {
+		if s.ServerURL != c.ServerURL {
+			servers = append(servers, s)
+		}
+	}
+
+	for i := range servers {
+		if servers[i].ServerCertificate == "" {
+			servers[i].ServerCertificate = c.ServerCertificate
+		}
+	}
+	return servers
+}
+
+// GetMQTTConfig returns configuration of the MQTT transport to the broker
+func (c menderConfig) GetMQTTConfig() client.MQTTConfig {
+	return client.MQTTConfig{
+		Broker:              c.MQTT.Broker,
+		ClientID:            c.MQTT.ClientID,
+		Username:            c.MQTT.Username,
+		Password:            c.MQTT.Password,
+		QoS:                 c.MQTT.QoS,
+		StatusTopic:         c.MQTT.StatusTopic,
+		InventoryTopic:      c.MQTT.InventoryTopic,
+		LogTopic:            c.MQTT.LogTopic,
+		UpdateRequestTopic:  c.MQTT.UpdateRequestTopic,
+		UpdateResponseTopic: c.MQTT.UpdateResponseTopic,
+		Timeout:             time.Duration(c.MQTT.TimeoutSeconds) * time.Second,
+		Config: client.Config{
+			ServerCert: c.ServerCertificate,
+			NoVerify:   c.HttpsClient.SkipVerify,
+		},
+	}
+}
+
 func (c menderConfig) GetDeviceConfig() deviceConfig {
 	return deviceConfig{
 		rootfsPartA: c.RootfsPartA,
 		rootfsPartB: c.RootfsPartB,
+		write:       c.PartitionWrite,
 	}
 }
 
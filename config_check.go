@@ -0,0 +1,482 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+// configProblem describes a single issue found in the configuration. Warnings
+// do not make the configuration invalid.
+type configProblem struct {
+	warning bool
+	msg     string
+}
+
+func (p configProblem) String() string {
+	if p.warning {
+		return "warning: " + p.msg
+	}
+	return "error: " + p.msg
+}
+
+type configProblems []configProblem
+
+func (p *configProblems) errorf(format string, args ...interface{}) {
+	*p = append(*p, configProblem{msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *configProblems) warnf(format string, args ...interface{}) {
+	*p = append(*p, configProblem{warning: true, msg: fmt.Sprintf(format, args...)})
+}
+
+// Errors returns number of problems that are not warnings
+func (p configProblems) Errors() int {
+	n := 0
+	for _, problem := range p {
+		if !problem.warning {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckConfig validates the effective configuration `config` and the
+// configuration files it was read from. Unknown keys in the files are errors,
+// unless `warnUnknown` is set.
+func CheckConfig(config *menderConfig, files []string, warnUnknown bool) configProblems {
+	problems := configProblems{}
+
+	for _, file := range files {
+		checkConfigFile(&problems, file, warnUnknown)
+	}
+
+	checkConfigValues(&problems, config)
+
+	return problems
+}
+
+// configFiles lists the files the configuration is read from, see LoadConfig()
+func configFiles(configFile, overlayFile string) []string {
+	files := append([]string{configFile}, configDropIns(configFile)...)
+	if overlayFile != "" {
+		if _, err := os.Stat(overlayFile); err == nil {
+			files = append(files, overlayFile)
+		}
+	}
+	return files
+}
+
+func checkConfigFile(problems *configProblems, file string, warnUnknown bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		problems.errorf("%s: %v", file, err)
+		return
+	}
+
+	var conf menderConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		problems.errorf("%s: %v", file, err)
+		return
+	}
+
+	report := problems.errorf
+	if warnUnknown {
+		report = problems.warnf
+	}
+	for _, key := range configUnknownKeysIn(data) {
+		if hint := configSuggestKey(key); hint != "" {
+			report("%s: unknown key %q, did you mean %q?", file, key, hint)
+		} else {
+			report("%s: unknown key %q", file, key)
+		}
+	}
+}
+
+// configUnknownKeysIn lists keys of JSON document `data` that do not match
+// any configuration field. Keys of nested objects are named with a dot.
+func configUnknownKeysIn(data []byte) []string {
+	unknown := unknownKeysIn(data, configFields(), "")
+	sort.Strings(unknown)
+	return unknown
+}
+
+func unknownKeysIn(data []byte, fields []string, prefix string) []string {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil
+	}
+
+	unknown := []string{}
+	for k, v := range keys {
+		nested := []string{}
+		found := false
+		for _, name := range fields {
+			parts := strings.SplitN(name, ".", 2)
+			if !strings.EqualFold(k, parts[0]) {
+				continue
+			}
+			found = true
+			if len(parts) == 2 {
+				nested = append(nested, parts[1])
+			}
+		}
+
+		if !found {
+			unknown = append(unknown, prefix+k)
+		} else if len(nested) > 0 {
+			unknown = append(unknown, unknownKeysIn(v, nested, prefix+k+".")...)
+		}
+	}
+	return unknown
+}
+
+// configSuggestKey returns configuration field with name similar to `key`, if
+// there is one
+func configSuggestKey(key string) string {
+	best := ""
+	bestDist := 4
+	for _, name := range configFields() {
+		d := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if d < bestDist {
+			best = name
+			bestDist = d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of `a` and `b`
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func checkReadable(problems *configProblems, field, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		problems.errorf("%s: can not read %s: %v", field, file, err)
+		return
+	}
+	f.Close()
+}
+
+func checkServer(problems *configProblems, field, server, protocol string) {
+	u, err := url.Parse(server)
+	if err != nil {
+		problems.errorf("%s: %v", field, err)
+	} else if strings.Contains(server, "://") &&
+		u.Scheme != "http" && u.Scheme != "https" {
+		problems.errorf("%s: unsupported scheme %q", field, u.Scheme)
+	} else if u.Scheme == "http" && protocol == "https" {
+		problems.errorf("%s: plain http server used with ClientProtocol \"https\"", field)
+	}
+}
+
+func checkServerCertificate(problems *configProblems, field, cert string) {
+	f, err := os.Open(cert)
+	if err != nil {
+		problems.errorf("%s: can not read %s, https connections "+
+			"to the server will fail: %v", field, cert, err)
+		return
+	}
+	f.Close()
+}
+
+func checkTransport(problems *configProblems, c *menderConfig) {
+	switch c.Transport {
+	case "", transportHTTP:
+		return
+	case transportMQTT:
+	default:
+		problems.errorf("Transport: must be %q or %q, got %q",
+			transportHTTP, transportMQTT, c.Transport)
+		return
+	}
+
+	// only part of the traffic goes over the broker
+	problems.warnf("Transport: authorization, device configuration and " +
+		"notifications still use http(s), the server must be reachable " +
+		"over it as well as the broker")
+
+	if c.MQTT.Broker == "" {
+		problems.errorf("MQTT.Broker: must be set with Transport %q", transportMQTT)
+	} else if u, err := url.Parse(c.MQTT.Broker); err != nil {
+		problems.errorf("MQTT.Broker: %v", err)
+	} else {
+		switch u.Scheme {
+		case "tcp", "mqtt":
+			problems.warnf("MQTT.Broker: connection to the broker is not encrypted")
+		case "ssl", "tls", "mqtts":
+		default:
+			problems.errorf("MQTT.Broker: unsupported scheme %q", u.Scheme)
+		}
+	}
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 1 {
+		problems.errorf("MQTT.QoS: must be 0 or 1, got %d", c.MQTT.QoS)
+	}
+}
+
+func checkDownloadLimits(problems *configProblems, c *menderConfig) {
+	if c.DownloadRateLimit < 0 {
+		problems.errorf("DownloadRateLimit: must not be negative, got %d",
+			c.DownloadRateLimit)
+	}
+	for i, w := range c.DownloadRateSchedule {
+		field := fmt.Sprintf("DownloadRateSchedule[%d]", i)
+		for _, tod := range []string{w.Start, w.End} {
+			if _, err := client.ParseTimeOfDay(tod); err != nil {
+				problems.errorf("%s: %v", field, err)
+			}
+		}
+		if w.BytesPerSecond < 0 {
+			problems.errorf("%s: BytesPerSecond must not be negative, got %d",
+				field, w.BytesPerSecond)
+		}
+	}
+
+	if script := c.MeteredConnection.CheckScript; script != "" {
+		checkReadable(problems, "MeteredConnection.CheckScript", script)
+	}
+	for _, pattern := range c.MeteredConnection.Interfaces {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			problems.errorf("MeteredConnection.Interfaces: %q: %v", pattern, err)
+		}
+	}
+}
+
+func checkPeerSharing(problems *configProblems, c *menderConfig) {
+	conf := c.PeerSharing
+	if !conf.Enabled {
+		return
+	}
+
+	if conf.ListenAddress != "" {
+		if conf.Certificate == "" || conf.Key == "" {
+			problems.errorf("PeerSharing: Certificate and Key must be set " +
+				"for serving peers")
+		}
+		if conf.Certificate != "" {
+			checkReadable(problems, "PeerSharing.Certificate", conf.Certificate)
+		}
+		if conf.Key != "" {
+			checkReadable(problems, "PeerSharing.Key", conf.Key)
+		}
+	}
+
+	for i, peer := range conf.Peers {
+		field := fmt.Sprintf("PeerSharing.Peers[%d]", i)
+		if u, err := url.Parse(peer); err != nil {
+			problems.errorf("%s: %v", field, err)
+		} else if u.Scheme != "https" {
+			problems.errorf("%s: peers must be reached over https, got %q",
+				field, peer)
+		}
+	}
+	if len(conf.Peers) > 0 && c.ArtifactVerifyKey == "" {
+		problems.errorf("PeerSharing.Peers: ArtifactVerifyKey must be set " +
+			"for downloading artifacts from peers")
+	}
+	if conf.ServerCertificate != "" {
+		checkServerCertificate(problems, "PeerSharing.ServerCertificate",
+			conf.ServerCertificate)
+	}
+}
+
+func checkGateway(problems *configProblems, c *menderConfig) {
+	conf := c.Gateway
+	if (conf.Certificate == "") != (conf.Key == "") {
+		problems.errorf("Gateway: Certificate and Key must be set together")
+	}
+	if conf.Certificate != "" {
+		checkReadable(problems, "Gateway.Certificate", conf.Certificate)
+	}
+	if conf.Key != "" {
+		checkReadable(problems, "Gateway.Key", conf.Key)
+	}
+	if conf.ListenAddress != "" && conf.Certificate == "" {
+		problems.warnf("Gateway: no Certificate set, devices will be " +
+			"served over plain HTTP")
+	}
+	if conf.MaxCachedArtifacts < 0 {
+		problems.errorf("Gateway.MaxCachedArtifacts: must not be negative, got %d",
+			conf.MaxCachedArtifacts)
+	}
+}
+
+func checkOfflineUpdate(problems *configProblems, c *menderConfig) {
+	conf := c.OfflineUpdate
+	if len(conf.MediaPaths) == 0 {
+		return
+	}
+	for i, pattern := range conf.MediaPaths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			problems.errorf("OfflineUpdate.MediaPaths[%d]: invalid pattern %q: %v",
+				i, pattern, err)
+		}
+	}
+	if c.ArtifactVerifyKey == "" {
+		problems.errorf("OfflineUpdate.MediaPaths: ArtifactVerifyKey must be set " +
+			"for installing updates from media")
+	}
+	if conf.PollIntervalSeconds < 0 {
+		problems.errorf("OfflineUpdate.PollIntervalSeconds: must not be negative, got %d",
+			conf.PollIntervalSeconds)
+	}
+}
+
+func checkPartitionWrite(problems *configProblems, c *menderConfig) {
+	conf := c.PartitionWrite
+	switch conf.Discard {
+	case "", discardRegular, discardSecure:
+	default:
+		problems.errorf("PartitionWrite.Discard: must be %q, %q or empty, got %q",
+			discardRegular, discardSecure, conf.Discard)
+		return
+	}
+	if conf.Discard != "" && conf.SkipUnchanged {
+		problems.warnf("PartitionWrite.Discard: the partition is not discarded " +
+			"before writing with SkipUnchanged set, only after the image")
+	}
+}
+
+func checkConfigValues(problems *configProblems, c *menderConfig) {
+	switch c.ClientProtocol {
+	case "", "http", "https":
+	default:
+		problems.errorf("ClientProtocol: must be \"http\" or \"https\", got %q",
+			c.ClientProtocol)
+	}
+
+	// zero selects the built-in default
+	for _, name := range []string{
+		"UpdatePollIntervalSeconds",
+		"InventoryPollIntervalSeconds",
+		"RetryPollIntervalSeconds",
+		"StateScriptTimeoutSeconds",
+		"StateScriptRetryTimeoutSeconds",
+		"StateScriptRetryIntervalSeconds",
+		"ServerProbeIntervalSeconds",
+		"MQTT.TimeoutSeconds",
+		"DownloadConcurrency",
+		"PartitionWrite.BufferSize",
+	} {
+		if v := configField(c, name).Int(); v < 0 {
+			problems.errorf("%s: must not be negative, got %d", name, v)
+		}
+	}
+
+	if c.ServerURL == "" && len(c.Servers) == 0 {
+		problems.errorf("ServerURL: must be set")
+	} else if c.ServerURL != "" {
+		checkServer(problems, "ServerURL", c.ServerURL, c.ClientProtocol)
+	}
+	for i, srv := range c.Servers {
+		field := fmt.Sprintf("Servers[%d].ServerURL", i)
+		if srv.ServerURL == "" {
+			problems.errorf("%s: must be set", field)
+		} else {
+			checkServer(problems, field, srv.ServerURL, c.ClientProtocol)
+		}
+		if srv.ServerCertificate != "" {
+			checkServerCertificate(problems,
+				fmt.Sprintf("Servers[%d].ServerCertificate", i), srv.ServerCertificate)
+		}
+	}
+
+	if c.ServerCertificate != "" {
+		checkServerCertificate(problems, "ServerCertificate", c.ServerCertificate)
+	}
+
+	if c.HttpsClient.SkipVerify {
+		problems.warnf("HttpsClient.SkipVerify: server certificate is not verified")
+	}
+	if (c.HttpsClient.Certificate == "") != (c.HttpsClient.Key == "") {
+		problems.errorf("HttpsClient: Certificate and Key must be set together")
+	}
+	if c.HttpsClient.Certificate != "" {
+		checkReadable(problems, "HttpsClient.Certificate", c.HttpsClient.Certificate)
+	}
+	if c.HttpsClient.Key != "" {
+		checkReadable(problems, "HttpsClient.Key", c.HttpsClient.Key)
+	}
+
+	checkTransport(problems, c)
+	checkDownloadLimits(problems, c)
+	checkPeerSharing(problems, c)
+	checkGateway(problems, c)
+	checkOfflineUpdate(problems, c)
+	checkPartitionWrite(problems, c)
+
+	switch c.StatusReportFailurePolicy {
+	case "", reportPolicyRollback, reportPolicyQueue:
+	default:
+		problems.errorf("StatusReportFailurePolicy: must be %q or %q, got %q",
+			reportPolicyRollback, reportPolicyQueue, c.StatusReportFailurePolicy)
+	}
+
+	if c.ArtifactVerifyKey != "" {
+		checkReadable(problems, "ArtifactVerifyKey", c.ArtifactVerifyKey)
+	}
+
+	if c.RootfsPartA == "" || c.RootfsPartB == "" {
+		problems.errorf("RootfsPartA, RootfsPartB: both partitions must be set")
+	} else if c.RootfsPartA == c.RootfsPartB {
+		problems.errorf("RootfsPartA, RootfsPartB: must be different partitions, "+
+			"both are %s", c.RootfsPartA)
+	}
+	for _, part := range []string{"RootfsPartA", "RootfsPartB"} {
+		dev := configField(c, part).String()
+		if dev == "" {
+			continue
+		}
+		resolved, err := resolvePartition(dev)
+		if err != nil {
+			problems.warnf("%s: %v", part, err)
+		} else if _, err := os.Stat(resolved); err != nil {
+			problems.warnf("%s: %v", part, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func problemsContain(problems configProblems, warning bool, substr string) bool {
+	for _, p := range problems {
+		if p.warning == warning && strings.Contains(p.msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	unknown := configUnknownKeysIn([]byte(`{
+  "UpdatePollIntervalSecond": 10,
+  "serverurl": "https://foo",
+  "HttpsClient": {"Certificate": "/foo", "Cert": "/bar"},
+  "Foo": 1
+}`))
+	assert.Equal(t, []string{"Foo", "HttpsClient.Cert", "UpdatePollIntervalSecond"}, unknown)
+
+	assert.Equal(t, "UpdatePollIntervalSeconds", configSuggestKey("UpdatePollIntervalSecond"))
+	assert.Equal(t, "ServerURL", configSuggestKey("ServerUrl"))
+	assert.Equal(t, "", configSuggestKey("Foo"))
+}
+
+func TestCheckConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	cert := path.Join(tdir, "server.crt")
+	assert.NoError(t, ioutil.WriteFile(cert, []byte("cert"), 0644))
+	partA := path.Join(tdir, "part-a")
+	partB := path.Join(tdir, "part-b")
+	assert.NoError(t, ioutil.WriteFile(partA, []byte{}, 0644))
+	assert.NoError(t, ioutil.WriteFile(partB, []byte{}, 0644))
+
+	confPath := path.Join(tdir, "mender.conf")
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"ServerURL": "https://foo", "UpdatePollIntervalSecond": 10}`), 0644))
+
+	good := menderConfig{
+		ClientProtocol:    "https",
+		ServerURL:         "https://foo",
+		ServerCertificate: cert,
+		RootfsPartA:       partA,
+		RootfsPartB:       partB,
+	}
+
+	problems := CheckConfig(&good, nil, false)
+	assert.Empty(t, problems)
+
+	// unknown keys are errors unless requested otherwise
+	problems = CheckConfig(&good, []string{confPath}, false)
+	assert.Equal(t, 1, problems.Errors())
+	assert.True(t, problemsContain(problems, false,
+		`unknown key "UpdatePollIntervalSecond", did you mean "UpdatePollIntervalSeconds"?`))
+	problems = CheckConfig(&good, []string{confPath}, true)
+	assert.Equal(t, 0, problems.Errors())
+	assert.Len(t, problems, 1)
+
+	// broken and missing files
+	broken := path.Join(tdir, "broken.conf")
+	assert.NoError(t, ioutil.WriteFile(broken,
+		[]byte(`{"UpdatePollIntervalSeconds": "10"}`), 0644))
+	problems = CheckConfig(&good, []string{broken, path.Join(tdir, "missing")}, false)
+	assert.Equal(t, 2, problems.Errors())
+
+	bad := good
+	bad.ClientProtocol = "ftp"
+	bad.ServerURL = ""
+	bad.ServerCertificate = path.Join(tdir, "missing.crt")
+	bad.RootfsPartB = partA
+	bad.RetryPollIntervalSeconds = -1
+	bad.HttpsClient.Certificate = cert
+	bad.HttpsClient.SkipVerify = true
+	bad.ArtifactVerifyKey = path.Join(tdir, "missing.key")
+
+	problems = CheckConfig(&bad, nil, false)
+	for _, substr := range []string{
+		"ClientProtocol",
+		"ServerURL: must be set",
+		"ServerCertificate: can not read",
+		"RootfsPartA, RootfsPartB: must be different",
+		"RetryPollIntervalSeconds: must not be negative",
+		"HttpsClient: Certificate and Key must be set together",
+		"ArtifactVerifyKey: can not read",
+	} {
+		assert.True(t, problemsContain(problems, false, substr), substr)
+	}
+	assert.True(t, problemsContain(problems, true, "HttpsClient.SkipVerify"))
+	assert.Equal(t, 7, problems.Errors())
+
+	bad = good
+	bad.ServerURL = "http://foo"
+	bad.RootfsPartB = path.Join(tdir, "part-c")
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false, "plain http server"))
+	assert.True(t, problemsContain(problems, true, "RootfsPartB"))
+	assert.Equal(t, 1, problems.Errors())
+
+	bad.ServerURL = "ftp://foo"
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false, "unsupported scheme"))
+
+	bad = good
+	bad.Transport = "carrier-pigeon"
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false, "Transport: must be"))
+
+	bad.Transport = transportMQTT
+	bad.MQTT.QoS = 2
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false, "MQTT.Broker: must be set"))
+	assert.True(t, problemsContain(problems, false, "MQTT.QoS"))
+	assert.Equal(t, 2, problems.Errors())
+	// the server is still needed for authorizing the device
+	assert.True(t, problemsContain(problems, true, "Transport: authorization"))
+
+	bad.MQTT.QoS = 1
+	bad.MQTT.Broker = "tcp://broker:1883"
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, true, "MQTT.Broker: connection to the broker is not encrypted"))
+	assert.Equal(t, 0, problems.Errors())
+
+	bad = good
+	bad.StatusReportFailurePolicy = "ignore"
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false, "StatusReportFailurePolicy"))
+	bad.StatusReportFailurePolicy = reportPolicyQueue
+	assert.Empty(t, CheckConfig(&bad, nil, false))
+
+	bad = good
+	bad.DownloadRateLimit = -1
+	bad.DownloadRateSchedule = []client.RateWindow{
+		{Start: "08:00", End: "18:00", BytesPerSecond: 1000},
+		{Start: "8am", End: "24:00"},
+	}
+	bad.MeteredConnection.Interfaces = []string{"wwan["}
+	problems = CheckConfig(&bad, nil, false)
+	for _, substr := range []string{
+		"DownloadRateLimit: must not be negative",
+		`DownloadRateSchedule[1]: invalid time of day "8am"`,
+		`DownloadRateSchedule[1]: invalid time of day "24:00"`,
+		"MeteredConnection.Interfaces",
+	} {
+		assert.True(t, problemsContain(problems, false, substr), substr)
+	}
+	assert.Equal(t, 4, problems.Errors())
+
+	bad = good
+	bad.PeerSharing.Enabled = true
+	bad.PeerSharing.ListenAddress = ":8443"
+	bad.PeerSharing.Certificate = cert
+	bad.PeerSharing.Peers = []string{"https://10.0.0.2:8443", "http://10.0.0.3:8443"}
+	problems = CheckConfig(&bad, nil, false)
+	for _, substr := range []string{
+		"PeerSharing: Certificate and Key must be set",
+		"PeerSharing.Peers[1]: peers must be reached over https",
+		"PeerSharing.Peers: ArtifactVerifyKey must be set",
+	} {
+		assert.True(t, problemsContain(problems, false, substr), substr)
+	}
+	assert.Equal(t, 3, problems.Errors())
+
+	bad = good
+	bad.Gateway.ListenAddress = ":443"
+	bad.Gateway.Key = "/no/such/key"
+	bad.Gateway.MaxCachedArtifacts = -1
+	problems = CheckConfig(&bad, nil, false)
+	for _, substr := range []string{
+		"Gateway: Certificate and Key must be set together",
+		"Gateway.Key",
+		"Gateway.MaxCachedArtifacts: must not be negative",
+	} {
+		assert.True(t, problemsContain(problems, false, substr), substr)
+	}
+	assert.True(t, problemsContain(problems, true, "served over plain HTTP"))
+	assert.Equal(t, 3, problems.Errors())
+
+	bad = good
+	bad.ArtifactVerifyKey = ""
+	bad.OfflineUpdate.MediaPaths = []string{"/media/*", "/run/media/["}
+	bad.OfflineUpdate.PollIntervalSeconds = -5
+	problems = CheckConfig(&bad, nil, false)
+	for _, substr := range []string{
+		`OfflineUpdate.MediaPaths[1]: invalid pattern "/run/media/["`,
+		"OfflineUpdate.MediaPaths: ArtifactVerifyKey must be set",
+		"OfflineUpdate.PollIntervalSeconds: must not be negative",
+	} {
+		assert.True(t, problemsContain(problems, false, substr), substr)
+	}
+	assert.Equal(t, 3, problems.Errors())
+
+	bad = good
+	bad.PartitionWrite.BufferSize = -1
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false,
+		"PartitionWrite.BufferSize: must not be negative"))
+	assert.Equal(t, 1, problems.Errors())
+
+	bad = good
+	bad.PartitionWrite.Discard = "trim"
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, false,
+		`PartitionWrite.Discard: must be "discard", "secure" or empty, got "trim"`))
+	assert.Equal(t, 1, problems.Errors())
+
+	bad = good
+	bad.PartitionWrite.Discard = discardSecure
+	bad.PartitionWrite.SkipUnchanged = true
+	problems = CheckConfig(&bad, nil, false)
+	assert.True(t, problemsContain(problems, true, "not discarded before writing"))
+	assert.Equal(t, 0, problems.Errors())
+}
@@ -14,8 +14,12 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,9 +103,148 @@ func Test_loadConfig_correctConfFile_returnsConfiguration(t *testing.T) {
 
 	configFile.WriteString(testConfig)
 
-	config, err := LoadConfig("mender.config")
+	config, _, err := LoadConfig("mender.config", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, config)
 
 	validateConfiguration(t, config)
 }
+
+func TestLoadConfigLayers(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	confPath := path.Join(tdir, "mender.conf")
+	overlayPath := path.Join(tdir, "overlay.conf")
+	dropInDir := confPath + configDropInSuffix
+	assert.NoError(t, os.Mkdir(dropInDir, 0755))
+
+	oldEnviron := configEnviron
+	defer func() { configEnviron = oldEnviron }()
+	configEnviron = func() []string { return []string{} }
+
+	// main file is mandatory
+	_, _, err = LoadConfig(confPath, overlayPath)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(testConfig), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "10-poll.conf"),
+		[]byte(`{"UpdatePollIntervalSeconds": 20, "ServerURL": "https://first"}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "20-server.conf"),
+		[]byte(`{"serverurl": "https://second", "HttpsClient": {"SkipVerify": true}}`), 0644))
+	// broken and not matching drop-ins are ignored
+	assert.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "30-broken.conf"),
+		[]byte(`{"ServerURL": `), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "40-other.txt"),
+		[]byte(`{"ServerURL": "https://other"}`), 0644))
+
+	// no overlay file yet
+	config, sources, err := LoadConfig(confPath, overlayPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, "https://second", config.ServerURL)
+	assert.True(t, config.HttpsClient.SkipVerify)
+	// sibling fields of nested structure are kept
+	assert.Equal(t, "/data/client.crt", config.HttpsClient.Certificate)
+	assert.Equal(t, "file "+confPath, sources["HttpsClient.Certificate"])
+	assert.Equal(t, "drop-in "+path.Join(dropInDir, "10-poll.conf"),
+		sources["UpdatePollIntervalSeconds"])
+	assert.Equal(t, "drop-in "+path.Join(dropInDir, "20-server.conf"),
+		sources["ServerURL"])
+	assert.Equal(t, "drop-in "+path.Join(dropInDir, "20-server.conf"),
+		sources["HttpsClient.SkipVerify"])
+
+	assert.NoError(t, ioutil.WriteFile(overlayPath,
+		[]byte(`{"UpdatePollIntervalSeconds": 30, "TenantToken": "tenant"}`), 0644))
+	configEnviron = func() []string {
+		return []string{
+			"PATH=/bin",
+			"MENDER_TENANTTOKEN=env-tenant",
+			"MENDER_HTTPSCLIENT_SKIPVERIFY=false",
+			"MENDER_RETRYPOLLINTERVALSECONDS=bad",
+		}
+	}
+
+	config, sources, err = LoadConfig(confPath, overlayPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, "overlay "+overlayPath, sources["UpdatePollIntervalSeconds"])
+	assert.Equal(t, "env-tenant", config.TenantToken)
+	assert.Equal(t, "environment MENDER_TENANTTOKEN", sources["TenantToken"])
+	assert.False(t, config.HttpsClient.SkipVerify)
+	assert.Equal(t, "environment MENDER_HTTPSCLIENT_SKIPVERIFY",
+		sources["HttpsClient.SkipVerify"])
+	// invalid value is skipped
+	assert.Equal(t, 0, config.RetryPollIntervalSeconds)
+	_, ok := sources["RetryPollIntervalSeconds"]
+	assert.False(t, ok)
+
+	// broken overlay is skipped
+	assert.NoError(t, ioutil.WriteFile(overlayPath, []byte(`{`), 0644))
+	config, _, err = LoadConfig(confPath, overlayPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, config.UpdatePollIntervalSeconds)
+}
+
+func TestShowConfig(t *testing.T) {
+	config := menderConfig{
+		ServerURL: "https://foo",
+		HttpsClient: struct {
+			Certificate string
+			Key         string
+			SkipVerify  bool
+		}{SkipVerify: true},
+		UpdatePollIntervalSeconds: 10,
+		TenantToken:               "secret-token",
+	}
+	sources := configSources{
+		"ServerURL":              "file /etc/mender/mender.conf",
+		"HttpsClient.SkipVerify": "environment MENDER_HTTPSCLIENT_SKIPVERIFY",
+		"TenantToken":            "file /etc/mender/mender.conf",
+	}
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, ShowConfig(out, &config, sources))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, len(configFields()))
+	assert.Contains(t, lines, `ServerURL="https://foo" (file /etc/mender/mender.conf)`)
+	assert.Contains(t, lines,
+		`HttpsClient.SkipVerify=true (environment MENDER_HTTPSCLIENT_SKIPVERIFY)`)
+	assert.Contains(t, lines, `UpdatePollIntervalSeconds=10 (default)`)
+	assert.Contains(t, lines, `HttpsClient.Certificate="" (default)`)
+
+	// credentials are not revealed
+	assert.NotContains(t, out.String(), "secret-token")
+	assert.Contains(t, lines, `TenantToken=<set> (file /etc/mender/mender.conf)`)
+	assert.Contains(t, lines, `MQTT.Password="" (default)`)
+}
+
+func TestGetServers(t *testing.T) {
+	config := menderConfig{}
+	assert.Equal(t, []serverConfig{{}}, config.GetServers())
+
+	config = menderConfig{
+		ServerURL:         "https://foo",
+		ServerCertificate: "/foo.crt",
+	}
+	assert.Equal(t, []serverConfig{
+		{ServerURL: "https://foo", ServerCertificate: "/foo.crt"},
+	}, config.GetServers())
+
+	config.Servers = []serverConfig{
+		{ServerURL: "https://foo"},
+		{ServerURL: "https://bar", ServerCertificate: "/bar.crt"},
+		{ServerURL: "https://baz"},
+	}
+	assert.Equal(t, []serverConfig{
+		{ServerURL: "https://foo", ServerCertificate: "/foo.crt"},
+		{ServerURL: "https://bar", ServerCertificate: "/bar.crt"},
+		{ServerURL: "https://baz", ServerCertificate: "/foo.crt"},
+	}, config.GetServers())
+
+	config.ServerURL = ""
+	assert.Equal(t, "https://foo", config.GetServers()[0].ServerURL)
+	assert.Len(t, config.GetServers(), 3)
+}
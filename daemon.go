@@ -14,18 +14,49 @@
 package main
 
 import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
 )
 
 // Config section
 
+// signals the daemon acts upon, see HandleSignals()
+var daemonSignals = []os.Signal{
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGHUP,
+	syscall.SIGTERM,
+}
+
 type menderDaemon struct {
 	mender Controller
 	stop   bool
 	sctx   StateContext
 	store  store.Store
+	// guards stop, current and config, used by signal handlers
+	lock sync.Mutex
+	// state being handled
+	current State
+	// configuration waiting to be reloaded
+	config *menderConfig
+	// when the state machine last moved on to another state, or reported
+	// progress within one
+	progress time.Time
+	// service manager to keep informed, nil if there is none
+	sd *sdNotifier
+	// serializes use of the controller by the state machine and the outbox
+	// sender; see transition()
+	ctrl   sync.Mutex
+	outbox *outboxSender
 }
 
 func NewDaemon(mender Controller, store store.Store) *menderDaemon {
@@ -36,11 +67,16 @@ func NewDaemon(mender Controller, store store.Store) *menderDaemon {
 			store: store,
 		},
 		store: store,
+		sd:    newSdNotifier(),
 	}
+	daemon.sctx.ctrl = &daemon.ctrl
+	daemon.outbox = newOutboxSender(store, mender, &daemon.ctrl)
 	return &daemon
 }
 
 func (d *menderDaemon) StopDaemon() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.stop = true
 }
 
@@ -54,15 +90,239 @@ func (d *menderDaemon) Cleanup() {
 }
 
 func (d *menderDaemon) shouldStop() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	return d.stop
 }
 
+func (d *menderDaemon) setCurrentState(s State) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.current = s
+	d.progress = time.Now()
+}
+
+// madeProgress records progress of the state being handled
+func (d *menderDaemon) madeProgress() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.progress = time.Now()
+}
+
+func (d *menderDaemon) currentState() State {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.current
+}
+
+func (d *menderDaemon) sdNotify(vars ...string) {
+	if d.sd == nil {
+		return
+	}
+	if err := d.sd.notify(vars...); err != nil {
+		log.Warnf("failed to notify service manager: %v", err)
+	}
+}
+
+// progressTracker is implemented by controllers and devices able to report
+// progress while handling a state takes long, such as downloading and writing
+// an update
+type progressTracker interface {
+	// trackProgress makes progress be reported by calling `f`
+	trackProgress(f func())
+}
+
+// contactTracker is implemented by controllers able to tell when the server
+// was reached
+type contactTracker interface {
+	// trackContact makes `f` be called whenever talking to the server
+	// succeeded
+	trackContact(f func())
+}
+
+// progressReader reports progress whenever data is read
+type progressReader struct {
+	io.ReadCloser
+	progress func()
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if n > 0 {
+		p.progress()
+	}
+	return n, err
+}
+
+// alive tells if the state machine is still making progress; waiting for the
+// next update check or inventory update may legitimately take longer than the
+// watchdog interval, handling any other state may not, unless it keeps
+// reporting progress; see progressTracker
+func (d *menderDaemon) alive() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, waiting := d.current.(WaitState); waiting {
+		return true
+	}
+	return time.Since(d.progress) < d.sd.watchdog
+}
+
+// startWatchdog pings the service manager watchdog for as long as the state
+// machine is alive, until the returned function is called
+func (d *menderDaemon) startWatchdog() func() {
+	if d.sd == nil || d.sd.watchdog == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// ping twice per interval, as sd_watchdog_enabled(3) recommends
+		ticker := time.NewTicker(d.sd.watchdog / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if d.alive() {
+					d.sdNotify(sdNotifyWatchdog)
+				} else {
+					log.Warnf("state machine stuck, not pinging service watchdog")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// HandleSignals makes the daemon act upon signals until the returned function
+// is called. SIGUSR1 checks for an update and SIGUSR2 sends the inventory right
+// away, SIGHUP reloads configuration using `loadConfig` and SIGTERM stops the
+// daemon, cancelling a download in progress.
+func (d *menderDaemon) HandleSignals(loadConfig func() (*menderConfig, error)) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, daemonSignals...)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				d.handleSignal(sig, loadConfig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+func (d *menderDaemon) handleSignal(sig os.Signal, loadConfig func() (*menderConfig, error)) {
+	log.Infof("received signal: %v", sig)
+
+	switch sig {
+	case syscall.SIGUSR1:
+		d.mender.Notify(client.Notification{Type: client.NotifyCheckUpdate})
+
+	case syscall.SIGUSR2:
+		d.mender.Notify(client.Notification{Type: client.NotifySendInventory})
+
+	case syscall.SIGHUP:
+		config, err := loadConfig()
+		if err != nil {
+			log.Errorf("failed to read configuration, keeping the current one: %v", err)
+			return
+		}
+		d.lock.Lock()
+		d.config = config
+		d.lock.Unlock()
+		// applied between state transitions; make a waiting daemon apply it
+		d.mender.Notify(client.Notification{Type: notifyReloadConfig})
+
+	case syscall.SIGTERM:
+		d.StopDaemon()
+		if s := d.currentState(); s != nil {
+			s.Cancel()
+		}
+	}
+}
+
+// reloadConfig applies configuration read by the SIGHUP handler, if any
+func (d *menderDaemon) reloadConfig() {
+	d.lock.Lock()
+	config := d.config
+	d.config = nil
+	d.lock.Unlock()
+
+	if config == nil {
+		return
+	}
+	d.ctrl.Lock()
+	defer d.ctrl.Unlock()
+	if err := d.mender.ReloadConfig(*config); err != nil {
+		log.Errorf("failed to reload configuration: %v", err)
+		return
+	}
+	log.Info("configuration reloaded")
+}
+
+// saveState keeps an update being downloaded when the daemon is stopped, so
+// that the download picks up again from the last checkpoint once the daemon is
+// started again
+func (d *menderDaemon) saveState(s State) error {
+	us, ok := s.(UpdateState)
+	if !ok || s.Transition() != ToDownload {
+		return nil
+	}
+	return StoreStateData(d.sctx.store, StateData{
+		Name:       MenderStateUpdateFetch,
+		UpdateInfo: us.Update(),
+		Checkpoint: loadInstallCheckpoint(d.sctx.store, us.Update()),
+	})
+}
+
+// transition handles state `s`; the controller is left to the outbox sender
+// while waiting, which may take long, but for the calls wait states make with
+// the lock held; see StateContext.withController()
+func (d *menderDaemon) transition(s State) (State, bool) {
+	if _, waiting := s.(WaitState); !waiting {
+		d.ctrl.Lock()
+		defer d.ctrl.Unlock()
+	}
+	return d.mender.TransitionState(s, &d.sctx)
+}
+
 func (d *menderDaemon) Run() error {
 	// set the first state transition
 	var toState State = d.mender.GetCurrentState()
 	cancelled := false
+
+	d.setCurrentState(nil)
+	d.sdNotify(sdNotifyReady, sdNotifyStatus+toState.Id().String())
+	defer d.sdNotify(sdNotifyStopping)
+	if t, ok := d.mender.(progressTracker); ok {
+		t.trackProgress(d.madeProgress)
+	}
+	stopWatchdog := d.startWatchdog()
+	defer stopWatchdog()
+	if t, ok := d.mender.(contactTracker); ok {
+		t.trackContact(d.outbox.wake)
+	}
+	stopOutbox := d.outbox.start()
+	defer stopOutbox()
+
 	for {
-		toState, cancelled = d.mender.TransitionState(toState, &d.sctx)
+		d.setCurrentState(toState)
+		d.sdNotify(sdNotifyStatus + toState.Id().String())
+		toState, cancelled = d.transition(toState)
+		d.setCurrentState(nil)
 
 		if toState.Id() == MenderStateError {
 			es, ok := toState.(*ErrorState)
@@ -78,7 +338,15 @@ func (d *menderDaemon) Run() error {
 			break
 		}
 		if d.shouldStop() {
-			return nil
+			break
+		}
+		d.reloadConfig()
+	}
+
+	if d.shouldStop() {
+		if err := d.saveState(toState); err != nil {
+			log.Errorf("failed to store state data: %v", err)
+			return err
 		}
 	}
 	return nil
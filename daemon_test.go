@@ -19,6 +19,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -178,3 +180,108 @@ func TestDaemonRun(t *testing.T) {
 	t.Logf("poke count: %v", dtc.updateCheckCount)
 	assert.False(t, dtc.updateCheckCount < (timespolled-1))
 }
+
+func TestDaemonSignals(t *testing.T) {
+	tc := &stateTestController{
+		localNotes: make(chan client.Notification, 1),
+	}
+	d := NewDaemon(tc, store.NewMemStore())
+
+	config := &menderConfig{UpdatePollIntervalSeconds: 10}
+	var configErr error
+	stop := d.HandleSignals(func() (*menderConfig, error) {
+		return config, configErr
+	})
+	defer stop()
+
+	expectNote := func(sig syscall.Signal, expected string) {
+		assert.NoError(t, syscall.Kill(os.Getpid(), sig))
+		select {
+		case note := <-tc.localNotes:
+			assert.Equal(t, expected, note.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification for %v", sig)
+		}
+	}
+
+	expectNote(syscall.SIGUSR1, client.NotifyCheckUpdate)
+	expectNote(syscall.SIGUSR2, client.NotifySendInventory)
+
+	// configuration is reloaded between state transitions
+	expectNote(syscall.SIGHUP, notifyReloadConfig)
+	assert.Nil(t, tc.reloadedConfig)
+	d.reloadConfig()
+	assert.Equal(t, config, tc.reloadedConfig)
+	tc.reloadedConfig = nil
+	d.reloadConfig()
+	assert.Nil(t, tc.reloadedConfig)
+
+	// configuration that can not be read is not reloaded
+	configErr = errors.New("invalid configuration")
+	d.handleSignal(syscall.SIGHUP, func() (*menderConfig, error) {
+		return nil, configErr
+	})
+	d.reloadConfig()
+	assert.Nil(t, tc.reloadedConfig)
+}
+
+// blockingReader blocks reading until it is closed
+type blockingReader struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.closed
+	return 0, errors.New("closed")
+}
+
+func (r *blockingReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestDaemonStopSignal(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	update := client.UpdateResponse{ID: "foo"}
+	in := &blockingReader{closed: make(chan struct{})}
+	dtc := &daemonTestController{
+		stateTestController{
+			fakeDevice: fakeDevice{consumeUpdate: true},
+			state:      NewUpdateStoreState(in, 10, update),
+		},
+		0,
+	}
+	d := NewDaemon(dtc, ms)
+
+	done := make(chan error)
+	go func() {
+		done <- d.Run()
+	}()
+
+	// wait for the download to start
+	for d.currentState() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	d.handleSignal(syscall.SIGTERM, nil)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+
+	// download starts over after restart
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateFetch, sd.Name)
+	assert.Equal(t, update, sd.UpdateInfo)
+
+	s, _ := initState.Handle(&StateContext{store: ms}, &stateTestController{})
+	assert.IsType(t, &UpdateFetchState{}, s)
+}
@@ -14,24 +14,36 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"path/filepath"
-	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/pkg/errors"
 )
 
 type deviceConfig struct {
 	rootfsPartA string
 	rootfsPartB string
+	write       partitionWriteConfig
 }
 
 type device struct {
 	BootEnvReadWriter
 	Commander
 	*partitions
+	write partitionWriteConfig
+	// checkpoint to resume installing from and where to record progress;
+	// see resumeInstall()
+	resume     *InstallCheckpoint
+	checkpoint func(written int64, sum []byte) error
+	// what installing the last image wrote
+	stats partitionWriteStats
+	// see trackProgress()
+	progress func()
 }
 
 var (
@@ -47,7 +59,12 @@ func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *de
 		active:            "",
 		inactive:          "",
 	}
-	device := device{env, sc, &partitions}
+	device := device{
+		BootEnvReadWriter: env,
+		Commander:         sc,
+		partitions:        &partitions,
+		write:             config.write,
+	}
 	return &device
 }
 
@@ -73,29 +90,18 @@ func (d *device) SwapPartitions() error {
 
 func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 
+	d.stats = partitionWriteStats{}
 	log.Debugf("Trying to install update of size: %d", size)
 	if image == nil || size < 0 {
 		return errors.New("Have invalid update. Aborting.")
 	}
 
-	inactivePartition, err := d.GetInactive()
+	b, err := d.inactiveBlockDevice(size)
 	if err != nil {
 		return err
 	}
-
-	typeUBI := isUbiBlockDevice(inactivePartition)
-	if typeUBI {
-		// UBI block devices are not prefixed with /dev due to the fact
-		// that the kernel root= argument does not handle UBI block
-		// devices which are prefixed with /dev
-		//
-		// Kernel root= only accepts:
-		// - ubi0_0
-		// - ubi:rootfsa
-		inactivePartition = filepath.Join("/dev", inactivePartition)
-	}
-
-	b := &BlockDevice{Path: inactivePartition, typeUBI: typeUBI, ImageSize: size}
+	inactivePartition := b.Path
+	typeUBI := b.typeUBI
 
 	if bsz, err := b.Size(); err != nil {
 		log.Errorf("failed to read size of block device %s: %v",
@@ -114,18 +120,61 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 		return err
 	}
 
-	// allocate buffer based on sector size and provide it for staging
-	// in io.CopyBuffer
-	buf := make([]byte, ssz)
+	// whole sectors are written from each buffer, as O_DIRECT requires
+	bufSize := d.write.BufferSize
+	if bufSize <= 0 {
+		bufSize = defaultWriteBufferSize
+	}
+	bufSize -= bufSize % ssz
+	if bufSize < ssz {
+		bufSize = ssz
+	}
+	b.Direct = d.write.DirectIO
+	b.SkipUnchanged = d.write.SkipUnchanged
+
+	var dst io.Writer = b
+	if d.checkpoint != nil && typeUBI {
+		// a volume update has to be written in one go
+		log.Debugf("writing to UBI volume %s can not be resumed", inactivePartition)
+		if d.resume != nil && d.resume.Written > 0 {
+			return errors.Wrapf(installer.ErrNotResumable,
+				"can not resume writing to UBI volume %s", inactivePartition)
+		}
+	} else if d.checkpoint != nil {
+		cw, err := newCheckpointWriter(b, d.resume, d.checkpoint)
+		if err != nil {
+			return err
+		}
+		dst = cw
+	}
 
-	w, err := io.CopyBuffer(b, image, buf)
+	if d.write.Discard != "" && !typeUBI {
+		if d.write.SkipUnchanged {
+			log.Debugf("not discarding device %v before writing, to keep the "+
+				"blocks that do not change", inactivePartition)
+		} else {
+			// when resuming, what was written before is kept
+			d.discard(b, b.Offset)
+		}
+	}
+
+	start := time.Now()
+	w, writing, err := copyImage(dst, image, bufSize)
 	if err != nil {
 		log.Errorf("failed to write image data to device %v: %v",
 			inactivePartition, err)
 	}
 
 	log.Infof("wrote %v/%v bytes of update to device %v",
-		w, size, inactivePartition)
+		b.Offset+w, size, inactivePartition)
+	log.Infof("update written to device %v at %s; writes to the device took %v (%s)",
+		inactivePartition, throughput(w, time.Since(start)), writing,
+		throughput(w, writing))
+	d.stats = partitionWriteStats{Written: w - b.Skipped, Skipped: b.Skipped}
+	if b.SkipUnchanged && !typeUBI && w > 0 {
+		log.Infof("%v of %v bytes were on device %v already and not written (%.1f%%)",
+			b.Skipped, w, inactivePartition, float64(b.Skipped)*100/float64(w))
+	}
 
 	if cerr := b.Close(); cerr != nil {
 		log.Errorf("closing device %v failed: %v", inactivePartition, cerr)
@@ -134,9 +183,102 @@ func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
 		}
 	}
 
+	if err == nil && d.write.Discard != "" && !typeUBI {
+		// the rest of the partition is not part of the image
+		d.discard(b, size)
+	}
+
 	return err
 }
 
+// discard discards the data from offset `from` of the device, if supported; a
+// failure does not affect installing the update.
+func (d *device) discard(b *BlockDevice, from int64) {
+	secure := d.write.Discard == discardSecure
+	err := b.Discard(from, secure)
+	if err == errDiscardNotSupported {
+		log.Infof("device %v does not support discard", b.Path)
+	} else if err != nil {
+		log.Warnf("failed to discard device %v from offset %v: %v", b.Path, from, err)
+	}
+}
+
+// VerifyUpdate reads back the image of `size` bytes written to the inactive
+// partition and compares it with `checksum` from the artifact manifest, if
+// verification of writes is enabled.
+func (d *device) VerifyUpdate(checksum []byte, size int64) error {
+	if !d.write.VerifyWrites {
+		return nil
+	}
+
+	b, err := d.inactiveBlockDevice(size)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("verifying %v bytes written to device %v", size, b.Path)
+	sum, err := b.Checksum()
+	if err != nil {
+		log.Errorf("failed to read back update from device %v: %v", b.Path, err)
+		return err
+	}
+	if !bytes.Equal(sum, checksum) {
+		log.Errorf("update written to device %v is corrupted; checksum %s, expected %s",
+			b.Path, sum, checksum)
+		return errors.Errorf("update written to device %v does not match the artifact",
+			b.Path)
+	}
+	log.Infof("update written to device %v verified", b.Path)
+	return nil
+}
+
+// inactiveBlockDevice returns the block device of the inactive partition, for
+// writing an image of `size` bytes to.
+func (d *device) inactiveBlockDevice(size int64) (*BlockDevice, error) {
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return nil, err
+	}
+
+	typeUBI := isUbiBlockDevice(inactivePartition)
+	if typeUBI {
+		// UBI block devices are not prefixed with /dev due to the fact
+		// that the kernel root= argument does not handle UBI block
+		// devices which are prefixed with /dev
+		//
+		// Kernel root= only accepts:
+		// - ubi0_0
+		// - ubi:rootfsa
+		inactivePartition = filepath.Join("/dev", inactivePartition)
+	}
+
+	return &BlockDevice{Path: inactivePartition, typeUBI: typeUBI,
+		typeFile: d.files, ImageSize: size, Progress: d.progress}, nil
+}
+
+func (d *device) lastWriteStats() partitionWriteStats {
+	return d.stats
+}
+
+func (d *device) trackProgress(f func()) {
+	d.progress = f
+}
+
+func (d *device) resumeInstall(from *InstallCheckpoint,
+	save func(written int64, sum []byte) error) {
+	d.resume = from
+	d.checkpoint = save
+}
+
+// readImage reads the image written to the inactive partition
+func (d *device) readImage(p []byte, off int64) (int, error) {
+	b, err := d.inactiveBlockDevice(0)
+	if err != nil {
+		return 0, err
+	}
+	return b.ReadAt(p, off)
+}
+
 func (d *device) getInactivePartition() (string, error) {
 	inactivePartition, err := d.GetInactive()
 	if err != nil {
@@ -145,12 +287,12 @@ func (d *device) getInactivePartition() (string, error) {
 
 	log.Debugf("Marking inactive partition (%s) as the new boot candidate.", inactivePartition)
 
-	partitionNumber := inactivePartition[len(inactivePartition)-1:]
-	if _, err := strconv.Atoi(partitionNumber); err != nil {
-		return "", errors.New("Invalid inactive partition: " + inactivePartition)
+	num, err := partitionNumber(inactivePartition)
+	if err != nil {
+		return "", errors.New("Invalid inactive partition: " + err.Error())
 	}
 
-	return partitionNumber, nil
+	return num, nil
 }
 
 func (d *device) EnableUpdatedPartition() error {
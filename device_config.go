@@ -0,0 +1,353 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+const (
+	// name of key that device configuration state is stored under
+	deviceConfigKey = "device-config"
+	// authorization attempts with a pending connectivity-critical
+	// configuration that may fail, without the server rejecting the device,
+	// before the configuration is rolled back
+	maxDeviceConfigAuthFailures = 5
+)
+
+// Keys of menderConfig that may be changed remotely. Keys set to true are
+// connectivity-critical: after such a change the device needs to authorize
+// again and the change is rolled back if the authorization fails.
+var deviceConfigApprovedKeys = map[string]bool{
+	"UpdatePollIntervalSeconds":    false,
+	"InventoryPollIntervalSeconds": false,
+	"RetryPollIntervalSeconds":     false,
+	"ServerURL":                    true,
+}
+
+// deviceConfigData is the device configuration state kept in the data store
+type deviceConfigData struct {
+	// last configuration that was applied successfully
+	Applied *client.DeviceConfig `json:",omitempty"`
+	// connectivity-critical configuration waiting for authorization
+	Pending *client.DeviceConfig `json:",omitempty"`
+	// values of the keys changed by Pending, restored on rollback
+	Previous json.RawMessage `json:",omitempty"`
+	// authorization attempts with Pending that failed so far
+	AuthFailures int `json:",omitempty"`
+	// version of the last configuration that was rejected
+	Rejected string `json:",omitempty"`
+	// report that has not been delivered to the server yet
+	Report *client.DeviceConfigReport `json:",omitempty"`
+}
+
+func loadDeviceConfigData(s store.Store) (deviceConfigData, error) {
+	var dc deviceConfigData
+
+	data, err := s.ReadAll(deviceConfigKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dc, nil
+		}
+		return dc, err
+	}
+
+	if err := json.Unmarshal(data, &dc); err != nil {
+		return dc, errors.Wrapf(err, "failed to parse device configuration state")
+	}
+	return dc, nil
+}
+
+func storeDeviceConfigData(s store.Store, dc deviceConfigData) error {
+	data, _ := json.Marshal(dc)
+	return s.WriteAll(deviceConfigKey, data)
+}
+
+// applyDeviceConfig validates the configuration document and returns a copy
+// of `base` with the document applied, together with the list of
+// connectivity-critical keys whose values were changed.
+func applyDeviceConfig(base menderConfig, conf *client.DeviceConfig) (menderConfig, []string, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(conf.Configuration, &keys); err != nil {
+		return base, nil, errors.Wrapf(err, "configuration is not a JSON object")
+	}
+
+	for k := range keys {
+		if _, ok := deviceConfigApprovedKeys[k]; !ok {
+			return base, nil, errors.Errorf("configuration key %s can not be changed remotely", k)
+		}
+	}
+
+	applied := base
+	dec := json.NewDecoder(bytes.NewReader(conf.Configuration))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&applied); err != nil {
+		return base, nil, errors.Wrapf(err, "invalid configuration")
+	}
+
+	intervals := map[string]int{
+		"UpdatePollIntervalSeconds":    applied.UpdatePollIntervalSeconds,
+		"InventoryPollIntervalSeconds": applied.InventoryPollIntervalSeconds,
+		"RetryPollIntervalSeconds":     applied.RetryPollIntervalSeconds,
+	}
+	for k, v := range intervals {
+		if _, ok := keys[k]; ok && v <= 0 {
+			return base, nil, errors.Errorf("%s must be a positive number", k)
+		}
+	}
+	if _, ok := keys["ServerURL"]; ok && applied.ServerURL == "" {
+		return base, nil, errors.New("ServerURL can not be empty")
+	}
+
+	critical := []string{}
+	for k := range keys {
+		if !deviceConfigApprovedKeys[k] {
+			continue
+		}
+		if !bytes.Equal(configValues(base, k), configValues(applied, k)) {
+			critical = append(critical, k)
+		}
+	}
+	return applied, critical, nil
+}
+
+// configValues returns JSON object with values of `keys` from configuration `c`
+func configValues(c menderConfig, keys ...string) json.RawMessage {
+	var all map[string]json.RawMessage
+	data, _ := json.Marshal(c)
+	json.Unmarshal(data, &all)
+
+	picked := make(map[string]json.RawMessage, len(keys))
+	for _, k := range keys {
+		picked[k] = all[k]
+	}
+	data, _ = json.Marshal(picked)
+	return data
+}
+
+// loadDeviceConfig applies the device configuration kept in the data store
+// on top of the configuration read from the configuration file.
+func (m *mender) loadDeviceConfig() error {
+	dc, err := loadDeviceConfigData(m.store)
+	if err != nil {
+		return err
+	}
+
+	for _, conf := range []*client.DeviceConfig{dc.Applied, dc.Pending} {
+		if conf == nil {
+			continue
+		}
+		applied, _, err := applyDeviceConfig(m.config, conf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply device configuration %v", conf.Version)
+		}
+		log.Infof("using device configuration version %v", conf.Version)
+		m.config = applied
+	}
+	return nil
+}
+
+// sendDeviceConfigReport attempts to deliver the report; the report is kept in
+// `dc` if that fails, so that it can be retried later.
+func (m *mender) sendDeviceConfigReport(dc *deviceConfigData, report client.DeviceConfigReport) {
+	dc.Report = &report
+	server, api := m.server()
+	err := m.deviceConfig.Report(api, server, report)
+	if err != nil {
+		log.Warnf("failed to report device configuration status: %v", err)
+		return
+	}
+	dc.Report = nil
+}
+
+// DeviceConfigRefresh fetches device configuration from the server and
+// applies it. Returns true if connectivity-critical settings were changed and
+// the device needs to authorize again.
+func (m *mender) DeviceConfigRefresh() (bool, error) {
+	if m.store == nil {
+		return false, nil
+	}
+
+	dc, err := loadDeviceConfigData(m.store)
+	if err != nil {
+		return false, err
+	}
+
+	if dc.Report != nil {
+		m.sendDeviceConfigReport(&dc, *dc.Report)
+		if dc.Report == nil {
+			if err := storeDeviceConfigData(m.store, dc); err != nil {
+				log.Errorf("failed to store device configuration state: %v", err)
+			}
+		}
+	}
+
+	if dc.Pending != nil {
+		// still waiting for the result of authorization
+		return false, nil
+	}
+
+	server, api := m.server()
+	conf, err := m.deviceConfig.Fetch(api, server)
+	if err != nil {
+		// remove authentication token if device is not authorized
+		if err == client.ErrNotAuthorized {
+			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
+				log.Warn("can not remove rejected authentication token")
+			}
+		}
+		return false, errors.Wrapf(err, "failed to fetch device configuration")
+	}
+
+	if conf == nil ||
+		conf.Version == dc.Rejected ||
+		(dc.Applied != nil && dc.Applied.Version == conf.Version) {
+		return false, nil
+	}
+
+	applied, critical, err := applyDeviceConfig(m.config, conf)
+	if err != nil {
+		log.Errorf("rejecting device configuration %v: %v", conf.Version, err)
+		dc.Rejected = conf.Version
+		m.sendDeviceConfigReport(&dc, client.DeviceConfigReport{
+			Version: conf.Version,
+			Status:  client.DeviceConfigFailed,
+			Error:   err.Error(),
+		})
+		if serr := storeDeviceConfigData(m.store, dc); serr != nil {
+			log.Errorf("failed to store device configuration state: %v", serr)
+		}
+		return false, errors.Wrapf(err, "invalid device configuration %v", conf.Version)
+	}
+
+	if len(critical) == 0 {
+		dc.Applied = conf
+		if err := storeDeviceConfigData(m.store, dc); err != nil {
+			return false, errors.Wrapf(err, "failed to store device configuration")
+		}
+		log.Infof("applied device configuration version %v", conf.Version)
+		m.config = applied
+
+		m.sendDeviceConfigReport(&dc, client.DeviceConfigReport{
+			Version: conf.Version,
+			Status:  client.DeviceConfigApplied,
+		})
+		if dc.Report != nil {
+			if err := storeDeviceConfigData(m.store, dc); err != nil {
+				log.Errorf("failed to store device configuration state: %v", err)
+			}
+		}
+		return false, nil
+	}
+
+	// The token is only valid for the server it was issued by. Remove it
+	// before switching, so that we never use it with the new settings.
+	if err := m.authMgr.RemoveAuthToken(); err != nil {
+		return false, errors.Wrapf(err, "failed to remove authentication token")
+	}
+	m.dropAuthToken()
+
+	dc.Pending = conf
+	dc.Previous = configValues(m.config, critical...)
+	dc.AuthFailures = 0
+	if err := storeDeviceConfigData(m.store, dc); err != nil {
+		return true, errors.Wrapf(err, "failed to store device configuration")
+	}
+	log.Infof("applied device configuration version %v changing %v; "+
+		"waiting for authorization", conf.Version, critical)
+	m.config = applied
+
+	return true, nil
+}
+
+// deviceConfigAuthorized confirms a pending connectivity-critical
+// configuration once the device has authorized with the new settings.
+func (m *mender) deviceConfigAuthorized() {
+	if m.store == nil {
+		return
+	}
+
+	dc, err := loadDeviceConfigData(m.store)
+	if err != nil || dc.Pending == nil {
+		return
+	}
+
+	log.Infof("authorized with device configuration version %v", dc.Pending.Version)
+	dc.Applied = dc.Pending
+	dc.Pending = nil
+	dc.Previous = nil
+	dc.AuthFailures = 0
+	m.sendDeviceConfigReport(&dc, client.DeviceConfigReport{
+		Version: dc.Applied.Version,
+		Status:  client.DeviceConfigApplied,
+	})
+	if err := storeDeviceConfigData(m.store, dc); err != nil {
+		log.Errorf("failed to store device configuration state: %v", err)
+	}
+}
+
+// deviceConfigAuthFailed rolls back a pending connectivity-critical
+// configuration once the server rejects the device with the new settings, or
+// after authorization with them failed too many times.
+func (m *mender) deviceConfigAuthFailed(cause error) {
+	if m.store == nil {
+		return
+	}
+
+	dc, err := loadDeviceConfigData(m.store)
+	if err != nil || dc.Pending == nil {
+		return
+	}
+
+	if cause != client.AuthErrorUnauthorized && cause != client.AuthErrorForbidden {
+		dc.AuthFailures++
+		if dc.AuthFailures < maxDeviceConfigAuthFailures {
+			log.Warnf("authorization failed with device configuration version %v "+
+				"(attempt %d of %d): %v", dc.Pending.Version, dc.AuthFailures,
+				maxDeviceConfigAuthFailures, cause)
+			if err := storeDeviceConfigData(m.store, dc); err != nil {
+				log.Errorf("failed to store device configuration state: %v", err)
+			}
+			return
+		}
+	}
+
+	log.Warnf("authorization failed with device configuration version %v, rolling back",
+		dc.Pending.Version)
+
+	if err := json.Unmarshal(dc.Previous, &m.config); err != nil {
+		log.Errorf("failed to restore previous configuration: %v", err)
+	}
+
+	// the report goes to the old server once we are authorized again
+	dc.Report = &client.DeviceConfigReport{
+		Version: dc.Pending.Version,
+		Status:  client.DeviceConfigFailed,
+		Error:   errors.Wrapf(cause, "authorization failed").Error(),
+	}
+	dc.Rejected = dc.Pending.Version
+	dc.Pending = nil
+	dc.Previous = nil
+	dc.AuthFailures = 0
+	if err := storeDeviceConfigData(m.store, dc); err != nil {
+		log.Errorf("failed to store device configuration state: %v", err)
+	}
+}
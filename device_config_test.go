@@ -0,0 +1,249 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyDeviceConfig(t *testing.T) {
+	base := menderConfig{
+		ServerURL:                 "https://foo",
+		UpdatePollIntervalSeconds: 10,
+	}
+
+	td := []struct {
+		conf     string
+		bad      bool
+		critical []string
+	}{
+		{`{"UpdatePollIntervalSeconds": 20}`, false, []string{}},
+		{`{"ServerURL": "https://foo"}`, false, []string{}},
+		{`{"ServerURL": "https://bar"}`, false, []string{"ServerURL"}},
+		{`{"UpdatePollIntervalSeconds": 0}`, true, nil},
+		{`{"UpdatePollIntervalSeconds": "10"}`, true, nil},
+		{`{"ServerURL": ""}`, true, nil},
+		{`{"ArtifactVerifyKey": "/tmp/key"}`, true, nil},
+		{`{"UpdatePollIntervalSecond": 10}`, true, nil},
+		{`[]`, true, nil},
+	}
+
+	for _, tc := range td {
+		conf, critical, err := applyDeviceConfig(base, &client.DeviceConfig{
+			Version:       "1",
+			Configuration: json.RawMessage(tc.conf),
+		})
+		if tc.bad {
+			assert.Error(t, err, tc.conf)
+			assert.Equal(t, base, conf)
+		} else {
+			assert.NoError(t, err, tc.conf)
+			assert.Equal(t, tc.critical, critical)
+		}
+	}
+}
+
+func TestMenderDeviceConfigRefresh(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL:                 srv.URL,
+			UpdatePollIntervalSeconds: 60,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+
+	// no configuration for the device
+	reauth, err := mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.False(t, reauth)
+	assert.True(t, srv.DeviceConfig.Called)
+
+	// configuration applied live and reported
+	srv.DeviceConfig.Data = &client.DeviceConfig{
+		Version:       "1",
+		Configuration: json.RawMessage(`{"UpdatePollIntervalSeconds": 10}`),
+	}
+	reauth, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.False(t, reauth)
+	assert.Equal(t, 10, mender.config.UpdatePollIntervalSeconds)
+	assert.Equal(t, client.DeviceConfigReport{
+		Version: "1",
+		Status:  client.DeviceConfigApplied,
+	}, srv.DeviceConfig.Report)
+
+	// same version is not applied nor reported again
+	srv.DeviceConfig.Reported = false
+	_, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.False(t, srv.DeviceConfig.Reported)
+
+	// configuration is persisted
+	other := newTestMender(nil,
+		menderConfig{
+			ServerURL:                 srv.URL,
+			UpdatePollIntervalSeconds: 60,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	assert.Equal(t, 10, other.config.UpdatePollIntervalSeconds)
+
+	// key that may not be changed remotely
+	srv.DeviceConfig.Data = &client.DeviceConfig{
+		Version:       "2",
+		Configuration: json.RawMessage(`{"ArtifactVerifyKey": "/tmp/key"}`),
+	}
+	_, err = mender.DeviceConfigRefresh()
+	assert.Error(t, err)
+	assert.Equal(t, "", mender.config.ArtifactVerifyKey)
+	assert.Equal(t, "2", srv.DeviceConfig.Report.Version)
+	assert.Equal(t, client.DeviceConfigFailed, srv.DeviceConfig.Report.Status)
+	assert.NotEmpty(t, srv.DeviceConfig.Report.Error)
+
+	// rejected version is not retried
+	srv.DeviceConfig.Reported = false
+	_, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.False(t, srv.DeviceConfig.Reported)
+
+	// undelivered report is sent with the next refresh
+	dc, err := loadDeviceConfigData(ms)
+	assert.NoError(t, err)
+	dc.Report = &client.DeviceConfigReport{
+		Version: "2",
+		Status:  client.DeviceConfigFailed,
+	}
+	assert.NoError(t, storeDeviceConfigData(ms, dc))
+	_, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.True(t, srv.DeviceConfig.Reported)
+	dc, err = loadDeviceConfigData(ms)
+	assert.NoError(t, err)
+	assert.Nil(t, dc.Report)
+}
+
+func TestMenderDeviceConfigConnectivity(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	newSrv := cltest.NewClientTestServer()
+	defer newSrv.Close()
+
+	ms := store.NewMemStore()
+	authMgr := &testAuthManager{
+		authtoken: client.AuthToken("token"),
+	}
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:   ms,
+				authMgr: authMgr,
+			},
+		},
+	)
+
+	srv.DeviceConfig.Data = &client.DeviceConfig{
+		Version:       "1",
+		Configuration: json.RawMessage(`{"ServerURL": "` + newSrv.URL + `"}`),
+	}
+	reauth, err := mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.True(t, reauth)
+	assert.Equal(t, newSrv.URL, mender.config.ServerURL)
+	assert.Equal(t, noAuthToken, mender.authToken)
+	// not reported until authorized with new settings
+	assert.False(t, srv.DeviceConfig.Reported)
+
+	// authorization with the new server fails; roll back
+	newSrv.Auth.Authorize = false
+	merr := mender.Authorize()
+	assert.Error(t, merr)
+	assert.True(t, newSrv.Auth.Called)
+	assert.Equal(t, srv.URL, mender.config.ServerURL)
+
+	// authorize with the old server and deliver the report there
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte("token")
+	merr = mender.Authorize()
+	assert.NoError(t, merr)
+
+	reauth, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.False(t, reauth)
+	assert.Equal(t, "1", srv.DeviceConfig.Report.Version)
+	assert.Equal(t, client.DeviceConfigFailed, srv.DeviceConfig.Report.Status)
+	assert.Equal(t, srv.URL, mender.config.ServerURL)
+
+	// new version; authorization succeeds this time
+	srv.DeviceConfig.Data.Version = "2"
+	reauth, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.True(t, reauth)
+
+	newSrv.Auth.Authorize = true
+	newSrv.Auth.Token = []byte("token")
+	merr = mender.Authorize()
+	assert.NoError(t, merr)
+	assert.Equal(t, newSrv.URL, mender.config.ServerURL)
+	assert.Equal(t, client.DeviceConfigReport{
+		Version: "2",
+		Status:  client.DeviceConfigApplied,
+	}, newSrv.DeviceConfig.Report)
+
+	dc, err := loadDeviceConfigData(ms)
+	assert.NoError(t, err)
+	assert.Nil(t, dc.Pending)
+	assert.Equal(t, "2", dc.Applied.Version)
+
+	// server not reachable; rolled back only after a few attempts
+	downSrv := cltest.NewClientTestServer()
+	downSrv.Close()
+	newSrv.DeviceConfig.Data = &client.DeviceConfig{
+		Version:       "3",
+		Configuration: json.RawMessage(`{"ServerURL": "` + downSrv.URL + `"}`),
+	}
+	reauth, err = mender.DeviceConfigRefresh()
+	assert.NoError(t, err)
+	assert.True(t, reauth)
+	for i := 1; i < maxDeviceConfigAuthFailures; i++ {
+		assert.Error(t, mender.Authorize())
+		assert.Equal(t, downSrv.URL, mender.config.ServerURL)
+	}
+	assert.Error(t, mender.Authorize())
+	assert.Equal(t, newSrv.URL, mender.config.ServerURL)
+	dc, err = loadDeviceConfigData(ms)
+	assert.NoError(t, err)
+	assert.Nil(t, dc.Pending)
+	assert.Equal(t, "3", dc.Rejected)
+}
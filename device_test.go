@@ -14,8 +14,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -208,3 +213,115 @@ func TestDeviceHasUpdate(t *testing.T) {
 	assert.True(t, has)
 	assert.NoError(t, err)
 }
+
+func TestDeviceVerifyUpdate(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "verify")
+	defer os.RemoveAll(tdir)
+
+	part := filepath.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 8192), 0600))
+
+	img := bytes.Repeat([]byte("update"), 1000)
+	sum := sha256.Sum256(img)
+	checksum := []byte(hex.EncodeToString(sum[:]))
+
+	d := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{VerifyWrites: true},
+	})
+	d.files = true
+	d.inactive = part
+	progress := 0
+	d.trackProgress(func() { progress++ })
+
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	assert.True(t, progress > 0)
+	written := progress
+	assert.NoError(t, d.VerifyUpdate(checksum, int64(len(img))))
+	// reading back reports progress as well
+	assert.True(t, progress > written)
+
+	// corrupted on the way to the storage
+	data, _ := ioutil.ReadFile(part)
+	data[100] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(part, data, 0600))
+	err := d.VerifyUpdate(checksum, int64(len(img)))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the artifact")
+
+	// nothing is read if not enabled
+	d.write.VerifyWrites = false
+	assert.NoError(t, d.VerifyUpdate(checksum, int64(len(img))))
+}
+
+func TestDeviceInstallSkipUnchanged(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "unchanged")
+	defer os.RemoveAll(tdir)
+
+	part := filepath.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 65536), 0600))
+
+	d := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{SkipUnchanged: true},
+	})
+	d.files = true
+	d.inactive = part
+
+	img := bytes.Repeat([]byte("update"), 5000)
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	assert.Equal(t, int64(len(img)), d.lastWriteStats().Written+d.lastWriteStats().Skipped)
+
+	// one block changed
+	img[10000]++
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	assert.Equal(t, partitionWriteStats{
+		Written: unchangedBlockSize,
+		Skipped: int64(len(img) - unchangedBlockSize),
+	}, d.lastWriteStats())
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:len(img)])
+}
+
+func TestDeviceInstallDiscard(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "discard")
+	defer os.RemoveAll(tdir)
+
+	part := filepath.Join(tdir, "part3")
+	img := bytes.Repeat([]byte("update"), 1000)
+	old := bytes.Repeat([]byte{0xff}, 16384)
+
+	d := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{Discard: discardRegular},
+	})
+	d.files = true
+	d.inactive = part
+
+	// punching holes is how discard is done for files
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+	bd := BlockDevice{Path: part, typeFile: true}
+	if bd.Discard(0, false) == errDiscardNotSupported {
+		t.Skipf("punching holes not supported in %s", tdir)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:len(img)])
+	assert.Equal(t, make([]byte, 16384-len(img)), data[len(img):])
+
+	// blocks on the partition are kept for skipping
+	d.write.SkipUnchanged = true
+	copy(old, img)
+	assert.NoError(t, ioutil.WriteFile(part, old, 0600))
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	assert.Equal(t, int64(len(img)), d.lastWriteStats().Skipped)
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:len(img)])
+	// rest of the last sector of the image is not discarded
+	assert.Equal(t, old[len(img):6144], data[len(img):6144])
+	assert.Equal(t, make([]byte, 16384-6144), data[6144:])
+}
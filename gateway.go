@@ -0,0 +1,450 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// In gateway mode the client does not update the device it runs on. It
+// authorizes with the server like any other device and then stands in for the
+// server on a network the devices can not reach it from. Device API calls are
+// passed on to the server with the credentials of the device making them,
+// while the artifacts the devices are told to install are downloaded once and
+// served to all of them from a cache.
+
+const (
+	gatewayAPIPrefix          = "/api/devices/v1/"
+	gatewayNextUpdatePath     = gatewayAPIPrefix + "deployments/device/deployments/next"
+	gatewayArtifactsPath      = "/gateway/artifacts/"
+	defaultGatewayCacheDir    = "gateway"
+	defaultMaxCachedArtifacts = 3
+)
+
+type gateway struct {
+	// guards the controller, which is not safe for concurrent use
+	lock  sync.Mutex
+	m     *mender
+	cache *artifactCache
+	proxy *httputil.ReverseProxy
+}
+
+func newGateway(m *mender, dataStore string) (*gateway, error) {
+	conf := m.config.Gateway
+	dir := conf.CacheDirectory
+	if dir == "" {
+		dir = path.Join(dataStore, defaultGatewayCacheDir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create gateway cache directory")
+	}
+	max := conf.MaxCachedArtifacts
+	if max <= 0 {
+		max = defaultMaxCachedArtifacts
+	}
+
+	g := &gateway{m: m}
+	// links are those handed out to devices; the gateway has no deployment
+	// of its own to renew them with
+	g.cache = newArtifactCache(dir, max,
+		func(uri string) (io.ReadCloser, int64, error) {
+			return m.fetchUpdate(uri, time.Time{}, nil)
+		})
+	g.proxy = &httputil.ReverseProxy{
+		// the server is picked by RoundTrip, as it may change
+		Director:  func(*http.Request) {},
+		Transport: g,
+	}
+	return g, nil
+}
+
+// authorize keeps trying to authorize the gateway until it succeeds
+func (g *gateway) authorize() {
+	for {
+		g.lock.Lock()
+		merr := g.m.Authorize()
+		wait := g.m.GetRetryPollInterval()
+		g.lock.Unlock()
+
+		if merr == nil {
+			log.Info("gateway authorized with the server")
+			return
+		}
+		log.Errorf("gateway authorization failed, retrying in %v: %v", wait, merr)
+		time.Sleep(wait)
+	}
+}
+
+// upstream returns URL of the server in use, its index in the server pool
+// and HTTP client for talking to it; the client does not add the
+// authorization token of the gateway to the requests of the devices
+func (g *gateway) upstream() (string, int, *client.ApiClient) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	server, _ := g.m.server()
+	idx := g.m.servers.current
+	return server, idx, g.m.servers.servers[idx].api
+}
+
+func (g *gateway) serverFailed(idx int, reason string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.m.servers.failed(idx, reason)
+}
+
+// RoundTrip passes a device API request on to the server
+func (g *gateway) RoundTrip(req *http.Request) (*http.Response, error) {
+	server, idx, api := g.upstream()
+	u, err := url.Parse(strings.TrimRight(server, "/") + req.URL.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid server URL")
+	}
+	u.RawQuery = req.URL.RawQuery
+
+	out := req.WithContext(req.Context())
+	out.URL = u
+	out.Host = ""
+	rsp, err := api.Transport.RoundTrip(out)
+	if err != nil {
+		g.serverFailed(idx, err.Error())
+		return nil, err
+	}
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		g.serverFailed(idx, rsp.Status)
+	}
+
+	if req.Method == http.MethodGet && req.URL.Path == gatewayNextUpdatePath &&
+		rsp.StatusCode == http.StatusOK {
+		return g.rewriteUpdate(req, rsp)
+	}
+	return rsp, nil
+}
+
+// rewriteUpdate points the artifact of the update in `rsp` to the cache of
+// the gateway and starts downloading it
+func (g *gateway) rewriteUpdate(req *http.Request, rsp *http.Response) (*http.Response, error) {
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read update response")
+	}
+
+	// the response is modified as a map, so that the fields unknown to
+	// the client are passed on as they are
+	var update map[string]interface{}
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, errors.Wrapf(err, "invalid update response")
+	}
+	artifact, _ := update["artifact"].(map[string]interface{})
+	source, _ := artifact["source"].(map[string]interface{})
+	uri, _ := source["uri"].(string)
+	if uri == "" {
+		log.Warnf("update response without artifact URI, passing it on as is")
+		return setBody(rsp, data), nil
+	}
+
+	key := g.cache.add(uri)
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	source["uri"] = scheme + "://" + req.Host + gatewayArtifactsPath + key
+	// artifacts are kept in the cache for as long as devices ask for them
+	delete(source, "expire")
+	log.Infof("artifact %v for device %s is served from cache %s",
+		artifact["artifact_name"], req.RemoteAddr, key)
+
+	data, err = json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	return setBody(rsp, data), nil
+}
+
+func setBody(rsp *http.Response, data []byte) *http.Response {
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	rsp.ContentLength = int64(len(data))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return rsp
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, gatewayAPIPrefix):
+		g.proxy.ServeHTTP(w, r)
+	case strings.HasPrefix(r.URL.Path, gatewayArtifactsPath):
+		g.serveArtifact(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveArtifact serves GET /gateway/artifacts/<key>, waiting for the
+// artifact to be downloaded if needed
+func (g *gateway) serveArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, gatewayArtifactsPath)
+	if !validCacheKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := g.cache.open(r.Context(), key)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Errorf("failed to serve artifact %s to device %s: %v",
+			key, r.RemoteAddr, err)
+		http.Error(w, "artifact not available", http.StatusBadGateway)
+		return
+	}
+	defer f.Close()
+
+	log.Infof("serving artifact %s to device %s", key, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, key, time.Time{}, f)
+}
+
+// listen opens the listener the devices connect to
+func (g *gateway) listen() (net.Listener, error) {
+	conf := g.m.config.Gateway
+	if conf.ListenAddress == "" {
+		return nil, errors.New("gateway listen address not configured")
+	}
+	if conf.Certificate == "" {
+		log.Warnf("gateway certificate not configured, serving devices over plain HTTP")
+		return net.Listen("tcp", conf.ListenAddress)
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.Certificate, conf.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load gateway certificate")
+	}
+	return tls.Listen("tcp", conf.ListenAddress, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+}
+
+// artifactCache keeps the artifacts downloaded by the gateway, named by the
+// hash of their URI, less the query, which carries the signature of
+// pre-signed URIs and changes with every update check
+type artifactCache struct {
+	dir   string
+	max   int
+	fetch func(uri string) (io.ReadCloser, int64, error)
+
+	lock sync.Mutex
+	// latest URI of each artifact, downloads in progress and errors of
+	// the last downloads, by key
+	sources  map[string]string
+	fetching map[string]chan struct{}
+	errors   map[string]error
+}
+
+func newArtifactCache(dir string, max int,
+	fetch func(uri string) (io.ReadCloser, int64, error)) *artifactCache {
+	return &artifactCache{
+		dir:      dir,
+		max:      max,
+		fetch:    fetch,
+		sources:  make(map[string]string),
+		fetching: make(map[string]chan struct{}),
+		errors:   make(map[string]error),
+	}
+}
+
+func cacheKey(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		u.RawQuery = ""
+		u.Fragment = ""
+		uri = u.String()
+	}
+	sum := sha256.Sum256([]byte(uri))
+	return hex.EncodeToString(sum[:])
+}
+
+func validCacheKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == sha256.Size
+}
+
+// add starts downloading the artifact at `uri`, unless it is cached already,
+// and returns its key
+func (c *artifactCache) add(uri string) string {
+	key := cacheKey(uri)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sources[key] = uri
+	c.download(key)
+	return key
+}
+
+// open returns the cached artifact `key`, once downloaded
+func (c *artifactCache) open(ctx context.Context, key string) (*os.File, error) {
+	c.lock.Lock()
+	done, err := c.download(key)
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.errors[key]; err != nil {
+		return nil, err
+	}
+	name := path.Join(c.dir, key)
+	f, err := os.Open(name)
+	if err == nil {
+		// keep the artifacts in use from being evicted
+		now := time.Now()
+		os.Chtimes(name, now, now)
+	}
+	return f, err
+}
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// download starts downloading artifact `key` unless it is cached or being
+// downloaded already; the returned channel is closed once it is done. Must be
+// called with the lock held.
+func (c *artifactCache) download(key string) (<-chan struct{}, error) {
+	if done, ok := c.fetching[key]; ok {
+		return done, nil
+	}
+	if _, err := os.Stat(path.Join(c.dir, key)); err == nil {
+		return closedChan, nil
+	}
+	uri, ok := c.sources[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	done := make(chan struct{})
+	c.fetching[key] = done
+	delete(c.errors, key)
+	go func() {
+		err := c.store(key, uri)
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if err != nil {
+			log.Errorf("failed to download artifact %s to gateway cache: %v", key, err)
+			c.errors[key] = err
+		} else {
+			c.evict()
+		}
+		delete(c.fetching, key)
+		close(done)
+	}()
+	return done, nil
+}
+
+func (c *artifactCache) store(key, uri string) error {
+	in, size, err := c.fetch(uri)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	name := path.Join(c.dir, key)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, in)
+	if err == nil && size >= 0 && n != size {
+		err = errors.Errorf("got %d bytes of artifact, expected %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	log.Infof("artifact %s downloaded to gateway cache", key)
+	return os.Rename(f.Name(), name)
+}
+
+// evict removes the least recently used artifacts above the limit. Must be
+// called with the lock held.
+func (c *artifactCache) evict() {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Errorf("failed to list gateway cache: %v", err)
+		return
+	}
+	cached := files[:0]
+	for _, fi := range files {
+		if validCacheKey(fi.Name()) {
+			cached = append(cached, fi)
+		}
+	}
+	if len(cached) <= c.max {
+		return
+	}
+
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().After(cached[j].ModTime())
+	})
+	for _, fi := range cached[c.max:] {
+		log.Infof("removing artifact %s from gateway cache", fi.Name())
+		if err := os.Remove(path.Join(c.dir, fi.Name())); err != nil {
+			log.Errorf("failed to remove cached artifact: %v", err)
+		}
+		delete(c.sources, fi.Name())
+	}
+}
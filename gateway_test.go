@@ -0,0 +1,182 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// the client does not accept artifacts smaller than 4KiB
+	first := strings.Repeat("first artifact ", 512)
+	second := strings.Repeat("second artifact ", 512)
+	artifacts := map[string]string{
+		"/storage/a1": first,
+		"/storage/a2": second,
+	}
+	var lock sync.Mutex
+	downloads := map[string]int{}
+	auth := map[string]string{}
+	nextArtifact := "/storage/a1"
+
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		auth[r.URL.Path] = r.Header.Get("Authorization")
+
+		switch {
+		case r.URL.Path == gatewayNextUpdatePath:
+			fmt.Fprintf(w, `{"id": "dep-1", "artifact": {"artifact_name": "release-1",
+				"device_types_compatible": ["vexpress"], "extra": "kept",
+				"source": {"uri": "%s%s?sig=%s", "expire": "2017-01-01T00:00:00Z"}}}`,
+				upstream.URL, nextArtifact, r.URL.Query().Get("sig"))
+		case strings.HasPrefix(r.URL.Path, "/storage/"):
+			data, ok := artifacts[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			downloads[r.URL.Path]++
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Write([]byte(data))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer upstream.Close()
+
+	m := newTestMender(nil, menderConfig{
+		ServerURL: upstream.URL,
+		Gateway: gatewayConfig{
+			CacheDirectory:     tdir,
+			MaxCachedArtifacts: 1,
+		},
+	}, testMenderPieces{})
+	m.authToken = "gateway-token"
+
+	gw, err := newGateway(m, "/no/data/store")
+	assert.NoError(t, err)
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	do := func(method, p, token string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+p, nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return rsp
+	}
+	checkUpdate := func(sig string) map[string]interface{} {
+		rsp := do(http.MethodGet, gatewayNextUpdatePath+"?sig="+sig, "device-token")
+		defer rsp.Body.Close()
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+		var update map[string]interface{}
+		assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&update))
+		return update["artifact"].(map[string]interface{})
+	}
+	get := func(uri string) (int, string) {
+		rsp := do(http.MethodGet, strings.TrimPrefix(uri, srv.URL), "")
+		defer rsp.Body.Close()
+		data, err := ioutil.ReadAll(rsp.Body)
+		assert.NoError(t, err)
+		return rsp.StatusCode, string(data)
+	}
+
+	// device calls are passed on with the credentials of the device only
+	rsp := do(http.MethodPost, gatewayAPIPrefix+"authentication/auth_requests", "")
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	rsp = do(http.MethodPatch, gatewayAPIPrefix+"inventory/device/attributes", "device-token")
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	lock.Lock()
+	assert.Equal(t, "", auth[gatewayAPIPrefix+"authentication/auth_requests"])
+	assert.Equal(t, "Bearer device-token", auth[gatewayAPIPrefix+"inventory/device/attributes"])
+	lock.Unlock()
+
+	// artifact is pointed to the cache, the rest of the update is kept
+	artifact := checkUpdate("one")
+	assert.Equal(t, "kept", artifact["extra"])
+	source := artifact["source"].(map[string]interface{})
+	uri := source["uri"].(string)
+	assert.True(t, strings.HasPrefix(uri, srv.URL+gatewayArtifactsPath), uri)
+	assert.NotContains(t, source, "expire")
+
+	// pre-signed URIs differ between update checks, the artifact does not
+	artifact = checkUpdate("two")
+	assert.Equal(t, uri, artifact["source"].(map[string]interface{})["uri"])
+
+	for i := 0; i < 2; i++ {
+		code, data := get(uri)
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, data == first)
+	}
+	req, _ := http.NewRequest(http.MethodGet, uri, nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(first)-9))
+	rsp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, rsp.StatusCode)
+	assert.Equal(t, "artifact ", string(data))
+	lock.Lock()
+	assert.Equal(t, 1, downloads["/storage/a1"])
+	lock.Unlock()
+
+	// artifacts over the limit are evicted
+	lock.Lock()
+	nextArtifact = "/storage/a2"
+	lock.Unlock()
+	uri2 := checkUpdate("three")["source"].(map[string]interface{})["uri"].(string)
+	code, data2 := get(uri2)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, data2 == second)
+	_, err = os.Stat(path.Join(tdir, strings.TrimPrefix(uri, srv.URL+gatewayArtifactsPath)))
+	assert.True(t, os.IsNotExist(err))
+	code, _ = get(uri)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// artifact that can not be downloaded
+	lock.Lock()
+	nextArtifact = "/storage/missing"
+	lock.Unlock()
+	uri3 := checkUpdate("four")["source"].(map[string]interface{})["uri"].(string)
+	code, _ = get(uri3)
+	assert.Equal(t, http.StatusBadGateway, code)
+
+	for _, p := range []string{gatewayArtifactsPath + "../mender.conf",
+		gatewayArtifactsPath + strings.Repeat("0", 64), "/"} {
+		code, _ = get(srv.URL + p)
+		assert.Equal(t, http.StatusNotFound, code, p)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// default size of the buffers images are written to devices from
+const defaultWriteBufferSize = 1024 * 1024
+
+type imageChunk struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// copyImage copies `src` to `dst` in chunks of `size` bytes, except for the
+// last one, from two buffers aligned for O_DIRECT: while one is being written,
+// the other is filled. It returns the number of bytes written and the time
+// spent writing them.
+func copyImage(dst io.Writer, src io.Reader, size int) (int64, time.Duration, error) {
+	free := make(chan []byte, 2)
+	full := make(chan imageChunk)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	for i := 0; i < cap(free); i++ {
+		free <- alignedBuffer(size, directIOAlignment)
+	}
+
+	go func() {
+		defer close(finished)
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := io.ReadFull(src, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case full <- imageChunk{buf, n, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		// src must not be read any more once returned
+		close(done)
+		<-finished
+	}()
+
+	var written int64
+	var writing time.Duration
+	for {
+		c := <-full
+		if c.n > 0 {
+			start := time.Now()
+			n, err := dst.Write(c.buf[:c.n])
+			writing += time.Since(start)
+			written += int64(n)
+			if err == nil && n < c.n {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return written, writing, err
+			}
+		}
+		if c.err == io.EOF {
+			return written, writing, nil
+		} else if c.err != nil {
+			return written, writing, c.err
+		}
+		free <- c.buf
+	}
+}
+
+// throughput formats the rate of writing `n` bytes in `d`
+func throughput(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f MiB/s", float64(n)/d.Seconds()/(1024*1024))
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkWriter records the writes made to it
+type chunkWriter struct {
+	bytes.Buffer
+	chunks  []int
+	aligned bool
+	err     error
+	// waited for before the first write
+	wait <-chan struct{}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.wait != nil {
+		select {
+		case <-w.wait:
+		case <-time.After(5 * time.Second):
+			return 0, errors.New("reading did not go on while writing")
+		}
+		w.wait = nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.chunks = append(w.chunks, len(p))
+	if uintptr(unsafe.Pointer(&p[0]))%directIOAlignment != 0 {
+		w.aligned = false
+	}
+	return w.Buffer.Write(p)
+}
+
+// signalReader closes `reached` once `at` bytes have been read
+type signalReader struct {
+	io.Reader
+	read    int64
+	at      int64
+	reached chan struct{}
+	err     error
+}
+
+func (r *signalReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt64(&r.read) >= r.at && r.reached != nil {
+		close(r.reached)
+		r.reached = nil
+	}
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	if err == io.EOF && r.err != nil {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestCopyImage(t *testing.T) {
+	img := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(img)
+
+	// the second chunk is read while the first one is being written
+	reached := make(chan struct{})
+	src := &signalReader{Reader: bytes.NewReader(img), at: 4096, reached: reached}
+	dst := &chunkWriter{aligned: true, wait: reached}
+	n, _, err := copyImage(dst, src, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(img)), n)
+	assert.Equal(t, img, dst.Bytes())
+	assert.Equal(t, []int{4096, 4096, 1808}, dst.chunks)
+	assert.True(t, dst.aligned)
+
+	// whatever was read before an error is written
+	src = &signalReader{Reader: bytes.NewReader(img[:5000]), err: errors.New("broken")}
+	dst = &chunkWriter{aligned: true}
+	n, _, err = copyImage(dst, src, 4096)
+	assert.EqualError(t, err, "broken")
+	assert.Equal(t, int64(5000), n)
+	assert.Equal(t, img[:5000], dst.Bytes())
+
+	// nothing is read after failing to write
+	src = &signalReader{Reader: bytes.NewReader(img)}
+	dst = &chunkWriter{err: errors.New("no space")}
+	n, _, err = copyImage(dst, src, 1024)
+	assert.EqualError(t, err, "no space")
+	assert.Zero(t, n)
+	read := atomic.LoadInt64(&src.read)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, read, atomic.LoadInt64(&src.read))
+	assert.True(t, read <= 2*1024)
+
+	dst = &chunkWriter{}
+	n, _, err = copyImage(dst, bytes.NewReader(nil), 4096)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Empty(t, dst.chunks)
+}
+
+func TestThroughput(t *testing.T) {
+	assert.Equal(t, "2.0 MiB/s", throughput(1024*1024, 500*time.Millisecond))
+	assert.Equal(t, "-", throughput(100, 0))
+}
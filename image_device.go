@@ -0,0 +1,234 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	imagePartitionPrefix = "part"
+	imageBootEnvFile     = "bootenv"
+	// times the bootloader boots an uncommitted update before falling back
+	// to the other partition, like bootlimit of U-Boot
+	imageBootLimit = 1
+)
+
+// partition numbers of the images
+var imagePartitions = []string{"2", "3"}
+
+// imageDevice stands in for a device with partition images instead of its
+// rootfs partitions, so that the whole update path, from writing the image to
+// committing or rolling back, can be run on any Linux machine. The images are
+// either written to as regular files or attached to loop devices, which makes
+// them real block devices. Rebooting does what the bootloader would.
+type imageDevice struct {
+	*device
+	env *fileEnv
+	// mender_boot_part of partitions A and B
+	numbers [2]string
+	// images attached to loop devices, if any
+	loops []string
+	// partition the device has booted from
+	booted string
+}
+
+// newImageDevice returns a device with partition images of `size` bytes kept
+// in `dir`, attaching them to loop devices if `loop` is set. Images and boot
+// environment already in `dir` are reused, as if the device was powered on
+// again.
+func newImageDevice(dir string, size int64, loop bool) (*imageDevice, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	id := &imageDevice{
+		env: &fileEnv{path: filepath.Join(dir, imageBootEnvFile)},
+	}
+	parts := make([]string, 0, len(imagePartitions))
+	for _, num := range imagePartitions {
+		image := filepath.Join(dir, imagePartitionPrefix+num)
+		if err := createImage(image, size); err != nil {
+			id.Close()
+			return nil, err
+		}
+		if !loop {
+			parts = append(parts, image)
+			continue
+		}
+		dev, err := attachLoop(image)
+		if err != nil {
+			id.Close()
+			return nil, err
+		}
+		id.loops = append(id.loops, dev)
+		parts = append(parts, dev)
+	}
+	for i, part := range parts {
+		num, err := partitionNumber(part)
+		if err != nil {
+			id.Close()
+			return nil, err
+		}
+		id.numbers[i] = num
+	}
+	if id.numbers[0] == id.numbers[1] {
+		id.Close()
+		return nil, errors.Errorf("partitions %s and %s have the same number",
+			parts[0], parts[1])
+	}
+
+	id.device = NewDevice(id.env, new(osCalls), deviceConfig{
+		rootfsPartA: parts[0],
+		rootfsPartB: parts[1],
+	})
+	id.files = !loop
+	id.mountedRoot = id.rootMount
+
+	env, err := id.env.ReadEnv("mender_boot_part")
+	if err != nil {
+		id.Close()
+		return nil, err
+	}
+	if _, ok := env["mender_boot_part"]; !ok {
+		if err := id.env.WriteEnv(BootVars{
+			"mender_boot_part":  id.numbers[0],
+			"upgrade_available": "0",
+			"bootcount":         "0",
+		}); err != nil {
+			id.Close()
+			return nil, err
+		}
+	}
+
+	if err := id.boot(); err != nil {
+		id.Close()
+		return nil, err
+	}
+	return id, nil
+}
+
+func createImage(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < size {
+		return f.Truncate(size)
+	}
+	return nil
+}
+
+func attachLoop(image string) (string, error) {
+	out, err := new(osCalls).Command("losetup", "--find", "--show", image).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to attach %s to a loop device", image)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// boot selects the partition to boot from like the bootloader does, falling
+// back to the other partition once an update was booted imageBootLimit times
+// without being committed
+func (id *imageDevice) boot() error {
+	env, err := id.env.ReadEnv()
+	if err != nil {
+		return err
+	}
+
+	if env["upgrade_available"] == "1" {
+		count, _ := strconv.Atoi(env["bootcount"])
+		count++
+		vars := BootVars{"bootcount": strconv.Itoa(count)}
+		if count > imageBootLimit {
+			log.Infof("update on partition %s failed to boot %d times, "+
+				"falling back", env["mender_boot_part"], count-1)
+			vars["mender_boot_part"] = id.otherPartition(env["mender_boot_part"])
+			vars["upgrade_available"] = "0"
+		}
+		if err := id.env.WriteEnv(vars); err != nil {
+			return err
+		}
+		for k, v := range vars {
+			env[k] = v
+		}
+	}
+
+	id.booted = ""
+	for i, part := range []string{id.rootfsPartA, id.rootfsPartB} {
+		if id.numbers[i] == env["mender_boot_part"] {
+			id.booted = part
+		}
+	}
+	if id.booted == "" {
+		return errors.Errorf("no partition matches mender_boot_part=%s",
+			env["mender_boot_part"])
+	}
+	log.Infof("booted from %s", id.booted)
+
+	// make the partitions be detected again
+	id.active = ""
+	id.inactive = ""
+	return nil
+}
+
+func (id *imageDevice) otherPartition(num string) string {
+	if id.numbers[0] == num {
+		return id.numbers[1]
+	}
+	return id.numbers[0]
+}
+
+// rootMount pretends root is mounted from the booted partition
+func (id *imageDevice) rootMount() (string, *syscall.Stat_t, error) {
+	info, err := os.Stat(id.booted)
+	if err != nil {
+		return "", nil, err
+	}
+	root := *info.Sys().(*syscall.Stat_t)
+	if info.Mode()&os.ModeDevice != 0 {
+		root.Dev = root.Rdev
+	}
+	return id.booted, &root, nil
+}
+
+func (id *imageDevice) Reboot() error {
+	log.Info("rebooting partition images")
+	return id.boot()
+}
+
+// Close detaches the loop devices; the images are left in place
+func (id *imageDevice) Close() error {
+	var err error
+	for _, dev := range id.loops {
+		if derr := new(osCalls).Command("losetup", "-d", dev).Run(); derr != nil {
+			err = errors.Wrapf(derr, "failed to detach loop device %s", dev)
+		}
+	}
+	id.loops = nil
+	return err
+}
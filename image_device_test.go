@@ -0,0 +1,123 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func installImage(t *testing.T, d *imageDevice, content string) {
+	img := bytes.Repeat([]byte(content), 1024)
+	assert.NoError(t, d.InstallUpdate(ioutil.NopCloser(bytes.NewReader(img)),
+		int64(len(img))))
+	assert.NoError(t, d.EnableUpdatedPartition())
+}
+
+func assertBooted(t *testing.T, d *imageDevice, part, content string) {
+	active, err := d.GetActive()
+	assert.NoError(t, err)
+	assert.Equal(t, part, active)
+
+	f, err := os.Open(part)
+	assert.NoError(t, err)
+	defer f.Close()
+	data := make([]byte, len(content))
+	_, err = f.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func testImageDevice(t *testing.T, loop bool) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	d, err := newImageDevice(tdir, 1024*1024, loop)
+	assert.NoError(t, err)
+	defer d.Close()
+	partA, partB := d.rootfsPartA, d.rootfsPartB
+	assertBooted(t, d, partA, "\x00")
+
+	// update and commit
+	installImage(t, d, "update-1")
+	has, err := d.HasUpdate()
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.NoError(t, d.Reboot())
+	assertBooted(t, d, partB, "update-1")
+	assert.NoError(t, d.CommitUpdate())
+	has, err = d.HasUpdate()
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.Equal(t, errorNoUpgradeMounted, d.CommitUpdate())
+
+	// rolled back by mender
+	installImage(t, d, "update-2")
+	assert.NoError(t, d.Reboot())
+	assertBooted(t, d, partA, "update-2")
+	assert.NoError(t, d.SwapPartitions())
+	assert.NoError(t, d.Reboot())
+	assertBooted(t, d, partB, "update-1")
+
+	// rolled back by the bootloader, after the update booted once
+	installImage(t, d, "update-3")
+	assert.NoError(t, d.Reboot())
+	assertBooted(t, d, partA, "update-3")
+	assert.NoError(t, d.Reboot())
+	assertBooted(t, d, partB, "update-1")
+	has, err = d.HasUpdate()
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// images and boot environment survive powering off
+	assert.NoError(t, d.Close())
+	d, err = newImageDevice(tdir, 1024*1024, loop)
+	assert.NoError(t, err)
+	defer d.Close()
+	assertBooted(t, d, d.rootfsPartB, "update-1")
+
+	// the installer writes artifacts to the partitions
+	art, err := MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{device: d},
+	})
+	m.deviceTypeFile = path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(m.deviceTypeFile,
+		[]byte("device_type=vexpress-qemu"), 0644))
+	assert.NoError(t, m.InstallUpdate(art, 0))
+	assert.NoError(t, m.EnableUpdatedPartition())
+	assert.NoError(t, m.Reboot())
+	assertBooted(t, d, d.rootfsPartA, "test update")
+}
+
+func TestImageDevice(t *testing.T) {
+	testImageDevice(t, false)
+}
+
+func TestImageDeviceLoop(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices need root")
+	}
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skip("loop devices not available")
+	}
+	testImageDevice(t, true)
+}
@@ -0,0 +1,685 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// This file is derived from src/compress/flate/inflate.go of the Go
+// distribution, which carries the following notice:
+//
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// The LICENSE file is found next to this one. The Northern.tech changes are
+// the block offsets reported by the decompressor and resuming at a block.
+
+// Package inflate decompresses DEFLATE data (RFC 1951), like compress/flate,
+// but tells where each block of the data starts, and can pick up decompressing
+// at the start of a block given the data decompressed right before it. This
+// is what it takes to resume decompressing a stream that was interrupted.
+package inflate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// the farthest back a match can refer to
+	WindowSize = 1 << 15
+
+	maxCodeLen = 16
+	maxNumLit  = 286
+	maxNumDist = 30
+	numCodes   = 19
+	endOfBlock = 256
+
+	// codes up to this long are looked up at once, longer ones in two steps
+	chunkBits  = 9
+	numChunks  = 1 << chunkBits
+	countMask  = 15
+	valueShift = 4
+)
+
+// CorruptInputError is the offset of the compressed data where it was found
+// to be invalid.
+type CorruptInputError int64
+
+func (e CorruptInputError) Error() string {
+	return fmt.Sprintf("inflate: corrupt input before offset %d", int64(e))
+}
+
+// Point is the start of a block of the compressed data.
+type Point struct {
+	// bytes of the compressed data read by then
+	In int64
+	// bits of the last byte read not decoded yet, and their number
+	Bits  uint32
+	NBits uint
+	// bytes decompressed before the block
+	Out int64
+}
+
+// Reader decompresses the data read from the reader it is created with.
+type Reader struct {
+	r   byteReader
+	in  int64
+	out int64
+	// bits read but not decoded yet
+	b  uint32
+	nb uint
+
+	win    window
+	toRead []byte
+	err    error
+
+	// next thing to do, and the state of the block being decoded
+	step     func(*Reader)
+	final    bool
+	stored   int
+	hl, hd   *huffman
+	h1, h2   huffman
+	copyLen  int
+	copyDist int
+	lengths  [maxNumLit + maxNumDist]int
+
+	block func(Point)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewReader returns a reader decompressing the data read from `r`. If `r`
+// does not implement io.ByteReader it is buffered, and the reader may read
+// more than the compressed data from it.
+func NewReader(r io.Reader) *Reader {
+	z := &Reader{r: makeReader(r), step: (*Reader).nextBlock}
+	z.win.init(nil)
+	return z
+}
+
+// Resume returns a reader decompressing the data from `p` on; `r` reads the
+// compressed data from p.In on, and `dict` is the data decompressed before
+// `p`, of which only the last WindowSize bytes are used.
+func Resume(r io.Reader, p Point, dict []byte) *Reader {
+	z := &Reader{
+		r:    makeReader(r),
+		in:   p.In,
+		out:  p.Out,
+		b:    p.Bits,
+		nb:   p.NBits,
+		step: (*Reader).nextBlock,
+	}
+	z.win.init(dict)
+	return z
+}
+
+func makeReader(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// OnBlock makes `f` be called at the start of each block, once all the data
+// decompressed before it is read; the points passed to it are where Resume()
+// can pick up decompressing.
+func (z *Reader) OnBlock(f func(Point)) {
+	z.block = f
+}
+
+// Offset returns the bytes of compressed data read, and of data decompressed
+// and read from `z`.
+func (z *Reader) Offset() (in, out int64) {
+	return z.in, z.out
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for {
+		if len(z.toRead) > 0 {
+			n := copy(p, z.toRead)
+			z.toRead = z.toRead[n:]
+			z.out += int64(n)
+			if len(z.toRead) == 0 {
+				return n, z.err
+			}
+			return n, nil
+		}
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.step(z)
+		if z.err != nil && len(z.toRead) == 0 {
+			z.toRead = z.win.flush()
+		}
+	}
+}
+
+func (z *Reader) nextBlock() {
+	if z.block != nil {
+		z.block(Point{In: z.in, Bits: z.b, NBits: z.nb, Out: z.out})
+	}
+	for z.nb < 3 {
+		if z.err = z.moreBits(); z.err != nil {
+			return
+		}
+	}
+	z.final = z.b&1 == 1
+	typ := z.b >> 1 & 3
+	z.b >>= 3
+	z.nb -= 3
+
+	switch typ {
+	case 0:
+		z.storedBlock()
+	case 1:
+		z.hl = &fixedLiterals
+		z.hd = nil
+		z.step = (*Reader).huffmanBlock
+		z.copyLen = 0
+		z.huffmanBlock()
+	case 2:
+		if z.err = z.readHuffman(); z.err != nil {
+			return
+		}
+		z.hl = &z.h1
+		z.hd = &z.h2
+		z.step = (*Reader).huffmanBlock
+		z.copyLen = 0
+		z.huffmanBlock()
+	default:
+		z.err = CorruptInputError(z.in)
+	}
+}
+
+// endBlock makes the next step read the next block, or end the data after the
+// final one, once what is decompressed so far is read
+func (z *Reader) endBlock() {
+	if z.final {
+		z.err = io.EOF
+	}
+	z.step = (*Reader).nextBlock
+	z.toRead = z.win.flush()
+}
+
+func (z *Reader) storedBlock() {
+	// the length starts at the next byte
+	z.b, z.nb = 0, 0
+
+	var buf [4]byte
+	n, err := io.ReadFull(z.r, buf[:])
+	z.in += int64(n)
+	if err != nil {
+		z.err = noEOF(err)
+		return
+	}
+	length := int(buf[0]) | int(buf[1])<<8
+	nlength := int(buf[2]) | int(buf[3])<<8
+	if uint16(nlength) != uint16(^length) {
+		z.err = CorruptInputError(z.in)
+		return
+	}
+	if length == 0 {
+		z.endBlock()
+		return
+	}
+	z.stored = length
+	z.storedData()
+}
+
+func (z *Reader) storedData() {
+	buf := z.win.writeSlice()
+	if len(buf) > z.stored {
+		buf = buf[:z.stored]
+	}
+	n, err := io.ReadFull(z.r, buf)
+	z.in += int64(n)
+	z.win.written(n)
+	z.stored -= n
+	if err != nil {
+		z.err = noEOF(err)
+		return
+	}
+	if z.stored == 0 {
+		z.endBlock()
+		return
+	}
+	z.step = (*Reader).storedData
+	z.toRead = z.win.flush()
+}
+
+// readHuffman reads the code lengths of a dynamic block and sets up decoding
+// with them
+func (z *Reader) readHuffman() error {
+	for z.nb < 5+5+4 {
+		if err := z.moreBits(); err != nil {
+			return err
+		}
+	}
+	nlit := int(z.b&0x1f) + 257
+	if nlit > maxNumLit {
+		return CorruptInputError(z.in)
+	}
+	z.b >>= 5
+	ndist := int(z.b&0x1f) + 1
+	if ndist > maxNumDist {
+		return CorruptInputError(z.in)
+	}
+	z.b >>= 5
+	nclen := int(z.b&0xf) + 4
+	z.b >>= 4
+	z.nb -= 5 + 5 + 4
+
+	// the lengths of the code for the code lengths come first
+	var clens [numCodes]int
+	for i := 0; i < nclen; i++ {
+		for z.nb < 3 {
+			if err := z.moreBits(); err != nil {
+				return err
+			}
+		}
+		clens[codeOrder[i]] = int(z.b & 7)
+		z.b >>= 3
+		z.nb -= 3
+	}
+	if !z.h1.init(clens[:]) {
+		return CorruptInputError(z.in)
+	}
+
+	for i, n := 0, nlit+ndist; i < n; {
+		x, err := z.huffSym(&z.h1)
+		if err != nil {
+			return err
+		}
+		if x < 16 {
+			z.lengths[i] = x
+			i++
+			continue
+		}
+		var rep, nb int
+		var b int
+		switch x {
+		case 16:
+			rep, nb = 3, 2
+			if i == 0 {
+				return CorruptInputError(z.in)
+			}
+			b = z.lengths[i-1]
+		case 17:
+			rep, nb = 3, 3
+		case 18:
+			rep, nb = 11, 7
+		default:
+			return CorruptInputError(z.in)
+		}
+		for z.nb < uint(nb) {
+			if err := z.moreBits(); err != nil {
+				return err
+			}
+		}
+		rep += int(z.b & uint32(1<<uint(nb)-1))
+		z.b >>= uint(nb)
+		z.nb -= uint(nb)
+		if i+rep > n {
+			return CorruptInputError(z.in)
+		}
+		for j := 0; j < rep; j++ {
+			z.lengths[i] = b
+			i++
+		}
+	}
+
+	if !z.h1.init(z.lengths[:nlit]) || !z.h2.init(z.lengths[nlit:nlit+ndist]) {
+		return CorruptInputError(z.in)
+	}
+	return nil
+}
+
+// huffmanBlock decodes a compressed block, until the window is full or the
+// block ends
+func (z *Reader) huffmanBlock() {
+	for {
+		if z.copyLen > 0 {
+			n := z.win.writeCopy(z.copyDist, z.copyLen)
+			z.copyLen -= n
+			if z.copyLen > 0 {
+				z.toRead = z.win.flush()
+				return
+			}
+		}
+		if z.win.available() == 0 {
+			z.toRead = z.win.flush()
+			return
+		}
+
+		v, err := z.huffSym(z.hl)
+		if err != nil {
+			z.err = err
+			return
+		}
+		switch {
+		case v < endOfBlock:
+			z.win.writeByte(byte(v))
+			continue
+		case v == endOfBlock:
+			z.endBlock()
+			return
+		case v >= endOfBlock+1+len(lengthBase):
+			z.err = CorruptInputError(z.in)
+			return
+		}
+
+		code := v - endOfBlock - 1
+		length := int(lengthBase[code])
+		if nb := uint(lengthExtra[code]); nb > 0 {
+			for z.nb < nb {
+				if z.err = z.moreBits(); z.err != nil {
+					return
+				}
+			}
+			length += int(z.b & uint32(1<<nb-1))
+			z.b >>= nb
+			z.nb -= nb
+		}
+
+		var dcode int
+		if z.hd == nil {
+			// fixed codes are 5 bits, most significant first
+			for z.nb < 5 {
+				if z.err = z.moreBits(); z.err != nil {
+					return
+				}
+			}
+			dcode = int(bits.Reverse8(uint8(z.b&0x1f) << 3))
+			z.b >>= 5
+			z.nb -= 5
+		} else if dcode, z.err = z.huffSym(z.hd); z.err != nil {
+			return
+		}
+
+		var dist int
+		switch {
+		case dcode < 4:
+			dist = dcode + 1
+		case dcode < maxNumDist:
+			nb := uint(dcode-2) >> 1
+			for z.nb < nb {
+				if z.err = z.moreBits(); z.err != nil {
+					return
+				}
+			}
+			dist = 1 + 1<<(nb+1) + (dcode&1)<<nb + int(z.b&uint32(1<<nb-1))
+			z.b >>= nb
+			z.nb -= nb
+		default:
+			z.err = CorruptInputError(z.in)
+			return
+		}
+		if dist > z.win.history() {
+			z.err = CorruptInputError(z.in)
+			return
+		}
+		z.copyLen, z.copyDist = length, dist
+	}
+}
+
+func (z *Reader) moreBits() error {
+	c, err := z.r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	z.in++
+	z.b |= uint32(c) << z.nb
+	z.nb += 8
+	return nil
+}
+
+// huffSym reads the next symbol coded with `h`
+func (z *Reader) huffSym(h *huffman) (int, error) {
+	n := uint(h.min)
+	b, nb := z.b, z.nb
+	for {
+		for nb < n {
+			c, err := z.r.ReadByte()
+			if err != nil {
+				z.b, z.nb = b, nb
+				return 0, noEOF(err)
+			}
+			z.in++
+			b |= uint32(c) << nb
+			nb += 8
+		}
+		chunk := h.chunks[b&(numChunks-1)]
+		n = uint(chunk & countMask)
+		if n > chunkBits {
+			chunk = h.links[chunk>>valueShift][(b>>chunkBits)&h.linkMask]
+			n = uint(chunk & countMask)
+		}
+		if n <= nb {
+			if n == 0 {
+				z.b, z.nb = b, nb
+				return 0, CorruptInputError(z.in)
+			}
+			z.b = b >> n
+			z.nb = nb - n
+			return int(chunk >> valueShift), nil
+		}
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// huffman decodes a canonical Huffman code. Codes of up to chunkBits bits are
+// looked up in `chunks`; for longer ones, `chunks` points to a table in
+// `links`, looked up with the following bits. Entries hold the symbol shifted
+// by valueShift and the length of its code; 0 is an invalid code.
+type huffman struct {
+	min      int
+	chunks   [numChunks]uint32
+	links    [][]uint32
+	linkMask uint32
+}
+
+// init sets up decoding the code with code lengths `lengths`, returning false
+// if they do not make up a complete code
+func (h *huffman) init(lengths []int) bool {
+	*h = huffman{}
+
+	var count [maxCodeLen]int
+	var min, max int
+	for _, n := range lengths {
+		if n == 0 {
+			continue
+		}
+		if min == 0 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+		count[n]++
+	}
+	if max == 0 {
+		// no symbols at all, which is fine until one is decoded
+		return true
+	}
+
+	var next [maxCodeLen]int
+	code := 0
+	for i := min; i <= max; i++ {
+		code <<= 1
+		next[i] = code
+		code += count[i]
+	}
+	// a single code of one bit is allowed, as zlib writes those
+	if code != 1<<uint(max) && !(code == 1 && max == 1) {
+		return false
+	}
+	h.min = min
+
+	if max > chunkBits {
+		numLinks := 1 << uint(max-chunkBits)
+		h.linkMask = uint32(numLinks - 1)
+		link := next[chunkBits+1] >> 1
+		h.links = make([][]uint32, numChunks-link)
+		for j := link; j < numChunks; j++ {
+			reverse := int(bits.Reverse16(uint16(j))) >> (16 - chunkBits)
+			off := j - link
+			h.chunks[reverse] = uint32(off<<valueShift | (chunkBits + 1))
+			h.links[off] = make([]uint32, numLinks)
+		}
+	}
+
+	for i, n := range lengths {
+		if n == 0 {
+			continue
+		}
+		code := next[n]
+		next[n]++
+		chunk := uint32(i<<valueShift | n)
+		reverse := int(bits.Reverse16(uint16(code))) >> uint(16-n)
+		if n <= chunkBits {
+			for off := reverse; off < numChunks; off += 1 << uint(n) {
+				h.chunks[off] = chunk
+			}
+			continue
+		}
+		links := h.links[h.chunks[reverse&(numChunks-1)]>>valueShift]
+		for off := reverse >> chunkBits; off < len(links); off += 1 << uint(n-chunkBits) {
+			links[off] = chunk
+		}
+	}
+	return true
+}
+
+// window keeps the last WindowSize bytes decompressed, which matches refer to;
+// hist[rd:wr] is decompressed but not read yet.
+type window struct {
+	hist []byte
+	wr   int
+	rd   int
+	full bool
+}
+
+func (w *window) init(dict []byte) {
+	w.hist = make([]byte, WindowSize)
+	if len(dict) > WindowSize {
+		dict = dict[len(dict)-WindowSize:]
+	}
+	w.wr = copy(w.hist, dict)
+	if w.wr == len(w.hist) {
+		w.wr = 0
+		w.full = true
+	}
+	w.rd = w.wr
+}
+
+// history returns how far back matches can refer to
+func (w *window) history() int {
+	if w.full {
+		return len(w.hist)
+	}
+	return w.wr
+}
+
+func (w *window) available() int {
+	return len(w.hist) - w.wr
+}
+
+func (w *window) writeSlice() []byte {
+	return w.hist[w.wr:]
+}
+
+func (w *window) written(n int) {
+	w.wr += n
+}
+
+func (w *window) writeByte(c byte) {
+	w.hist[w.wr] = c
+	w.wr++
+}
+
+// writeCopy copies `length` bytes from `dist` bytes back, as many as there is
+// room for, and returns how many it copied
+func (w *window) writeCopy(dist, length int) int {
+	start := w.wr
+	dst := start
+	src := dst - dist
+	end := dst + length
+	if end > len(w.hist) {
+		end = len(w.hist)
+	}
+
+	// the part from before the window wrapped around comes first
+	if src < 0 {
+		src += len(w.hist)
+		dst += copy(w.hist[dst:end], w.hist[src:])
+		src = 0
+	}
+	// the source may overlap what is copied, repeating it
+	for dst < end {
+		dst += copy(w.hist[dst:end], w.hist[src:dst])
+	}
+	w.wr = dst
+	return dst - start
+}
+
+// flush returns the data decompressed since the last flush, which stays valid
+// until the next write
+func (w *window) flush() []byte {
+	p := w.hist[w.rd:w.wr]
+	w.rd = w.wr
+	if w.wr == len(w.hist) {
+		w.wr, w.rd = 0, 0
+		w.full = true
+	}
+	return p
+}
+
+// order the code length code lengths come in
+var codeOrder = [numCodes]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+var lengthBase = [...]uint16{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+	35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+
+var lengthExtra = [...]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+	3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+
+var fixedLiterals huffman
+
+func init() {
+	var lengths [288]int
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLiterals.init(lengths[:])
+}
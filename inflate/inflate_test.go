@@ -0,0 +1,198 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package inflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testData returns `size` bytes of data mixing runs of zeros, text and random
+// bytes, so that all kinds of blocks are written for it
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(int64(size)))
+	words := []string{"mender ", "update ", "rootfs ", "partition ", "artifact\n"}
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		n := rnd.Intn(64*1024) + 1
+		switch rnd.Intn(3) {
+		case 0:
+			data = append(data, make([]byte, n)...)
+		case 1:
+			for i := 0; i < n; i += 8 {
+				data = append(data, words[rnd.Intn(len(words))]...)
+			}
+		case 2:
+			buf := make([]byte, n)
+			rnd.Read(buf)
+			data = append(data, buf...)
+		}
+	}
+	return data[:size]
+}
+
+func compress(t *testing.T, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+var testLevels = []int{
+	flate.NoCompression,
+	flate.BestSpeed,
+	flate.DefaultCompression,
+	flate.BestCompression,
+	flate.HuffmanOnly,
+}
+
+// smallReader returns a few bytes at a time
+type smallReader struct {
+	r io.Reader
+}
+
+func (s smallReader) Read(p []byte) (int, error) {
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return s.r.Read(p)
+}
+
+func TestReader(t *testing.T) {
+	for _, size := range []int{0, 1, 100, 70000, 1000000} {
+		data := testData(size)
+		for _, level := range testLevels {
+			comp := compress(t, data, level)
+
+			z := NewReader(bytes.NewReader(comp))
+			out, err := ioutil.ReadAll(z)
+			assert.NoError(t, err, "size %d, level %d", size, level)
+			assert.True(t, bytes.Equal(data, out), "size %d, level %d", size, level)
+			in, n := z.Offset()
+			assert.Equal(t, int64(len(comp)), in)
+			assert.Equal(t, int64(size), n)
+
+			out, err = ioutil.ReadAll(smallReader{NewReader(bytes.NewReader(comp))})
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data, out), "size %d, level %d", size, level)
+		}
+	}
+}
+
+func TestReaderFixed(t *testing.T) {
+	// short data compressed by zlib, with the fixed codes
+	comp := []byte{203, 77, 205, 75, 73, 45, 82, 200, 69, 161, 74, 11, 82, 18,
+		75, 82, 161, 20, 0}
+	assert.Equal(t, byte(1), comp[0]>>1&3)
+
+	out, err := ioutil.ReadAll(NewReader(bytes.NewReader(comp)))
+	assert.NoError(t, err)
+	assert.Equal(t, "mender mender mender update update", string(out))
+}
+
+func TestResume(t *testing.T) {
+	data := testData(1000000)
+	for _, level := range testLevels {
+		comp := compress(t, data, level)
+
+		var points []Point
+		z := NewReader(bytes.NewReader(comp))
+		z.OnBlock(func(p Point) {
+			// the data before the block is read by then
+			_, out := z.Offset()
+			assert.Equal(t, out, p.Out)
+			points = append(points, p)
+		})
+		_, err := io.Copy(ioutil.Discard, z)
+		assert.NoError(t, err)
+		assert.True(t, len(points) > 2, "level %d", level)
+
+		for _, p := range points {
+			r := Resume(bytes.NewReader(comp[p.In:]), p, data[:p.Out])
+			out, err := ioutil.ReadAll(r)
+			assert.NoError(t, err, "level %d, point %+v", level, p)
+			assert.True(t, bytes.Equal(data[p.Out:], out), "level %d, point %+v", level, p)
+			in, n := r.Offset()
+			assert.Equal(t, int64(len(comp)), in)
+			assert.Equal(t, int64(len(data)), n)
+		}
+	}
+}
+
+func TestResumeWrongDictionary(t *testing.T) {
+	var data []byte
+	for len(data) < 200000 {
+		data = append(data, "mender update rootfs partition artifact\n"...)
+	}
+	comp := compress(t, data, flate.DefaultCompression)
+
+	var points []Point
+	z := NewReader(bytes.NewReader(comp))
+	z.OnBlock(func(p Point) {
+		points = append(points, p)
+	})
+	_, err := io.Copy(ioutil.Discard, z)
+	assert.NoError(t, err)
+	assert.True(t, len(points) > 2)
+	p := points[1]
+
+	out, err := ioutil.ReadAll(Resume(bytes.NewReader(comp[p.In:]), p,
+		make([]byte, p.Out)))
+	assert.NoError(t, err)
+	assert.False(t, bytes.Equal(data[p.Out:], out))
+
+	// without one, matches refer to before the start of the data
+	_, err = ioutil.ReadAll(Resume(bytes.NewReader(comp[p.In:]), p, nil))
+	assert.IsType(t, CorruptInputError(0), err)
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	data := testData(100000)
+	comp := compress(t, data, flate.DefaultCompression)
+
+	_, err := ioutil.ReadAll(NewReader(bytes.NewReader(comp[:len(comp)/2])))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// block type 3 does not exist
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x07, 0x00})))
+	assert.IsType(t, CorruptInputError(0), err)
+
+	// stored block with a length not matching its complement
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0x01, 0x05, 0x00, 0x00, 0x00})))
+	assert.IsType(t, CorruptInputError(0), err)
+}
+
+func BenchmarkReader(b *testing.B) {
+	data := testData(4 * 1024 * 1024)
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	comp := buf.Bytes()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.Copy(ioutil.Discard, NewReader(bytes.NewReader(comp)))
+	}
+}
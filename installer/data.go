@@ -0,0 +1,497 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/inflate"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the part of an artifact before its data file is kept in memory
+	maxArtifactHeadSize = 64 * 1024 * 1024
+	// skipping less than this is done by reading rather than seeking, which
+	// takes a new request
+	minSeekDistance = 1024 * 1024
+
+	gzipFlagHCRC    = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+)
+
+var errArtifactHeadTooLarge = errors.New("installer: artifact header is too large")
+
+// artifactStream reads an artifact, keeping track of the offset in it
+type artifactStream struct {
+	r    io.Reader
+	off  int64
+	seek func(offset int64) error
+	// where to keep what is read, if not nil
+	rec *bytes.Buffer
+}
+
+func (s *artifactStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.off += int64(n)
+	if s.rec != nil && n > 0 {
+		if s.rec.Len()+n > maxArtifactHeadSize {
+			return n, errArtifactHeadTooLarge
+		}
+		s.rec.Write(p[:n])
+	}
+	return n, err
+}
+
+// skipTo makes reading continue at `offset`, seeking there if it is far
+func (s *artifactStream) skipTo(offset int64) error {
+	if offset == s.off {
+		return nil
+	}
+	if s.seek != nil && (offset < s.off || offset-s.off >= minSeekDistance) {
+		err := s.seek(offset)
+		if err == nil {
+			s.off = offset
+			return nil
+		}
+		log.Warnf("installer: can not seek to offset %d of the artifact, "+
+			"reading up to there instead: %v", offset, err)
+	}
+	if offset < s.off {
+		return errors.Errorf("installer: can not go back to offset %d of the artifact",
+			offset)
+	}
+	if _, err := io.CopyN(ioutil.Discard, s, offset-s.off); err != nil {
+		return errors.Wrapf(noEOF(err), "installer: failed to read artifact")
+	}
+	return nil
+}
+
+// artifactHead is the part of an artifact before its data file
+type artifactHead struct {
+	raw []byte
+	// tar header of the data file, nil if there is none, and where its
+	// content starts and ends in the artifact
+	data  *tar.Header
+	start int64
+	end   int64
+}
+
+// readHead reads the artifact up to the content of its first data file
+func readHead(in *artifactStream) (*artifactHead, error) {
+	rec := new(bytes.Buffer)
+	in.rec = rec
+	defer func() {
+		in.rec = nil
+	}()
+
+	tr := tar.NewReader(in)
+	// where the header of the next file starts
+	var next int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return &artifactHead{raw: rec.Bytes()}, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "installer: failed to read artifact")
+		}
+		if filepath.Dir(hdr.Name) == "data" {
+			return &artifactHead{
+				raw:   rec.Bytes()[:next],
+				data:  hdr,
+				start: in.off,
+				end:   in.off + hdr.Size,
+			}, nil
+		}
+		next = in.off + blockAligned(hdr.Size)
+	}
+}
+
+// blockAligned rounds `n` up to the size of tar blocks
+func blockAligned(n int64) int64 {
+	return (n + 511) &^ 511
+}
+
+// stub returns the artifact with its data file left out but for the tar
+// header of the image, which is what the artifact reader needs to check the
+// data file against the header of the artifact
+func (h *artifactHead) stub(image []byte) ([]byte, error) {
+	if h.data == nil {
+		return h.raw, nil
+	}
+
+	data := new(bytes.Buffer)
+	zw := gzip.NewWriter(data)
+	zw.Write(image)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	art := bytes.NewBuffer(h.raw[:len(h.raw):len(h.raw)])
+	tw := tar.NewWriter(art)
+	hdr := *h.data
+	hdr.Size = int64(data.Len())
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return art.Bytes(), nil
+}
+
+// finish reads the rest of the artifact after the data file; resuming an
+// artifact with other data files is not supported
+func (h *artifactHead) finish(in *artifactStream) error {
+	if h.data == nil {
+		return nil
+	}
+	if err := in.skipTo(blockAligned(h.end)); err != nil {
+		return err
+	}
+	hdr, err := tar.NewReader(in).Next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "installer: failed to read artifact")
+	}
+	return errors.Wrapf(ErrNotResumable, "installer: more than one data file, "+
+		"such as %s", hdr.Name)
+}
+
+// imageData decompresses the data file of an artifact, which holds the image
+// in a tar archive
+type imageData struct {
+	in  *artifactStream
+	res *Resumer
+	// offset of the compressed data in the artifact, and its end
+	stream int64
+	end    int64
+	// tar header of the image
+	header []byte
+
+	br  *bufio.Reader
+	z   *inflate.Reader
+	crc uint32
+	// set once the data turns out to be corrupted
+	corrupt bool
+}
+
+// openData starts reading the data file of `head`; unless resuming `res`, the
+// tar header of the image is read
+func openData(in *artifactStream, head *artifactHead, res *Resumer) (*imageData, error) {
+	d := &imageData{in: in, res: res, end: head.end}
+	if err := readGzipHeader(in); err != nil {
+		return nil, errors.Wrapf(err, "installer: failed to read data file %s",
+			head.data.Name)
+	}
+	d.stream = in.off
+
+	if res.resuming() {
+		if res.From.Stream != d.stream {
+			return nil, ErrNotResumable
+		}
+		d.header = res.From.Header
+		return d, nil
+	}
+
+	d.br = bufio.NewReader(io.LimitReader(in, d.end-in.off))
+	d.z = inflate.NewReader(d.br)
+	d.track()
+
+	hdr := new(bytes.Buffer)
+	_, err := tar.NewReader(io.TeeReader(d, hdr)).Next()
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "installer: failed to read data file %s",
+			head.data.Name)
+	}
+	d.header = hdr.Bytes()
+	return d, nil
+}
+
+// track makes the start of each block a point to resume from
+func (d *imageData) track() {
+	if d.res == nil {
+		return
+	}
+	d.z.OnBlock(func(p inflate.Point) {
+		d.res.add(ResumePoint{
+			Stream: d.stream,
+			In:     p.In,
+			Bits:   p.Bits,
+			NBits:  p.NBits,
+			Out:    p.Out,
+			CRC:    d.crc,
+			Header: d.header,
+		})
+	})
+}
+
+func (d *imageData) Read(p []byte) (int, error) {
+	n, err := d.z.Read(p)
+	d.crc = crc32.Update(d.crc, crc32.IEEETable, p[:n])
+	if _, ok := err.(inflate.CorruptInputError); ok {
+		d.corrupt = true
+	}
+	return n, err
+}
+
+// resume picks up decompressing the image at the point being resumed, and
+// skips the image up to where installing it resumes
+func (d *imageData) resume(df *handlers.DataFile) error {
+	p := d.res.From
+	image := p.Image()
+	if image < inflate.WindowSize || image > d.res.Written || d.res.Written > df.Size {
+		return ErrNotResumable
+	}
+
+	// matches refer to up to a window of data back
+	dict := make([]byte, inflate.WindowSize)
+	n, err := d.res.ReadImage(dict, image-int64(len(dict)))
+	if n < len(dict) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrapf(err, "installer: failed to read image installed")
+	}
+
+	if err := d.in.skipTo(p.Stream + p.In); err != nil {
+		return err
+	}
+	d.br = bufio.NewReader(io.LimitReader(d.in, d.end-d.in.off))
+	d.z = inflate.Resume(d.br, inflate.Point{
+		In:    p.In,
+		Bits:  p.Bits,
+		NBits: p.NBits,
+		Out:   p.Out,
+	}, dict)
+	d.crc = p.CRC
+	d.track()
+
+	if _, err := io.CopyN(ioutil.Discard, d, d.res.Written-image); err != nil {
+		return errors.Wrapf(noEOF(err), "installer: failed to read update")
+	}
+	log.Infof("installer: resuming install of %s after %d bytes, from offset %d "+
+		"of the artifact", df.Name, d.res.Written, p.Stream+p.In)
+	return nil
+}
+
+// install installs the image `df` to `device`; if resuming, corrupted data is
+// taken for an artifact other than the one installed before
+func (d *imageData) install(device UInstaller, df *handlers.DataFile) error {
+	err := d.installImage(device, df)
+	if err != nil && d.corrupt && d.res.resuming() {
+		return errors.Wrapf(ErrNotResumable, "%v", err)
+	}
+	return err
+}
+
+func (d *imageData) installImage(device UInstaller, df *handlers.DataFile) error {
+	h := sha256.New()
+	var written int64
+	if d.res.resuming() {
+		u, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok || u.UnmarshalBinary(d.res.Checksum) != nil {
+			return ErrNotResumable
+		}
+		if err := d.resume(df); err != nil {
+			return err
+		}
+		written = d.res.Written
+	}
+
+	log.Debugf("installing update %v of size %v", df.Name, df.Size)
+	img := &imageReader{r: io.LimitReader(d, df.Size-written), hash: h}
+	if err := device.InstallUpdate(ioutil.NopCloser(img), df.Size); err != nil {
+		log.Errorf("update image installation failed: %v", err)
+		return err
+	}
+	if img.n != df.Size-written {
+		return errors.Errorf("installer: %d bytes of image %s were installed, "+
+			"instead of %d", written+img.n, df.Name, df.Size)
+	}
+
+	sum := make([]byte, hex.EncodedLen(h.Size()))
+	hex.Encode(sum, h.Sum(nil))
+	if !bytes.Equal(sum, df.Checksum) {
+		d.corrupt = true
+		return errors.Errorf("installer: invalid checksum of image %s; "+
+			"expected: [%s]; actual: [%s]", df.Name, df.Checksum, sum)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	return verifyUpdate(device, df)
+}
+
+// finish reads the rest of the data file, where only the end of the tar
+// archive is expected, and checks the CRC and size gzip ends with
+func (d *imageData) finish() error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := d.Read(buf)
+		for _, c := range buf[:n] {
+			if c != 0 {
+				d.corrupt = true
+				return errors.New("installer: unexpected data after the update image")
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "installer: failed to read update")
+		}
+	}
+
+	var trailer [8]byte
+	if _, err := io.ReadFull(d.br, trailer[:]); err != nil {
+		return errors.Wrapf(noEOF(err), "installer: failed to read update")
+	}
+	_, out := d.z.Offset()
+	if binary.LittleEndian.Uint32(trailer[:4]) != d.crc ||
+		binary.LittleEndian.Uint32(trailer[4:]) != uint32(out) {
+		d.corrupt = true
+		return errors.Wrapf(gzip.ErrChecksum, "installer: failed to read update")
+	}
+	if _, err := d.br.ReadByte(); err != io.EOF {
+		d.corrupt = true
+		return errors.New("installer: unexpected data after the compressed update")
+	}
+	return nil
+}
+
+// resumeTracker follows a copy of an artifact being installed, to find the
+// points installing it can be resumed from; see Resumer
+type resumeTracker struct {
+	w    *io.PipeWriter
+	done chan struct{}
+}
+
+// trackResumePoints adds the points to resume installing from to `res`, as
+// the artifact is written to the tracker returned
+func trackResumePoints(res *Resumer) *resumeTracker {
+	r, w := io.Pipe()
+	t := &resumeTracker{w: w, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		// the artifact written has to be read whatever happens
+		defer io.Copy(ioutil.Discard, r)
+
+		in := &artifactStream{r: r}
+		head, err := readHead(in)
+		if err != nil || head.data == nil {
+			return
+		}
+		data, err := openData(in, head, res)
+		if err != nil {
+			log.Debugf("installer: not tracking where to resume installing from: %v",
+				err)
+			return
+		}
+		if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			log.Debugf("installer: stopped tracking where to resume installing "+
+				"from: %v", err)
+		}
+	}()
+	return t
+}
+
+func (t *resumeTracker) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+// stop waits for the tracker to be done with what was written to it
+func (t *resumeTracker) stop() {
+	t.w.Close()
+	<-t.done
+}
+
+// readGzipHeader reads the header of gzip data, without reading any further
+func readGzipHeader(r io.Reader) error {
+	var hdr [10]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return noEOF(err)
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return gzip.ErrHeader
+	}
+	flags := hdr[3]
+
+	if flags&gzipFlagExtra != 0 {
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return noEOF(err)
+		}
+		n := int64(binary.LittleEndian.Uint16(hdr[:2]))
+		if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+			return noEOF(err)
+		}
+	}
+	for _, flag := range []byte{gzipFlagName, gzipFlagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		// zero terminated
+		for hdr[0] = 1; hdr[0] != 0; {
+			if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+				return noEOF(err)
+			}
+		}
+	}
+	if flags&gzipFlagHCRC != 0 {
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+// imageReader reads an image, hashing it
+type imageReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (r *imageReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -15,6 +15,7 @@
 package installer
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
@@ -32,9 +33,40 @@ type UInstaller interface {
 	EnableUpdatedPartition() error
 }
 
+// UVerifier is implemented by installers able to check an installed image
+// against the checksum from the artifact manifest.
+type UVerifier interface {
+	VerifyUpdate(checksum []byte, size int64) error
+}
+
+// errImageInstalled stops the artifact reader once the image is installed
+// when resuming; see installResumed()
+var errImageInstalled = errors.New("installer: image installed")
+
 func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 	device UInstaller, acceptStateScripts bool) error {
 
+	return InstallResumable(art, dt, "", key, scrDir, device, acceptStateScripts, nil)
+}
+
+// InstallResumable installs the update like Install(), keeping track in `res`
+// of where installing it can be resumed from, and resuming from res.From if
+// set; nil `res` does neither. The artifact has to be named `name`, unless it
+// is empty.
+func InstallResumable(art io.ReadCloser, dt string, name string, key []byte,
+	scrDir string, device UInstaller, acceptStateScripts bool, res *Resumer) error {
+
+	if res.resuming() {
+		return installResumed(art, dt, name, key, scrDir, device,
+			acceptStateScripts, res)
+	}
+
+	if res != nil {
+		t := trackResumePoints(res)
+		defer t.stop()
+		art = ioutil.NopCloser(io.TeeReader(art, t))
+	}
+
 	rootfs := handlers.NewRootfsInstaller()
 
 	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
@@ -44,8 +76,96 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 			log.Errorf("update image installation failed: %v", err)
 			return err
 		}
+		return verifyUpdate(device, df)
+	}
+
+	ar, scr, err := newArtifactReader(art, rootfs, dt, name, key, scrDir,
+		acceptStateScripts)
+	if err != nil {
+		return err
+	}
+
+	// read the artifact
+	if err := ar.ReadArtifact(); err != nil {
+		return errors.Wrap(err, "installer: failed to read and install update")
+	}
+	return finalize(ar, scr)
+}
+
+// installResumed resumes installing the update from res.From. The artifact
+// reader is given the artifact up to the tar header of the image, to check
+// it; the rest of the image is then decompressed and installed from the
+// artifact here, picking up decompressing it where it was interrupted.
+func installResumed(art io.ReadCloser, dt string, name string, key []byte,
+	scrDir string, device UInstaller, acceptStateScripts bool, res *Resumer) error {
+
+	in := &artifactStream{r: art, seek: res.Seek}
+	head, err := readHead(in)
+	if err != nil {
+		return err
+	}
+	if head.data == nil {
+		return ErrNotResumable
+	}
+	data, err := openData(in, head, res)
+	if err != nil {
+		return err
+	}
+	stub, err := head.stub(data.header)
+	if err != nil {
+		return errors.Wrap(err, "installer: failed to read artifact")
+	}
+
+	rootfs := handlers.NewRootfsInstaller()
+
+	reached := false
+	rootfs.InstallHandler = func(r io.Reader, df *handlers.DataFile) error {
+		reached = true
+		if err := data.install(device, df); err != nil {
+			return err
+		}
+		return errImageInstalled
+	}
+
+	ar, scr, err := newArtifactReader(bytes.NewReader(stub), rootfs, dt, name,
+		key, scrDir, acceptStateScripts)
+	if err != nil {
+		return err
+	}
+
+	// read the artifact
+	if err := ar.ReadArtifact(); err != nil && errors.Cause(err) != errImageInstalled {
+		// the tar header of the image kept to resume does not fit the
+		// artifact if it is not reached
+		if !reached {
+			return errors.Wrapf(ErrNotResumable, "installer: %v", err)
+		}
+		return errors.Wrap(err, "installer: failed to read and install update")
+	}
+	if err := head.finish(in); err != nil {
+		return err
+	}
+	return finalize(ar, scr)
+}
+
+// verifyUpdate checks the image installed, if `device` is able to
+func verifyUpdate(device UInstaller, df *handlers.DataFile) error {
+	v, ok := device.(UVerifier)
+	if !ok {
 		return nil
 	}
+	if err := v.VerifyUpdate(df.Checksum, df.Size); err != nil {
+		log.Errorf("update image verification failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// newArtifactReader sets up reading the artifact from `art`, installing the
+// image with `rootfs`, and storing the state scripts in `scrDir`
+func newArtifactReader(art io.Reader, rootfs *handlers.Rootfs, dt string,
+	name string, key []byte, scrDir string,
+	acceptStateScripts bool) (*areader.Reader, *statescript.Store, error) {
 
 	var ar *areader.Reader
 	// if there is a verification key artifact must be signed
@@ -56,10 +176,15 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 	}
 
 	if err := ar.RegisterHandler(rootfs); err != nil {
-		return errors.Wrap(err, "failed to register install handler")
+		return nil, nil, errors.Wrap(err, "failed to register install handler")
 	}
 
 	ar.CompatibleDevicesCallback = func(devices []string) error {
+		// called once the header info is read, before anything is installed
+		if name != "" && ar.GetArtifactName() != name {
+			return errors.Errorf("installer: artifact name %q does not match "+
+				"the expected %q", ar.GetArtifactName(), name)
+		}
 		log.Debugf("checking if device [%s] is on compatibile device list: %v\n",
 			dt, devices)
 		if dt == "" {
@@ -98,7 +223,8 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 	if err := scr.Clear(); err != nil {
 		log.Errorf("installer: error initializing directory for scripts [%s]: %v",
 			scrDir, err)
-		return errors.Wrap(err, "installer: error initializing directory for scripts")
+		return nil, nil, errors.Wrap(err,
+			"installer: error initializing directory for scripts")
 	}
 
 	if acceptStateScripts {
@@ -114,11 +240,11 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 		}
 	}
 
-	// read the artifact
-	if err := ar.ReadArtifact(); err != nil {
-		return errors.Wrap(err, "installer: failed to read and install update")
-	}
+	return ar, scr, nil
+}
 
+// finalize finishes storing the state scripts of the artifact read
+func finalize(ar *areader.Reader, scr *statescript.Store) error {
 	if err := scr.Finalize(ar.GetInfo().Version); err != nil {
 		return errors.Wrap(err, "installer: error finalizing writing scripts")
 	}
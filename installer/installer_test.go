@@ -16,6 +16,8 @@ package installer
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"os"
@@ -108,6 +110,42 @@ func TestInstallWithScripts(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestInstallVerify(t *testing.T) {
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	dev := new(vDevice)
+	err = Install(art, "vexpress-qemu", nil, "", dev, true)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256(dev.data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), string(dev.checksum))
+	assert.Equal(t, int64(len(dev.data)), dev.size)
+
+	art, err = MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	dev = &vDevice{err: errors.New("mismatch")}
+	err = Install(art, "vexpress-qemu", nil, "", dev, true)
+	assert.Error(t, err)
+	assert.Contains(t, errors.Cause(err).Error(), "mismatch")
+}
+
+func TestInstallArtifactName(t *testing.T) {
+	art, err := MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	dev := new(vDevice)
+	err = InstallResumable(art, "vexpress-qemu", "mender-1.0", nil, "", dev, true, nil)
+	assert.Error(t, err)
+	assert.Contains(t, errors.Cause(err).Error(), `"mender-1.1" does not match`)
+	// nothing is written
+	assert.Nil(t, dev.data)
+
+	art, err = MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	err = InstallResumable(art, "vexpress-qemu", "mender-1.1", nil, "", dev, true, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, dev.data)
+}
+
 type fDevice struct{}
 
 func (d *fDevice) InstallUpdate(r io.ReadCloser, l int64) error {
@@ -117,6 +155,27 @@ func (d *fDevice) InstallUpdate(r io.ReadCloser, l int64) error {
 
 func (d *fDevice) EnableUpdatedPartition() error { return nil }
 
+// vDevice records what is installed and what it is verified against
+type vDevice struct {
+	fDevice
+	data     []byte
+	checksum []byte
+	size     int64
+	err      error
+}
+
+func (d *vDevice) InstallUpdate(r io.ReadCloser, l int64) error {
+	var err error
+	d.data, err = ioutil.ReadAll(r)
+	return err
+}
+
+func (d *vDevice) VerifyUpdate(checksum []byte, size int64) error {
+	d.checksum = checksum
+	d.size = size
+	return d.err
+}
+
 const (
 	PublicRSAKey = `-----BEGIN PUBLIC KEY-----
 MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDSTLzZ9hQq3yBB+dMDVbKem6ia
@@ -0,0 +1,102 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"sync"
+
+	"github.com/mendersoftware/mender/inflate"
+	"github.com/pkg/errors"
+)
+
+// ErrNotResumable is the cause of errors resuming an install of an artifact
+// other than the one installed before.
+var ErrNotResumable = errors.New("installer: artifact differs from the one being resumed")
+
+// ResumePoint is where installing an update can pick up again after being
+// interrupted: the start of a block of the compressed image, where
+// decompressing it can start over.
+type ResumePoint struct {
+	// offset of the compressed data file in the artifact, and how far
+	// decompressing it got by the point: bytes read from there, bits of the
+	// last of them not decoded yet, and bytes decompressed
+	Stream int64
+	In     int64
+	Bits   uint32
+	NBits  uint
+	Out    int64
+	// CRC-32 of the data decompressed, as gzip checks it in the end
+	CRC uint32
+	// tar header of the image, at the start of the data decompressed
+	Header []byte
+}
+
+// Image returns the offset of the image the point is at.
+func (p *ResumePoint) Image() int64 {
+	return p.Out - int64(len(p.Header))
+}
+
+// Resumer keeps track of where installing an update can be resumed from, and
+// resumes installing it; see InstallResumable().
+type Resumer struct {
+	// where to resume installing from, once `Written` bytes of the image
+	// were installed, with the state of their SHA-256 hash in `Checksum`;
+	// nil installs the update from the start
+	From     *ResumePoint
+	Written  int64
+	Checksum []byte
+	// ReadImage reads the image installed, at offset `off`, as
+	// decompressing picks up again with the data decompressed before
+	ReadImage func(p []byte, off int64) (int, error)
+	// Seek makes reading the artifact continue at `offset`; without it,
+	// or if it fails, the artifact is read up to there
+	Seek func(offset int64) error
+
+	lock   sync.Mutex
+	points []ResumePoint
+}
+
+// Point returns where to resume installing from once `written` bytes of the
+// image are installed, or nil if there is no such point yet.
+func (r *Resumer) Point(written int64) *ResumePoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i := 0
+	for i < len(r.points) && r.points[i].Image() <= written {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+	p := r.points[i-1]
+	// the ones before it are of no use any more
+	r.points = r.points[i-1:]
+	return &p
+}
+
+func (r *Resumer) add(p ResumePoint) {
+	// the data before the point is read back from the image to resume, so
+	// none of it may be from the tar header
+	if p.Image() < inflate.WindowSize {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.points = append(r.points, p)
+}
+
+func (r *Resumer) resuming() bool {
+	return r != nil && r.From != nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/inflate"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeImage returns `size` bytes of an image, compressible in parts
+func makeImage(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	image := make([]byte, 0, size)
+	for len(image) < size {
+		buf := make([]byte, rnd.Intn(256*1024)+1)
+		if rnd.Intn(2) == 0 {
+			rnd.Read(buf)
+		} else {
+			for i := range buf {
+				buf[i] = "mender update\n"[i%14]
+			}
+		}
+		image = append(image, buf...)
+	}
+	return image[:size]
+}
+
+func makeImageArtifact(t *testing.T, image []byte) []byte {
+	upd, err := MakeFakeUpdate(string(image))
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+	return art.Bytes()
+}
+
+// rDevice installs the image to memory, from `start` on, failing once `fail`
+// bytes of it are installed if set
+type rDevice struct {
+	fDevice
+	image []byte
+	start int64
+	fail  int64
+}
+
+func (d *rDevice) InstallUpdate(r io.ReadCloser, l int64) error {
+	if int64(len(d.image)) != l {
+		d.image = make([]byte, l)
+	}
+	off := d.start
+	for off < l {
+		end := l
+		if d.fail > 0 && end > d.fail {
+			end = d.fail
+		}
+		if off == end {
+			return errors.New("device failure")
+		}
+		n, err := r.Read(d.image[off:end])
+		off += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *rDevice) ReadImage(p []byte, off int64) (int, error) {
+	return bytes.NewReader(d.image).ReadAt(p, off)
+}
+
+// sReader reads an artifact, counting the bytes read and seeked over
+type sReader struct {
+	*bytes.Reader
+	read   int64
+	seeked int64
+}
+
+func (r *sReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *sReader) seekTo(offset int64) error {
+	cur, _ := r.Reader.Seek(0, io.SeekCurrent)
+	r.seeked += offset - cur
+	_, err := r.Reader.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (r *sReader) Close() error {
+	return nil
+}
+
+// interruptedInstall installs `art` up to `written` bytes of the image,
+// returning how to resume it
+func interruptedInstall(t *testing.T, art []byte, written int64) (*rDevice, *Resumer) {
+	dev := &rDevice{fail: written}
+	res := new(Resumer)
+	err := InstallResumable(&sReader{Reader: bytes.NewReader(art)}, "vexpress-qemu",
+		"", nil, "", dev, true, res)
+	assert.Error(t, err)
+
+	from := res.Point(written)
+	assert.NotNil(t, from)
+	h := sha256.New()
+	h.Write(dev.image[:written])
+	checksum, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	assert.NoError(t, err)
+
+	dev.start = written
+	dev.fail = 0
+	return dev, &Resumer{
+		From:      from,
+		Written:   written,
+		Checksum:  checksum,
+		ReadImage: dev.ReadImage,
+	}
+}
+
+func TestInstallResumable(t *testing.T) {
+	image := makeImage(8*1024*1024, 1)
+	art := makeImageArtifact(t, image)
+
+	// uninterrupted
+	dev := new(rDevice)
+	res := new(Resumer)
+	err := InstallResumable(&rc{bytes.NewBuffer(art)}, "vexpress-qemu", "", nil, "",
+		dev, true, res)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(image, dev.image))
+	assert.Nil(t, res.Point(inflate.WindowSize))
+	assert.NotNil(t, res.Point(int64(len(image))))
+
+	written := int64(6 * 1024 * 1024)
+
+	// seeking over the data installed already
+	dev, res = interruptedInstall(t, art, written)
+	r := &sReader{Reader: bytes.NewReader(art)}
+	res.Seek = r.seekTo
+	err = InstallResumable(r, "vexpress-qemu", "", nil, "", dev, true, res)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(image, dev.image))
+	assert.True(t, r.seeked > int64(len(art))/2, "seeked over %d bytes", r.seeked)
+	assert.True(t, r.read < int64(len(art))/2, "read %d bytes", r.read)
+
+	// reading up to it without seeking
+	dev, res = interruptedInstall(t, art, written)
+	r = &sReader{Reader: bytes.NewReader(art)}
+	err = InstallResumable(r, "vexpress-qemu", "", nil, "", dev, true, res)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(image, dev.image))
+	assert.Equal(t, int64(len(art)), r.read)
+
+	// resuming with the hash of other data than written before
+	dev, res = interruptedInstall(t, art, written)
+	h := sha256.New()
+	h.Write(make([]byte, written))
+	res.Checksum, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+	assert.NoError(t, err)
+	err = InstallResumable(&sReader{Reader: bytes.NewReader(art)}, "vexpress-qemu",
+		"", nil, "", dev, true, res)
+	assert.Error(t, err)
+	assert.Equal(t, ErrNotResumable, errors.Cause(err))
+}
+
+func TestInstallResumableOtherArtifact(t *testing.T) {
+	image := makeImage(4*1024*1024, 1)
+	art := makeImageArtifact(t, image)
+	written := int64(3 * 1024 * 1024)
+
+	// the same size, but other data
+	other := makeImage(len(image), 2)
+	dev, res := interruptedInstall(t, art, written)
+	err := InstallResumable(&sReader{Reader: bytes.NewReader(makeImageArtifact(t, other))},
+		"vexpress-qemu", "", nil, "", dev, true, res)
+	assert.Error(t, err)
+	assert.Equal(t, ErrNotResumable, errors.Cause(err))
+
+	// other size
+	other = makeImage(len(image)+1, 1)
+	dev, res = interruptedInstall(t, art, written)
+	err = InstallResumable(&sReader{Reader: bytes.NewReader(makeImageArtifact(t, other))},
+		"vexpress-qemu", "", nil, "", dev, true, res)
+	assert.Error(t, err)
+	assert.Equal(t, ErrNotResumable, errors.Cause(err))
+
+	// a small image
+	upd, err := MakeRootfsImageArtifact(2, false, false)
+	assert.NoError(t, err)
+	_, res = interruptedInstall(t, art, written)
+	err = InstallResumable(upd, "vexpress-qemu", "", nil, "", new(fDevice), true, res)
+	assert.Error(t, err)
+	assert.Equal(t, ErrNotResumable, errors.Cause(err))
+}
+
+func TestResumerPoint(t *testing.T) {
+	res := new(Resumer)
+	assert.Nil(t, res.Point(1<<30))
+
+	hdr := make([]byte, 512)
+	for _, image := range []int64{0, 1, 2, 3} {
+		res.add(ResumePoint{Out: image*inflate.WindowSize + 512, Header: hdr})
+	}
+	// the first has no window of data before it
+	assert.Nil(t, res.Point(inflate.WindowSize-1))
+	assert.Equal(t, int64(inflate.WindowSize), res.Point(inflate.WindowSize).Image())
+	assert.Equal(t, int64(2*inflate.WindowSize), res.Point(3*inflate.WindowSize-1).Image())
+	// older points are dropped
+	assert.Nil(t, res.Point(inflate.WindowSize))
+	assert.Equal(t, int64(3*inflate.WindowSize), res.Point(1<<30).Image())
+}
+
+func TestInstallResumableDataFiles(t *testing.T) {
+	image := makeImage(1024*1024, 1)
+	upd, err := MakeFakeUpdate(string(image))
+	assert.NoError(t, err)
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	updates := &awriter.Updates{U: []handlers.Composer{
+		handlers.NewRootfsV2(upd), handlers.NewRootfsV2(upd)}}
+	err = aw.WriteArtifact("mender", 2, []string{"vexpress-qemu"},
+		"mender-1.1", updates, nil)
+	assert.NoError(t, err)
+
+	// installed by the artifact reader, while tracking where to resume from
+	dev := new(rDevice)
+	err = InstallResumable(&rc{bytes.NewBuffer(art.Bytes())}, "vexpress-qemu", "",
+		nil, "", dev, true, new(Resumer))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(image, dev.image))
+}
@@ -86,7 +86,7 @@ func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
 			continue
 		}
 
-		p := utils.KeyValParser{}
+		p := utils.TypedKeyValParser{}
 		if err := p.Parse(out); err != nil {
 			log.Warnf("inventory tool %s returned unparsable output: %v", t, err)
 			continue
@@ -96,7 +96,7 @@ func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
 			log.Warnf("inventory tool %s wait failed: %v", t, err)
 		}
 
-		idec.AppendFromRaw(p.Collect())
+		idec.AppendFromTyped(p.Collect())
 	}
 	return idec.GetInventoryData(), nil
 }
@@ -122,33 +122,66 @@ func (id *InventoryDataDecoder) GetInventoryData() client.InventoryData {
 	return idata
 }
 
+// AppendFromRaw appends plain string values, as collected by
+// utils.KeyValParser.
 func (id *InventoryDataDecoder) AppendFromRaw(raw map[string][]string) {
+	typed := make(map[string][]interface{}, len(raw))
+	for k, v := range raw {
+		vals := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			vals = append(vals, s)
+		}
+		typed[k] = vals
+	}
+	id.AppendFromTyped(typed)
+}
+
+// AppendFromTyped appends values collected by utils.TypedKeyValParser. Values
+// of an attribute that already exists are merged into a list. A list made
+// only of strings is kept as []string, which is what the backend has always
+// received for plain 'key=value' entries.
+func (id *InventoryDataDecoder) AppendFromTyped(raw map[string][]interface{}) {
 	for k, v := range raw {
 		if data, ok := id.data[k]; ok {
-			var newVal []string
-			switch data.Value.(type) {
-			case string:
-				newVal = []string{data.Value.(string)}
-			case []string:
-				newVal = data.Value.([]string)
-			}
-			newVal = append(newVal, v...)
-			id.data[k] = client.InventoryAttribute{
-				Name:  k,
-				Value: newVal,
-			}
-		} else {
-			if len(v) == 1 {
-				id.data[k] = client.InventoryAttribute{
-					Name:  k,
-					Value: v[0],
-				}
-			} else {
-				id.data[k] = client.InventoryAttribute{
-					Name:  k,
-					Value: v,
-				}
-			}
+			v = append(inventoryValues(data.Value), v...)
+		}
+		id.data[k] = client.InventoryAttribute{
+			Name:  k,
+			Value: inventoryValue(v),
+		}
+	}
+}
+
+// inventoryValues unpacks the value of an inventory attribute into a list
+func inventoryValues(val interface{}) []interface{} {
+	switch v := val.(type) {
+	case []string:
+		vals := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			vals = append(vals, s)
+		}
+		return vals
+	case []interface{}:
+		return append([]interface{}{}, v...)
+	default:
+		return []interface{}{v}
+	}
+}
+
+// inventoryValue packs a list of values into a single inventory attribute
+// value
+func inventoryValue(vals []interface{}) interface{} {
+	if len(vals) == 1 {
+		return vals[0]
+	}
+
+	strs := make([]string, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			return vals
 		}
+		strs = append(strs, s)
 	}
+	return strs
 }
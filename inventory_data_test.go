@@ -14,6 +14,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/mendersoftware/mender/client"
@@ -50,3 +51,36 @@ func TestInventoryDataDecoder(t *testing.T) {
 	assert.Contains(t, idata, client.InventoryAttribute{"foo", []string{"bar", "baz"}})
 	assert.Contains(t, idata, client.InventoryAttribute{"bar", "zen"})
 }
+
+func TestInventoryDataDecoderTyped(t *testing.T) {
+	idec := NewInventoryDataDecoder()
+
+	idec.AppendFromTyped(map[string][]interface{}{
+		"mem_total_kB": {int64(1024)},
+		"rootfs_ro":    {true},
+		"ifaces":       {"eth0"},
+	})
+	idec.AppendFromRaw(map[string][]string{
+		"ifaces": {"wlan0"},
+	})
+	idec.AppendFromTyped(map[string][]interface{}{
+		"load": {0.5, int64(1)},
+	})
+
+	idata := idec.GetInventoryData()
+	assert.Len(t, idata, 4)
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "mem_total_kB", Value: int64(1024)})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "rootfs_ro", Value: true})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "ifaces", Value: []string{"eth0", "wlan0"}})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "load", Value: []interface{}{0.5, int64(1)}})
+
+	// types must be carried through to the submitted JSON
+	for _, ia := range idata {
+		if ia.Name != "mem_total_kB" {
+			continue
+		}
+		data, err := json.Marshal(ia)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"name": "mem_total_kB", "value": 1024}`, string(data))
+	}
+}
@@ -115,6 +115,54 @@ func ioctlWrite(fd uintptr, request ioctlRequestValue, data int64) error {
 	return nil
 }
 
+// from <linux/falloc.h>
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// discardRange discards `length` bytes from `start` of the block device, with
+// BLKDISCARD or BLKSECDISCARD if `secure` is set.
+func discardRange(file *os.File, start, length uint64, secure bool) error {
+	request := BLKDISCARD
+	if secure {
+		request = BLKSECDISCARD
+	}
+	r := [2]uint64{start, length}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(),
+		uintptr(request),
+		uintptr(unsafe.Pointer(&r)))
+
+	if errno == syscall.ENOTTY {
+		return NotABlockDevice
+	} else if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// punchHole deallocates `length` bytes from `start` of the regular file,
+// keeping its size.
+func punchHole(file *os.File, start, length int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize,
+		start, length)
+}
+
+// clearDirectIO turns O_DIRECT off for further I/O on `file`.
+func clearDirectIO(file *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(),
+		syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, file.Fd(),
+		syscall.F_SETFL, flags&^syscall.O_DIRECT)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func getBlockDeviceSectorSize(file *os.File) (int, error) {
 	var sectorSize int
 
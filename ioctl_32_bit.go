@@ -21,6 +21,8 @@ const UBI_IOCVOLUP ioctlRequestValue = 0x40084f00
 
 // Taken from <linux/fs.h>
 const BLKSSZGET ioctlRequestValue = 0x00001268
+const BLKDISCARD ioctlRequestValue = 0x00001277
+const BLKSECDISCARD ioctlRequestValue = 0x0000127d
 
 // Taken from <sys/mount.h>
 const BLKGETSIZE64 ioctlRequestValue = 0x80041272
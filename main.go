@@ -16,6 +16,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -39,23 +41,31 @@ type logOptionsType struct {
 }
 
 type runOptionsType struct {
-	version         *bool
-	config          *string
-	dataStore       *string
-	imageFile       *string
-	runStateScripts *bool
-	commit          *bool
-	bootstrap       *bool
-	daemon          *bool
-	bootstrapForce  *bool
+	version            *bool
+	config             *string
+	dataStore          *string
+	imageFile          *string
+	runStateScripts    *bool
+	commit             *bool
+	bootstrap          *bool
+	daemon             *bool
+	gateway            *bool
+	simulate           *string
+	simulateFail       *string
+	simulateScripts    *string
+	simulateRunScripts *bool
+	bootstrapForce     *bool
+	showConfig         *bool
+	checkConfig        *bool
+	warnUnknownKeys    *bool
 	client.Config
 }
 
 var (
 	errMsgNoArgumentsGiven = errors.New("Must give one of -rootfs, " +
-		"-commit, -bootstrap or -daemon arguments")
+		"-commit, -bootstrap, -daemon, -gateway or -simulate arguments")
 	errMsgAmbiguousArgumentsGiven = errors.New("Ambiguous parameters given " +
-		"- must give exactly one from: -rootfs, -commit, -bootstrap, -authorize or -daemon")
+		"- must give exactly one from: -rootfs, -commit, -bootstrap, -authorize, -daemon, -gateway or -simulate")
 	errMsgIncompatibleLogOptions = errors.New("One or more " +
 		"incompatible log log options specified.")
 )
@@ -111,6 +121,34 @@ func argsParse(args []string) (runOptionsType, error) {
 
 	daemon := parsing.Bool("daemon", false, "Run as a daemon.")
 
+	gateway := parsing.Bool("gateway", false,
+		"Serve the device API to devices without access to the server, "+
+			"caching their artifacts.")
+
+	simulate := parsing.String("simulate", "",
+		"Simulate installing the given artifact, showing the states and "+
+			"state scripts a device would go through.")
+
+	simulateFail := parsing.String("simulate-fail", "",
+		"Comma separated failures to inject when simulating: download, "+
+			"install, enable, reboot, boot, commit, rollback, report or "+
+			"the scripts of a state, e.g. ArtifactCommit_Enter.")
+
+	simulateScripts := parsing.String("simulate-scripts", "",
+		"Directory with the rootfs state scripts to simulate with.")
+
+	simulateRunScripts := parsing.Bool("simulate-run-scripts", false,
+		"Run the state scripts when simulating, instead of only listing them.")
+
+	showConfig := parsing.Bool("show-config", false,
+		"Show effective configuration, with the origin of each value, and exit.")
+
+	checkConfig := parsing.Bool("check-config", false,
+		"Validate configuration and exit. Returns (1) if there are any errors.")
+
+	warnUnknownKeys := parsing.Bool("warn-unknown-config-keys", false,
+		"Treat unknown configuration keys as warnings instead of errors.")
+
 	// add bootstrap related command line options
 	serverCert := parsing.String("trusted-certs", "", "Trusted server certificates")
 	forcebootstrap := parsing.Bool("forcebootstrap", false, "Force bootstrap")
@@ -126,15 +164,23 @@ func argsParse(args []string) (runOptionsType, error) {
 	}
 
 	runOptions := runOptionsType{
-		version:         version,
-		config:          config,
-		dataStore:       data,
-		imageFile:       imageFile,
-		runStateScripts: forceStateScripts,
-		commit:          commit,
-		bootstrap:       bootstrap,
-		daemon:          daemon,
-		bootstrapForce:  forcebootstrap,
+		version:            version,
+		config:             config,
+		dataStore:          data,
+		imageFile:          imageFile,
+		runStateScripts:    forceStateScripts,
+		commit:             commit,
+		bootstrap:          bootstrap,
+		daemon:             daemon,
+		gateway:            gateway,
+		simulate:           simulate,
+		simulateFail:       simulateFail,
+		simulateScripts:    simulateScripts,
+		simulateRunScripts: simulateRunScripts,
+		bootstrapForce:     forcebootstrap,
+		showConfig:         showConfig,
+		checkConfig:        checkConfig,
+		warnUnknownKeys:    warnUnknownKeys,
 		Config: client.Config{
 			ServerCert: *serverCert,
 			NoVerify:   *skipVerify,
@@ -175,6 +221,12 @@ func moreThanOneRunOptionSelected(runOptions runOptionsType) bool {
 	if *runOptions.daemon {
 		runOptionsCount++
 	}
+	if *runOptions.gateway {
+		runOptionsCount++
+	}
+	if *runOptions.simulate != "" {
+		runOptionsCount++
+	}
 
 	if runOptionsCount > 1 {
 		return true
@@ -358,6 +410,10 @@ func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 		controller.ForceBootstrap()
 	}
 
+	if err := controller.ServePeers(); err != nil {
+		log.Errorf("artifacts will not be shared with peers: %v", err)
+	}
+
 	daemon := NewDaemon(controller, mp.store)
 
 	// add logging hook; only daemon needs this
@@ -366,6 +422,69 @@ func initDaemon(config *menderConfig, dev *device, env BootEnvReadWriter,
 	return daemon, nil
 }
 
+func doGateway(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	if *opts.bootstrapForce {
+		controller.ForceBootstrap()
+	}
+
+	gw, err := newGateway(controller, *opts.dataStore)
+	if err != nil {
+		return err
+	}
+	ln, err := gw.listen()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go gw.authorize()
+
+	log.Infof("serving devices on %s", ln.Addr())
+	return http.Serve(ln, gw)
+}
+
+func doCheckConfig(out io.Writer, config *menderConfig, files []string,
+	warnUnknown bool) error {
+
+	problems := CheckConfig(config, files, warnUnknown)
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+
+	if n := problems.Errors(); n > 0 {
+		return errors.Errorf("configuration is invalid, found %d error(s)", n)
+	}
+	fmt.Fprintln(out, "configuration is valid")
+	return nil
+}
+
+// reloadConfig reads configuration of the running daemon again
+func reloadConfig(confFile, overlayFile string) (*menderConfig, error) {
+	config, _, err := LoadConfig(confFile, overlayFile)
+	if err != nil {
+		return nil, err
+	}
+	problems := CheckConfig(config, configFiles(confFile, overlayFile), true)
+	for _, problem := range problems {
+		log.Warnf("configuration problem: %s", problem.msg)
+	}
+	if n := problems.Errors(); n > 0 {
+		return nil, errors.Errorf("configuration is invalid, found %d error(s)", n)
+	}
+	return config, nil
+}
+
 func doMain(args []string) error {
 	runOptions, err := argsParse(args)
 	if err != nil {
@@ -377,11 +496,31 @@ func doMain(args []string) error {
 		return nil
 	}
 
-	config, err := LoadConfig(*runOptions.config)
+	overlayFile := path.Join(*runOptions.dataStore, configOverlayName)
+	config, sources, err := LoadConfig(*runOptions.config, overlayFile)
+
+	if *runOptions.checkConfig {
+		if err != nil {
+			// still report all problems with the files
+			config = &menderConfig{}
+		}
+		return doCheckConfig(os.Stdout, config,
+			configFiles(*runOptions.config, overlayFile), *runOptions.warnUnknownKeys)
+	}
+
 	if err != nil {
 		return err
 	}
 
+	if *runOptions.showConfig {
+		return ShowConfig(os.Stdout, config, sources)
+	}
+
+	for _, problem := range CheckConfig(config,
+		configFiles(*runOptions.config, overlayFile), true) {
+		log.Warnf("configuration problem: %s", problem.msg)
+	}
+
 	if runOptions.Config.NoVerify {
 		config.HttpsClient.SkipVerify = true
 	}
@@ -412,10 +551,25 @@ func doMain(args []string) error {
 			return err
 		}
 		defer d.Cleanup()
+		stopSignals := d.HandleSignals(func() (*menderConfig, error) {
+			config, err := reloadConfig(*runOptions.config, overlayFile)
+			if err == nil && runOptions.Config.NoVerify {
+				config.HttpsClient.SkipVerify = true
+			}
+			return config, err
+		})
+		defer stopSignals()
 		return d.Run()
 
+	case *runOptions.gateway:
+		return doGateway(config, &runOptions)
+
+	case *runOptions.simulate != "":
+		return doSimulate(config, &runOptions)
+
 	case *runOptions.imageFile == "" && !*runOptions.commit &&
-		!*runOptions.daemon && !*runOptions.bootstrap:
+		!*runOptions.daemon && !*runOptions.bootstrap && !*runOptions.gateway &&
+		*runOptions.simulate == "":
 		return errMsgNoArgumentsGiven
 	}
 
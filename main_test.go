@@ -201,6 +201,71 @@ func writeConfig(t *testing.T, path string, conf menderConfig) {
 	assert.NoError(t, err)
 }
 
+func TestMainShowConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	cpath := path.Join(tdir, "mender.config")
+	writeConfig(t, cpath, menderConfig{
+		ServerURL: "https://foo",
+	})
+
+	err = doMain([]string{"-data", tdir, "-config", cpath, "-show-config"})
+	assert.NoError(t, err)
+
+	// main configuration file is still mandatory
+	err = doMain([]string{"-data", tdir, "-config", path.Join(tdir, "missing"),
+		"-show-config"})
+	assert.Error(t, err)
+}
+
+func TestMainCheckConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	cpath := path.Join(tdir, "mender.config")
+	assert.NoError(t, ioutil.WriteFile(cpath, []byte(`{
+  "ServerURL": "https://foo",
+  "RootfsPartA": "/dev/foo",
+  "RootfsPartB": "/dev/foo",
+  "UpdatePollIntervalSecond": 10
+}`), 0644))
+
+	err = doMain([]string{"-data", tdir, "-config", cpath, "-check-config"})
+	assert.Error(t, err)
+
+	out := &bytes.Buffer{}
+	config, _, err := LoadConfig(cpath, "")
+	assert.NoError(t, err)
+	err = doCheckConfig(out, config, []string{cpath}, true)
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), `warning: `+cpath+`: unknown key "UpdatePollIntervalSecond"`)
+	assert.Contains(t, out.String(), "error: RootfsPartA, RootfsPartB: must be different")
+
+	// broken main file is reported as well
+	assert.NoError(t, ioutil.WriteFile(cpath, []byte(`{"ServerURL": `), 0644))
+	out.Reset()
+	err = doCheckConfig(out, &menderConfig{}, []string{cpath}, false)
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "error: "+cpath)
+
+	writeConfig(t, cpath, menderConfig{
+		ServerURL:   "https://foo",
+		RootfsPartA: cpath,
+		RootfsPartB: path.Join(tdir, "mender.conf"),
+	})
+	err = doMain([]string{"-data", tdir, "-config", cpath, "-check-config"})
+	assert.NoError(t, err)
+	out.Reset()
+	config, _, err = LoadConfig(cpath, "")
+	assert.NoError(t, err)
+	err = doCheckConfig(out, config, []string{cpath}, false)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "configuration is valid")
+}
+
 func writeFakeIdentityHelper(t *testing.T, path string, script string) {
 	f, err := os.Create(path)
 	assert.NoError(t, err)
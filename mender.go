@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -54,12 +55,26 @@ type Controller interface {
 	GetUpdatePollInterval() time.Duration
 	GetInventoryPollInterval() time.Duration
 	GetRetryPollInterval() time.Duration
+	GetStatusReportFailurePolicy() string
 	HasUpgrade() (bool, menderError)
 	CheckUpdate() (*client.UpdateResponse, menderError)
-	FetchUpdate(url string) (io.ReadCloser, int64, error)
+	PreflightUpdate(update client.UpdateResponse) menderError
+	FetchUpdate(update client.UpdateResponse) (io.ReadCloser, int64, error)
+	FetchUpdateFromPeers(update client.UpdateResponse) (io.ReadCloser, int64, error)
+	ShareUpdate(update client.UpdateResponse) error
+	ResumeUpdate(from io.ReadCloser, size int64, name string, cp *InstallCheckpoint,
+		save func(InstallCheckpoint) error) error
+	IsMeteredConnection() bool
 	ReportUpdateStatus(update client.UpdateResponse, status string) menderError
 	UploadLog(update client.UpdateResponse, logs []byte) menderError
 	InventoryRefresh() error
+	DeviceConfigRefresh() (bool, error)
+	ListenNotifications() (<-chan client.Notification, func())
+	LocalNotifications() <-chan client.Notification
+	Notify(note client.Notification) bool
+	ReloadConfig(config menderConfig) error
+	WatchMedia() (<-chan string, func())
+	CheckMediaUpdate(dir string) (*client.UpdateResponse, menderError)
 	CheckScriptsCompatibility() error
 
 	UInstallCommitRebooter
@@ -95,6 +110,8 @@ const (
 	MenderStateCheckWait
 	// check update
 	MenderStateUpdateCheck
+	// check inserted media for update
+	MenderStateMediaUpdateCheck
 	// update fetch
 	MenderStateUpdateFetch
 	// update store
@@ -104,6 +121,8 @@ const (
 	// wait before retrying fetch & install after first failing (timeout,
 	// for example)
 	MenderStateFetchStoreRetryWait
+	// wait for a connection that is not metered before fetching update
+	MenderStateFetchMeteredWait
 	// varify update
 	MenderStateUpdateVerify
 	// commit needed
@@ -141,10 +160,12 @@ var (
 		MenderStateInventoryUpdate:     "inventory-update",
 		MenderStateCheckWait:           "check-wait",
 		MenderStateUpdateCheck:         "update-check",
+		MenderStateMediaUpdateCheck:    "media-update-check",
 		MenderStateUpdateFetch:         "update-fetch",
 		MenderStateUpdateStore:         "update-store",
 		MenderStateUpdateInstall:       "update-install",
 		MenderStateFetchStoreRetryWait: "fetch-install-retry-wait",
+		MenderStateFetchMeteredWait:    "fetch-metered-wait",
 		MenderStateUpdateVerify:        "update-verify",
 		MenderStateUpdateCommit:        "update-commit",
 		MenderStateUpdateStatusReport:  "update-status-report",
@@ -191,6 +212,9 @@ func (m *MenderState) UnmarshalJSON(data []byte) error {
 type mender struct {
 	UInstallCommitRebooter
 	updater             client.Updater
+	statusReporter      client.StatusReporter
+	logUploader         client.LogUploader
+	inventorySubmitter  client.InventorySubmitter
 	state               State
 	stateScriptExecutor statescript.Executor
 	stateScriptPath     string
@@ -201,7 +225,19 @@ type mender struct {
 	authReq             client.AuthRequester
 	authMgr             AuthManager
 	api                 *client.ApiClient
+	servers             *serverPool
+	serverURL           string
 	authToken           client.AuthToken
+	store               store.Store
+	deviceConfig        client.DeviceConfigurer
+	notifier            client.Notifier
+	peerCache           *peerCache
+	media               *mediaTracker
+	localNotes          chan client.Notification
+	// see trackProgress()
+	progress func()
+	// see trackContact()
+	contacted func()
 }
 
 type MenderPieces struct {
@@ -216,6 +252,11 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 		return nil, errors.Wrap(err, "error creating HTTP client")
 	}
 
+	servers, err := newServerPool(config)
+	if err != nil {
+		return nil, err
+	}
+
 	stateScrExec := statescript.Launcher{
 		ArtScriptsPath:          defaultArtScriptsPath,
 		RootfsScriptsPath:       defaultRootfsScriptsPath,
@@ -228,6 +269,9 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 	m := &mender{
 		UInstallCommitRebooter: pieces.device,
 		updater:                client.NewUpdate(),
+		statusReporter:         client.NewStatus(),
+		logUploader:            client.NewLog(),
+		inventorySubmitter:     client.NewInventory(),
 		artifactInfoFile:       defaultArtifactInfoFile,
 		deviceTypeFile:         defaultDeviceTypeFile,
 		state:                  initState,
@@ -235,9 +279,37 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 		authMgr:                pieces.authMgr,
 		authReq:                client.NewAuth(),
 		api:                    api,
+		servers:                servers,
+		serverURL:              servers.servers[0].url,
 		authToken:              noAuthToken,
 		stateScriptExecutor:    stateScrExec,
 		stateScriptPath:        defaultArtScriptsPath,
+		store:                  pieces.store,
+		deviceConfig:           client.NewDeviceConfig(),
+		notifier:               client.NewNotify(),
+		media:                  newMediaTracker(),
+		localNotes:             make(chan client.Notification, 1),
+	}
+
+	if err := m.setupTransport(); err != nil {
+		return nil, err
+	}
+	if cd, ok := m.updater.(client.ConcurrentDownloader); ok {
+		cd.SetDownloadConcurrency(config.DownloadConcurrency)
+	}
+
+	if config.PeerSharing.Enabled && config.PeerSharing.ListenAddress != "" {
+		dir := config.PeerSharing.Directory
+		if dir == "" {
+			dir = defaultDataStore
+		}
+		m.peerCache = newPeerCache(dir)
+	}
+
+	if m.store != nil {
+		if err := m.loadDeviceConfig(); err != nil {
+			log.Errorf("error loading device configuration: %v", err)
+		}
 	}
 
 	if m.authMgr != nil {
@@ -249,6 +321,40 @@ func NewMender(config menderConfig, pieces MenderPieces) (*mender, error) {
 	return m, nil
 }
 
+// ReloadConfig switches to `config` read again from the configuration files;
+// the device configuration received from the server still applies on top of
+// it. Changing the transport requires a restart.
+func (m *mender) ReloadConfig(config menderConfig) error {
+	if config.Transport != m.config.Transport {
+		return errors.New("changing Transport requires a restart")
+	}
+	api, err := client.New(config.GetHttpConfig())
+	if err != nil {
+		return errors.Wrap(err, "error creating HTTP client")
+	}
+
+	previous := m.config
+	m.config = config
+	if m.store != nil {
+		if err := m.loadDeviceConfig(); err != nil {
+			m.config = previous
+			return errors.Wrap(err, "error loading device configuration")
+		}
+	}
+	m.api = api
+
+	if l, ok := m.stateScriptExecutor.(statescript.Launcher); ok {
+		l.Timeout = config.StateScriptTimeoutSeconds
+		l.RetryTimeout = config.StateScriptRetryIntervalSeconds
+		l.RetryInterval = config.StateScriptRetryTimeoutSeconds
+		m.stateScriptExecutor = l
+	}
+	if cd, ok := m.updater.(client.ConcurrentDownloader); ok {
+		cd.SetDownloadConcurrency(config.DownloadConcurrency)
+	}
+	return nil
+}
+
 func getManifestData(dataType, manifestFile string) (string, error) {
 	// This is where Yocto stores buid information
 	manifest, err := os.Open(manifestFile)
@@ -331,7 +437,8 @@ func (m *mender) Bootstrap() menderError {
 	return m.doBootstrap()
 }
 
-// cache authorization code
+// cache authorization code; the token is switched along with the server in
+// use, so m.servers.lock has to be held once the client is in use
 func (m *mender) loadAuth() menderError {
 	if m.authToken != noAuthToken {
 		return nil
@@ -346,10 +453,27 @@ func (m *mender) loadAuth() menderError {
 	return nil
 }
 
+// cacheAuth caches authorization code like loadAuth(), holding m.servers.lock
+func (m *mender) cacheAuth() menderError {
+	m.servers.lock.Lock()
+	defer m.servers.lock.Unlock()
+	return m.loadAuth()
+}
+
+// dropAuthToken stops using the cached authorization code
+func (m *mender) dropAuthToken() {
+	m.servers.lock.Lock()
+	defer m.servers.lock.Unlock()
+	m.authToken = noAuthToken
+}
+
 func (m *mender) IsAuthorized() bool {
+	// make sure we look at the token of the server in use
+	m.server()
+
 	if m.authMgr.IsAuthorized() {
 		log.Info("authorization data present and valid")
-		if err := m.loadAuth(); err != nil {
+		if err := m.cacheAuth(); err != nil {
 			return false
 		}
 		return true
@@ -358,9 +482,15 @@ func (m *mender) IsAuthorized() bool {
 }
 
 func (m *mender) Authorize() menderError {
+	server, api := m.server()
+
 	if m.authMgr.IsAuthorized() {
 		log.Info("authorization data present and valid, skipping authorization attempt")
-		return m.loadAuth()
+		if err := m.cacheAuth(); err != nil {
+			return err
+		}
+		m.deviceConfigAuthorized()
+		return nil
 	}
 
 	if err := m.Bootstrap(); err != nil {
@@ -368,9 +498,9 @@ func (m *mender) Authorize() menderError {
 		return err
 	}
 
-	m.authToken = noAuthToken
+	m.dropAuthToken()
 
-	rsp, err := m.authReq.Request(m.api, m.config.ServerURL, m.authMgr)
+	rsp, err := m.authReq.Request(api, server, m.authMgr)
 	if err != nil {
 		if err == client.AuthErrorUnauthorized {
 			// make sure to remove auth token once device is rejected
@@ -378,17 +508,24 @@ func (m *mender) Authorize() menderError {
 				log.Warn("can not remove rejected authentication token")
 			}
 		}
+		m.deviceConfigAuthFailed(err)
 		return NewTransientError(errors.Wrap(err, "authorization request failed"))
 	}
 
 	err = m.authMgr.RecvAuthResponse(rsp)
 	if err != nil {
+		m.deviceConfigAuthFailed(err)
 		return NewTransientError(errors.Wrap(err, "failed to parse authorization response"))
 	}
 
 	log.Info("successfuly received new authorization data")
+	m.serverContacted()
 
-	return m.loadAuth()
+	if err := m.cacheAuth(); err != nil {
+		return err
+	}
+	m.deviceConfigAuthorized()
+	return nil
 }
 
 func (m *mender) doBootstrap() menderError {
@@ -405,8 +542,130 @@ func (m *mender) doBootstrap() menderError {
 	return nil
 }
 
-func (m *mender) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+func (m *mender) FetchUpdate(update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	if isMediaUpdate(update) {
+		return openMediaArtifact(update.URI())
+	}
+	in, size, err := m.fetchUpdate(update.URI(), update.Expire(),
+		func() (string, time.Time, error) {
+			return m.refreshUpdateURI(update)
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return m.watchMetered(in), size, nil
+}
+
+// fetchUpdate downloads the artifact at `url`, switching to links obtained
+// with `refresh` once it expires at `expire` or is refused; nil `refresh`
+// sticks to `url`
+func (m *mender) fetchUpdate(url string, expire time.Time,
+	refresh client.RefreshFunc) (io.ReadCloser, int64, error) {
+
+	in, size, err := m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+	if errors.Cause(err) == client.ErrDownloadForbidden && refresh != nil {
+		log.Info("artifact download was refused, requesting a new link")
+		if url, expire, err = refresh(); err != nil {
+			return nil, 0, err
+		}
+		in, size, err = m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if r, ok := in.(client.Refresher); ok && refresh != nil {
+		r.SetRefresh(expire, refresh)
+	}
+	if limit := m.config.GetRateLimit(); limit != nil {
+		in = client.NewThrottledReader(in, limit)
+	}
+	return in, size, nil
+}
+
+// refreshUpdateURI asks the server for a new link to the artifact of `update`,
+// as links may expire before a long download is over
+func (m *mender) refreshUpdateURI(update client.UpdateResponse) (string, time.Time, error) {
+	fresh, merr := m.CheckUpdate()
+	if merr != nil {
+		return "", time.Time{}, merr
+	}
+	if fresh == nil || fresh.ID != update.ID ||
+		fresh.ArtifactName() != update.ArtifactName() {
+		return "", time.Time{}, errors.Errorf("deployment %s is no longer pending",
+			update.ID)
+	}
+	return fresh.URI(), fresh.Expire(), nil
+}
+
+// FetchUpdateFromPeers tries to download the artifact of `update` from the
+// configured peers, in order
+func (m *mender) FetchUpdateFromPeers(update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	conf := m.config.PeerSharing
+	if !conf.Enabled || len(conf.Peers) == 0 {
+		return nil, 0, errors.New("no peers configured")
+	}
+	if isMediaUpdate(update) {
+		return nil, 0, errors.New("artifact is on media")
+	}
+	// peers are trusted no more than the signature of the artifact
+	if m.GetArtifactVerifyKey() == nil {
+		return nil, 0, errors.New("downloading from peers requires artifact verification key")
+	}
+
+	api, err := newPeerAPI(conf)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, peer := range conf.Peers {
+		url := peerArtifactURL(peer, update.ArtifactName())
+		in, size, err := m.updater.FetchUpdate(api, url, m.GetRetryPollInterval())
+		if err != nil {
+			log.Debugf("artifact not available from peer %s: %v", peer, err)
+			continue
+		}
+		log.Infof("downloading artifact %s from peer %s", update.ArtifactName(), peer)
+		return m.watchMetered(in), size, nil
+	}
+	return nil, 0, errors.Errorf("artifact %s not available from any peer",
+		update.ArtifactName())
+}
+
+// ShareUpdate makes the artifact of `update`, installed last, available to
+// peers
+func (m *mender) ShareUpdate(update client.UpdateResponse) error {
+	if m.peerCache == nil {
+		return nil
+	}
+	return m.peerCache.commit(update.ArtifactName())
+}
+
+// ServePeers starts serving the shared artifact to peers, if enabled
+func (m *mender) ServePeers() error {
+	if m.peerCache == nil {
+		return nil
+	}
+	_, err := listenPeers(m.config.PeerSharing, m.peerCache)
+	return err
+}
+
+// watchMetered makes download `in` fail with errMeteredConnection once the
+// connection turns metered, if metered connections are configured
+func (m *mender) watchMetered(in io.ReadCloser) io.ReadCloser {
+	conf := m.config.MeteredConnection
+	if conf.CheckScript == "" && len(conf.Interfaces) == 0 {
+		return in
+	}
+	return newMeteredReader(in, m.IsMeteredConnection)
+}
+
+func (m *mender) IsMeteredConnection() bool {
+	metered, err := NewMeteredConnectionChecker(m.config.MeteredConnection).Metered()
+	if err != nil {
+		log.Errorf("failed to check if connection is metered, assuming it is not: %v",
+			err)
+		return false
+	}
+	return metered
 }
 
 // Check if new update is available. In case of errors, returns nil and error
@@ -422,8 +681,9 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
 	}
-	haveUpdate, err := m.updater.GetScheduledUpdate(m.api.Request(m.authToken),
-		m.config.ServerURL, client.CurrentUpdate{
+	server, api := m.server()
+	haveUpdate, err := m.updater.GetScheduledUpdate(api,
+		server, client.CurrentUpdate{
 			Artifact:   currentArtifactName,
 			DeviceType: deviceType,
 		})
@@ -438,6 +698,7 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 		log.Error("Error receiving scheduled update data: ", err)
 		return nil, NewTransientError(err)
 	}
+	m.serverContacted()
 
 	if haveUpdate == nil {
 		log.Debug("no updates available")
@@ -457,9 +718,41 @@ func (m *mender) CheckUpdate() (*client.UpdateResponse, menderError) {
 	return &update, nil
 }
 
+func (m *mender) setupTransport() error {
+	switch m.config.Transport {
+	case "", transportHTTP:
+		return nil
+	case transportMQTT:
+	default:
+		return errors.Errorf("unsupported transport %q", m.config.Transport)
+	}
+
+	conf := m.config.GetMQTTConfig()
+	if conf.ClientID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "MQTT client ID not set and host name not available")
+		}
+		conf.ClientID = host
+	}
+	mc, err := client.NewMQTT(conf)
+	if err != nil {
+		return errors.Wrap(err, "error creating MQTT client")
+	}
+	m.updater = mc
+	m.statusReporter = mc
+	m.logUploader = mc
+	m.inventorySubmitter = mc
+	return nil
+}
+
 func (m *mender) ReportUpdateStatus(update client.UpdateResponse, status string) menderError {
-	s := client.NewStatus()
-	err := s.Report(m.api.Request(m.authToken), m.config.ServerURL,
+	if isMediaUpdate(update) {
+		reportToMedia(update, status)
+		return nil
+	}
+	server, api := m.server()
+	err := m.statusReporter.Report(api, server,
 		client.StatusReport{
 			DeploymentID: update.ID,
 			Status:       status,
@@ -483,8 +776,12 @@ func (m *mender) ReportUpdateStatus(update client.UpdateResponse, status string)
 }
 
 func (m *mender) UploadLog(update client.UpdateResponse, logs []byte) menderError {
-	s := client.NewLog()
-	err := s.Upload(m.api.Request(m.authToken), m.config.ServerURL,
+	if isMediaUpdate(update) {
+		uploadLogToMedia(update, logs)
+		return nil
+	}
+	server, api := m.server()
+	err := m.logUploader.Upload(api, server,
 		client.LogData{
 			DeploymentID: update.ID,
 			Messages:     logs,
@@ -496,6 +793,13 @@ func (m *mender) UploadLog(update client.UpdateResponse, logs []byte) menderErro
 	return nil
 }
 
+func (m mender) GetStatusReportFailurePolicy() string {
+	if m.config.StatusReportFailurePolicy == "" {
+		return reportPolicyRollback
+	}
+	return m.config.StatusReportFailurePolicy
+}
+
 func (m mender) GetUpdatePollInterval() time.Duration {
 	t := time.Duration(m.config.UpdatePollIntervalSeconds) * time.Second
 	if t == 0 {
@@ -614,7 +918,6 @@ func (m *mender) TransitionState(to State, ctx *StateContext) (State, bool) {
 }
 
 func (m *mender) InventoryRefresh() error {
-	ic := client.NewInventory()
 	idg := NewInventoryDataRunner(path.Join(getDataDirPath(), "inventory"))
 
 	idata, err := idg.Get()
@@ -636,6 +939,13 @@ func (m *mender) InventoryRefresh() error {
 		{Name: "artifact_name", Value: artifactName},
 		{Name: "mender_client_version", Value: VersionString()},
 	}
+	if m.store != nil {
+		if ws, err := loadWriteStats(m.store); err != nil {
+			log.Errorf("failed to load partition write statistics: %v", err)
+		} else if ws.Total.Written+ws.Total.Skipped > 0 {
+			reqAttr = append(reqAttr, ws.inventoryAttributes()...)
+		}
+	}
 
 	if idata == nil {
 		idata = make(client.InventoryData, 0, len(reqAttr))
@@ -647,7 +957,8 @@ func (m *mender) InventoryRefresh() error {
 		return nil
 	}
 
-	err = ic.Submit(m.api.Request(m.authToken), m.config.ServerURL, idata)
+	server, api := m.server()
+	err = m.inventorySubmitter.Submit(api, server, idata)
 	if err != nil {
 		return errors.Wrapf(err, "failed to submit inventory data")
 	}
@@ -659,11 +970,133 @@ func (m *mender) CheckScriptsCompatibility() error {
 	return m.stateScriptExecutor.CheckRootfsScriptsVersion()
 }
 
+// ResumeUpdate installs the update like InstallUpdate(), but saves checkpoints
+// of the progress with `save`, and resumes from `cp` if not nil; the artifact
+// has to be named `name`, as the one scheduled may be downloaded from peers
+func (m *mender) ResumeUpdate(from io.ReadCloser, size int64, name string,
+	cp *InstallCheckpoint, save func(InstallCheckpoint) error) error {
+
+	dev, ok := m.UInstallCommitRebooter.(installResumer)
+	if !ok {
+		return m.installResumable(from, name, nil)
+	}
+
+	res := &installer.Resumer{ReadImage: dev.readImage}
+	if cp != nil && cp.Resume != nil && cp.Written > 0 {
+		res.From = cp.Resume
+		res.Written = cp.Written
+		res.Checksum = cp.Checksum
+		// the download picks up where the compressed image does
+		if s, ok := from.(io.Seeker); ok {
+			res.Seek = func(offset int64) error {
+				_, err := s.Seek(offset, io.SeekStart)
+				return err
+			}
+		}
+	} else {
+		cp = nil
+	}
+	dev.resumeInstall(cp, func(written int64, sum []byte) error {
+		p := res.Point(written)
+		if p == nil {
+			// nowhere to resume from yet
+			return nil
+		}
+		return save(InstallCheckpoint{
+			Written:  written,
+			Checksum: sum,
+			Resume:   p,
+		})
+	})
+	defer dev.resumeInstall(nil, nil)
+
+	err := m.installResumable(from, name, res)
+	if errors.Cause(err) == installer.ErrNotResumable {
+		log.Warnf("installing the update can not be resumed, "+
+			"starting over next time: %v", err)
+		if serr := save(InstallCheckpoint{}); serr != nil {
+			log.Errorf("failed to reset install checkpoint: %v", serr)
+		}
+	}
+	return err
+}
+
+// trackProgress makes downloading and installing an update report progress,
+// down to the device writing it, as well as running state scripts
+func (m *mender) trackProgress(f func()) {
+	m.progress = f
+	if dev, ok := m.UInstallCommitRebooter.(progressTracker); ok {
+		dev.trackProgress(f)
+	}
+	if l, ok := m.stateScriptExecutor.(statescript.Launcher); ok {
+		l.Progress = f
+		m.stateScriptExecutor = l
+	}
+}
+
+// trackContact makes successful authorization and update checks call `f`
+func (m *mender) trackContact(f func()) {
+	m.contacted = f
+}
+
+func (m *mender) serverContacted() {
+	if m.contacted != nil {
+		m.contacted()
+	}
+}
+
 func (m *mender) InstallUpdate(from io.ReadCloser, size int64) error {
+	return m.installResumable(from, "", nil)
+}
+
+// installResumable installs the update, named `name` unless empty, keeping
+// track of where to resume installing it from with `res`, and resuming
+// res.From; see installer.InstallResumable()
+func (m *mender) installResumable(from io.ReadCloser, name string,
+	res *installer.Resumer) error {
+
+	if m.progress != nil {
+		from = &progressReader{ReadCloser: from, progress: m.progress}
+	}
+	err := m.installUpdate(from, name, res)
+
+	// what was written wears the flash even if installing failed
+	if dev, ok := m.UInstallCommitRebooter.(writeStatsReporter); ok && m.store != nil {
+		stats := dev.lastWriteStats()
+		if stats.Written+stats.Skipped > 0 {
+			if serr := addWriteStats(m.store, stats); serr != nil {
+				log.Errorf("failed to save partition write statistics: %v", serr)
+			}
+		}
+	}
+	return err
+}
+
+func (m *mender) installUpdate(from io.ReadCloser, name string,
+	res *installer.Resumer) error {
+
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
 	}
-	return installer.Install(from, deviceType,
-		m.GetArtifactVerifyKey(), m.stateScriptPath, m.UInstallCommitRebooter, true)
+	resuming := res != nil && res.From != nil
+	if m.peerCache != nil && resuming {
+		// the part of the artifact installed before is not downloaded again
+		log.Infof("resumed update will not be shared with peers")
+		m.peerCache.unstage()
+	}
+	if m.peerCache == nil || resuming {
+		return installer.InstallResumable(from, deviceType, name,
+			m.GetArtifactVerifyKey(), m.stateScriptPath, m.UInstallCommitRebooter,
+			true, res)
+	}
+
+	// keep a copy for the peers; see ShareUpdate()
+	staged := m.peerCache.stage(from)
+	err = installer.InstallResumable(ioutil.NopCloser(staged), deviceType, name,
+		m.GetArtifactVerifyKey(), m.stateScriptPath, m.UInstallCommitRebooter, true, res)
+	if serr := staged.finish(); serr != nil {
+		log.Errorf("failed to keep artifact for peers: %v", serr)
+	}
+	return err
 }
@@ -20,6 +20,8 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"syscall"
@@ -31,6 +33,7 @@ import (
 	"github.com/mendersoftware/mender-artifact/handlers"
 	"github.com/mendersoftware/mender/client"
 	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -264,6 +267,8 @@ func Test_CheckUpdateSimple(t *testing.T) {
 		testMenderPieces{})
 	mender.artifactInfoFile = artifactInfo
 	mender.deviceTypeFile = deviceType
+	contacted := false
+	mender.trackContact(func() { contacted = true })
 
 	srv.Update.Current = client.CurrentUpdate{
 		Artifact:   "fake-id",
@@ -274,6 +279,7 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	up, err = mender.CheckUpdate()
 	assert.Error(t, err)
 	assert.Nil(t, nil)
+	assert.False(t, contacted)
 
 	// NOTE: manifest file data must match current update information expected by
 	// the server
@@ -289,6 +295,8 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	up, err = mender.CheckUpdate()
 	assert.Equal(t, err, NewTransientError(os.ErrExist))
 	assert.NotNil(t, up)
+	// the server was reached, even if there is nothing to install
+	assert.True(t, contacted)
 
 	// make artifact name different from current
 	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
@@ -410,6 +418,9 @@ func (a *testAuthManager) RemoveAuthToken() error {
 	return nil
 }
 
+func (a *testAuthManager) UseServer(server string) {
+}
+
 func TestMenderAuthorize(t *testing.T) {
 	runner := newTestOSCalls("", -1)
 
@@ -550,6 +561,34 @@ func TestMenderReportStatus(t *testing.T) {
 	assert.True(t, err.IsFatal())
 }
 
+func TestMenderTransport(t *testing.T) {
+	pieces := MenderPieces{store: store.NewMemStore()}
+
+	m, err := NewMender(menderConfig{ServerURL: "https://foo"}, pieces)
+	assert.NoError(t, err)
+	assert.IsType(t, &client.UpdateClient{}, m.updater)
+
+	_, err = NewMender(menderConfig{Transport: "foo"}, pieces)
+	assert.Error(t, err)
+
+	_, err = NewMender(menderConfig{Transport: transportMQTT}, pieces)
+	assert.Error(t, err)
+
+	m, err = NewMender(menderConfig{
+		Transport: transportMQTT,
+		MQTT: mqttConfig{
+			Broker:   "tcp://localhost:1883",
+			ClientID: "foo",
+		},
+	}, pieces)
+	assert.NoError(t, err)
+	mc, ok := m.updater.(*client.MQTTClient)
+	assert.True(t, ok)
+	assert.Equal(t, mc, m.statusReporter)
+	assert.Equal(t, mc, m.logUploader)
+	assert.Equal(t, mc, m.inventorySubmitter)
+}
+
 func TestMenderLogUpload(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -745,6 +784,23 @@ echo foo=bar`),
 		assert.Contains(t, srv.Inventory.Attrs, a)
 	}
 
+	// partition write statistics
+	assert.NoError(t, addWriteStats(ms, partitionWriteStats{Written: 10, Skipped: 20}))
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	err = mender.InventoryRefresh()
+	assert.Nil(t, err)
+	exp = []client.InventoryAttribute{
+		{Name: "device_type", Value: "foo-bar"},
+		// numbers, as the server decodes them
+		{Name: "rootfs_bytes_written", Value: float64(10)},
+		{Name: "rootfs_bytes_skipped_total", Value: float64(20)},
+	}
+	for _, a := range exp {
+		assert.Contains(t, srv.Inventory.Attrs, a)
+	}
+
 	// 3. pretend client is no longer authorized
 	srv.Auth.Token = []byte("footoken")
 	err = mender.InventoryRefresh()
@@ -942,7 +998,9 @@ func TestMenderFetchUpdate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, rcount, len(rbytes))
 
-	img, sz, err := mender.FetchUpdate(srv.URL + "/api/devices/v1/download")
+	update := client.UpdateResponse{}
+	update.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+	img, sz, err := mender.FetchUpdate(update)
 	assert.NoError(t, err)
 	assert.NotNil(t, img)
 	assert.EqualValues(t, len(rbytes), sz)
@@ -953,4 +1011,108 @@ func TestMenderFetchUpdate(t *testing.T) {
 	assert.EqualValues(t, sz, dl.Len())
 
 	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
+
+	// rate limited download; from a server of its own, as the handler of
+	// the previous download may still be copying from its data
+	limited := cltest.NewClientTestServer()
+	defer limited.Close()
+	limited.UpdateDownload.Data.Write(rbytes)
+	update.Artifact.Source.URI = limited.URL + "/api/devices/v1/download"
+	mender.config.DownloadRateLimit = 1024 * 1024
+	img, _, err = mender.FetchUpdate(update)
+	assert.NoError(t, err)
+	assert.IsType(t, &client.ThrottledReader{}, img)
+
+	dl.Reset()
+	_, err = io.Copy(&dl, img)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
+}
+
+func TestMenderReloadConfig(t *testing.T) {
+	mender := newTestMender(nil, menderConfig{
+		UpdatePollIntervalSeconds: 10,
+	}, testMenderPieces{})
+
+	assert.NoError(t, mender.ReloadConfig(menderConfig{
+		UpdatePollIntervalSeconds: 20,
+		StateScriptTimeoutSeconds: 5,
+	}))
+	assert.Equal(t, 20*time.Second, mender.GetUpdatePollInterval())
+	assert.Equal(t, 5, mender.stateScriptExecutor.(statescript.Launcher).Timeout)
+
+	assert.Error(t, mender.ReloadConfig(menderConfig{
+		UpdatePollIntervalSeconds: 30,
+		Transport:                 transportMQTT,
+	}))
+	assert.Equal(t, 20*time.Second, mender.GetUpdatePollInterval())
+}
+
+func TestMenderFetchUpdateRefresh(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-fetch")
+	defer os.RemoveAll(td)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	// links the device was given before
+	expired := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer expired.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: srv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	mender.artifactInfoFile = path.Join(td, "artifact_info")
+	mender.deviceTypeFile = path.Join(td, "device_type")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=current"), 0600)
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=hammer"), 0600)
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "current",
+		DeviceType: "hammer",
+	}
+
+	ms.WriteAll(authTokenName, []byte("tokendata"))
+	assert.NoError(t, mender.Authorize())
+
+	rbytes := make([]byte, 8192)
+	rand.Read(rbytes)
+	srv.UpdateDownload.Data.Write(rbytes)
+
+	srv.Update.Has = true
+	srv.Update.Data.ID = "deployment"
+	srv.Update.Data.Artifact.ArtifactName = "new"
+	srv.Update.Data.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+	srv.Update.Data.Artifact.Source.Expire = "2017-10-02T12:00:00Z"
+
+	update := srv.Update.Data
+	update.Artifact.Source.URI = expired.URL + "/download"
+
+	img, _, err := mender.FetchUpdate(update)
+	assert.NoError(t, err)
+	dl, err := ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(rbytes, dl))
+
+	// deployment aborted in the meantime
+	srv.Update.Has = false
+	_, _, err = mender.FetchUpdate(update)
+	assert.Error(t, err)
+
+	// or replaced by another one
+	srv.Update.Has = true
+	srv.Update.Data.ID = "another"
+	_, _, err = mender.FetchUpdate(update)
+	assert.Error(t, err)
+
+	assert.Equal(t, time.Date(2017, 10, 2, 12, 0, 0, 0, time.UTC), update.Expire())
+	assert.True(t, client.UpdateResponse{}.Expire().IsZero())
 }
@@ -0,0 +1,166 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultRouteFile = "/proc/net/route"
+
+// how often a download checks if the connection turned metered, as running
+// the check script for every read would be too much; see meteredReader
+var meteredCheckInterval = 1 * time.Minute
+
+// errMeteredConnection stops a download once the connection turns metered
+var errMeteredConnection = errors.New("connection turned metered")
+
+// MeteredConnectionChecker tells if the device is connected over a link that
+// should not be used for downloading updates, such as cellular. The script, if
+// set, decides: exit code 0 means metered, 1 means not metered. Otherwise the
+// connection is metered if the interface of the default route matches one of
+// the interface patterns, for instance "wwan*" or "ppp*".
+type MeteredConnectionChecker struct {
+	Script     string
+	Interfaces []string
+	cmdr       Commander
+	routeFile  string
+}
+
+func NewMeteredConnectionChecker(config meteredConfig) *MeteredConnectionChecker {
+	return &MeteredConnectionChecker{
+		Script:     config.CheckScript,
+		Interfaces: config.Interfaces,
+		cmdr:       &osCalls{},
+		routeFile:  defaultRouteFile,
+	}
+}
+
+func (mc *MeteredConnectionChecker) Metered() (bool, error) {
+	if mc.Script != "" {
+		return mc.runScript()
+	}
+	if len(mc.Interfaces) == 0 {
+		return false, nil
+	}
+
+	iface, err := defaultRouteInterface(mc.routeFile)
+	if err != nil || iface == "" {
+		return false, err
+	}
+	for _, pattern := range mc.Interfaces {
+		if match, _ := filepath.Match(pattern, iface); match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (mc *MeteredConnectionChecker) runScript() (bool, error) {
+	err := mc.cmdr.Command(mc.Script).Run()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok &&
+			status.ExitStatus() == 1 {
+			return false, nil
+		}
+	}
+	return false, errors.Wrapf(err, "metered connection check %s failed", mc.Script)
+}
+
+// defaultRouteInterface returns the interface of the default route with the
+// lowest metric, or "" if there is none
+func defaultRouteInterface(routeFile string) (string, error) {
+	f, err := os.Open(routeFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read routing table")
+	}
+	defer f.Close()
+
+	const rtfUp = 0x1
+
+	iface := ""
+	best := -1
+	s := bufio.NewScanner(f)
+	// skip header
+	s.Scan()
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if best < 0 || metric < best {
+			iface = fields[0]
+			best = metric
+		}
+	}
+	return iface, s.Err()
+}
+
+// meteredReader fails reading a download with errMeteredConnection once
+// `metered` tells that the connection turned metered
+type meteredReader struct {
+	io.ReadCloser
+	metered func() bool
+	checked time.Time
+}
+
+func newMeteredReader(r io.ReadCloser, metered func() bool) *meteredReader {
+	return &meteredReader{
+		ReadCloser: r,
+		metered:    metered,
+		// checked just before the download started
+		checked: time.Now(),
+	}
+}
+
+func (r *meteredReader) Read(b []byte) (int, error) {
+	if now := time.Now(); now.Sub(r.checked) >= meteredCheckInterval {
+		r.checked = now
+		if r.metered() {
+			return 0, errMeteredConnection
+		}
+	}
+	return r.ReadCloser.Read(b)
+}
+
+// Seek seeks the underlying download, if it supports it
+func (r *meteredReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := r.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("download can not seek")
+	}
+	return s.Seek(offset, whence)
+}
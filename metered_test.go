@@ -0,0 +1,191 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRouteTable = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wwan0	00000000	0100A8C0	0003	0	0	700	00000000	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+
+func TestDefaultRouteInterface(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	routes := path.Join(tdir, "route")
+	assert.NoError(t, ioutil.WriteFile(routes, []byte(testRouteTable), 0644))
+
+	iface, err := defaultRouteInterface(routes)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth0", iface)
+
+	mc := &MeteredConnectionChecker{
+		Interfaces: []string{"wwan*", "ppp*"},
+		routeFile:  routes,
+	}
+	metered, err := mc.Metered()
+	assert.NoError(t, err)
+	assert.False(t, metered)
+
+	// ethernet is gone, only cellular is left
+	assert.NoError(t, ioutil.WriteFile(routes, []byte(
+		"Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask\n"+
+			"wwan0	00000000	0100A8C0	0003	0	0	700	00000000\n"), 0644))
+	metered, err = mc.Metered()
+	assert.NoError(t, err)
+	assert.True(t, metered)
+
+	// no default route at all
+	assert.NoError(t, ioutil.WriteFile(routes, []byte(
+		"Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask\n"), 0644))
+	metered, err = mc.Metered()
+	assert.NoError(t, err)
+	assert.False(t, metered)
+
+	mc.routeFile = path.Join(tdir, "missing")
+	_, err = mc.Metered()
+	assert.Error(t, err)
+
+	// nothing configured
+	metered, err = (&MeteredConnectionChecker{}).Metered()
+	assert.NoError(t, err)
+	assert.False(t, metered)
+}
+
+func TestMeteredConnectionScript(t *testing.T) {
+	for code, expected := range map[int]bool{0: true, 1: false} {
+		cmdr := newTestOSCalls("", code)
+		mc := &MeteredConnectionChecker{
+			Script: "check-metered",
+			cmdr:   &cmdr,
+		}
+		metered, err := mc.Metered()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, metered)
+	}
+
+	cmdr := newTestOSCalls("", 2)
+	mc := &MeteredConnectionChecker{
+		Script: "check-metered",
+		cmdr:   &cmdr,
+	}
+	_, err := mc.Metered()
+	assert.Error(t, err)
+}
+
+func TestMeteredReader(t *testing.T) {
+	metered := false
+	r := newMeteredReader(ioutil.NopCloser(bytes.NewReader([]byte("foobar"))),
+		func() bool { return metered })
+
+	// not checked again right after the download started
+	metered = true
+	buf := make([]byte, 3)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	r.checked = time.Now().Add(-meteredCheckInterval)
+	_, err = r.Read(buf)
+	assert.Equal(t, errMeteredConnection, err)
+
+	metered = false
+	r.checked = time.Now().Add(-meteredCheckInterval)
+	n, err = r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(buf[:n]))
+
+	// resuming the download seeks it
+	_, err = r.Seek(0, io.SeekStart)
+	assert.Error(t, err)
+	r = newMeteredReader(&artifactReader{Reader: bytes.NewReader([]byte("foobar"))},
+		func() bool { return false })
+	off, err := r.Seek(3, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), off)
+}
+
+func TestMenderResumeUpdateMetered(t *testing.T) {
+	oldInterval := installCheckpointInterval
+	installCheckpointInterval = 128 * 1024
+	oldCheck := meteredCheckInterval
+	meteredCheckInterval = 0
+	defer func() {
+		installCheckpointInterval = oldInterval
+		meteredCheckInterval = oldCheck
+	}()
+
+	tdir, _ := ioutil.TempDir("", "metered")
+	defer os.RemoveAll(tdir)
+
+	size := 4 * 1024 * 1024
+	art := makeLargeArtifact(t, tdir, size, false, []string{"vexpress-qemu"})
+	img := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(img)
+
+	part := filepath.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 2*size), 0600))
+	dev := NewDevice(nil, nil, deviceConfig{
+		write: partitionWriteConfig{BufferSize: 4096},
+	})
+	dev.files = true
+	dev.inactive = part
+
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{device: dev},
+	})
+	m.deviceTypeFile = filepath.Join(tdir, "device_type")
+
+	var saved *InstallCheckpoint
+	save := func(cp InstallCheckpoint) error {
+		saved = &cp
+		return nil
+	}
+
+	// connection turns metered half way through the download
+	in := &artifactReader{Reader: bytes.NewReader(art)}
+	err := m.ResumeUpdate(newMeteredReader(in, func() bool {
+		return in.read > int64(len(art)/2)
+	}), int64(len(art)), "large", nil, save)
+	assert.Equal(t, errMeteredConnection, errors.Cause(err))
+	if !assert.NotNil(t, saved) || !assert.NotNil(t, saved.Resume) {
+		return
+	}
+
+	// and the download picks up from the checkpoint once it is not
+	from := saved
+	in = &artifactReader{Reader: bytes.NewReader(art)}
+	assert.NoError(t, m.ResumeUpdate(newMeteredReader(in, func() bool { return false }),
+		int64(len(art)), "large", from, save))
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, img, data[:size])
+	assert.True(t, in.read < int64(len(art))-from.Resume.Image(),
+		"read %d bytes of the artifact", in.read)
+}
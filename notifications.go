@@ -0,0 +1,99 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// notification raised locally once the configuration is to be reloaded
+const notifyReloadConfig = "reload-config"
+
+// minimum time between notification requests, in case the server answers
+// without holding the request
+var notifyMinRequestInterval = 1 * time.Second
+
+// ListenNotifications opens notification channel to the server in use, if
+// enabled. Notifications are delivered over the returned channel, which is
+// closed when the connection drops. Returned function stops listening.
+func (m *mender) ListenNotifications() (<-chan client.Notification, func()) {
+	if !m.config.EnableNotifications {
+		return nil, func() {}
+	}
+
+	server, _ := m.server()
+	// problems with notifications do not make the server fail over; the
+	// regular polling takes care of that
+	m.servers.lock.Lock()
+	api := m.servers.servers[m.servers.current].api.Request(m.authToken)
+	m.servers.lock.Unlock()
+	notifier := m.notifier
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan client.Notification)
+
+	go func() {
+		defer close(out)
+		for {
+			start := time.Now()
+			note, err := notifier.Next(ctx, api, server)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Warnf("notification channel dropped, falling back to polling: %v", err)
+				return
+			}
+
+			if note != nil {
+				select {
+				case out <- *note:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-time.After(notifyMinRequestInterval - time.Since(start)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, cancel
+}
+
+// Notify raises notification `note` locally, e.g. for a signal; it is handled
+// like the ones received from the server. Returns false if the notification
+// was dropped as an earlier one is still pending.
+func (m *mender) Notify(note client.Notification) bool {
+	select {
+	case m.localNotes <- note:
+		return true
+	default:
+		return false
+	}
+}
+
+// LocalNotifications returns channel notifications raised by Notify() are
+// delivered over.
+func (m *mender) LocalNotifications() <-chan client.Notification {
+	return m.localNotes
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMenderListenNotifications(t *testing.T) {
+	oldInterval := notifyMinRequestInterval
+	notifyMinRequestInterval = 10 * time.Millisecond
+	defer func() { notifyMinRequestInterval = oldInterval }()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusNoContent)
+		case 2:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"type": "check-update"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	mender := newTestMender(nil, menderConfig{ServerURL: srv.URL}, testMenderPieces{})
+
+	// disabled
+	notes, stop := mender.ListenNotifications()
+	assert.Nil(t, notes)
+	stop()
+
+	mender.config.EnableNotifications = true
+	notes, stop = mender.ListenNotifications()
+	defer stop()
+
+	select {
+	case note := <-notes:
+		assert.Equal(t, client.NotifyCheckUpdate, note.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+
+	// channel is closed once the connection drops
+	select {
+	case _, ok := <-notes:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification channel not closed")
+	}
+	assert.Equal(t, 3, requests)
+}
@@ -0,0 +1,413 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Devices without access to the server can be updated from removable media.
+// The daemon watches the configured mount points for a "mender" directory
+// holding signed artifacts and, optionally, a signed deployment manifest
+// naming the artifact to install. The update then goes through the same
+// states as one coming from the server, with the status reports and the
+// deployment logs written to the "reports" directory on the media.
+//
+//   <media>/mender/release-2.mender
+//   <media>/mender/manifest.json      {"id": "...", "artifact": "release-2.mender"}
+//   <media>/mender/manifest.json.sig  base64 signature of manifest.json
+//   <media>/mender/reports/<host name>/<deployment id>.json
+//
+// An update is attempted once per device; its report has to be removed from
+// the media for it to be attempted again.
+
+const (
+	mediaDir             = "mender"
+	mediaManifestFile    = "manifest.json"
+	mediaManifestSigFile = "manifest.json.sig"
+	mediaReportsDir      = "reports"
+	mediaArtifactSuffix  = ".mender"
+	mediaURIPrefix       = "file://"
+	mediaUpdateIDPrefix  = "media-"
+
+	defaultMediaPollInterval = 5 * time.Second
+)
+
+type mediaManifest struct {
+	// ID the deployment is reported under
+	ID string `json:"id"`
+	// artifact file, relative to the manifest
+	Artifact string `json:"artifact"`
+}
+
+type mediaStatus struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// mediaReport is written to the media for each update attempted
+type mediaReport struct {
+	ID           string        `json:"id"`
+	ArtifactName string        `json:"artifact_name"`
+	Status       string        `json:"status"`
+	History      []mediaStatus `json:"history"`
+}
+
+func isMediaUpdate(update client.UpdateResponse) bool {
+	return update.Media
+}
+
+// WatchMedia looks for media inserted in the configured mount points. The
+// mount points with media that has not been checked for updates yet are
+// delivered over the returned channel. Returned function stops watching.
+func (m *mender) WatchMedia() (<-chan string, func()) {
+	conf := m.config.OfflineUpdate
+	if len(conf.MediaPaths) == 0 {
+		return nil, func() {}
+	}
+	interval := time.Duration(conf.PollIntervalSeconds) * time.Second
+	if interval == 0 {
+		interval = defaultMediaPollInterval
+	}
+
+	out := make(chan string)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer close(out)
+		for {
+			for _, dir := range m.media.scan(conf.MediaPaths) {
+				select {
+				case out <- dir:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case <-time.After(interval):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out, func() {
+		close(done)
+		<-exited
+	}
+}
+
+// mediaTracker keeps track of the media checked for updates already, by
+// mount point
+type mediaTracker struct {
+	lock    sync.Mutex
+	checked map[string]bool
+}
+
+func newMediaTracker() *mediaTracker {
+	return &mediaTracker{checked: make(map[string]bool)}
+}
+
+func (t *mediaTracker) setChecked(dir string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.checked[dir] = true
+}
+
+// scan returns the mount points holding media that has not been checked yet;
+// media removed since it was checked is forgotten, so that it is checked again
+// once inserted
+func (t *mediaTracker) scan(patterns []string) []string {
+	present := map[string]bool{}
+	for _, pattern := range patterns {
+		dirs, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Errorf("invalid media path %q: %v", pattern, err)
+			continue
+		}
+		for _, dir := range dirs {
+			if fi, err := os.Stat(path.Join(dir, mediaDir)); err == nil && fi.IsDir() {
+				present[dir] = true
+			}
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for dir := range t.checked {
+		if !present[dir] {
+			log.Infof("media removed from %s", dir)
+			delete(t.checked, dir)
+		}
+	}
+	var found []string
+	for dir := range present {
+		if !t.checked[dir] {
+			found = append(found, dir)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// CheckMediaUpdate returns the update to install from the media mounted on
+// `dir`, if there is one
+func (m *mender) CheckMediaUpdate(dir string) (*client.UpdateResponse, menderError) {
+	m.media.setChecked(dir)
+
+	log.Infof("checking media in %s for updates", dir)
+
+	key := m.GetArtifactVerifyKey()
+	if key == nil {
+		return nil, NewFatalError(errors.New("updates from media require " +
+			"artifact verification key"))
+	}
+
+	dir = path.Join(dir, mediaDir)
+	files, id, err := mediaArtifacts(dir, key, m.config.OfflineUpdate.RequireManifest)
+	if err != nil {
+		return nil, NewTransientError(err)
+	}
+
+	current, err := m.GetCurrentArtifactName()
+	if err != nil {
+		log.Error("could not get the current artifact name")
+	}
+	deviceType, err := m.GetDeviceType()
+	if err != nil {
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", defaultDeviceTypeFile, err)
+	}
+
+	for _, file := range files {
+		name, devices, err := readArtifactFile(file, key)
+		if err != nil {
+			log.Warnf("ignoring artifact %s: %v", file, err)
+			continue
+		}
+		if !deviceCompatible(deviceType, devices) {
+			log.Infof("ignoring artifact %s for device types %v", file, devices)
+			continue
+		}
+		if name == current {
+			log.Infof("artifact %s from %s is installed already", name, file)
+			continue
+		}
+
+		update := client.UpdateResponse{ID: id}
+		if update.ID == "" {
+			sum := sha256.Sum256([]byte(name))
+			update.ID = mediaUpdateIDPrefix + hex.EncodeToString(sum[:8])
+		}
+		update.Artifact.ArtifactName = name
+		update.Artifact.CompatibleDevices = devices
+		update.Artifact.Source.URI = mediaURIPrefix + file
+		update.Media = true
+
+		if _, err := os.Stat(mediaReportPath(update, ".json")); err == nil {
+			log.Infof("update %s from %s was attempted already; remove its "+
+				"report from the media to attempt it again", update.ID, file)
+			continue
+		}
+		log.Infof("installing artifact %s from media", name)
+		return &update, nil
+	}
+
+	log.Infof("no updates on media in %s", dir)
+	return nil, nil
+}
+
+// mediaArtifacts returns the artifacts in `dir` to choose the update from and
+// the deployment ID, both given by the manifest if there is one
+func mediaArtifacts(dir string, key []byte, requireManifest bool) ([]string, string, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, mediaManifestFile))
+	if os.IsNotExist(err) && !requireManifest {
+		files, err := filepath.Glob(path.Join(dir, "*"+mediaArtifactSuffix))
+		sort.Strings(files)
+		return files, "", err
+	} else if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read deployment manifest")
+	}
+
+	sig, err := ioutil.ReadFile(path.Join(dir, mediaManifestSigFile))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read deployment manifest signature")
+	}
+	if err := artifact.NewVerifier(key).Verify(data, bytes.TrimSpace(sig)); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid deployment manifest signature")
+	}
+
+	var manifest mediaManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid deployment manifest")
+	}
+	// both end up in file names
+	if manifest.Artifact == "" || path.Base(manifest.Artifact) != manifest.Artifact {
+		return nil, "", errors.Errorf("invalid artifact %q in deployment manifest",
+			manifest.Artifact)
+	}
+	if manifest.ID != "" && path.Base(manifest.ID) != manifest.ID {
+		return nil, "", errors.Errorf("invalid ID %q in deployment manifest",
+			manifest.ID)
+	}
+	return []string{path.Join(dir, manifest.Artifact)}, manifest.ID, nil
+}
+
+var errArtifactHeaderRead = errors.New("artifact header read")
+
+// newArtifactReader returns a reader of the artifact `r`, verifying its
+// signature with `key` and requiring one if `key` is given
+func newArtifactReader(r io.Reader, key []byte) *areader.Reader {
+	if key == nil {
+		ar := areader.NewReader(r)
+		ar.VerifySignatureCallback = func(message, sig []byte) error {
+			return nil
+		}
+		return ar
+	}
+	ar := areader.NewReaderSigned(r)
+	ar.VerifySignatureCallback = artifact.NewVerifier(key).Verify
+	return ar
+}
+
+// readArtifactHeader returns name and compatible devices of the artifact read
+// from `r`, which must be signed if `key` is given. Only the beginning of the
+// artifact is read and verified; the rest is verified while installing.
+func readArtifactHeader(r io.Reader, key []byte) (string, []string, error) {
+	ar := newArtifactReader(r, key)
+	var devices []string
+	ar.CompatibleDevicesCallback = func(d []string) error {
+		devices = d
+		return errArtifactHeaderRead
+	}
+	err := ar.ReadArtifact()
+	if errors.Cause(err) != errArtifactHeaderRead {
+		if err == nil {
+			err = errors.New("artifact without header")
+		}
+		return "", nil, err
+	}
+	if key != nil && ar.GetInfo().Version < 2 {
+		return "", nil, errors.New("artifact is not signed")
+	}
+	return ar.GetArtifactName(), devices, nil
+}
+
+func readArtifactFile(file string, key []byte) (string, []string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	return readArtifactHeader(f, key)
+}
+
+func deviceCompatible(deviceType string, devices []string) bool {
+	if deviceType == "" {
+		// same as the installer, which continues with unknown device type
+		return true
+	}
+	for _, dev := range devices {
+		if dev == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaReportPath returns path of the report file with extension `ext` of
+// the media update
+func mediaReportPath(update client.UpdateResponse, ext string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	dir := path.Dir(strings.TrimPrefix(update.URI(), mediaURIPrefix))
+	// the ID is checked when reading the manifest, but must not lead out
+	// of the reports directory in any case
+	return path.Join(dir, mediaReportsDir, host, filepath.Base(update.ID)+ext)
+}
+
+// reportToMedia records the status of the media update on the media. The
+// media may have been removed, which does not fail the update; the status is
+// in the deployment log in any case.
+func reportToMedia(update client.UpdateResponse, status string) {
+	name := mediaReportPath(update, ".json")
+	report := mediaReport{
+		ID:           update.ID,
+		ArtifactName: update.ArtifactName(),
+	}
+	if data, err := ioutil.ReadFile(name); err == nil {
+		if err := json.Unmarshal(data, &report); err != nil {
+			log.Warnf("overwriting invalid media report %s: %v", name, err)
+		}
+	}
+	report.Status = status
+	report.History = append(report.History, mediaStatus{
+		Status: status,
+		Time:   time.Now().UTC(),
+	})
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if err := writeMediaFile(name, data); err != nil {
+		log.Warnf("failed to write status %s of update %s to media: %v",
+			status, update.ID, err)
+	}
+}
+
+func uploadLogToMedia(update client.UpdateResponse, logs []byte) {
+	if err := writeMediaFile(mediaReportPath(update, ".log"), logs); err != nil {
+		log.Warnf("failed to write deployment log of update %s to media: %v",
+			update.ID, err)
+	}
+}
+
+func writeMediaFile(name string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileSync(name, data)
+}
+
+func openMediaArtifact(uri string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(strings.TrimPrefix(uri, mediaURIPrefix))
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "artifact not available on media")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	return f, fi.Size(), nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeMediaArtifact(t *testing.T, name string, signed bool) {
+	art, err := MakeRootfsImageArtifact(2, signed)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(art)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(name, data, 0644))
+}
+
+func TestMediaUpdate(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	key := path.Join(tdir, "artifact-verify-key.pem")
+	assert.NoError(t, ioutil.WriteFile(key, []byte(PublicRSAKey), 0644))
+	artifactInfo := path.Join(tdir, "artifact_info")
+	assert.NoError(t, ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0"), 0644))
+	deviceType := path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu"), 0644))
+
+	mount := path.Join(tdir, "media", "usb")
+	dir := path.Join(mount, mediaDir)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	// unsigned artifacts are not installed
+	writeMediaArtifact(t, path.Join(dir, "0-unsigned.mender"), false)
+	writeMediaArtifact(t, path.Join(dir, "1-signed.mender"), true)
+
+	conf := menderConfig{
+		ArtifactVerifyKey: key,
+		OfflineUpdate: offlineUpdateConfig{
+			MediaPaths: []string{path.Join(tdir, "media", "*")},
+		},
+	}
+	m := newTestMender(nil, conf, testMenderPieces{})
+	m.artifactInfoFile = artifactInfo
+	m.deviceTypeFile = deviceType
+
+	media, stop := m.WatchMedia()
+	select {
+	case found := <-media:
+		assert.Equal(t, mount, found)
+	case <-time.After(5 * time.Second):
+		t.Fatal("media not found")
+	}
+	stop()
+
+	update, merr := m.CheckMediaUpdate(mount)
+	assert.Nil(t, merr)
+	assert.NotNil(t, update)
+	assert.True(t, isMediaUpdate(*update))
+	// the URI alone does not make an update come from media
+	remote := *update
+	remote.Media = false
+	assert.False(t, isMediaUpdate(remote))
+	assert.Equal(t, "mender-1.1", update.ArtifactName())
+	assert.Equal(t, []string{"vexpress-qemu"}, update.CompatibleDevices())
+	assert.Equal(t, mediaURIPrefix+path.Join(dir, "1-signed.mender"), update.URI())
+
+	// media is checked once while inserted
+	assert.Empty(t, m.media.scan(conf.OfflineUpdate.MediaPaths))
+
+	in, size, err := m.FetchUpdate(*update)
+	assert.NoError(t, err)
+	fi, _ := os.Stat(path.Join(dir, "1-signed.mender"))
+	assert.Equal(t, fi.Size(), size)
+	in.Close()
+
+	// status and logs are written to the media
+	assert.Nil(t, m.ReportUpdateStatus(*update, client.StatusDownloading))
+	assert.Nil(t, m.ReportUpdateStatus(*update, client.StatusFailure))
+	assert.Nil(t, m.UploadLog(*update, []byte(`{"messages": []}`)))
+	data, err := ioutil.ReadFile(mediaReportPath(*update, ".json"))
+	assert.NoError(t, err)
+
+	// the ID can not lead out of the reports directory
+	escaping := *update
+	escaping.ID = "../../../../etc/foo"
+	assert.Equal(t, path.Dir(mediaReportPath(*update, ".json")),
+		path.Dir(mediaReportPath(escaping, ".json")))
+
+	var report mediaReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, update.ID, report.ID)
+	assert.Equal(t, client.StatusFailure, report.Status)
+	assert.Len(t, report.History, 2)
+	data, err = ioutil.ReadFile(mediaReportPath(*update, ".log"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"messages": []}`, string(data))
+
+	// attempted update is not attempted again
+	update, merr = m.CheckMediaUpdate(mount)
+	assert.Nil(t, merr)
+	assert.Nil(t, update)
+
+	// until its report is removed; then it is not installed if it is
+	// installed already
+	assert.NoError(t, os.RemoveAll(path.Join(dir, mediaReportsDir)))
+	assert.NoError(t, ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1"), 0644))
+	update, merr = m.CheckMediaUpdate(mount)
+	assert.Nil(t, merr)
+	assert.Nil(t, update)
+	assert.NoError(t, ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0"), 0644))
+
+	// media is checked again once inserted again
+	assert.NoError(t, os.Rename(mount, path.Join(tdir, "removed")))
+	assert.Empty(t, m.media.scan(conf.OfflineUpdate.MediaPaths))
+	assert.NoError(t, os.Rename(path.Join(tdir, "removed"), mount))
+	assert.Equal(t, []string{mount}, m.media.scan(conf.OfflineUpdate.MediaPaths))
+
+	// deployment manifest names the artifact and the deployment
+	manifest := []byte(`{"id": "deployment-1", "artifact": "1-signed.mender"}`)
+	sig, err := artifact.NewSigner([]byte(PrivateRSAKey)).Sign(manifest)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, mediaManifestFile), manifest, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, mediaManifestSigFile), sig, 0644))
+	update, merr = m.CheckMediaUpdate(mount)
+	assert.Nil(t, merr)
+	assert.NotNil(t, update)
+	assert.Equal(t, "deployment-1", update.ID)
+
+	// manifest that was tampered with is rejected
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, mediaManifestFile),
+		[]byte(`{"id": "deployment-1", "artifact": "0-unsigned.mender"}`), 0644))
+	_, merr = m.CheckMediaUpdate(mount)
+	assert.NotNil(t, merr)
+
+	// as is media without manifest, if one is required
+	assert.NoError(t, os.Remove(path.Join(dir, mediaManifestFile)))
+	m.config.OfflineUpdate.RequireManifest = true
+	_, merr = m.CheckMediaUpdate(mount)
+	assert.NotNil(t, merr)
+
+	// updates from media must be signed
+	m.config.ArtifactVerifyKey = ""
+	_, merr = m.CheckMediaUpdate(mount)
+	assert.NotNil(t, merr)
+	assert.True(t, merr.IsFatal())
+}
+
+func TestStateMediaUpdate(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := &StateContext{store: store.NewMemStore()}
+	ctx.lastInventoryUpdate = time.Now()
+	ctx.lastUpdateCheck = ctx.lastInventoryUpdate
+
+	update := client.UpdateResponse{ID: "media-1", Media: true}
+	update.Artifact.Source.URI = mediaURIPrefix + "/media/usb/mender/release.mender"
+	sc := &stateTestController{
+		pollIntvl:   time.Minute,
+		retryIntvl:  time.Minute,
+		media:       make(chan string, 1),
+		mediaUpdate: &update,
+		metered:     true,
+	}
+
+	// waiting is interrupted by inserted media, also while the server can
+	// not be reached
+	for _, ws := range []State{NewCheckWaitState(), NewAuthorizeWaitState()} {
+		sc.media <- "/media/usb"
+		s, c := ws.Handle(ctx, sc)
+		assert.IsType(t, &MediaUpdateCheckState{}, s)
+		assert.False(t, c)
+	}
+
+	s, _ := NewMediaUpdateCheckState("/media/usb").Handle(ctx, sc)
+	assert.Equal(t, "/media/usb", sc.mediaChecked)
+	assert.IsType(t, &UpdateFetchState{}, s)
+
+	// metered connection does not hold up updates from media
+	sc.updater.fetchUpdateReturnReadCloser = ioutil.NopCloser(nil)
+	s, _ = s.Handle(ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.Equal(t, client.StatusDownloading, sc.reportStatus)
+
+	sc.mediaUpdate = nil
+	s, _ = NewMediaUpdateCheckState("/media/usb").Handle(ctx, sc)
+	assert.Equal(t, idleState, s)
+	sc.mediaUpdateErr = NewTransientError(os.ErrNotExist)
+	s, _ = NewMediaUpdateCheckState("/media/usb").Handle(ctx, sc)
+	assert.Equal(t, idleState, s)
+}
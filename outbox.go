@@ -0,0 +1,221 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// Status reports and deployment logs that could not be delivered while
+// handling a deployment are kept in the outbox in the data store, so that they
+// survive reboots, and are sent in order by the outbox sender of the daemon
+// once the server can be reached again.
+
+const (
+	outboxKey = "outbox"
+
+	// roll back an update if the success could not be reported (default)
+	reportPolicyRollback = "rollback"
+	// keep the update and leave the success report in the outbox
+	reportPolicyQueue = "queue"
+
+	// how long the outbox sender waits before trying again after failing to
+	// send a report, doubling up to the maximum
+	outboxMinBackoff = 30 * time.Second
+	outboxMaxBackoff = 30 * time.Minute
+)
+
+type outboxEntry struct {
+	Update client.UpdateResponse
+	Status string
+	// logs to upload after the status, if any
+	Logs []byte `json:",omitempty"`
+	// status was delivered, but logs were not yet
+	StatusSent bool `json:",omitempty"`
+}
+
+func loadOutbox(s store.Store) ([]outboxEntry, error) {
+	data, err := s.ReadAll(outboxKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []outboxEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode outbox")
+	}
+	return entries, nil
+}
+
+func storeOutbox(s store.Store, entries []outboxEntry) error {
+	if len(entries) == 0 {
+		if err := s.Remove(outboxKey); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, _ := json.Marshal(entries)
+	return s.WriteAll(outboxKey, data)
+}
+
+// QueueStatusReport appends status report of `update`, followed by `logs` if
+// not nil, to the outbox
+func QueueStatusReport(s store.Store, update client.UpdateResponse,
+	status string, logs []byte) error {
+	entries, err := loadOutbox(s)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, outboxEntry{
+		Update: update,
+		Status: status,
+		Logs:   logs,
+	})
+	log.Infof("queued status %s of deployment %s, %d report(s) pending",
+		status, update.ID, len(entries))
+	return storeOutbox(s, entries)
+}
+
+// FlushOutbox sends the queued reports in order, stopping at the first one
+// that fails with a transient error. Reports rejected by the server are
+// dropped. Returns the number of reports still pending.
+func FlushOutbox(s store.Store, c Controller) (int, error) {
+	entries, err := loadOutbox(s)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	for len(entries) > 0 {
+		entry := &entries[0]
+
+		if !entry.StatusSent {
+			merr := c.ReportUpdateStatus(entry.Update, entry.Status)
+			if merr != nil && !merr.IsFatal() {
+				return len(entries), merr
+			} else if merr != nil {
+				log.Errorf("dropping status %s of deployment %s from outbox: %v",
+					entry.Status, entry.Update.ID, merr)
+				entry.Logs = nil
+			}
+			entry.StatusSent = true
+		}
+
+		if entry.Logs != nil {
+			if merr := c.UploadLog(entry.Update, entry.Logs); merr != nil {
+				// keep the progress made so far
+				if err := storeOutbox(s, entries); err != nil {
+					log.Errorf("failed to update outbox: %v", err)
+				}
+				return len(entries), merr
+			}
+		}
+
+		log.Infof("sent queued status %s of deployment %s",
+			entry.Status, entry.Update.ID)
+		entries = entries[1:]
+		if err := storeOutbox(s, entries); err != nil {
+			return len(entries), errors.Wrapf(err, "failed to update outbox")
+		}
+	}
+	return 0, nil
+}
+
+// outboxSender drains the outbox in the background whenever it is woken up,
+// which happens once the server was reached; reports failing to be sent are
+// retried with backoff until the outbox is empty
+type outboxSender struct {
+	store store.Store
+	c     Controller
+	// serializes use of the controller with the state machine
+	lock       sync.Locker
+	wakeup     chan struct{}
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newOutboxSender(s store.Store, c Controller, lock sync.Locker) *outboxSender {
+	return &outboxSender{
+		store:      s,
+		c:          c,
+		lock:       lock,
+		wakeup:     make(chan struct{}, 1),
+		minBackoff: outboxMinBackoff,
+		maxBackoff: outboxMaxBackoff,
+	}
+}
+
+// wake makes the sender try sending the queued reports right away
+func (o *outboxSender) wake() {
+	select {
+	case o.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// flush sends the queued reports, returns true if some are still pending
+func (o *outboxSender) flush() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	pending, err := FlushOutbox(o.store, o.c)
+	if err != nil {
+		log.Warnf("failed to send queued status reports, %d pending: %v",
+			pending, err)
+	}
+	return pending > 0
+}
+
+// start runs the sender until the returned function is called
+func (o *outboxSender) start() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		var retry <-chan time.Time
+		backoff := o.minBackoff
+		for {
+			select {
+			case <-o.wakeup:
+				backoff = o.minBackoff
+			case <-retry:
+			case <-done:
+				return
+			}
+
+			retry = nil
+			if o.flush() {
+				log.Infof("retrying to send queued status reports in %v", backoff)
+				retry = time.After(backoff)
+				if backoff *= 2; backoff > o.maxBackoff {
+					backoff = o.maxBackoff
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	ms := store.NewMemStore()
+	sc := &stateTestController{}
+
+	// nothing to send
+	pending, err := FlushOutbox(ms, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, "", sc.reportStatus)
+
+	first := client.UpdateResponse{ID: "first"}
+	second := client.UpdateResponse{ID: "second"}
+	assert.NoError(t, QueueStatusReport(ms, first, client.StatusFailure, []byte("logs")))
+	assert.NoError(t, QueueStatusReport(ms, second, client.StatusSuccess, nil))
+
+	// server not reachable, everything stays in the outbox
+	sc.reportError = NewTransientError(errors.New("network down"))
+	pending, err = FlushOutbox(ms, sc)
+	assert.Error(t, err)
+	assert.Equal(t, 2, pending)
+
+	// status delivered, logs not
+	sc.reportError = nil
+	sc.logSendingError = NewTransientError(errors.New("network down"))
+	pending, err = FlushOutbox(ms, sc)
+	assert.Error(t, err)
+	assert.Equal(t, 2, pending)
+	entries, err := loadOutbox(ms)
+	assert.NoError(t, err)
+	assert.True(t, entries[0].StatusSent)
+	assert.False(t, entries[1].StatusSent)
+
+	// status is not sent again, only the logs and the next report
+	sc.logSendingError = nil
+	sc.reportStatus = ""
+	sc.reportError = nil
+	pending, err = FlushOutbox(ms, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, first, sc.logUpdate)
+	assert.Equal(t, []byte("logs"), sc.logs)
+	assert.Equal(t, second, sc.reportUpdate)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	_, err = ms.ReadAll(outboxKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// reports rejected by the server are dropped along with the logs
+	assert.NoError(t, QueueStatusReport(ms, first, client.StatusFailure, []byte("logs")))
+	sc.reportError = NewFatalError(client.ErrDeploymentAborted)
+	sc.logs = nil
+	pending, err = FlushOutbox(ms, sc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+	assert.Nil(t, sc.logs)
+}
+
+func TestOutboxSender(t *testing.T) {
+	ms := store.NewMemStore()
+	sc := &stateTestController{
+		reportError: NewTransientError(errors.New("network down")),
+	}
+	var lock sync.Mutex
+	o := newOutboxSender(ms, sc, &lock)
+	o.minBackoff = 10 * time.Millisecond
+	o.maxBackoff = 20 * time.Millisecond
+	stop := o.start()
+	defer stop()
+
+	pending := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		entries, err := loadOutbox(ms)
+		assert.NoError(t, err)
+		return len(entries)
+	}
+
+	// reports are sent only once the sender is woken up
+	update := client.UpdateResponse{ID: "foo"}
+	lock.Lock()
+	assert.NoError(t, QueueStatusReport(ms, update, client.StatusSuccess, nil))
+	lock.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, "", sc.reportStatus)
+	lock.Unlock()
+
+	o.wake()
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	// connectivity is back, sending is retried without waking up
+	sc.reportError = nil
+	lock.Unlock()
+
+	for i := 0; i < 100 && pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, pending())
+	lock.Lock()
+	assert.Equal(t, update, sc.reportUpdate)
+	lock.Unlock()
+}
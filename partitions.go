@@ -14,9 +14,13 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"syscall"
 
@@ -31,6 +35,27 @@ var (
 	ErrorPartitionNoMatchActive    = errors.New("Active root partition matches neither RootfsPartA nor RootfsPartB.")
 )
 
+// Directories partitions are looked up in; changed when testing.
+var (
+	blockDevDir   = "/dev"
+	diskByDir     = "/dev/disk"
+	sysClassBlock = "/sys/class/block"
+)
+
+// Tags RootfsPartA and RootfsPartB can name partitions by, like root= of the
+// kernel does, for instance PARTLABEL=rootfs-a, with the directories in
+// /dev/disk holding links to the partitions by each tag, and the variables in
+// the uevent file of partitions in sysfs for the tags found there.
+var partitionTags = map[string]struct {
+	byDir  string
+	uevent string
+}{
+	"PARTUUID":  {"by-partuuid", "PARTUUID"},
+	"PARTLABEL": {"by-partlabel", "PARTNAME"},
+	"UUID":      {"by-uuid", ""},
+	"LABEL":     {"by-label", ""},
+}
+
 type partitions struct {
 	StatCommander
 	BootEnvReadWriter
@@ -38,6 +63,11 @@ type partitions struct {
 	rootfsPartB string
 	active      string
 	inactive    string
+	// partitions are regular files instead of block devices
+	files bool
+	// returns the mount candidate for root and the device root is on;
+	// the mount table and stat of / are used if not set
+	mountedRoot func() (string, *syscall.Stat_t, error)
 }
 
 func (p *partitions) GetInactive() (string, error) {
@@ -64,15 +94,27 @@ func (p *partitions) getAndCacheInactivePartition() (string, error) {
 		return "", ErrorPartitionNumberSame
 	}
 
+	partA, err := resolvePartition(p.rootfsPartA)
+	if err != nil {
+		return "", err
+	}
+	partB, err := resolvePartition(p.rootfsPartB)
+	if err != nil {
+		return "", err
+	}
+	if partA == partB {
+		return "", ErrorPartitionNumberSame
+	}
+
 	active, err := p.GetActive()
 	if err != nil {
 		return "", err
 	}
 
-	if active == p.rootfsPartA {
-		p.inactive = p.rootfsPartB
-	} else if active == p.rootfsPartB {
-		p.inactive = p.rootfsPartA
+	if p.samePartition(active, partA) {
+		p.inactive = partB
+	} else if p.samePartition(active, partB) {
+		p.inactive = partA
 	} else {
 		return "", ErrorPartitionNoMatchActive
 	}
@@ -149,17 +191,11 @@ func getRootFromMountedDevices(sc StatCommander,
 
 func (p *partitions) getAndCacheActivePartition(rootChecker func(StatCommander, string, *syscall.Stat_t) bool,
 	getMountedDevices func(string) ([]string, error)) (string, error) {
-	mountData, err := p.Command("mount").Output()
+	mountCandidate, rootDevice, err := p.getMountedRoot()
 	if err != nil {
 		return "", err
 	}
 
-	mountCandidate := getRootCandidateFromMount(mountData)
-	rootDevice := getRootDevice(p)
-	if rootDevice == nil {
-		return "", errors.New("Can not find root device")
-	}
-
 	// Fetch active partition from ENV
 	bootEnvBootPart, err := getBootEnvActivePartition(p.BootEnvReadWriter)
 	if err != nil {
@@ -203,6 +239,23 @@ func (p *partitions) getAndCacheActivePartition(rootChecker func(StatCommander,
 	return "", ErrorNoMatchBootPartRootPart
 }
 
+func (p *partitions) getMountedRoot() (string, *syscall.Stat_t, error) {
+	if p.mountedRoot != nil {
+		return p.mountedRoot()
+	}
+
+	mountData, err := p.Command("mount").Output()
+	if err != nil {
+		return "", nil, err
+	}
+
+	rootDevice := getRootDevice(p)
+	if rootDevice == nil {
+		return "", nil, errors.New("Can not find root device")
+	}
+	return getRootCandidateFromMount(mountData), rootDevice, nil
+}
+
 func getBootEnvActivePartition(env BootEnvReadWriter) (string, error) {
 	bootEnv, err := env.ReadEnv("mender_boot_part")
 	if err != nil {
@@ -214,5 +267,132 @@ func getBootEnvActivePartition(env BootEnvReadWriter) (string, error) {
 }
 
 func checkBootEnvAndRootPartitionMatch(bootPartNum string, rootPart string) bool {
-	return strings.HasSuffix(rootPart, bootPartNum)
+	num, err := partitionNumber(rootPart)
+	return err == nil && num == bootPartNum
+}
+
+// samePartition tells if `a` and `b` are the same partition, by path or, for
+// device files, by device number.
+func (p *partitions) samePartition(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if resolved, err := filepath.EvalSymlinks(a); err == nil && resolved == b {
+		return true
+	}
+
+	statA, err := p.Stat(a)
+	if err != nil || statA.Mode()&os.ModeDevice == 0 {
+		return false
+	}
+	statB, err := p.Stat(b)
+	if err != nil || statB.Mode()&os.ModeDevice == 0 {
+		return false
+	}
+	return statA.Sys().(*syscall.Stat_t).Rdev == statB.Sys().(*syscall.Stat_t).Rdev
+}
+
+// resolvePartition returns the path of the partition named by `spec`, either a
+// path or TAG=value with one of partitionTags. Tagged partitions are looked up
+// in the links udev maintains in /dev/disk, or in sysfs without them. Paths
+// that are symbolic links are resolved.
+func resolvePartition(spec string) (string, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		if filepath.IsAbs(spec) {
+			if dev, err := filepath.EvalSymlinks(spec); err == nil {
+				return dev, nil
+			}
+		}
+		return spec, nil
+	}
+
+	tag, value := spec[:i], spec[i+1:]
+	t, ok := partitionTags[tag]
+	if !ok || value == "" {
+		return "", fmt.Errorf("invalid partition %s, expected a path or one of "+
+			"PARTUUID=, PARTLABEL=, UUID= or LABEL=", spec)
+	}
+
+	dev, err := filepath.EvalSymlinks(filepath.Join(diskByDir, t.byDir, value))
+	if err == nil {
+		log.Debugf("partition %s is %s", spec, dev)
+		return dev, nil
+	}
+	if t.uevent != "" {
+		if dev, serr := findPartitionInSysfs(t.uevent, value); serr == nil {
+			log.Debugf("partition %s is %s, found in sysfs", spec, dev)
+			return dev, nil
+		}
+	}
+	return "", fmt.Errorf("partition %s not found: %v", spec, err)
+}
+
+// findPartitionInSysfs returns the path of the partition with `value` of
+// variable `key` in its uevent file in sysfs.
+func findPartitionInSysfs(key, value string) (string, error) {
+	entries, err := ioutil.ReadDir(sysClassBlock)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		vars, err := readUevent(filepath.Join(sysClassBlock, entry.Name(), "uevent"))
+		if err != nil || vars["DEVTYPE"] != "partition" {
+			continue
+		}
+		// UUIDs are compared regardless of case
+		if strings.EqualFold(vars[key], value) {
+			name := vars["DEVNAME"]
+			if name == "" {
+				name = entry.Name()
+			}
+			return filepath.Join(blockDevDir, name), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func readUevent(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			vars[kv[0]] = kv[1]
+		}
+	}
+	return vars, scanner.Err()
+}
+
+// partitionNumber returns the number of partition `dev`, as set in
+// mender_boot_part, from its partition attribute in sysfs. Devices without one,
+// like UBI volumes, loop devices or regular files standing in for partitions,
+// are numbered by the digits their name ends with.
+func partitionNumber(dev string) (string, error) {
+	name := filepath.Base(dev)
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		name = filepath.Base(resolved)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(sysClassBlock, name, "partition"))
+	if err == nil {
+		if num := strings.TrimSpace(string(data)); num != "" {
+			return num, nil
+		}
+	}
+
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	if i == len(name) {
+		return "", fmt.Errorf("partition number of %s is not known", dev)
+	}
+	return name[i:], nil
 }
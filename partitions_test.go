@@ -15,8 +15,10 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strings"
 	"syscall"
@@ -224,3 +226,150 @@ func Test_getAllMountedDevices(t *testing.T) {
 	sort.Sort(actual)
 	assert.Equal(t, actual, sort.StringSlice(expected))
 }
+
+// fakePartitionDirs makes a /dev, /dev/disk and /sys/class/block in a
+// temporary directory, to be removed by the returned function
+func fakePartitionDirs(t *testing.T) (string, func()) {
+	tdir, err := ioutil.TempDir("", "partitions")
+	assert.NoError(t, err)
+	tdir, _ = filepath.EvalSymlinks(tdir)
+
+	oldDev, oldDisk, oldSys := blockDevDir, diskByDir, sysClassBlock
+	blockDevDir = filepath.Join(tdir, "dev")
+	diskByDir = filepath.Join(tdir, "dev", "disk")
+	sysClassBlock = filepath.Join(tdir, "sys", "class", "block")
+
+	for _, dir := range []string{diskByDir, sysClassBlock} {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	return tdir, func() {
+		blockDevDir, diskByDir, sysClassBlock = oldDev, oldDisk, oldSys
+		os.RemoveAll(tdir)
+	}
+}
+
+func fakeBlockPartition(t *testing.T, name, num, uevent string) string {
+	dev := filepath.Join(blockDevDir, name)
+	assert.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+	sys := filepath.Join(sysClassBlock, name)
+	assert.NoError(t, os.MkdirAll(sys, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sys, "partition"),
+		[]byte(num+"\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(sys, "uevent"),
+		[]byte("DEVTYPE=partition\nDEVNAME="+name+"\n"+uevent), 0644))
+	return dev
+}
+
+func TestResolvePartition(t *testing.T) {
+	_, cleanup := fakePartitionDirs(t)
+	defer cleanup()
+
+	partA := fakeBlockPartition(t, "nvme0n1p10", "10",
+		"PARTN=10\nPARTNAME=rootfs-a\nPARTUUID=6a1d2f3e-0a\n")
+	partB := fakeBlockPartition(t, "nvme0n1p11", "11",
+		"PARTN=11\nPARTNAME=rootfs-b\nPARTUUID=6a1d2f3e-0b\n")
+
+	byLabel := filepath.Join(diskByDir, "by-label")
+	assert.NoError(t, os.MkdirAll(byLabel, 0755))
+	assert.NoError(t, os.Symlink("../../nvme0n1p10", filepath.Join(byLabel, "root-a")))
+
+	dev, err := resolvePartition("LABEL=root-a")
+	assert.NoError(t, err)
+	assert.Equal(t, partA, dev)
+
+	// without udev links, partitions are found in sysfs
+	dev, err = resolvePartition("PARTLABEL=rootfs-b")
+	assert.NoError(t, err)
+	assert.Equal(t, partB, dev)
+	dev, err = resolvePartition("PARTUUID=6A1D2F3E-0A")
+	assert.NoError(t, err)
+	assert.Equal(t, partA, dev)
+
+	_, err = resolvePartition("UUID=1234")
+	assert.Error(t, err)
+	_, err = resolvePartition("PARTLABEL=rootfs-c")
+	assert.Error(t, err)
+	_, err = resolvePartition("SERIAL=1234")
+	assert.Error(t, err)
+	_, err = resolvePartition("LABEL=")
+	assert.Error(t, err)
+
+	// paths are used as they are, unless they are links
+	dev, err = resolvePartition("/dev/mmcblk0p2")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmcblk0p2", dev)
+	dev, err = resolvePartition(filepath.Join(byLabel, "root-a"))
+	assert.NoError(t, err)
+	assert.Equal(t, partA, dev)
+	dev, err = resolvePartition("ubi0_1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ubi0_1", dev)
+}
+
+func TestPartitionNumber(t *testing.T) {
+	_, cleanup := fakePartitionDirs(t)
+	defer cleanup()
+
+	part := fakeBlockPartition(t, "nvme0n1p10", "10", "")
+	link := filepath.Join(diskByDir, "rootfs")
+	assert.NoError(t, os.Symlink(part, link))
+
+	for dev, num := range map[string]string{
+		part:             "10",
+		link:             "10",
+		"/dev/mmcblk0p2": "2",
+		"/dev/loop12":    "12",
+		"ubi0_1":         "1",
+		"/tmp/part3":     "3",
+	} {
+		n, err := partitionNumber(dev)
+		assert.NoError(t, err)
+		assert.Equal(t, num, n, dev)
+	}
+
+	_, err := partitionNumber("/dev/sda")
+	assert.Error(t, err)
+
+	assert.True(t, checkBootEnvAndRootPartitionMatch("10", part))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("0", part))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("", "/dev/sda"))
+}
+
+func TestGetInactiveTaggedPartitions(t *testing.T) {
+	_, cleanup := fakePartitionDirs(t)
+	defer cleanup()
+
+	partA := fakeBlockPartition(t, "nvme0n1p10", "10", "PARTNAME=rootfs-a\n")
+	partB := fakeBlockPartition(t, "nvme0n1p11", "11", "PARTNAME=rootfs-b\n")
+
+	env := &fakeBootEnv{}
+	d := NewDevice(env, new(osCalls), deviceConfig{
+		rootfsPartA: "PARTLABEL=rootfs-a",
+		rootfsPartB: "PARTLABEL=rootfs-b",
+	})
+	d.active = partB
+
+	inactive, err := d.GetInactive()
+	assert.NoError(t, err)
+	assert.Equal(t, partA, inactive)
+
+	assert.NoError(t, d.EnableUpdatedPartition())
+	assert.Equal(t, "10", env.writeVars["mender_boot_part"])
+
+	// both name the same partition
+	d = NewDevice(env, new(osCalls), deviceConfig{
+		rootfsPartA: "PARTLABEL=rootfs-a",
+		rootfsPartB: partA,
+	})
+	d.active = partA
+	_, err = d.GetInactive()
+	assert.Equal(t, ErrorPartitionNumberSame, err)
+
+	d = NewDevice(env, new(osCalls), deviceConfig{
+		rootfsPartA: "PARTLABEL=rootfs-a",
+		rootfsPartB: "PARTLABEL=rootfs-c",
+	})
+	d.active = partA
+	_, err = d.GetInactive()
+	assert.Error(t, err)
+}
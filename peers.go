@@ -0,0 +1,242 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Devices on the same network can share artifacts: once an artifact has been
+// installed, and thereby verified, it is kept in the data store directory and
+// served over HTTPS to the peers, which try their peers before downloading
+// from the server. Peers are not trusted; the artifact signature is verified
+// while installing, same as for artifacts coming from the server.
+
+const (
+	peerArtifactsPath = "/artifacts/"
+	peerArtifactFile  = "peer-artifact"
+	peerStagingFile   = "peer-artifact.tmp"
+	peerMetaFile      = "peer-artifact.json"
+)
+
+// peerArtifact describes the artifact available to peers
+type peerArtifact struct {
+	ArtifactName string
+	Size         int64
+}
+
+type peerCache struct {
+	dir  string
+	lock sync.RWMutex
+}
+
+func newPeerCache(dir string) *peerCache {
+	return &peerCache{dir: dir}
+}
+
+// stage returns reader copying everything read from `in` to the staging
+// file; finish() must be called once done
+func (pc *peerCache) stage(in io.Reader) *stagingReader {
+	f, err := os.Create(path.Join(pc.dir, peerStagingFile))
+	if err != nil {
+		log.Errorf("failed to create artifact staging file, "+
+			"artifact will not be shared: %v", err)
+	}
+	return &stagingReader{r: in, file: f, err: err}
+}
+
+// unstage removes the staging file, as the artifact is not read in full
+func (pc *peerCache) unstage() {
+	err := os.Remove(path.Join(pc.dir, peerStagingFile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove artifact staging file: %v", err)
+	}
+}
+
+type stagingReader struct {
+	r    io.Reader
+	file *os.File
+	err  error
+}
+
+func (s *stagingReader) Read(buf []byte) (int, error) {
+	n, err := s.r.Read(buf)
+	if n > 0 && s.err == nil {
+		_, s.err = s.file.Write(buf[:n])
+	}
+	return n, err
+}
+
+func (s *stagingReader) finish() error {
+	if s.file == nil {
+		return s.err
+	}
+	if err := s.file.Close(); s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		os.Remove(s.file.Name())
+	}
+	return s.err
+}
+
+// commit makes the staged artifact available to peers as `name`
+func (pc *peerCache) commit(name string) error {
+	staged := path.Join(pc.dir, peerStagingFile)
+	fi, err := os.Stat(staged)
+	if err != nil {
+		return errors.Wrapf(err, "no staged artifact")
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if err := os.Rename(staged, path.Join(pc.dir, peerArtifactFile)); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(peerArtifact{
+		ArtifactName: name,
+		Size:         fi.Size(),
+	})
+	return writeFileSync(path.Join(pc.dir, peerMetaFile), data)
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// open returns the shared artifact, if it is `name`
+func (pc *peerCache) open(name string) (*os.File, error) {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+
+	data, err := ioutil.ReadFile(path.Join(pc.dir, peerMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta peerArtifact
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	if meta.ArtifactName != name {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(path.Join(pc.dir, peerArtifactFile))
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != meta.Size {
+		f.Close()
+		return nil, errors.New("shared artifact does not match its description")
+	}
+	return f, nil
+}
+
+// ServeHTTP serves GET /artifacts/<artifact name>
+func (pc *peerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, peerArtifactsPath) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, peerArtifactsPath)
+
+	f, err := pc.open(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to open shared artifact: %v", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	log.Infof("serving artifact %s to peer %s", name, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
+
+// peerArtifactURL returns URL of artifact `name` at `peer`
+func peerArtifactURL(peer, name string) string {
+	return strings.TrimRight(peer, "/") + peerArtifactsPath + url.PathEscape(name)
+}
+
+// peers that are down should not hold up the download for long
+var peerConnectTimeout = 5 * time.Second
+
+func newPeerAPI(config peerSharingConfig) (*client.ApiClient, error) {
+	api, err := client.New(client.Config{
+		ServerCert: config.ServerCertificate,
+		// peers are not trusted anyway, see above
+		NoVerify: config.ServerCertificate == "",
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create peer HTTP client")
+	}
+	api.Transport.(*http.Transport).DialContext = (&net.Dialer{
+		Timeout: peerConnectTimeout,
+	}).DialContext
+	return api, nil
+}
+
+// listenPeers starts serving the shared artifact over HTTPS
+func listenPeers(config peerSharingConfig, handler http.Handler) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load peer sharing certificate")
+	}
+	ln, err := tls.Listen("tcp", config.ListenAddress, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for peers")
+	}
+
+	go func() {
+		err := http.Serve(ln, handler)
+		log.Infof("stopped serving artifacts to peers: %v", err)
+	}()
+	return ln, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCache(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	pc := newPeerCache(tdir)
+
+	// nothing shared yet
+	rec := httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/artifacts/release-1", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Error(t, pc.commit("release-1"))
+
+	data := []byte("artifact data")
+	staged := pc.stage(bytes.NewReader(data))
+	out, err := ioutil.ReadAll(staged)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.NoError(t, staged.finish())
+	assert.NoError(t, pc.commit("release 1"))
+
+	rec = httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		peerArtifactURL("http://peer/", "release 1"), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+
+	// ranges are supported, for resuming and parallel downloads
+	req := httptest.NewRequest(http.MethodGet, "/artifacts/release%201", nil)
+	req.Header.Set("Range", "bytes=9-")
+	rec = httptest.NewRecorder()
+	pc.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "data", rec.Body.String())
+
+	// only the shared artifact is served
+	for _, p := range []string{"/artifacts/release-2", "/", "/artifacts/"} {
+		rec = httptest.NewRecorder()
+		pc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, p)
+	}
+	rec = httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/artifacts/release%201", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// shared artifact that was tampered with is not served
+	assert.NoError(t, ioutil.WriteFile(path.Join(tdir, peerArtifactFile),
+		[]byte("evil"), 0644))
+	rec = httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/artifacts/release%201", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMenderPeers(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	key := path.Join(tdir, "artifact-verify-key.pem")
+	assert.NoError(t, ioutil.WriteFile(key, []byte("key"), 0644))
+
+	// device sharing the artifact it has installed
+	data := make([]byte, 8192)
+	_, err = rand.Read(data)
+	assert.NoError(t, err)
+
+	sharing := newTestMender(nil, menderConfig{
+		ServerURL: "https://server",
+		PeerSharing: peerSharingConfig{
+			Enabled:       true,
+			ListenAddress: "127.0.0.1:0",
+			Certificate:   "client/client.crt",
+			Key:           "client/client.key",
+			Directory:     tdir,
+		},
+	}, testMenderPieces{})
+	assert.NotNil(t, sharing.peerCache)
+
+	staged := sharing.peerCache.stage(bytes.NewReader(data))
+	_, err = ioutil.ReadAll(staged)
+	assert.NoError(t, err)
+	assert.NoError(t, staged.finish())
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-1"
+	assert.NoError(t, sharing.ShareUpdate(update))
+
+	ln, err := listenPeers(sharing.config.PeerSharing, sharing.peerCache)
+	assert.NoError(t, err)
+	defer ln.Close()
+	peer := "https://" + ln.Addr().String()
+
+	// device downloading from the peers, the first of which is down
+	conf := menderConfig{
+		ServerURL:         "https://server",
+		ArtifactVerifyKey: key,
+		PeerSharing: peerSharingConfig{
+			Enabled: true,
+			Peers:   []string{"https://127.0.0.1:1", peer},
+		},
+	}
+	m := newTestMender(nil, conf, testMenderPieces{
+		MenderPieces: MenderPieces{store: store.NewMemStore()},
+	})
+	assert.Nil(t, m.peerCache)
+	assert.NoError(t, m.ShareUpdate(update))
+
+	in, size, err := m.FetchUpdateFromPeers(update)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	out, err := ioutil.ReadAll(in)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, out))
+	in.Close()
+
+	// artifact the peers do not have
+	other := update
+	other.Artifact.ArtifactName = "release-2"
+	_, _, err = m.FetchUpdateFromPeers(other)
+	assert.Error(t, err)
+
+	// peers are not used without verification key
+	m.config.ArtifactVerifyKey = ""
+	_, _, err = m.FetchUpdateFromPeers(update)
+	assert.Error(t, err)
+}
+
+func TestMenderPeersOtherArtifact(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	key := path.Join(tdir, "artifact-verify-key.pem")
+	assert.NoError(t, ioutil.WriteFile(key, []byte(PublicRSAKey), 0644))
+
+	// peer serving a validly signed artifact, named "large", as "release-1"
+	art := makeLargeArtifact(t, tdir, 64*1024, true, []string{"vexpress-qemu"})
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(art)))
+			w.Write(art)
+		}))
+	defer srv.Close()
+
+	part := path.Join(tdir, "part3")
+	assert.NoError(t, ioutil.WriteFile(part, make([]byte, 128*1024), 0600))
+	dev := NewDevice(nil, nil, deviceConfig{})
+	dev.files = true
+	dev.inactive = part
+
+	m := newTestMender(nil, menderConfig{
+		ServerURL:         "https://server",
+		ArtifactVerifyKey: key,
+		PeerSharing: peerSharingConfig{
+			Enabled: true,
+			Peers:   []string{srv.URL},
+		},
+	}, testMenderPieces{
+		MenderPieces: MenderPieces{device: dev, store: store.NewMemStore()},
+	})
+	m.deviceTypeFile = path.Join(tdir, "device_type")
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-1"
+	in, size, err := m.FetchUpdateFromPeers(update)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer in.Close()
+
+	// it is rejected before anything is written
+	err = m.ResumeUpdate(in, size, update.ArtifactName(), nil,
+		func(InstallCheckpoint) error { return nil })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"large" does not match the expected "release-1"`)
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, make([]byte, 128*1024), data)
+}
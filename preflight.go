@@ -0,0 +1,124 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Before downloading an artifact, its beginning up to the data is fetched with
+// range requests and checked the way the installer would, so that artifacts
+// that can not be installed are rejected without downloading all of them.
+
+const (
+	// size of the first range of the artifact fetched; every next one is
+	// twice as large
+	preflightChunkSize = 64 * 1024
+	// artifact headers, state scripts included, are not expected to be
+	// larger than this
+	preflightMaxSize = 16 * 1024 * 1024
+)
+
+// checkArtifactHeader reads the artifact from `r` up to its data, verifying
+// its version, manifest, signature with `key`, compatibility with
+// `deviceType`, state scripts and update headers
+func checkArtifactHeader(r io.Reader, key []byte, deviceType string) error {
+	ar := newArtifactReader(r, key)
+
+	ar.CompatibleDevicesCallback = func(devices []string) error {
+		if !deviceCompatible(deviceType, devices) {
+			return errors.Errorf("artifact (device types %v) not compatible with device %v",
+				devices, deviceType)
+		}
+		return nil
+	}
+
+	// the installer fails on scripts stored twice
+	scripts := map[string]bool{}
+	ar.ScriptsReadCallback = func(r io.Reader, fi os.FileInfo) error {
+		if scripts[fi.Name()] {
+			return errors.Errorf("state script %s included more than once", fi.Name())
+		}
+		scripts[fi.Name()] = true
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	rootfs := handlers.NewRootfsInstaller()
+	rootfs.InstallHandler = func(io.Reader, *handlers.DataFile) error {
+		return errArtifactHeaderRead
+	}
+	if err := ar.RegisterHandler(rootfs); err != nil {
+		return err
+	}
+
+	err := ar.ReadArtifact()
+	if errors.Cause(err) != errArtifactHeaderRead {
+		if err == nil {
+			err = errors.New("artifact without data")
+		}
+		return err
+	}
+	if key != nil && ar.GetInfo().Version < 2 {
+		return errors.New("artifact is not signed")
+	}
+	return nil
+}
+
+// fetchErrorReader records errors of reading from the underlying reader,
+// telling them from problems with the data read
+type fetchErrorReader struct {
+	io.Reader
+	err error
+}
+
+func (r *fetchErrorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// PreflightUpdate checks the header of the artifact of `update` before it is
+// downloaded. The error is fatal if the artifact can not be installed, and
+// transient if the header could not be checked.
+func (m *mender) PreflightUpdate(update client.UpdateResponse) menderError {
+	deviceType, err := m.GetDeviceType()
+	if err != nil {
+		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v",
+			m.deviceTypeFile, err)
+	}
+
+	rr := client.NewRangeReader(m.api, update.URI(), preflightChunkSize, preflightMaxSize)
+	defer rr.Close()
+	r := &fetchErrorReader{Reader: rr}
+
+	err = checkArtifactHeader(r, m.GetArtifactVerifyKey(), deviceType)
+	switch {
+	case err == nil:
+		return nil
+	case r.err != nil:
+		return NewTransientError(errors.Wrapf(r.err, "failed to fetch artifact header"))
+	default:
+		return NewFatalError(errors.Wrapf(err, "artifact rejected"))
+	}
+}
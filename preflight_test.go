@@ -0,0 +1,182 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeLargeArtifact returns an artifact with an image of `size` random bytes,
+// which do not compress
+func makeLargeArtifact(t *testing.T, dir string, size int, signed bool,
+	devices []string) []byte {
+
+	img := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(img)
+	name := path.Join(dir, "image")
+	assert.NoError(t, ioutil.WriteFile(name, img, 0600))
+	defer os.Remove(name)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art)
+	if signed {
+		aw = awriter.NewWriterSigned(art, artifact.NewSigner([]byte(PrivateRSAKey)))
+	}
+	updates := &awriter.Updates{U: []handlers.Composer{handlers.NewRootfsV2(name)}}
+	assert.NoError(t, aw.WriteArtifact("mender", 2, devices, "large", updates, nil))
+	return art.Bytes()
+}
+
+// artifactServer serves an artifact, counting the bytes sent
+type artifactServer struct {
+	data     []byte
+	noRanges bool
+
+	lock sync.Mutex
+	sent int
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	s *artifactServer
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.s.lock.Lock()
+	w.s.sent += n
+	w.s.lock.Unlock()
+	return n, err
+}
+
+func (s *artifactServer) bytesSent() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sent
+}
+
+func (s *artifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cw := countingWriter{w, s}
+	if s.noRanges {
+		cw.WriteHeader(http.StatusOK)
+		cw.Write(s.data)
+		return
+	}
+	http.ServeContent(cw, r, "artifact", time.Time{}, bytes.NewReader(s.data))
+}
+
+func TestPreflightUpdate(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "preflight")
+	defer os.RemoveAll(tdir)
+
+	key := path.Join(tdir, "artifact-verify-key.pem")
+	assert.NoError(t, ioutil.WriteFile(key, []byte(PublicRSAKey), 0644))
+	deviceType := path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu"), 0644))
+
+	// every artifact gets a server of its own, so that handlers still
+	// running for the previous one can not interfere
+	var servers []*httptest.Server
+	defer func() {
+		for _, ts := range servers {
+			ts.Close()
+		}
+	}()
+	serve := func(srv *artifactServer) client.UpdateResponse {
+		ts := httptest.NewServer(srv)
+		servers = append(servers, ts)
+		update := client.UpdateResponse{ID: "foo"}
+		update.Artifact.Source.URI = ts.URL + "/artifact"
+		return update
+	}
+
+	size := 4 * 1024 * 1024
+	unsigned := makeLargeArtifact(t, tdir, size, false, []string{"vexpress-qemu"})
+	signed := makeLargeArtifact(t, tdir, size, true, []string{"vexpress-qemu"})
+	other := makeLargeArtifact(t, tdir, size, false, []string{"beaglebone"})
+
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	m.deviceTypeFile = deviceType
+
+	// only the header is downloaded
+	srv := &artifactServer{data: unsigned}
+	assert.Nil(t, m.PreflightUpdate(serve(srv)))
+	assert.True(t, srv.bytesSent() < size/16, "%d bytes sent", srv.bytesSent())
+
+	merr := m.PreflightUpdate(serve(&artifactServer{data: other}))
+	if assert.NotNil(t, merr) {
+		assert.True(t, merr.IsFatal())
+		assert.Contains(t, merr.Error(), "not compatible with device vexpress-qemu")
+	}
+
+	// signature is required with a key
+	m = newTestMender(nil, menderConfig{ArtifactVerifyKey: key}, testMenderPieces{})
+	m.deviceTypeFile = deviceType
+
+	merr = m.PreflightUpdate(serve(&artifactServer{data: unsigned}))
+	if assert.NotNil(t, merr) {
+		assert.True(t, merr.IsFatal())
+	}
+
+	srv = &artifactServer{data: signed}
+	assert.Nil(t, m.PreflightUpdate(serve(srv)))
+	assert.True(t, srv.bytesSent() < size/16, "%d bytes sent", srv.bytesSent())
+
+	// tampered manifest fails verification
+	corrupt := append([]byte{}, signed...)
+	i := bytes.Index(corrupt, []byte("  header.tar.gz\n"))
+	assert.True(t, i > 0)
+	if corrupt[i-1] == '0' {
+		corrupt[i-1] = '1'
+	} else {
+		corrupt[i-1] = '0'
+	}
+	merr = m.PreflightUpdate(serve(&artifactServer{data: corrupt}))
+	if assert.NotNil(t, merr) {
+		assert.True(t, merr.IsFatal())
+	}
+
+	// server without range support; the rest of the artifact is not read
+	assert.Nil(t, m.PreflightUpdate(serve(&artifactServer{data: signed, noRanges: true})))
+
+	// header can not be checked
+	update := serve(&artifactServer{data: signed})
+	update.Artifact.Source.URI += "\x7f"
+	merr = m.PreflightUpdate(update)
+	if assert.NotNil(t, merr) {
+		assert.False(t, merr.IsFatal())
+	}
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	update.Artifact.Source.URI = unreachable.URL + "/artifact"
+	merr = m.PreflightUpdate(update)
+	if assert.NotNil(t, merr) {
+		assert.False(t, merr.IsFatal())
+	}
+	unreachable.Close()
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service manager notifications, see sd_notify(3). Only the protocol is
+// implemented, so that the daemon does not depend on libsystemd.
+
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+	sdNotifyStatus   = "STATUS="
+
+	// keep a busy service manager from holding up the daemon
+	sdNotifyTimeout = time.Second
+)
+
+type sdNotifier struct {
+	// datagram socket of the service manager
+	addr *net.UnixAddr
+	// interval the service manager expects watchdog pings within; 0 if the
+	// watchdog is disabled
+	watchdog time.Duration
+}
+
+// newSdNotifier returns a notifier for the service manager the process runs
+// under, as told by $NOTIFY_SOCKET, or nil if there is none.
+func newSdNotifier() *sdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+
+	n := &sdNotifier{
+		addr: &net.UnixAddr{Name: socket, Net: "unixgram"},
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return n
+	}
+	// the watchdog may be meant for another process of the service
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+	n.watchdog = time.Duration(usec) * time.Microsecond
+	return n
+}
+
+// notify sends a single message with one variable assignment per line
+func (n *sdNotifier) notify(vars ...string) error {
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetWriteDeadline(time.Now().Add(sdNotifyTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(strings.Join(vars, "\n")))
+	return err
+}
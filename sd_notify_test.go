@@ -0,0 +1,421 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func setNotifyEnv(t *testing.T, vars map[string]string) func() {
+	saved := map[string]string{}
+	for _, k := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		saved[k] = os.Getenv(k)
+		os.Unsetenv(k)
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range saved {
+			if v == "" {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, v)
+			}
+		}
+	}
+}
+
+// listenNotify stands in for the service manager
+func listenNotify(t *testing.T) (string, *net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return path, conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSdNotifier(t *testing.T) {
+	restore := setNotifyEnv(t, nil)
+	assert.Nil(t, newSdNotifier())
+	restore()
+
+	restore = setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": "@mender/notify",
+		"WATCHDOG_USEC": "bogus",
+	})
+	n := newSdNotifier()
+	assert.Equal(t, "\x00mender/notify", n.addr.Name)
+	assert.Equal(t, time.Duration(0), n.watchdog)
+	restore()
+
+	restore = setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": "/run/notify",
+		"WATCHDOG_USEC": "3000000",
+		"WATCHDOG_PID":  strconv.Itoa(os.Getpid() + 1),
+	})
+	assert.Equal(t, time.Duration(0), newSdNotifier().watchdog)
+	restore()
+
+	restore = setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": "/run/notify",
+		"WATCHDOG_USEC": "3000000",
+		"WATCHDOG_PID":  strconv.Itoa(os.Getpid()),
+	})
+	assert.Equal(t, 3*time.Second, newSdNotifier().watchdog)
+	restore()
+
+	path, conn, cleanup := listenNotify(t)
+	defer cleanup()
+	restore = setNotifyEnv(t, map[string]string{"NOTIFY_SOCKET": path})
+	defer restore()
+
+	n = newSdNotifier()
+	assert.NoError(t, n.notify(sdNotifyReady, sdNotifyStatus+"init"))
+
+	buf := make([]byte, 256)
+	sz, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "READY=1\nSTATUS=init", string(buf[:sz]))
+
+	cleanup()
+	assert.Error(t, n.notify(sdNotifyStopping))
+}
+
+type sdTestWaitState struct {
+	WaitState
+	next State
+	wait time.Duration
+}
+
+func (s *sdTestWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	return s.Wait(s.next, s, s.wait)
+}
+
+type sdTestStuckState struct {
+	baseState
+	stuck time.Duration
+}
+
+func (s *sdTestStuckState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	time.Sleep(s.stuck)
+	return doneState, false
+}
+
+type sdTestMessage struct {
+	msg string
+	at  time.Time
+}
+
+func TestDaemonSdNotify(t *testing.T) {
+	path, conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	watchdog := 200 * time.Millisecond
+	restore := setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": path,
+		"WATCHDOG_USEC": strconv.FormatInt(int64(watchdog/time.Microsecond), 10),
+	})
+	defer restore()
+
+	stuck := &sdTestStuckState{
+		baseState: baseState{id: MenderStateInventoryUpdate},
+		stuck:     4 * watchdog,
+	}
+	wait := &sdTestWaitState{
+		WaitState: NewWaitState(MenderStateCheckWait, ToIdle),
+		next:      stuck,
+		wait:      3 * watchdog,
+	}
+
+	dtc := &daemonTestController{
+		stateTestController{state: wait},
+		0,
+	}
+	daemon := NewDaemon(dtc, store.NewMemStore())
+
+	// keep reading while the daemon runs; notifications block once the
+	// socket queue is full
+	msgs := make(chan sdTestMessage, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			sz, err := conn.Read(buf)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- sdTestMessage{string(buf[:sz]), time.Now()}
+		}
+	}()
+
+	assert.NoError(t, daemon.Run())
+
+	var got []sdTestMessage
+	timeout := time.After(time.Second)
+collect:
+	for {
+		select {
+		case m := <-msgs:
+			got = append(got, m)
+			if m.msg == sdNotifyStopping {
+				break collect
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+
+	var waitPings, stuckPings int
+	var stuckAt time.Time
+	var statuses []string
+	for _, m := range got {
+		switch {
+		case m.msg == sdNotifyWatchdog && stuckAt.IsZero():
+			waitPings++
+		case m.msg == sdNotifyWatchdog && m.at.Sub(stuckAt) > watchdog+watchdog/2:
+			stuckPings++
+		case strings.Contains(m.msg, sdNotifyStatus):
+			statuses = append(statuses, m.msg)
+			if m.msg == sdNotifyStatus+"inventory-update" {
+				stuckAt = m.at
+			}
+		}
+	}
+
+	if !assert.NotEmpty(t, got) {
+		return
+	}
+	assert.Equal(t, "READY=1\nSTATUS=check-wait", got[0].msg)
+	assert.Equal(t, sdNotifyStopping, got[len(got)-1].msg)
+	assert.Equal(t, []string{
+		"READY=1\nSTATUS=check-wait",
+		"STATUS=check-wait",
+		"STATUS=inventory-update",
+	}, statuses)
+
+	// waiting keeps the watchdog happy no matter how long it takes
+	assert.True(t, waitPings >= 3, "only %d pings while waiting", waitPings)
+	// a state taking longer than the watchdog interval does not
+	assert.Equal(t, 0, stuckPings)
+}
+
+// sdTestProgressState takes long, but keeps reporting progress
+type sdTestProgressState struct {
+	baseState
+	took     time.Duration
+	interval time.Duration
+}
+
+func (s *sdTestProgressState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	progress := c.(*sdTestProgressController).progress
+	for start := time.Now(); time.Since(start) < s.took; {
+		time.Sleep(s.interval)
+		progress()
+	}
+	return doneState, false
+}
+
+type sdTestProgressController struct {
+	daemonTestController
+	progress func()
+}
+
+func (c *sdTestProgressController) trackProgress(f func()) {
+	c.progress = f
+}
+
+func (c *sdTestProgressController) TransitionState(next State, ctx *StateContext) (State, bool) {
+	next, cancel := c.state.Handle(ctx, c)
+	c.state = next
+	return next, cancel
+}
+
+func TestDaemonSdNotifyProgress(t *testing.T) {
+	path, conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	watchdog := 200 * time.Millisecond
+	restore := setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": path,
+		"WATCHDOG_USEC": strconv.FormatInt(int64(watchdog/time.Microsecond), 10),
+	})
+	defer restore()
+
+	dtc := &sdTestProgressController{}
+	dtc.state = &sdTestProgressState{
+		baseState: baseState{id: MenderStateUpdateStore},
+		took:      4 * watchdog,
+		interval:  watchdog / 4,
+	}
+	daemon := NewDaemon(dtc, store.NewMemStore())
+
+	msgs := make(chan sdTestMessage, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			sz, err := conn.Read(buf)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- sdTestMessage{string(buf[:sz]), time.Now()}
+		}
+	}()
+
+	assert.NoError(t, daemon.Run())
+
+	var started time.Time
+	var latePings int
+	timeout := time.After(time.Second)
+collect:
+	for {
+		select {
+		case m := <-msgs:
+			switch {
+			case started.IsZero():
+				started = m.at
+			case m.msg == sdNotifyWatchdog && m.at.Sub(started) > 2*watchdog:
+				latePings++
+			case m.msg == sdNotifyStopping:
+				break collect
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+
+	// the state takes longer than the watchdog interval, but is not stuck
+	assert.True(t, latePings > 0, "no pings while making progress")
+}
+
+// sdTestScriptState is entered through the ArtifactReboot_Enter scripts
+type sdTestScriptState struct {
+	baseState
+}
+
+func (s *sdTestScriptState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	return doneState, false
+}
+
+func TestDaemonSdNotifyScripts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow state scripts in short tests")
+	}
+
+	path, conn, cleanup := listenNotify(t)
+	defer cleanup()
+
+	// progress is reported every second while scripts run
+	watchdog := 1500 * time.Millisecond
+	restore := setNotifyEnv(t, map[string]string{
+		"NOTIFY_SOCKET": path,
+		"WATCHDOG_USEC": strconv.FormatInt(int64(watchdog/time.Microsecond), 10),
+	})
+	defer restore()
+
+	tdir, err := ioutil.TempDir("", "sdnotify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// postpones the reboot once, and is slow the second time
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tdir, "version"), []byte("2"), 0644))
+	flag := filepath.Join(tdir, "postponed")
+	script := "#!/bin/sh\nif [ ! -f " + flag + " ]; then\n  touch " + flag +
+		"\n  exit 21\nfi\nsleep 2\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tdir, "ArtifactReboot_Enter_00"),
+		[]byte(script), 0755))
+
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	m.stateScriptExecutor = statescript.Launcher{
+		ArtScriptsPath:          tdir,
+		RootfsScriptsPath:       filepath.Join(tdir, "rootfs"),
+		SupportedScriptVersions: []int{2},
+		Timeout:                 10,
+		RetryInterval:           2,
+		RetryTimeout:            10,
+	}
+	m.state = &sdTestWaitState{
+		WaitState: NewWaitState(MenderStateCheckWait, ToIdle),
+		next: &sdTestScriptState{
+			baseState: baseState{id: MenderStateReboot, t: ToArtifactReboot_Enter},
+		},
+		wait: 10 * time.Millisecond,
+	}
+	daemon := NewDaemon(m, store.NewMemStore())
+
+	msgs := make(chan sdTestMessage, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			sz, err := conn.Read(buf)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- sdTestMessage{string(buf[:sz]), time.Now()}
+		}
+	}()
+
+	assert.NoError(t, daemon.Run())
+	_, err = os.Stat(flag)
+	assert.NoError(t, err)
+
+	var scriptsAt time.Time
+	var latePings int
+	timeout := time.After(time.Second)
+collect:
+	for {
+		select {
+		case m := <-msgs:
+			switch {
+			case m.msg == sdNotifyStatus+MenderStateReboot.String():
+				scriptsAt = m.at
+			case scriptsAt.IsZero():
+			case m.msg == sdNotifyWatchdog && m.at.Sub(scriptsAt) > 2*watchdog:
+				latePings++
+			case m.msg == sdNotifyStopping:
+				break collect
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+
+	// the scripts take longer than the watchdog interval, but are not stuck
+	assert.False(t, scriptsAt.IsZero())
+	assert.True(t, latePings > 0, "no pings while running scripts")
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultServerProbeInterval = 1 * time.Hour
+	serverProbeTimeout         = 30 * time.Second
+)
+
+type server struct {
+	url string
+	api *client.ApiClient
+}
+
+// serverPool keeps track of the servers the client may talk to. Once a server
+// fails, the pool sticks to the next one that works, until the preferred
+// server (the first one) responds to a probe again.
+type serverPool struct {
+	// guards the pool along with the server in use by the client, as the
+	// state machine and the outbox sender may talk to the server at once
+	lock    sync.Mutex
+	config  []serverConfig
+	servers []server
+	// server currently in use
+	current int
+	// when the preferred server was last tried
+	lastProbe     time.Time
+	probeInterval time.Duration
+	// probes of the preferred server in progress
+	probing sync.WaitGroup
+}
+
+func newServerPool(config menderConfig) (*serverPool, error) {
+	p := &serverPool{}
+	if err := p.update(config); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// update sets up the pool for the servers in `config`; nothing is changed if
+// the list of servers is the same as before
+func (p *serverPool) update(config menderConfig) error {
+	p.probeInterval = time.Duration(config.ServerProbeIntervalSeconds) * time.Second
+	if p.probeInterval == 0 {
+		p.probeInterval = defaultServerProbeInterval
+	}
+
+	conf := config.GetServers()
+	if reflect.DeepEqual(conf, p.config) {
+		return nil
+	}
+
+	servers := make([]server, 0, len(conf))
+	for _, sc := range conf {
+		httpConf := config.GetHttpConfig()
+		httpConf.ServerCert = sc.ServerCertificate
+		api, err := client.New(httpConf)
+		if err != nil {
+			return errors.Wrapf(err, "error creating HTTP client for server %s",
+				sc.ServerURL)
+		}
+		servers = append(servers, server{url: sc.ServerURL, api: api})
+	}
+
+	p.config = conf
+	p.servers = servers
+	p.current = 0
+	return nil
+}
+
+// failed moves on to the next server, if server `idx` is still the one in use
+func (p *serverPool) failed(idx int, reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if idx != p.current || len(p.servers) < 2 {
+		return
+	}
+	p.current = (idx + 1) % len(p.servers)
+	log.Warnf("server %s failed (%s), switching to %s",
+		p.servers[idx].url, reason, p.servers[p.current].url)
+	if idx == 0 {
+		p.lastProbe = time.Now()
+	}
+}
+
+// probe starts checking if the preferred server is back, once every probe
+// interval; the pool switches to it once it is. The pool is not locked while
+// checking, as the server may take long to respond.
+func (p *serverPool) probe() {
+	if p.current == 0 || time.Since(p.lastProbe) < p.probeInterval {
+		return
+	}
+	p.lastProbe = time.Now()
+
+	p.probing.Add(1)
+	go func(preferred server) {
+		defer p.probing.Done()
+		if !p.check(preferred) {
+			return
+		}
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		// the server list may have changed meanwhile
+		if p.current == 0 || p.servers[0] != preferred {
+			return
+		}
+		log.Infof("preferred server %s is back, switching to it", preferred.url)
+		p.current = 0
+	}(p.servers[0])
+}
+
+// check returns true if `preferred` responds without failing
+func (p *serverPool) check(preferred server) bool {
+	req, err := http.NewRequest(http.MethodGet, preferred.url, nil)
+	if err != nil {
+		log.Errorf("failed to create server probe request: %v", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverProbeTimeout)
+	defer cancel()
+
+	rsp, err := preferred.api.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Debugf("preferred server %s still not reachable: %v", preferred.url, err)
+		return false
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		log.Debugf("preferred server %s still failing, status %v",
+			preferred.url, rsp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// request returns ApiRequester for the server `idx` that reports failures of
+// the server back to the pool
+func (p *serverPool) request(idx int, code client.AuthToken) client.ApiRequester {
+	return &serverRequest{
+		ApiRequest: p.servers[idx].api.Request(code),
+		pool:       p,
+		idx:        idx,
+	}
+}
+
+type serverRequest struct {
+	*client.ApiRequest
+	pool *serverPool
+	idx  int
+}
+
+func (r *serverRequest) Do(req *http.Request) (*http.Response, error) {
+	rsp, err := r.ApiRequest.Do(req)
+	if err != nil {
+		r.pool.failed(r.idx, err.Error())
+	} else if rsp.StatusCode >= http.StatusInternalServerError {
+		r.pool.failed(r.idx, rsp.Status)
+	}
+	return rsp, err
+}
+
+// server returns URL of the server to use and ApiRequester for talking to it.
+// Authorization token is switched along with the server.
+func (m *mender) server() (string, client.ApiRequester) {
+	m.servers.lock.Lock()
+	defer m.servers.lock.Unlock()
+
+	if err := m.servers.update(m.config); err != nil {
+		log.Errorf("failed to update server list, keeping the old one: %v", err)
+	}
+	m.servers.probe()
+
+	idx := m.servers.current
+	if srv := m.servers.servers[idx].url; srv != m.serverURL {
+		m.useServer(idx)
+	}
+	return m.serverURL, m.servers.request(idx, m.authToken)
+}
+
+func (m *mender) useServer(idx int) {
+	m.serverURL = m.servers.servers[idx].url
+	if m.authMgr == nil {
+		return
+	}
+
+	if idx == 0 {
+		m.authMgr.UseServer("")
+	} else {
+		m.authMgr.UseServer(m.serverURL)
+	}
+	m.authToken = noAuthToken
+	if err := m.loadAuth(); err != nil {
+		log.Errorf("failed to load authorization token of server %s: %v",
+			m.serverURL, err)
+	}
+}
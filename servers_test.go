@@ -0,0 +1,148 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerPoolFailover(t *testing.T) {
+	failing := true
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer primary.Close()
+
+	secondary := cltest.NewClientTestServer()
+	defer secondary.Close()
+	secondary.Auth.Authorize = true
+	secondary.Auth.Token = []byte("secondary-token")
+
+	ms := store.NewMemStore()
+	assert.NoError(t, ms.WriteAll(authTokenName, []byte("primary-token")))
+
+	mender := newTestMender(nil,
+		menderConfig{
+			ServerURL: primary.URL,
+			Servers: []serverConfig{
+				{ServerURL: secondary.URL},
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	assert.True(t, mender.IsAuthorized())
+	assert.Equal(t, client.AuthToken("primary-token"), mender.authToken)
+
+	// 5xx from the preferred server
+	_, err := mender.CheckUpdate()
+	assert.Error(t, err)
+	assert.Equal(t, 1, mender.servers.current)
+
+	// secondary server has its own token
+	assert.False(t, mender.IsAuthorized())
+	assert.NoError(t, mender.Authorize())
+	assert.True(t, secondary.Auth.Called)
+	assert.Equal(t, client.AuthToken("secondary-token"), mender.authToken)
+	data, serr := ms.ReadAll(authTokenName)
+	assert.NoError(t, serr)
+	assert.Equal(t, []byte("primary-token"), data)
+
+	// sticks to the working server
+	_, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	assert.True(t, secondary.Update.Called)
+	assert.Equal(t, 1, mender.servers.current)
+
+	// probe not due yet
+	failing = false
+	mender.server()
+	assert.Equal(t, 1, mender.servers.current)
+
+	// preferred server still failing
+	failing = true
+	mender.servers.lastProbe = time.Now().Add(-2 * defaultServerProbeInterval)
+	mender.server()
+	mender.servers.probing.Wait()
+	assert.Equal(t, 1, mender.servers.current)
+
+	// preferred server is back, with its token; the probe does not hold up
+	// the request it is started by
+	failing = false
+	mender.servers.lastProbe = time.Now().Add(-2 * defaultServerProbeInterval)
+	srv, _ := mender.server()
+	assert.Equal(t, secondary.URL, srv)
+	mender.servers.probing.Wait()
+	srv, _ = mender.server()
+	assert.Equal(t, primary.URL, srv)
+	assert.Equal(t, client.AuthToken("primary-token"), mender.authToken)
+
+	// connection errors
+	primary.Close()
+	_, err = mender.CheckUpdate()
+	assert.Error(t, err)
+	srv, _ = mender.server()
+	assert.Equal(t, secondary.URL, srv)
+	assert.Equal(t, client.AuthToken("secondary-token"), mender.authToken)
+}
+
+func TestServerPoolUpdate(t *testing.T) {
+	config := menderConfig{
+		ServerURL: "https://foo",
+		Servers: []serverConfig{
+			{ServerURL: "https://bar"},
+		},
+		ServerProbeIntervalSeconds: 10,
+	}
+	pool, err := newServerPool(config)
+	assert.NoError(t, err)
+	assert.Len(t, pool.servers, 2)
+	assert.Equal(t, 10*time.Second, pool.probeInterval)
+
+	// same servers, pool state kept
+	pool.failed(0, "test")
+	assert.Equal(t, 1, pool.current)
+	assert.NoError(t, pool.update(config))
+	assert.Equal(t, 1, pool.current)
+
+	// failure of server no longer in use is ignored
+	pool.failed(0, "test")
+	assert.Equal(t, 1, pool.current)
+
+	config.ServerURL = "https://baz"
+	assert.NoError(t, pool.update(config))
+	assert.Len(t, pool.servers, 2)
+	assert.Equal(t, 0, pool.current)
+	assert.Equal(t, "https://baz", pool.servers[0].url)
+
+	// bad certificate keeps the old pool
+	config.Servers[0].ServerCertificate = "/does/not/exist"
+	assert.Error(t, pool.update(config))
+	assert.Equal(t, "https://baz", pool.servers[0].url)
+}
@@ -0,0 +1,592 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+// Simulation runs the daemon against a device made up of files, so that state
+// scripts and failure handling can be tried without flashing a device. The
+// boot environment is kept in a file, written images are discarded and a
+// reboot starts a new daemon, which picks the update up from the state data
+// left by the previous one, as it would after a real reboot. The server is
+// simulated too; it offers the given artifact once and accepts everything
+// else. Every transition and state script is printed as it happens.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/pkg/errors"
+)
+
+const (
+	simulatedServerURL      = "https://simulated.server"
+	simulatedDeploymentID   = "simulated-deployment"
+	simulatedArtifactName   = "simulated-original"
+	simulatedBootEnvFile    = "bootenv"
+	simulatedScriptsDir     = "scripts"
+	simulatedPartA          = "2"
+	simulatedPartB          = "3"
+	simulatedMaxTransitions = 1000
+)
+
+// Failures that can be injected, besides failing the scripts of a state, which
+// are given as <State>_<Action>, e.g. ArtifactCommit_Enter.
+var simulatedFailures = map[string]string{
+	"download": "downloading the artifact fails",
+	"install":  "writing the image fails",
+	"enable":   "enabling the updated partition fails",
+	"reboot":   "reboot command fails",
+	"boot":     "updated partition fails to boot",
+	"commit":   "committing the update fails",
+	"rollback": "swapping partitions back fails",
+	"report":   "server rejects status reports",
+}
+
+var simulatedScriptFailure = regexp.MustCompile(`^([A-Za-z]+)_(Enter|Leave|Error)$`)
+
+func parseSimulatedFailures(list string) (map[string]bool, error) {
+	failures := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if _, ok := simulatedFailures[f]; !ok && !isScriptState(f) {
+			return nil, errors.Errorf("unknown failure to simulate: %q", f)
+		}
+		failures[f] = true
+	}
+	return failures, nil
+}
+
+func isScriptState(failure string) bool {
+	m := simulatedScriptFailure.FindStringSubmatch(failure)
+	if m == nil {
+		return false
+	}
+	for t := range transitionNames {
+		if getName(t, m[2]) == m[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// fileEnv is a boot environment kept in a file, one name=value per line
+type fileEnv struct {
+	path string
+}
+
+func (e *fileEnv) load() (BootVars, error) {
+	vars := make(BootVars)
+	f, err := os.Open(e.path)
+	if os.IsNotExist(err) {
+		return vars, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			vars[kv[0]] = kv[1]
+		}
+	}
+	return vars, scanner.Err()
+}
+
+func (e *fileEnv) ReadEnv(names ...string) (BootVars, error) {
+	vars, err := e.load()
+	if err != nil || len(names) == 0 {
+		return vars, err
+	}
+	selected := make(BootVars)
+	for _, name := range names {
+		if v, ok := vars[name]; ok {
+			selected[name] = v
+		}
+	}
+	return selected, nil
+}
+
+func (e *fileEnv) WriteEnv(vars BootVars) error {
+	env, err := e.load()
+	if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		env[k] = v
+	}
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var content string
+	for _, k := range names {
+		content += k + "=" + env[k] + "\n"
+	}
+	return writeFileSync(e.path, []byte(content))
+}
+
+type simulation struct {
+	out      io.Writer
+	dir      string
+	artifact string
+	update   client.UpdateResponse
+	failures map[string]bool
+	env      *fileEnv
+	// partition the device is running from, and the artifact on each one
+	running   string
+	installed map[string]string
+	offered   bool
+	rebooted  bool
+	// state scripts are only listed unless this is set
+	runScripts  bool
+	scripts     string
+	transitions int
+}
+
+func newSimulation(out io.Writer, dir, artifact string, key []byte) (*simulation, error) {
+	name, devices, err := readArtifactFile(artifact, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not read artifact %s", artifact)
+	}
+	s := &simulation{
+		out:       out,
+		dir:       dir,
+		artifact:  artifact,
+		failures:  make(map[string]bool),
+		env:       &fileEnv{path: filepath.Join(dir, simulatedBootEnvFile)},
+		installed: make(map[string]string),
+		scripts:   defaultRootfsScriptsPath,
+	}
+	s.update.ID = simulatedDeploymentID
+	s.update.Artifact.Source.URI = simulatedServerURL + "/artifacts/" +
+		filepath.Base(artifact)
+	s.update.Artifact.ArtifactName = name
+	s.update.Artifact.CompatibleDevices = devices
+
+	current, err := GetCurrentArtifactName(defaultArtifactInfoFile)
+	if err != nil {
+		current = simulatedArtifactName
+	}
+	deviceType, err := GetDeviceType(defaultDeviceTypeFile)
+	if err != nil && len(devices) > 0 {
+		deviceType = devices[0]
+	}
+	s.installed[simulatedPartA] = current
+	if err := writeFileSync(s.deviceTypeFile(),
+		[]byte("device_type="+deviceType+"\n")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *simulation) printf(what, format string, args ...interface{}) {
+	fmt.Fprintf(s.out, "%-8s %s\n", what, fmt.Sprintf(format, args...))
+}
+
+// fail tells if `failure` is to be injected
+func (s *simulation) fail(failure string) bool {
+	if !s.failures[failure] {
+		return false
+	}
+	desc, ok := simulatedFailures[failure]
+	if !ok {
+		desc = "scripts fail"
+	}
+	s.printf("fail", "%s: %s", failure, desc)
+	return true
+}
+
+func (s *simulation) artifactInfoFile() string {
+	return filepath.Join(s.dir, "artifact_info")
+}
+
+func (s *simulation) deviceTypeFile() string {
+	return filepath.Join(s.dir, "device_type")
+}
+
+func otherPartition(part string) string {
+	if part == simulatedPartA {
+		return simulatedPartB
+	}
+	return simulatedPartA
+}
+
+// boot starts the device from the partition selected by the boot
+// environment, falling back to the other one, as the bootloader does, if an
+// update fails to boot
+func (s *simulation) boot() error {
+	env, err := s.env.ReadEnv()
+	if err != nil {
+		return err
+	}
+	part, ok := env["mender_boot_part"]
+	if !ok {
+		part = simulatedPartA
+	}
+	if env["upgrade_available"] == "1" && s.fail("boot") {
+		part = otherPartition(part)
+		if err := s.env.WriteEnv(BootVars{
+			"mender_boot_part":  part,
+			"upgrade_available": "0",
+		}); err != nil {
+			return err
+		}
+	}
+	s.running = part
+	s.printf("boot", "partition %s with artifact %s", part, s.installed[part])
+	return writeFileSync(s.artifactInfoFile(),
+		[]byte("artifact_name="+s.installed[part]+"\n"))
+}
+
+// simulatedController shows the transitions made by the daemon, and stops it
+// once the update offered by the simulated server is done with
+type simulatedController struct {
+	*mender
+	sim *simulation
+	err error
+}
+
+func (c *simulatedController) TransitionState(to State, ctx *StateContext) (State, bool) {
+	s := c.sim
+	s.printf("state", "%s -> %s", c.GetCurrentState().Id(), to.Id())
+
+	s.transitions++
+	if s.transitions > simulatedMaxTransitions {
+		c.err = errors.Errorf("state machine did not settle in %d transitions",
+			simulatedMaxTransitions)
+		return to, true
+	}
+	if to.Id() == MenderStateCheckWait && s.offered {
+		return to, true
+	}
+	return c.mender.TransitionState(to, ctx)
+}
+
+// simulatedDevice implements UInstallCommitRebooter on top of the simulated
+// boot environment
+type simulatedDevice struct {
+	*simulation
+}
+
+func (d simulatedDevice) InstallUpdate(image io.ReadCloser, size int64) error {
+	d.printf("device", "writing %d bytes to partition %s",
+		size, otherPartition(d.running))
+	if d.fail("install") {
+		return errors.New("simulated install failure")
+	}
+	_, err := io.Copy(ioutil.Discard, image)
+	return err
+}
+
+func (d simulatedDevice) EnableUpdatedPartition() error {
+	part := otherPartition(d.running)
+	d.printf("device", "enabling partition %s", part)
+	if d.fail("enable") {
+		return errors.New("simulated failure enabling partition")
+	}
+	d.installed[part] = d.update.Artifact.ArtifactName
+	return d.env.WriteEnv(BootVars{
+		"upgrade_available": "1",
+		"mender_boot_part":  part,
+		"bootcount":         "0",
+	})
+}
+
+func (d simulatedDevice) HasUpdate() (bool, error) {
+	env, err := d.env.ReadEnv("upgrade_available")
+	if err != nil {
+		return false, err
+	}
+	return env["upgrade_available"] == "1", nil
+}
+
+func (d simulatedDevice) CommitUpdate() error {
+	has, err := d.HasUpdate()
+	if err != nil {
+		return err
+	}
+	if !has {
+		return errorNoUpgradeMounted
+	}
+	d.printf("device", "committing partition %s", d.running)
+	if d.fail("commit") {
+		return errors.New("simulated commit failure")
+	}
+	return d.env.WriteEnv(BootVars{"upgrade_available": "0"})
+}
+
+func (d simulatedDevice) SwapPartitions() error {
+	part := otherPartition(d.running)
+	d.printf("device", "setting partition %s for rollback", part)
+	if d.fail("rollback") {
+		return errors.New("simulated failure setting partition for rollback")
+	}
+	return d.env.WriteEnv(BootVars{
+		"mender_boot_part":  part,
+		"upgrade_available": "0",
+	})
+}
+
+func (d simulatedDevice) Reboot() error {
+	d.printf("device", "reboot")
+	if d.fail("reboot") {
+		return errors.New("simulated reboot failure")
+	}
+	d.rebooted = true
+	return nil
+}
+
+// simulatedServer offers the artifact being simulated once and accepts
+// anything sent to it
+type simulatedServer struct {
+	*simulation
+}
+
+func (s simulatedServer) GetScheduledUpdate(api client.ApiRequester, server string,
+	current client.CurrentUpdate) (interface{}, error) {
+	if s.offered {
+		return nil, nil
+	}
+	s.offered = true
+	s.printf("server", "offering artifact %s", s.update.Artifact.ArtifactName)
+	return s.update, nil
+}
+
+func (s simulatedServer) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	s.printf("server", "downloading %s", s.artifact)
+	if s.fail("download") {
+		return nil, -1, errors.New("simulated download failure")
+	}
+	f, err := os.Open(s.artifact)
+	if err != nil {
+		return nil, -1, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	return f, info.Size(), nil
+}
+
+func (s simulatedServer) Report(api client.ApiRequester, server string,
+	report client.StatusReport) error {
+	s.printf("server", "status %s", report.Status)
+	if s.fail("report") {
+		return errors.New("simulated status report failure")
+	}
+	return nil
+}
+
+func (s simulatedServer) Upload(api client.ApiRequester, server string,
+	logs client.LogData) error {
+	s.printf("server", "deployment log, %d bytes", len(logs.Messages))
+	return nil
+}
+
+func (s simulatedServer) Submit(api client.ApiRequester, server string,
+	data interface{}) error {
+	s.printf("server", "inventory")
+	return nil
+}
+
+func (s simulatedServer) Request(api client.ApiRequester, server string,
+	dataSrc client.AuthDataMessenger) ([]byte, error) {
+	s.printf("server", "authorization request")
+	return []byte("simulated-token"), nil
+}
+
+// simulatedDeviceConfig stands for a server without configuration documents
+type simulatedDeviceConfig struct{}
+
+func (simulatedDeviceConfig) Fetch(api client.ApiRequester,
+	server string) (*client.DeviceConfig, error) {
+	return nil, nil
+}
+
+func (simulatedDeviceConfig) Report(api client.ApiRequester, server string,
+	report client.DeviceConfigReport) error {
+	return nil
+}
+
+// simulatedExecutor lists the scripts of each transition, running them only
+// if asked to
+type simulatedExecutor struct {
+	*simulation
+	launcher statescript.Launcher
+}
+
+func (e simulatedExecutor) ExecuteAll(state, action string, ignoreError bool) error {
+	scripts, err := e.launcher.Scripts(state, action)
+	if err == nil {
+		for _, s := range scripts {
+			e.printf("script", "%s", s)
+		}
+		if e.fail(state + "_" + action) {
+			err = errors.Errorf("simulated failure of %s_%s scripts", state, action)
+		} else if e.runScripts {
+			err = e.launcher.ExecuteAll(state, action, ignoreError)
+		}
+	}
+	if err != nil && ignoreError {
+		e.printf("script", "ignoring error: %v", err)
+		return nil
+	}
+	return err
+}
+
+func (e simulatedExecutor) CheckRootfsScriptsVersion() error {
+	return e.launcher.CheckRootfsScriptsVersion()
+}
+
+// simulationConfig returns `config` pointed at the simulated server, without
+// the features talking to anything else
+func simulationConfig(config menderConfig) menderConfig {
+	config.ServerURL = simulatedServerURL
+	config.Servers = nil
+	config.ServerCertificate = ""
+	config.HttpsClient.Certificate = ""
+	config.HttpsClient.Key = ""
+	config.EnableNotifications = false
+	config.Transport = ""
+	config.DownloadRateLimit = 0
+	config.DownloadRateSchedule = nil
+	config.MeteredConnection = meteredConfig{}
+	config.PeerSharing = peerSharingConfig{}
+	config.Gateway = gatewayConfig{}
+	config.OfflineUpdate = offlineUpdateConfig{}
+	return config
+}
+
+func (s *simulation) newController(config menderConfig,
+	pieces MenderPieces) (*simulatedController, error) {
+	pieces.device = simulatedDevice{s}
+	m, err := NewMender(config, pieces)
+	if err != nil {
+		return nil, err
+	}
+	server := simulatedServer{s}
+	m.updater = server
+	m.statusReporter = server
+	m.logUploader = server
+	m.inventorySubmitter = server
+	m.authReq = server
+	m.deviceConfig = simulatedDeviceConfig{}
+	m.artifactInfoFile = s.artifactInfoFile()
+	m.deviceTypeFile = s.deviceTypeFile()
+	m.stateScriptPath = filepath.Join(s.dir, simulatedScriptsDir)
+
+	launcher, ok := m.stateScriptExecutor.(statescript.Launcher)
+	if !ok {
+		return nil, errors.New("unexpected state script executor")
+	}
+	launcher.ArtScriptsPath = m.stateScriptPath
+	launcher.RootfsScriptsPath = s.scripts
+	m.stateScriptExecutor = simulatedExecutor{s, launcher}
+
+	return &simulatedController{mender: m, sim: s}, nil
+}
+
+// run runs the daemon until the offered update is done with, starting it
+// again after each reboot
+func (s *simulation) run(config menderConfig, pieces MenderPieces) error {
+	config = simulationConfig(config)
+
+	defer func(wait func(time.Duration) time.Duration) {
+		waitTime = wait
+	}(waitTime)
+	waitTime = func(wait time.Duration) time.Duration {
+		s.printf("wait", "%v", wait)
+		return time.Millisecond
+	}
+
+	if err := s.boot(); err != nil {
+		return err
+	}
+	for {
+		c, err := s.newController(config, pieces)
+		if err != nil {
+			return err
+		}
+		s.rebooted = false
+		err = NewDaemon(c, pieces.store).Run()
+		if err == nil {
+			err = c.err
+		}
+		if err != nil {
+			s.printf("exit", "%v", err)
+			return err
+		}
+		if !s.rebooted {
+			break
+		}
+		if err := s.boot(); err != nil {
+			return err
+		}
+	}
+	s.printf("done", "running partition %s with artifact %s",
+		s.running, s.installed[s.running])
+	return nil
+}
+
+func doSimulate(config *menderConfig, opts *runOptionsType) error {
+	failures, err := parseSimulatedFailures(*opts.simulateFail)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "mender-simulate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	sim, err := newSimulation(os.Stdout, dir, *opts.simulate,
+		config.GetVerificationKey())
+	if err != nil {
+		return err
+	}
+	sim.failures = failures
+	sim.runScripts = *opts.simulateRunScripts
+	if *opts.simulateScripts != "" {
+		sim.scripts = *opts.simulateScripts
+	}
+
+	simOpts := *opts
+	simOpts.dataStore = &dir
+	mp, err := commonInit(config, &simOpts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+	DeploymentLogger = NewDeploymentLogManager(dir)
+
+	return sim.run(*config, *mp)
+}
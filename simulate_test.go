@@ -0,0 +1,128 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func runTestSimulation(t *testing.T, failures string) (string, error) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	artifact := path.Join(tdir, "update.mender")
+	writeMediaArtifact(t, artifact, false)
+
+	scripts := path.Join(tdir, "rootfs-scripts")
+	assert.NoError(t, os.MkdirAll(scripts, 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(scripts, "version"), []byte("2"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(scripts, "Download_Enter_00"),
+		[]byte("#!/bin/sh\nexit 0\n"), 0755))
+
+	DeploymentLogger = NewDeploymentLogManager(tdir)
+
+	var out bytes.Buffer
+	sim, err := newSimulation(&out, tdir, artifact, nil)
+	assert.NoError(t, err)
+	sim.scripts = scripts
+	sim.installed[simulatedPartA] = "mender-1.0"
+	sim.failures, err = parseSimulatedFailures(failures)
+	assert.NoError(t, err)
+
+	err = sim.run(menderConfig{}, MenderPieces{
+		store: store.NewMemStore(),
+		authMgr: &testAuthManager{
+			authorized: true,
+			authtoken:  "token",
+		},
+	})
+	return out.String(), err
+}
+
+func TestSimulate(t *testing.T) {
+	out, err := runTestSimulation(t, "")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "boot     partition 2 with artifact mender-1.0\n")
+	assert.Contains(t, out, "server   offering artifact mender-1.1\n")
+	assert.Contains(t, out, "script   ")
+	assert.Contains(t, out, "rootfs-scripts/Download_Enter_00\n")
+	assert.Contains(t, out, "device   reboot\n")
+	assert.Contains(t, out, "boot     partition 3 with artifact mender-1.1\n")
+	assert.Contains(t, out, "device   committing partition 3\n")
+	assert.Contains(t, out, "server   status success\n")
+	assert.True(t, strings.HasSuffix(out,
+		"done     running partition 3 with artifact mender-1.1\n"))
+
+	// failed install is reported, nothing else changes
+	out, err = runTestSimulation(t, "install")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "fail     install: writing the image fails\n")
+	assert.NotContains(t, out, "device   reboot\n")
+	assert.Contains(t, out, "server   status failure\n")
+	assert.True(t, strings.HasSuffix(out,
+		"done     running partition 2 with artifact mender-1.0\n"))
+
+	// failing commit scripts roll back to the original partition
+	out, err = runTestSimulation(t, "ArtifactCommit_Enter")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "fail     ArtifactCommit_Enter: scripts fail\n")
+	assert.Contains(t, out, "device   setting partition 2 for rollback\n")
+	assert.Contains(t, out, "server   status failure\n")
+	assert.True(t, strings.HasSuffix(out,
+		"done     running partition 2 with artifact mender-1.0\n"))
+
+	// failed boot is detected after the bootloader falls back
+	out, err = runTestSimulation(t, "boot")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "fail     boot: updated partition fails to boot\n")
+	assert.Contains(t, out, "server   status failure\n")
+	assert.True(t, strings.HasSuffix(out,
+		"done     running partition 2 with artifact mender-1.0\n"))
+
+	_, err = parseSimulatedFailures("install,Foo_Enter")
+	assert.Error(t, err)
+	failures, err := parseSimulatedFailures("reboot, ArtifactInstall_Leave")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"reboot": true, "ArtifactInstall_Leave": true}, failures)
+}
+
+func TestFileEnv(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	env := &fileEnv{path: path.Join(tdir, "env")}
+	vars, err := env.ReadEnv("upgrade_available")
+	assert.NoError(t, err)
+	assert.Empty(t, vars)
+
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "1", "bootcount": "0"}))
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	vars, err = env.ReadEnv("upgrade_available", "mender_boot_part")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"upgrade_available": "0"}, vars)
+
+	data, err := ioutil.ReadFile(env.path)
+	assert.NoError(t, err)
+	assert.Equal(t, "bootcount=0\nupgrade_available=0\n", string(data))
+}
@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -139,6 +140,18 @@ type StateContext struct {
 	lastUpdateCheck      time.Time
 	lastInventoryUpdate  time.Time
 	fetchInstallAttempts int
+	// held around the controller calls of wait states, which are handled
+	// without holding it, if not nil
+	ctrl sync.Locker
+}
+
+// withController runs `f`, calling the controller from a wait state
+func (ctx *StateContext) withController(f func()) {
+	if ctx.ctrl != nil {
+		ctx.ctrl.Lock()
+		defer ctx.ctrl.Unlock()
+	}
+	f()
 }
 
 type StateRunner interface {
@@ -160,6 +173,8 @@ type StateData struct {
 	UpdateInfo client.UpdateResponse
 	// update status
 	UpdateStatus string
+	// progress of writing the update to the inactive partition
+	Checkpoint *InstallCheckpoint `json:",omitempty"`
 }
 
 const (
@@ -231,6 +246,9 @@ type State interface {
 type WaitState interface {
 	Id() MenderState
 	Cancel() bool
+	// Wake interrupts wait in progress, which then returns `next`; returns
+	// false if there was no wait in progress
+	Wake(next State) bool
 	Wait(next, same State, wait time.Duration) (State, bool)
 	Transition() Transition
 	SetTransition(t Transition)
@@ -269,20 +287,28 @@ func (b *baseState) SetTransition(tran Transition) {
 type waitState struct {
 	baseState
 	cancel chan bool
+	wakeup chan State
 }
 
 func NewWaitState(id MenderState, t Transition) WaitState {
 	return &waitState{
 		baseState: baseState{id: id, t: t},
-		cancel:    make(chan bool),
+		cancel:    make(chan bool, 1),
+		wakeup:    make(chan State),
 	}
 }
 
+// waitTime returns how long wait states actually wait for instead of `wait`;
+// the simulation does not wait for real
+var waitTime = func(wait time.Duration) time.Duration {
+	return wait
+}
+
 // Wait performs wait for time `wait` and return state (`next`, false) after the wait
 // has completed. If wait was interrupted returns (`same`, true)
 func (ws *waitState) Wait(next, same State,
 	wait time.Duration) (State, bool) {
-	ticker := time.NewTicker(wait)
+	ticker := time.NewTicker(waitTime(wait))
 
 	defer ticker.Stop()
 	select {
@@ -291,15 +317,149 @@ func (ws *waitState) Wait(next, same State,
 		return next, false
 	case <-ws.cancel:
 		log.Infof("wait canceled")
+	case next := <-ws.wakeup:
+		log.Infof("wait interrupted, next state: %v", next.Id())
+		return next, false
 	}
 	return same, true
 }
 
+// Cancel makes the wait in progress, or the next one, return; it does not
+// block
 func (ws *waitState) Cancel() bool {
-	ws.cancel <- true
+	select {
+	case ws.cancel <- true:
+	default:
+		// cancelled already
+	}
 	return true
 }
 
+func (ws *waitState) Wake(next State) bool {
+	select {
+	case ws.wakeup <- next:
+		return true
+	default:
+		return false
+	}
+}
+
+// how often to retry waking up a state that has not started waiting yet
+var wakeRetryInterval = 10 * time.Millisecond
+
+// listenNotifications wakes up wait state `ws` with the state `handle` returns
+// for a notification received from the server, or raised locally. Notifications
+// that `handle` returns nil for are ignored. Returned function stops listening.
+func listenNotifications(ctx *StateContext, c Controller, ws WaitState,
+	handle func(client.Notification) State) func() {
+
+	var notes, local <-chan client.Notification
+	var stopListen func()
+	ctx.withController(func() {
+		notes, stopListen = c.ListenNotifications()
+		local = c.LocalNotifications()
+	})
+	if notes == nil && local == nil {
+		return stopListen
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			var note client.Notification
+			var ok bool
+			select {
+			case note, ok = <-notes:
+				if !ok {
+					// server dropped the connection
+					notes = nil
+					if local == nil {
+						return
+					}
+					continue
+				}
+			case note = <-local:
+			case <-done:
+				return
+			}
+
+			next := handle(note)
+			if next == nil {
+				log.Debugf("ignoring notification %v in state %v", note.Type, ws.Id())
+				continue
+			}
+			log.Infof("received notification %v", note.Type)
+			if !wakeWaiting(ws, next, done) {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		stopListen()
+		<-exited
+	}
+}
+
+// wakeWaiting wakes up `ws` with `next` once it is waiting; returns false if
+// `done` is closed first
+func wakeWaiting(ws WaitState, next State, done <-chan struct{}) bool {
+	// the state may not be waiting just yet
+	for !ws.Wake(next) {
+		select {
+		case <-time.After(wakeRetryInterval):
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// watchMedia wakes up wait state `ws` for checking media inserted while
+// waiting. Returned function stops watching.
+func watchMedia(ctx *StateContext, c Controller, ws WaitState) func() {
+	var media <-chan string
+	var stopWatch func()
+	ctx.withController(func() {
+		media, stopWatch = c.WatchMedia()
+	})
+	if media == nil {
+		return stopWatch
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			var dir string
+			var ok bool
+			select {
+			case dir, ok = <-media:
+				if !ok {
+					return
+				}
+			case <-done:
+				return
+			}
+
+			log.Infof("media inserted in %s", dir)
+			if !wakeWaiting(ws, NewMediaUpdateCheckState(dir), done) {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		stopWatch()
+		<-exited
+	}
+}
+
 type updateState struct {
 	baseState
 	update client.UpdateResponse
@@ -365,6 +525,18 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	case MenderStateRollbackReboot:
 		return NewAfterRollbackRebootState(sd.UpdateInfo), false
 
+	// download was interrupted; the update has not been enabled yet, so it
+	// is safe to start over
+	case MenderStateUpdateFetch, MenderStateUpdateStore:
+		log.Infof("download of update %v was interrupted, fetching it again",
+			sd.UpdateInfo.ArtifactName())
+		if cp := sd.Checkpoint; cp != nil && cp.Written > 0 && cp.Resume != nil {
+			log.Infof("%d bytes of the update were written when interrupted, "+
+				"resuming at %d bytes of the artifact", cp.Written,
+				cp.Resume.Stream+cp.Resume.In)
+		}
+		return NewUpdateFetchState(sd.UpdateInfo), false
+
 	// this should not happen
 	default:
 		log.Errorf("got invalid state: %v", sd.Name)
@@ -389,6 +561,11 @@ func (a *AuthorizeWaitState) Handle(ctx *StateContext, c Controller) (State, boo
 	intvl := c.GetRetryPollInterval()
 
 	log.Debugf("wait %v before next authorization attempt", intvl)
+
+	// devices that can not reach the server may still be updated from media
+	stop := watchMedia(ctx, c, a)
+	defer stop()
+
 	return a.Wait(authorizeState, a, intvl)
 }
 
@@ -542,6 +719,35 @@ func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 	return checkWaitState, false
 }
 
+// MediaUpdateCheckState checks media inserted in the mount point `dir` for
+// updates, see offline.go.
+type MediaUpdateCheckState struct {
+	baseState
+	dir string
+}
+
+func NewMediaUpdateCheckState(dir string) State {
+	return &MediaUpdateCheckState{
+		baseState: baseState{
+			id: MenderStateMediaUpdateCheck,
+			t:  ToSync,
+		},
+		dir: dir,
+	}
+}
+
+func (mu *MediaUpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle media update check state")
+
+	update, err := c.CheckMediaUpdate(mu.dir)
+	if err != nil {
+		log.Errorf("media update check failed: %s", err)
+	} else if update != nil {
+		return NewUpdateFetchState(*update), false
+	}
+	return idleState, false
+}
+
 type UpdateFetchState struct {
 	baseState
 	update client.UpdateResponse
@@ -557,6 +763,10 @@ func NewUpdateFetchState(update client.UpdateResponse) State {
 	}
 }
 
+func (u *UpdateFetchState) Update() client.UpdateResponse {
+	return u.update
+}
+
 func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	// start deployment logging
 	if err := DeploymentLogger.Enable(u.update.ID); err != nil {
@@ -568,17 +778,41 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 	if err := StoreStateData(ctx.store, StateData{
 		Name:       u.Id(),
 		UpdateInfo: u.update,
+		Checkpoint: loadInstallCheckpoint(ctx.store, u.update),
 	}); err != nil {
 		log.Errorf("failed to store state data in fetch state: %v", err)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
+	if !isMediaUpdate(u.update) && c.IsMeteredConnection() {
+		log.Infof("connection is metered, postponing download of update %v",
+			u.update.ArtifactName())
+		return NewFetchMeteredWaitState(u.update), false
+	}
+
 	merr := c.ReportUpdateStatus(u.update, client.StatusDownloading)
 	if merr != nil && merr.IsFatal() {
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	in, size, err := c.FetchUpdate(u.update.URI())
+	// media artifacts had their header checked when found
+	if !isMediaUpdate(u.update) {
+		merr = c.PreflightUpdate(u.update)
+		if merr != nil && merr.IsFatal() {
+			log.Errorf("update %v can not be installed: %v",
+				u.update.ArtifactName(), merr)
+			return NewUpdateStatusReportState(u.update, client.StatusFailure), false
+		} else if merr != nil {
+			log.Warnf("downloading update %v without checking its header first: %v",
+				u.update.ArtifactName(), merr)
+		}
+	}
+
+	in, size, err := c.FetchUpdateFromPeers(u.update)
+	if err != nil {
+		log.Debugf("update not fetched from peers: %v", err)
+		in, size, err = c.FetchUpdate(u.update)
+	}
 	if err != nil {
 		log.Errorf("update fetch failed: %s", err)
 		return NewFetchStoreRetryState(u, u.update, err), false
@@ -587,6 +821,33 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 	return NewUpdateStoreState(in, size, u.update), false
 }
 
+// FetchMeteredWaitState waits for the device to get off a metered connection
+// before fetching the update again.
+type FetchMeteredWaitState struct {
+	WaitState
+	update client.UpdateResponse
+}
+
+func NewFetchMeteredWaitState(update client.UpdateResponse) State {
+	return &FetchMeteredWaitState{
+		WaitState: NewWaitState(MenderStateFetchMeteredWait, ToDownload),
+		update:    update,
+	}
+}
+
+func (fm *FetchMeteredWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle fetch metered wait state")
+
+	stop := listenNotifications(ctx, c, fm, abortNotification(fm.update))
+	defer stop()
+
+	return fm.Wait(NewUpdateFetchState(fm.update), fm, c.GetRetryPollInterval())
+}
+
+func (fm *FetchMeteredWaitState) Update() client.UpdateResponse {
+	return fm.update
+}
+
 type UpdateStoreState struct {
 	baseState
 	update client.UpdateResponse
@@ -608,6 +869,19 @@ func NewUpdateStoreState(in io.ReadCloser, size int64, update client.UpdateRespo
 	}
 }
 
+func (u *UpdateStoreState) Update() client.UpdateResponse {
+	return u.update
+}
+
+// Cancel aborts the download by closing the stream with image data
+func (u *UpdateStoreState) Cancel() bool {
+	if err := u.imagein.Close(); err != nil {
+		log.Errorf("failed to cancel download: %v", err)
+		return false
+	}
+	return true
+}
+
 func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// make sure to close the stream with image data
@@ -620,9 +894,11 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	log.Debugf("handle update install state")
 
+	checkpoint := loadInstallCheckpoint(ctx.store, u.update)
 	if err := StoreStateData(ctx.store, StateData{
 		Name:       u.Id(),
 		UpdateInfo: u.update,
+		Checkpoint: checkpoint,
 	}); err != nil {
 		log.Errorf("failed to store state data in install state: %v", err)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
@@ -633,7 +909,21 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(u.update, client.StatusFailure), false
 	}
 
-	if err := c.InstallUpdate(u.imagein, u.size); err != nil {
+	save := func(cp InstallCheckpoint) error {
+		return StoreStateData(ctx.store, StateData{
+			Name:       u.Id(),
+			UpdateInfo: u.update,
+			Checkpoint: &cp,
+		})
+	}
+	if err := c.ResumeUpdate(u.imagein, u.size, u.update.ArtifactName(),
+		checkpoint, save); err != nil {
+		if errors.Cause(err) == errMeteredConnection {
+			// carry on from the last checkpoint once off the metered connection
+			log.Infof("connection turned metered, postponing the rest of "+
+				"the download of update %v", u.update.ArtifactName())
+			return NewFetchMeteredWaitState(u.update), false
+		}
 		log.Errorf("update install failed: %s", err)
 		return NewFetchStoreRetryState(u, u.update, err), false
 	}
@@ -641,6 +931,10 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 	// restart counter so that we are able to retry next time
 	ctx.fetchInstallAttempts = 0
 
+	if err := c.ShareUpdate(u.update); err != nil {
+		log.Errorf("failed to share update with peers: %v", err)
+	}
+
 	// check if update is not aborted
 	// this step is needed as installing might take a while and we might end up with
 	// proceeding with already cancelled update
@@ -682,6 +976,18 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 	return NewRebootState(is.Update()), false
 }
 
+// abortNotification handles abort of `update` while waiting to fetch it
+func abortNotification(update client.UpdateResponse) func(client.Notification) State {
+	return func(n client.Notification) State {
+		if n.Type == client.NotifyAbortDeployment &&
+			(n.DeploymentID == "" || n.DeploymentID == update.ID) {
+			return NewUpdateErrorState(
+				NewFatalError(client.ErrDeploymentAborted), update)
+		}
+		return nil
+	}
+}
+
 type FetchStoreRetryState struct {
 	WaitState
 	from   State
@@ -699,6 +1005,10 @@ func NewFetchStoreRetryState(from State, update client.UpdateResponse,
 	}
 }
 
+func (fir *FetchStoreRetryState) Update() client.UpdateResponse {
+	return fir.update
+}
+
 func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle fetch install retry state")
 
@@ -714,6 +1024,10 @@ func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State,
 	ctx.fetchInstallAttempts++
 
 	log.Debugf("wait %v before next fetch/install attempt", intvl)
+
+	stop := listenNotifications(ctx, c, fir, abortNotification(fir.update))
+	defer stop()
+
 	return fir.Wait(NewUpdateFetchState(fir.update), fir, intvl)
 }
 
@@ -765,6 +1079,23 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 	if next.when.After(time.Now()) {
 		wait := next.when.Sub(now)
 		log.Debugf("waiting %s for the next state", wait)
+
+		stop := listenNotifications(ctx, c, cw, func(n client.Notification) State {
+			switch n.Type {
+			case client.NotifyCheckUpdate:
+				return updateCheckState
+			case client.NotifySendInventory:
+				return inventoryUpdateState
+			case notifyReloadConfig:
+				// wait again, with the new configuration
+				return cw
+			}
+			return nil
+		})
+		defer stop()
+		stopMedia := watchMedia(ctx, c, cw)
+		defer stopMedia()
+
 		return cw.Wait(next.state, cw, wait)
 	}
 
@@ -786,6 +1117,15 @@ func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State,
 	} else {
 		log.Debugf("inventory refresh complete")
 	}
+
+	reauth, err := c.DeviceConfigRefresh()
+	if err != nil {
+		log.Warnf("failed to refresh device configuration: %v", err)
+	}
+	if reauth {
+		log.Infof("connectivity settings changed, authorizing again")
+		return authorizeState, false
+	}
 	return checkWaitState, false
 }
 
@@ -1027,17 +1367,32 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 
 	switch res.updateStatus {
 	case client.StatusSuccess:
-		// error while reporting success; rollback
-		return NewRollbackState(res.Update(), true, true), false
+		if c.GetStatusReportFailurePolicy() != reportPolicyQueue {
+			// error while reporting success; rollback
+			return NewRollbackState(res.Update(), true, true), false
+		}
+		// keep the update, the server will learn about it later
+		log.Warnf("keeping update %v, success will be reported once the "+
+			"server can be reached", res.Update().ArtifactName())
+		res.queueReport(ctx, nil)
+		RemoveStateData(ctx.store)
+		return idleState, false
 	case client.StatusFailure:
 		// error while reporting failure;
 		// start from scratch as previous update was broken
 		log.Errorf("error while performing update: %v (%v)", res.updateStatus, res.Update())
+		logs, err := DeploymentLogger.GetLogs(res.Update().ID)
+		if err != nil {
+			log.Errorf("failed to get deployment logs for deployment [%v]: %v",
+				res.Update().ID, err)
+		}
+		res.queueReport(ctx, logs)
 		RemoveStateData(ctx.store)
 		return idleState, false
 	case client.StatusAlreadyInstalled:
 		// we've failed to report already-installed status, not a big
 		// deal, start from scratch
+		res.queueReport(ctx, nil)
 		RemoveStateData(ctx.store)
 		return idleState, false
 	default:
@@ -1046,6 +1401,14 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 	}
 }
 
+// queueReport leaves the status for the outbox; see outboxSender
+func (res *ReportErrorState) queueReport(ctx *StateContext, logs []byte) {
+	if err := QueueStatusReport(ctx.store, res.Update(), res.updateStatus,
+		logs); err != nil {
+		log.Errorf("failed to queue status report: %v", err)
+	}
+}
+
 type RebootState struct {
 	UpdateState
 }
@@ -20,11 +20,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
 	"github.com/stretchr/testify/assert"
 )
@@ -49,6 +51,25 @@ type stateTestController struct {
 	logUpdate       client.UpdateResponse
 	logs            []byte
 	inventoryErr    error
+	configReauth    bool
+	configErr       error
+	notifications   chan client.Notification
+	reportPolicy    string
+	metered         bool
+	peerUpdate      io.ReadCloser
+	peerUpdateSize  int64
+	sharedUpdate    client.UpdateResponse
+	media           chan string
+	mediaChecked    string
+	mediaUpdate     *client.UpdateResponse
+	mediaUpdateErr  menderError
+	localNotes      chan client.Notification
+	reloadedConfig  *menderConfig
+	reloadErr       error
+	resumedFrom     *InstallCheckpoint
+	checkpoint      *InstallCheckpoint
+	preflightErr    menderError
+	preflighted     bool
 }
 
 func (s *stateTestController) GetCurrentArtifactName() (string, error) {
@@ -70,6 +91,13 @@ func (s *stateTestController) GetRetryPollInterval() time.Duration {
 	return s.retryIntvl
 }
 
+func (s *stateTestController) GetStatusReportFailurePolicy() string {
+	if s.reportPolicy == "" {
+		return reportPolicyRollback
+	}
+	return s.reportPolicy
+}
+
 func (s *stateTestController) HasUpgrade() (bool, menderError) {
 	return s.hasUpgrade, s.hasUpgradeErr
 }
@@ -78,8 +106,41 @@ func (s *stateTestController) CheckUpdate() (*client.UpdateResponse, menderError
 	return s.updateResp, s.updateRespErr
 }
 
-func (s *stateTestController) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return s.updater.FetchUpdate(nil, url)
+func (s *stateTestController) PreflightUpdate(update client.UpdateResponse) menderError {
+	s.preflighted = true
+	return s.preflightErr
+}
+
+func (s *stateTestController) FetchUpdate(update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	return s.updater.FetchUpdate(nil, update.URI())
+}
+
+func (s *stateTestController) FetchUpdateFromPeers(update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	if s.peerUpdate == nil {
+		return nil, 0, errors.New("no peers")
+	}
+	return s.peerUpdate, s.peerUpdateSize, nil
+}
+
+func (s *stateTestController) ShareUpdate(update client.UpdateResponse) error {
+	s.sharedUpdate = update
+	return nil
+}
+
+func (s *stateTestController) ResumeUpdate(from io.ReadCloser, size int64,
+	name string, cp *InstallCheckpoint, save func(InstallCheckpoint) error) error {
+
+	s.resumedFrom = cp
+	if s.checkpoint != nil {
+		if err := save(*s.checkpoint); err != nil {
+			return err
+		}
+	}
+	return s.InstallUpdate(from, size)
+}
+
+func (s *stateTestController) IsMeteredConnection() bool {
+	return s.metered
 }
 
 func (s *stateTestController) GetCurrentState() State {
@@ -120,6 +181,50 @@ func (s *stateTestController) InventoryRefresh() error {
 	return s.inventoryErr
 }
 
+func (s *stateTestController) DeviceConfigRefresh() (bool, error) {
+	return s.configReauth, s.configErr
+}
+
+func (s *stateTestController) ListenNotifications() (<-chan client.Notification, func()) {
+	if s.notifications == nil {
+		return nil, func() {}
+	}
+	return s.notifications, func() {}
+}
+
+func (s *stateTestController) LocalNotifications() <-chan client.Notification {
+	return s.localNotes
+}
+
+func (s *stateTestController) Notify(note client.Notification) bool {
+	select {
+	case s.localNotes <- note:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *stateTestController) ReloadConfig(config menderConfig) error {
+	if s.reloadErr != nil {
+		return s.reloadErr
+	}
+	s.reloadedConfig = &config
+	return nil
+}
+
+func (s *stateTestController) WatchMedia() (<-chan string, func()) {
+	if s.media == nil {
+		return nil, func() {}
+	}
+	return s.media, func() {}
+}
+
+func (s *stateTestController) CheckMediaUpdate(dir string) (*client.UpdateResponse, menderError) {
+	s.mediaChecked = dir
+	return s.mediaUpdate, s.mediaUpdateErr
+}
+
 func (s *stateTestController) CheckScriptsCompatibility() error {
 	return nil
 }
@@ -134,6 +239,10 @@ func (c *waitStateTest) Wait(next, same State, wait time.Duration) (State, bool)
 	return next, false
 }
 
+func (c *waitStateTest) Wake(next State) bool {
+	return false
+}
+
 func (c *waitStateTest) Stop() {
 	// Noop for now.
 }
@@ -183,6 +292,13 @@ func TestStateWait(t *testing.T) {
 	assert.Equal(t, authorizeWaitState, s)
 	assert.True(t, c)
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+
+	// cancelling before waiting does not block, and the wait returns
+	assert.True(t, cs.Cancel())
+	assert.True(t, cs.Cancel())
+	s, c = cs.Wait(authorizeState, authorizeWaitState, time.Minute)
+	assert.Equal(t, authorizeWaitState, s)
+	assert.True(t, c)
 }
 
 func TestStateError(t *testing.T) {
@@ -440,6 +556,16 @@ func TestStateInit(t *testing.T) {
 	assert.False(t, c)
 	ms.Disable(false)
 
+	// interrupted download is started over
+	StoreStateData(ms, StateData{
+		Name:       MenderStateUpdateStore,
+		UpdateInfo: update,
+	})
+	s, c = i.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, update, s.(*UpdateFetchState).Update())
+	assert.False(t, c)
+
 	// pretend reading invalid state
 	StoreStateData(ms, StateData{
 		UpdateInfo: update,
@@ -480,6 +606,17 @@ func TestStateInvetoryUpdate(t *testing.T) {
 
 	s, _ = ius.Handle(ctx, &stateTestController{})
 	assert.IsType(t, &CheckWaitState{}, s)
+
+	s, _ = ius.Handle(ctx, &stateTestController{
+		configErr: errors.New("bad config"),
+	})
+	assert.IsType(t, &CheckWaitState{}, s)
+
+	// connectivity settings changed
+	s, _ = ius.Handle(ctx, &stateTestController{
+		configReauth: true,
+	})
+	assert.IsType(t, &AuthorizeState{}, s)
 }
 
 func TestStateAuthorizeWait(t *testing.T) {
@@ -621,7 +758,7 @@ func TestStateUpdateCommit(t *testing.T) {
 
 func TestStateUpdateCheckWait(t *testing.T) {
 	cws := NewCheckWaitState()
-	ctx := new(StateContext)
+	ctx := &StateContext{store: store.NewMemStore()}
 
 	// no iventory was sent; we should first send inventory
 	var tstart, tend time.Time
@@ -664,6 +801,125 @@ func TestStateUpdateCheckWait(t *testing.T) {
 	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
 }
 
+func TestStateCheckWaitNotifications(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := &StateContext{store: store.NewMemStore()}
+	ctx.lastInventoryUpdate = time.Now()
+	ctx.lastUpdateCheck = ctx.lastInventoryUpdate
+
+	notes := make(chan client.Notification, 2)
+	sc := &stateTestController{
+		pollIntvl:     time.Minute,
+		notifications: notes,
+	}
+
+	td := []struct {
+		note  string
+		state State
+	}{
+		{client.NotifyCheckUpdate, &UpdateCheckState{}},
+		{client.NotifySendInventory, &InventoryUpdateState{}},
+	}
+	for _, tc := range td {
+		notes <- client.Notification{Type: client.NotifyAbortDeployment}
+		notes <- client.Notification{Type: tc.note}
+
+		tstart := time.Now()
+		s, c := cws.Handle(ctx, sc)
+		assert.IsType(t, tc.state, s, tc.note)
+		assert.False(t, c)
+		assert.WithinDuration(t, time.Now(), tstart, time.Second)
+	}
+
+	// channel dropped; local notifications are still delivered
+	close(notes)
+	sc.localNotes = make(chan client.Notification, 1)
+	assert.True(t, sc.Notify(client.Notification{Type: notifyReloadConfig}))
+	assert.False(t, sc.Notify(client.Notification{Type: client.NotifyCheckUpdate}))
+	s, c := cws.Handle(ctx, sc)
+	assert.Equal(t, cws, s)
+	assert.False(t, c)
+
+	// regular polling goes on
+	sc.pollIntvl = 50 * time.Millisecond
+	s, c = cws.Handle(ctx, sc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+}
+
+// heldLock records whether it is held
+type heldLock struct {
+	sync.Mutex
+	held bool
+}
+
+func (l *heldLock) Lock() {
+	l.Mutex.Lock()
+	l.held = true
+}
+
+func (l *heldLock) Unlock() {
+	l.held = false
+	l.Mutex.Unlock()
+}
+
+// lockCheckController records whether the controller lock was held when
+// listening to notifications
+type lockCheckController struct {
+	*stateTestController
+	lock   *heldLock
+	locked bool
+}
+
+func (c *lockCheckController) ListenNotifications() (<-chan client.Notification, func()) {
+	c.locked = c.lock.held
+	return c.stateTestController.ListenNotifications()
+}
+
+func TestStateWaitControllerLock(t *testing.T) {
+	lock := new(heldLock)
+	ctx := &StateContext{store: store.NewMemStore(), ctrl: lock}
+	ctx.lastInventoryUpdate = time.Now()
+	ctx.lastUpdateCheck = ctx.lastInventoryUpdate
+
+	sc := &lockCheckController{
+		stateTestController: &stateTestController{pollIntvl: 50 * time.Millisecond},
+		lock:                lock,
+	}
+	s, c := NewCheckWaitState().Handle(ctx, sc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+	assert.True(t, sc.locked)
+	// not held while waiting, nor after
+	assert.False(t, lock.held)
+}
+
+func TestStateFetchRetryAbort(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	ctx := new(StateContext)
+	notes := make(chan client.Notification, 2)
+	sc := &stateTestController{
+		pollIntvl:     time.Minute,
+		notifications: notes,
+	}
+
+	// notification for another deployment is ignored
+	notes <- client.Notification{
+		Type:         client.NotifyAbortDeployment,
+		DeploymentID: "other",
+	}
+	notes <- client.Notification{
+		Type:         client.NotifyAbortDeployment,
+		DeploymentID: "foobar",
+	}
+	s, c := NewFetchStoreRetryState(NewUpdateFetchState(update), update, nil).Handle(ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.ErrDeploymentAborted, s.(*UpdateErrorState).cause.Cause())
+}
+
 func TestStateUpdateCheck(t *testing.T) {
 	cs := UpdateCheckState{}
 	ctx := new(StateContext)
@@ -718,6 +974,77 @@ func TestUpdateCheckSameImage(t *testing.T) {
 	assert.Equal(t, client.StatusAlreadyInstalled, urs.status)
 }
 
+func TestStateUpdateFetchMetered(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		metered:    true,
+		retryIntvl: 10 * time.Millisecond,
+	}
+
+	// download is postponed, nothing is reported
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchMeteredWaitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, "", sc.reportStatus)
+	assert.Equal(t, update, s.(*FetchMeteredWaitState).Update())
+
+	// fetch is tried again after the wait
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, c)
+
+	// deployment may be aborted while waiting
+	notes := make(chan client.Notification, 1)
+	notes <- client.Notification{Type: client.NotifyAbortDeployment}
+	sc.notifications = notes
+	sc.retryIntvl = time.Minute
+	s, _ = NewFetchMeteredWaitState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+}
+
+func TestStateUpdateFetchPeers(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+
+	// artifact from peer is preferred over the one from the server
+	fromPeer := ioutil.NopCloser(bytes.NewBufferString("peer"))
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString("server")),
+			fetchUpdateReturnSize:       int64(len("server")),
+		},
+		peerUpdate:     fromPeer,
+		peerUpdateSize: int64(len("peer")),
+	}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	uss := s.(*UpdateStoreState)
+	assert.Equal(t, fromPeer, uss.imagein)
+	assert.Equal(t, int64(len("peer")), uss.size)
+
+	// installed artifact is shared
+	s, _ = uss.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Equal(t, update, sc.sharedUpdate)
+}
+
 func TestStateUpdateFetch(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -784,6 +1111,50 @@ func TestStateUpdateFetch(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateUpdateFetchPreflight(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	data := "test"
+	newController := func(err menderError) *stateTestController {
+		return &stateTestController{
+			updater: fakeUpdater{
+				fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+				fetchUpdateReturnSize:       int64(len(data)),
+			},
+			preflightErr: err,
+		}
+	}
+
+	// artifact can not be installed
+	sc := newController(NewFatalError(errors.New("not compatible")))
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.True(t, sc.preflighted)
+
+	// header could not be checked; downloaded anyway
+	sc = newController(NewTransientError(errors.New("no ranges")))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.True(t, sc.preflighted)
+
+	// header of media artifacts is checked when they are found
+	update.Artifact.Source.URI = mediaURIPrefix + "/media/mender/update.mender"
+	update.Media = true
+	sc = newController(NewFatalError(errors.New("not compatible")))
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	assert.False(t, sc.preflighted)
+}
+
 func TestStateUpdateFetchRetry(t *testing.T) {
 	// pretend we have an update
 	update := client.UpdateResponse{
@@ -878,6 +1249,114 @@ func TestStateUpdateStore(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateUpdateStoreCheckpoint(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	cp := &InstallCheckpoint{Written: 100, Checksum: []byte("sum"),
+		Resume: &installer.ResumePoint{Stream: 1024, In: 200, Out: 80}}
+
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	StoreStateData(ms, StateData{
+		Name:       MenderStateUpdateStore,
+		UpdateInfo: update,
+		Checkpoint: cp,
+	})
+
+	// kept when fetching the same update again, after a restart
+	s, _ := initState.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	data := "test"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	sd, _ := LoadStateData(ms)
+	assert.Equal(t, cp, sd.Checkpoint)
+
+	// resumed from, and replaced with new progress
+	sc = &stateTestController{
+		checkpoint: &InstallCheckpoint{Written: 300, Checksum: []byte("more"),
+			Resume: &installer.ResumePoint{Stream: 1024, In: 400, Out: 280}},
+	}
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Equal(t, cp, sc.resumedFrom)
+	sd, _ = LoadStateData(ms)
+	assert.Equal(t, MenderStateUpdateStore, sd.Name)
+	assert.Equal(t, sc.checkpoint, sd.Checkpoint)
+
+	// not used for another update
+	other := client.UpdateResponse{
+		ID: "bar",
+	}
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+	sc = &stateTestController{}
+	s, _ = NewUpdateStoreState(stream, int64(len(data)), other).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Nil(t, sc.resumedFrom)
+	sd, _ = LoadStateData(ms)
+	assert.Nil(t, sd.Checkpoint)
+}
+
+func TestStateUpdateStoreMetered(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := store.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// download stops once the connection turns metered, keeping the progress
+	cp := &InstallCheckpoint{Written: 100, Checksum: []byte("sum"),
+		Resume: &installer.ResumePoint{Stream: 1024, In: 200, Out: 80}}
+	data := "test"
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			retInstallUpdate: NewTransientError(errMeteredConnection),
+		},
+		checkpoint: cp,
+		retryIntvl: 10 * time.Millisecond,
+	}
+	uss := NewUpdateStoreState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+	s, _ := uss.Handle(&ctx, sc)
+	assert.IsType(t, &FetchMeteredWaitState{}, s)
+	assert.Equal(t, 0, ctx.fetchInstallAttempts)
+
+	// fetched again after the wait, resuming from the checkpoint
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	sc = &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Equal(t, cp, sc.resumedFrom)
+}
+
 func TestStateUpdateInstallRetry(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -1104,6 +1583,33 @@ func TestStateReportError(t *testing.T) {
 
 	_, err = LoadStateData(ms)
 	assert.Equal(t, err, os.ErrNotExist)
+
+	// the failed reports end up in the outbox
+	entries, err := loadOutbox(ms)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, client.StatusFailure, entries[0].Status)
+	assert.Equal(t, client.StatusAlreadyInstalled, entries[1].Status)
+	assert.NoError(t, storeOutbox(ms, nil))
+
+	// with the queue policy a success that could not be reported keeps the
+	// update
+	StoreStateData(ms, StateData{
+		Name:       MenderStateReportStatusError,
+		UpdateInfo: update,
+	})
+	sc.reportPolicy = reportPolicyQueue
+	res = NewReportErrorState(update, client.StatusSuccess)
+	s, c = res.Handle(ctx, sc)
+	assert.IsType(t, &IdleState{}, s)
+	assert.False(t, c)
+
+	_, err = LoadStateData(ms)
+	assert.Equal(t, err, os.ErrNotExist)
+	entries, err = loadOutbox(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, []outboxEntry{{Update: update, Status: client.StatusSuccess}},
+		entries)
 }
 
 func TestMaxSendingAttempts(t *testing.T) {
@@ -36,6 +36,9 @@ const (
 	defaultStateScriptRetryInterval time.Duration = 30 * time.Minute
 
 	defaultStateScriptRetryTimeout time.Duration = 60 * time.Second
+
+	// how often Launcher.Progress is called while a script runs
+	progressInterval = time.Second
 )
 
 type Executor interface {
@@ -50,6 +53,9 @@ type Launcher struct {
 	Timeout                 int
 	RetryInterval           int
 	RetryTimeout            int
+	// Progress, if set, is called every second while a script runs or
+	// waits to be retried, as that may take long
+	Progress func()
 }
 
 func (l *Launcher) getRetryInterval() time.Duration {
@@ -252,6 +258,9 @@ func retCode(err error) int {
 // retry.
 func executeScript(s os.FileInfo, dir string, l Launcher, timeout time.Duration, ignoreError bool) error {
 
+	stop := l.reportProgress()
+	defer stop()
+
 	iet := time.Now()
 	for {
 		err := execute(filepath.Join(dir, s.Name()), timeout)
@@ -282,6 +291,45 @@ func executeScript(s os.FileInfo, dir string, l Launcher, timeout time.Duration,
 	}
 }
 
+// reportProgress calls l.Progress every progressInterval until the returned
+// function is called
+func (l Launcher) reportProgress() func() {
+	if l.Progress == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.Progress()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Scripts returns paths of the scripts for `state` and `action`, in the order
+// they are executed in
+func (l Launcher) Scripts(state, action string) ([]string, error) {
+	scr, dir, err := l.get(state, action)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(scr))
+	for _, s := range scr {
+		paths = append(paths, filepath.Join(dir, s.Name()))
+	}
+	return paths, nil
+}
+
 func (l Launcher) ExecuteAll(state, action string, ignoreError bool) error {
 	scr, dir, err := l.get(state, action)
 	if err != nil {
@@ -147,6 +147,13 @@ func TestExecutor(t *testing.T) {
 	assert.Equal(t, tmpRootfs, dir)
 	assert.Equal(t, "Download_Enter_00", s[0].Name())
 
+	scripts, err := e.Scripts("Download", "Enter")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpRootfs, "Download_Enter_00")}, scripts)
+	scripts, err = e.Scripts("Download", "Leave")
+	assert.NoError(t, err)
+	assert.Empty(t, scripts)
+
 	// now, let's try to execute some scripts
 	err = e.ExecuteAll("Download", "Enter", false)
 	assert.Error(t, err)
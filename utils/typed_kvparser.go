@@ -0,0 +1,164 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TypedKeyValParser is a parser reading lines in one of the formats:
+//
+//    key=value
+//    key:type=value
+//    {"key": <JSON value>, ...}
+//
+// where type is one of 'string', 'int', 'float' or 'bool'. Plain 'key=value'
+// lines are collected as strings, exactly like KeyValParser does. Lines
+// starting with '{' are decoded as JSON objects; numbers, booleans and nested
+// objects are preserved, while JSON arrays are expanded into multiple values
+// of the same key. Keys appearing multiple times will have their values merged
+// into a single list.
+type TypedKeyValParser struct {
+	data map[string][]interface{}
+}
+
+const (
+	KeyValTypeString = "string"
+	KeyValTypeInt    = "int"
+	KeyValTypeFloat  = "float"
+	KeyValTypeBool   = "bool"
+)
+
+func (k *TypedKeyValParser) Parse(raw io.Reader) error {
+	if k.data == nil {
+		k.data = map[string][]interface{}{}
+	}
+
+	in := bufio.NewScanner(raw)
+
+	for in.Scan() {
+		if err := in.Err(); err != nil {
+			return errors.Wrapf(err, "failed to read input line")
+		}
+		line := in.Text()
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") {
+			if err := k.parseJSON(line); err != nil {
+				return errors.Wrapf(err, "incorrect JSON line '%s'", line)
+			}
+			continue
+		}
+
+		val := strings.SplitN(line, "=", 2)
+
+		if len(val) < 2 {
+			return errors.Errorf("incorrect line '%s'", line)
+		}
+
+		key, typ := splitKeyType(val[0])
+		v, err := parseTypedValue(typ, val[1])
+		if err != nil {
+			return errors.Wrapf(err, "incorrect line '%s'", line)
+		}
+		k.add(key, v)
+	}
+	return nil
+}
+
+func (k *TypedKeyValParser) add(key string, vals ...interface{}) {
+	k.data[key] = append(k.data[key], vals...)
+}
+
+func (k *TypedKeyValParser) parseJSON(line string) error {
+	dec := json.NewDecoder(bytes.NewBufferString(line))
+	// keep numbers as they were given; int64 values would otherwise lose
+	// precision when decoded into float64
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return err
+	}
+
+	for key, v := range obj {
+		if list, ok := v.([]interface{}); ok {
+			k.add(key, list...)
+		} else {
+			k.add(key, v)
+		}
+	}
+	return nil
+}
+
+// splitKeyType splits 'key:type' into key and type. If the part after the last
+// ':' is not a known type, the whole string is used as the key, so that plain
+// keys containing ':' keep working.
+func splitKeyType(raw string) (string, string) {
+	idx := strings.LastIndex(raw, ":")
+	if idx < 0 {
+		return raw, KeyValTypeString
+	}
+	switch typ := raw[idx+1:]; typ {
+	case KeyValTypeString, KeyValTypeInt, KeyValTypeFloat, KeyValTypeBool:
+		return raw[:idx], typ
+	}
+	return raw, KeyValTypeString
+}
+
+func parseTypedValue(typ, raw string) (interface{}, error) {
+	switch typ {
+	case KeyValTypeInt:
+		return strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	case KeyValTypeFloat:
+		return strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	case KeyValTypeBool:
+		return strconv.ParseBool(strings.TrimSpace(raw))
+	default:
+		return raw, nil
+	}
+}
+
+// Collect() data read during Parse(). Map keys correspond to entry names, while
+// map values is a list of entry values collected for particular key.
+//
+// For instance, input:
+//
+//    foo=bar
+//    mem_total_kB:int=1024
+//    {"baz": [1, true], "zen": {"a": "b"}}
+//
+// will be converted to:
+//
+//    map[string][]interface{}{
+//        "foo":          []interface{}{"bar"},
+//        "mem_total_kB": []interface{}{int64(1024)},
+//        "baz":          []interface{}{json.Number("1"), true},
+//        "zen":          []interface{}{map[string]interface{}{"a": "b"}},
+//    }
+//
+// If no data was collected during Parse(), returns nil.
+func (k *TypedKeyValParser) Collect() map[string][]interface{} {
+	return k.data
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedKeyValParser(t *testing.T) {
+	td := []struct {
+		data string
+		bad  bool
+		ref  map[string][]interface{}
+	}{
+		{
+			`
+foo=bar
+key=value=23
+mac=de:ad:be:ef:00:01
+foo=baz
+`,
+			false,
+			map[string][]interface{}{
+				"foo": {"bar", "baz"},
+				"key": {"value=23"},
+				"mac": {"de:ad:be:ef:00:01"},
+			},
+		},
+		{
+			`
+mem_total_kB:int=1024
+load:float=0.5
+rootfs_ro:bool=true
+name:string=foo:int
+odd:key=bar
+`,
+			false,
+			map[string][]interface{}{
+				"mem_total_kB": {int64(1024)},
+				"load":         {0.5},
+				"rootfs_ro":    {true},
+				"name":         {"foo:int"},
+				"odd:key":      {"bar"},
+			},
+		},
+		{
+			`
+{"cpus": 4, "ifaces": ["eth0", "wlan0"], "ok": false}
+{"disk": {"size": 10, "model": "foo"}}
+ifaces=usb0
+`,
+			false,
+			map[string][]interface{}{
+				"cpus":   {json.Number("4")},
+				"ifaces": {"eth0", "wlan0", "usb0"},
+				"ok":     {false},
+				"disk": {map[string]interface{}{
+					"size":  json.Number("10"),
+					"model": "foo",
+				}},
+			},
+		},
+		{
+			`
+mem_total_kB:int=lots
+`,
+			true,
+			nil,
+		},
+		{
+			`
+{"broken":
+`,
+			true,
+			nil,
+		},
+		{
+			`
+foo=bar
+mac
+`,
+			true,
+			nil,
+		},
+	}
+
+	for id, tc := range td {
+		t.Logf("testing case: %+v\n", id)
+
+		p := TypedKeyValParser{}
+		in := bytes.NewBuffer([]byte(tc.data))
+		err := p.Parse(in)
+		if tc.bad {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.ref, p.Collect())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+const writeStatsKey = "partition-write-stats"
+
+// Flash endurance is a concern for devices, so what installing updates writes
+// to the partitions is kept in the data store and reported in the inventory.
+//
+// partitionWriteStats counts bytes of images written to a partition, and
+// bytes not written because the partition held them already
+type partitionWriteStats struct {
+	Written int64
+	Skipped int64
+}
+
+type writeStats struct {
+	// last update installed
+	Last partitionWriteStats
+	// all updates installed since the data store was created
+	Total partitionWriteStats
+}
+
+// writeStatsReporter is implemented by devices counting what installing the
+// last image wrote
+type writeStatsReporter interface {
+	lastWriteStats() partitionWriteStats
+}
+
+func loadWriteStats(s store.Store) (writeStats, error) {
+	var ws writeStats
+	data, err := s.ReadAll(writeStatsKey)
+	if os.IsNotExist(err) {
+		return ws, nil
+	} else if err != nil {
+		return ws, err
+	}
+	if err := json.Unmarshal(data, &ws); err != nil {
+		return ws, errors.Wrapf(err, "failed to decode partition write statistics")
+	}
+	return ws, nil
+}
+
+// addWriteStats records `last` as the statistics of the last update installed
+func addWriteStats(s store.Store, last partitionWriteStats) error {
+	ws, err := loadWriteStats(s)
+	if err != nil {
+		// start over rather than stop counting
+		log.Errorf("failed to load partition write statistics: %v", err)
+	}
+	ws.Last = last
+	ws.Total.Written += last.Written
+	ws.Total.Skipped += last.Skipped
+
+	data, _ := json.Marshal(ws)
+	return s.WriteAll(writeStatsKey, data)
+}
+
+func (ws writeStats) inventoryAttributes() []client.InventoryAttribute {
+	return []client.InventoryAttribute{
+		{Name: "rootfs_bytes_written", Value: ws.Last.Written},
+		{Name: "rootfs_bytes_skipped", Value: ws.Last.Skipped},
+		{Name: "rootfs_bytes_written_total", Value: ws.Total.Written},
+		{Name: "rootfs_bytes_skipped_total", Value: ws.Total.Skipped},
+	}
+}
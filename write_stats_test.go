@@ -0,0 +1,107 @@
+// Copyright 2017 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStats(t *testing.T) {
+	ms := store.NewMemStore()
+
+	ws, err := loadWriteStats(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, writeStats{}, ws)
+
+	assert.NoError(t, addWriteStats(ms, partitionWriteStats{Written: 100, Skipped: 900}))
+	assert.NoError(t, addWriteStats(ms, partitionWriteStats{Written: 300, Skipped: 700}))
+	ws, err = loadWriteStats(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, writeStats{
+		Last:  partitionWriteStats{Written: 300, Skipped: 700},
+		Total: partitionWriteStats{Written: 400, Skipped: 1600},
+	}, ws)
+
+	assert.Equal(t, []client.InventoryAttribute{
+		{Name: "rootfs_bytes_written", Value: int64(300)},
+		{Name: "rootfs_bytes_skipped", Value: int64(700)},
+		{Name: "rootfs_bytes_written_total", Value: int64(400)},
+		{Name: "rootfs_bytes_skipped_total", Value: int64(1600)},
+	}, ws.inventoryAttributes())
+
+	// broken statistics are started over
+	ms.WriteAll(writeStatsKey, []byte("{"))
+	_, err = loadWriteStats(ms)
+	assert.Error(t, err)
+	assert.NoError(t, addWriteStats(ms, partitionWriteStats{Written: 10}))
+	ws, err = loadWriteStats(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), ws.Total.Written)
+}
+
+// statsDevice reports fixed write statistics
+type statsDevice struct {
+	fakeDevice
+	stats partitionWriteStats
+}
+
+func (d *statsDevice) lastWriteStats() partitionWriteStats {
+	return d.stats
+}
+
+func TestMenderInstallUpdateWriteStats(t *testing.T) {
+	td, _ := ioutil.TempDir("", "write-stats")
+	defer os.RemoveAll(td)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	ms := store.NewMemStore()
+	dev := &statsDevice{
+		fakeDevice: fakeDevice{consumeUpdate: true},
+		stats:      partitionWriteStats{Written: 4096, Skipped: 8192},
+	}
+	m := newTestMender(nil, menderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: dev,
+			store:  ms,
+		},
+	})
+	m.deviceTypeFile = deviceType
+
+	for i := 0; i < 2; i++ {
+		upd, err := MakeRootfsImageArtifact(2, false)
+		assert.NoError(t, err)
+		assert.NoError(t, m.InstallUpdate(upd, 0))
+	}
+	ws, err := loadWriteStats(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, dev.stats, ws.Last)
+	assert.Equal(t, partitionWriteStats{Written: 8192, Skipped: 16384}, ws.Total)
+
+	// nothing written, nothing recorded
+	dev.stats = partitionWriteStats{}
+	upd, err := MakeRootfsImageArtifact(2, false)
+	assert.NoError(t, err)
+	assert.NoError(t, m.InstallUpdate(upd, 0))
+	ws, err = loadWriteStats(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, partitionWriteStats{Written: 4096, Skipped: 8192}, ws.Last)
+}